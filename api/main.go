@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -14,8 +16,15 @@ import (
 	"go.temporal.io/sdk/converter"
 )
 
+// strictJSON rejects request bodies with fields the payload types do not have
+var strictJSON = os.Getenv("STRICT_JSON_REQUESTS") == "true"
+
 func main() {
+	// Mask PII such as names and emails in everything written to the log
+	log.SetOutput(shared.NewRedactingWriter(os.Stderr, shared.LogRedactFieldsFromEnv()))
+
 	http.HandleFunc("/submit", handler)
+	http.HandleFunc("/submit-record", recordHandler)
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
@@ -37,7 +46,7 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var p shared.Payload
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+	if err := shared.DecodeJSON(r.Body, &p, strictJSON); err != nil {
 		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -48,6 +57,59 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// New payloads are stamped with the schema they were written against
+	if p.Version == 0 {
+		p.Version = shared.CurrentPayloadVersion
+	}
+	if err := p.CheckVersion(); err != nil {
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A version 1 worker path would drop the phone without a word
+	if p.Phone != "" && p.SchemaVersion() < shared.PayloadVersion2 {
+		http.Error(w, "Invalid payload: phone needs version 2 or later", http.StatusBadRequest)
+		return
+	}
+
+	startWorkflow(w, requestCorrelationID(r), fmt.Sprintf("payload-%d", p.ID), "ProcessPayloadWorkflow", p)
+}
+
+// recordHandler starts a workflow for a schema-less record
+func recordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var rec shared.Record
+	if err := shared.DecodeJSON(r.Body, &rec, strictJSON); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(rec.Fields) == 0 {
+		http.Error(w, "Invalid record: fields are required", http.StatusBadRequest)
+		return
+	}
+
+	// An empty workflow ID lets Temporal assign a unique one
+	startWorkflow(w, requestCorrelationID(r), "", "ProcessRecordWorkflow", rec)
+}
+
+// requestCorrelationID returns the caller's correlation ID, or a new one if it sent none
+// or an unusable one
+func requestCorrelationID(r *http.Request) string {
+	if id := r.Header.Get(shared.CorrelationIDHeader); shared.ValidCorrelationID(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startWorkflow connects to Temporal with codec support and starts the given workflow.
+// The correlation ID is recorded on the workflow's encrypted payloads and returned to the caller.
+func startWorkflow(w http.ResponseWriter, correlationID string, workflowID string, workflowType string, arg interface{}) {
 	// Get configuration from environment variables
 	codecServerURL := os.Getenv("CODEC_SERVER_URL")
 	if codecServerURL == "" {
@@ -60,7 +122,14 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create a data converter with codec support
-	codecClient := NewRemoteCodecClient(codecServerURL)
+	// The workflow type lets the codec server pick a protection profile for its payloads
+	codecClient := NewRemoteCodecClient(codecServerURL).
+		WithCorrelationID(correlationID).
+		WithCodecContext(map[string]string{"WorkflowType": workflowType}).
+		WithSizeLimits(shared.PayloadSizeLimitsFromEnv())
+	if os.Getenv("CODEC_HTTP2") == "true" {
+		codecClient.WithHTTP2()
+	}
 	codecConverter := converter.NewCodecDataConverter(
 		converter.GetDefaultDataConverter(),
 		codecClient,
@@ -80,24 +149,26 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	defer c.Close()
 
 	workflowOptions := client.StartWorkflowOptions{
-		ID:        fmt.Sprintf("payload-%d", p.ID),
+		ID:        workflowID,
 		TaskQueue: "payload-task-queue",
 	}
 
-	we, err := c.ExecuteWorkflow(context.Background(), workflowOptions, "ProcessPayloadWorkflow", p)
+	we, err := c.ExecuteWorkflow(context.Background(), workflowOptions, workflowType, arg)
 	if err != nil {
 		log.Printf("Workflow start error: %v", err)
 		http.Error(w, "Workflow start error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Started workflow %s for payload ID %d", we.GetID(), p.ID)
+	log.Printf("Started workflow %s (%s), correlation ID %s", we.GetID(), workflowType, correlationID)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(shared.CorrelationIDHeader, correlationID)
 	w.WriteHeader(http.StatusAccepted)
 
 	response := map[string]string{
-		"workflow_id": we.GetID(),
-		"status":      "started",
+		"workflow_id":    we.GetID(),
+		"status":         "started",
+		"correlation_id": correlationID,
 	}
 	json.NewEncoder(w).Encode(response)
 }
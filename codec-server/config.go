@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"temporal-key-rotation/kmscodec"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the codec server configuration read from the YAML or JSON file named by
+// CONFIG_FILE. Every setting stands for the environment variable in its env tag and
+// has the same meaning; a variable that is set overrides the file. Settings the file
+// leaves out keep their usual defaults.
+type Config struct {
+	KMS      KMSConfig      `yaml:"kms"`
+	DataKey  DataKeyConfig  `yaml:"data_key"`
+	Cache    CacheConfig    `yaml:"cache"`
+	Payloads PayloadsConfig `yaml:"payloads"`
+	Server   ServerConfig   `yaml:"server"`
+	Audit    AuditConfig    `yaml:"audit"`
+}
+
+// KMSConfig configures the master key and the calls made to KMS
+type KMSConfig struct {
+	Mode                 *string   `yaml:"mode" env:"CODEC_MODE"`
+	LocalMasterKey       *string   `yaml:"local_master_key" env:"CODEC_LOCAL_MASTER_KEY"`
+	KeyAlias             *string   `yaml:"key_alias" env:"KMS_KEY_ALIAS"`
+	Region               *string   `yaml:"region" env:"AWS_REGION"`
+	EndpointURL          *string   `yaml:"endpoint_url" env:"KMS_ENDPOINT_URL"`
+	AssumeRoleARN        *string   `yaml:"assume_role_arn" env:"KMS_ASSUME_ROLE_ARN"`
+	AssumeRoleExternalID *string   `yaml:"assume_role_external_id" env:"KMS_ASSUME_ROLE_EXTERNAL_ID"`
+	TrackedKeyARNs       []string  `yaml:"tracked_key_arns" env:"KMS_TRACKED_KEY_ARNS"`
+	BreakerThreshold     *int      `yaml:"breaker_threshold" env:"KMS_BREAKER_THRESHOLD"`
+	BreakerCooldown      *Duration `yaml:"breaker_cooldown" env:"KMS_BREAKER_COOLDOWN"`
+	GenerateTimeout      *Duration `yaml:"generate_timeout" env:"KMS_GENERATE_TIMEOUT"`
+	DecryptTimeout       *Duration `yaml:"decrypt_timeout" env:"KMS_DECRYPT_TIMEOUT"`
+	ForceRecheckInterval *Duration `yaml:"force_recheck_interval" env:"FORCE_KMS_RECHECK_INTERVAL"`
+	NegativeCacheTTL     *Duration `yaml:"negative_cache_ttl" env:"NEGATIVE_CACHE_TTL"`
+	MultiRegionRefresh   *Duration `yaml:"multi_region_refresh_interval" env:"MULTI_REGION_REFRESH_INTERVAL"`
+	ReplicaRegion        *string   `yaml:"replica_region" env:"KMS_REPLICA_REGION"`
+	RotationSNSTopicARN  *string   `yaml:"rotation_sns_topic_arn" env:"ROTATION_SNS_TOPIC_ARN"`
+	ContextValidation    *string   `yaml:"encryption_context_validation" env:"ENCRYPTION_CONTEXT_VALIDATION"`
+	EncryptionContext    []string  `yaml:"encryption_context" env:"ENCRYPTION_CONTEXT"`
+}
+
+// DataKeyConfig configures data key generation and rotation
+type DataKeyConfig struct {
+	Mode               *string   `yaml:"mode" env:"DATA_KEY_MODE"`
+	Spec               *string   `yaml:"spec" env:"DATA_KEY_SPEC"`
+	PairSpec           *string   `yaml:"pair_spec" env:"DATA_KEY_PAIR_SPEC"`
+	RotationInterval   *Duration `yaml:"rotation_interval" env:"DATA_KEY_ROTATION_INTERVAL"`
+	PreRotationWindow  *Duration `yaml:"pre_rotation_window" env:"PRE_ROTATION_WINDOW"`
+	ClockSkewTolerance *Duration `yaml:"clock_skew_tolerance" env:"CLOCK_SKEW_TOLERANCE"`
+	PoolDepth          *int      `yaml:"pool_depth" env:"KEY_POOL_DEPTH"`
+	ForceNewKeyMin     *Duration `yaml:"force_new_key_min_interval" env:"FORCE_NEW_KEY_MIN_INTERVAL"`
+}
+
+// CacheConfig configures the decryption cache of older data keys
+type CacheConfig struct {
+	TTL              *Duration `yaml:"ttl" env:"KMS_CACHE_TTL"`
+	CleanupInterval  *Duration `yaml:"cleanup_interval" env:"CACHE_CLEANUP_INTERVAL"`
+	Backend          *string   `yaml:"backend" env:"DECRYPTION_CACHE_BACKEND"`
+	MemoryEncryption *bool     `yaml:"memory_encryption" env:"MEMORY_CACHE_ENCRYPTION"`
+	RedisURL         *string   `yaml:"redis_url" env:"REDIS_URL"`
+	RedisKEK         *string   `yaml:"redis_kek" env:"REDIS_CACHE_KEK"`
+	RedisPrefix      *string   `yaml:"redis_prefix" env:"REDIS_CACHE_PREFIX"`
+	ShareCurrentKey  *bool     `yaml:"share_current_key" env:"SHARE_CURRENT_KEY"`
+	RevocationsKey   *string   `yaml:"redis_revocations_key" env:"REDIS_REVOCATIONS_KEY"`
+	RevocationSync   *Duration `yaml:"revocation_sync_interval" env:"REVOCATION_SYNC_INTERVAL"`
+}
+
+// PayloadsConfig configures how payloads are encoded and decoded
+type PayloadsConfig struct {
+	MaxPerRequest         *int     `yaml:"max_per_request" env:"MAX_PAYLOADS_PER_REQUEST"`
+	Concurrency           *int     `yaml:"concurrency" env:"PAYLOAD_CONCURRENCY"`
+	Cipher                *string  `yaml:"cipher" env:"PAYLOAD_CIPHER"`
+	Transforms            []string `yaml:"transforms" env:"PAYLOAD_TRANSFORMS"`
+	EncryptFields         []string `yaml:"encrypt_fields" env:"ENCRYPT_FIELDS"`
+	EncryptionPolicy      []string `yaml:"encryption_policy" env:"ENCRYPTION_POLICY"`
+	ForeignEncryption     *string  `yaml:"foreign_encryption_policy" env:"FOREIGN_ENCRYPTION_POLICY"`
+	ForeignMarkers        []string `yaml:"foreign_encryption_markers" env:"FOREIGN_ENCRYPTION_MARKERS"`
+	MetadataAllowlist     []string `yaml:"metadata_allowlist" env:"METADATA_ALLOWLIST"`
+	EncodeTimestamp       *bool    `yaml:"encode_timestamp" env:"ENCODE_TIMESTAMP"`
+	EncodeDedupMaxEntries *int     `yaml:"encode_dedup_max_entries" env:"ENCODE_DEDUP_MAX_ENTRIES"`
+	DecodeLenient         *bool    `yaml:"decode_lenient" env:"DECODE_LENIENT"`
+	DecodePartial         *bool    `yaml:"decode_partial" env:"DECODE_PARTIAL"`
+	DecodeStrict          *bool    `yaml:"decode_strict" env:"DECODE_STRICT"`
+	DecodeDefaultEncoding *string  `yaml:"decode_default_encoding" env:"DECODE_DEFAULT_ENCODING"`
+	DecodeEmptyEncoding   *string  `yaml:"decode_empty_encoding" env:"DECODE_EMPTY_ENCODING"`
+	LegacyStaticKey       *string  `yaml:"legacy_static_key" env:"LEGACY_STATIC_KEY"`
+	ProfileAttribute      *string  `yaml:"profile_attribute" env:"CODEC_PROFILE_ATTRIBUTE"`
+	Profiles              []string `yaml:"profiles" env:"CODEC_PROFILES"`
+
+	DecodeMaxAge *Duration `yaml:"decode_max_age" env:"DECODE_MAX_AGE"`
+}
+
+// ServerConfig configures the HTTP server, its endpoints and logging
+type ServerConfig struct {
+	Port                 *string  `yaml:"port" env:"PORT"`
+	HTTP2                *bool    `yaml:"http2" env:"CODEC_HTTP2"`
+	TLSCertFile          *string  `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile           *string  `yaml:"tls_key_file" env:"TLS_KEY_FILE"`
+	AdminToken           *string  `yaml:"admin_token" env:"ADMIN_TOKEN"`
+	ReadyChecks          []string `yaml:"ready_checks" env:"READY_CHECKS"`
+	ReadyCacheMaxEntries *int     `yaml:"ready_cache_max_entries" env:"READY_CACHE_MAX_ENTRIES"`
+	LogRedactFields      []string `yaml:"log_redact_fields" env:"LOG_REDACT_FIELDS"`
+	FleetPeers           []string `yaml:"fleet_peers" env:"FLEET_PEERS"`
+	Environment          *string  `yaml:"environment" env:"ENV"`
+	StrictJSON           *bool    `yaml:"strict_json_requests" env:"STRICT_JSON_REQUESTS"`
+}
+
+// AuditConfig configures the audit log of decoded payloads
+type AuditConfig struct {
+	Sink        *string `yaml:"sink" env:"AUDIT_LOG_SINK"`
+	File        *string `yaml:"file" env:"AUDIT_LOG_FILE"`
+	SQSQueueURL *string `yaml:"sqs_queue_url" env:"AUDIT_LOG_SQS_QUEUE_URL"`
+	Buffer      *int    `yaml:"buffer" env:"AUDIT_LOG_BUFFER"`
+}
+
+// Duration is a config file duration, given either as whole seconds like the environment
+// variables or as a Go duration string such as "90s" or "1h"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if node.Tag == "!!int" {
+		seconds, err := strconv.Atoi(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid duration %q", node.Line, node.Value)
+		}
+		*d = Duration(time.Duration(seconds) * time.Second)
+		return nil
+	}
+	parsed, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q: use seconds or a duration such as 90s or 1h", node.Line, node.Value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// loadConfig reads and validates the config file at path. JSON files are read as YAML,
+// of which JSON is a subset. Unknown settings are rejected so a typo can't go unnoticed.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var cfg Config
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// validate checks the settings present in the file; the environment is checked at startup
+// as it always was
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if v := c.KMS.Mode; v != nil {
+		check(*v == "kms" || *v == "local", "kms.mode must be kms or local")
+		check(*v != "local" || c.Server.Environment == nil || *c.Server.Environment != "production",
+			"kms.mode local is not secure and cannot be used in production")
+	}
+	if v := c.KMS.LocalMasterKey; v != nil {
+		check(isBase64Key(*v), "kms.local_master_key must be a base64 encoded 32-byte key")
+	}
+	if v := c.KMS.KeyAlias; v != nil {
+		check(*v != "", "kms.key_alias must not be empty")
+	}
+	if v := c.KMS.BreakerThreshold; v != nil {
+		check(*v >= 0, "kms.breaker_threshold must not be negative")
+	}
+	if v := c.KMS.ContextValidation; v != nil {
+		_, err := kmscodec.ParseContextValidation(*v)
+		check(err == nil, "kms.encryption_context_validation: %v", err)
+	}
+	if c.KMS.EncryptionContext != nil {
+		_, err := kmscodec.ParseEncryptionContext(strings.Join(c.KMS.EncryptionContext, ","))
+		check(err == nil, "kms.encryption_context: %v", err)
+	}
+	checkDuration := func(name string, d *Duration, positive bool) {
+		if d == nil {
+			return
+		}
+		switch {
+		case positive && *d <= 0:
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		case *d < 0:
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		case time.Duration(*d)%time.Second != 0:
+			errs = append(errs, fmt.Errorf("%s must be a whole number of seconds", name))
+		}
+	}
+	checkDuration("kms.breaker_cooldown", c.KMS.BreakerCooldown, false)
+	checkDuration("kms.generate_timeout", c.KMS.GenerateTimeout, false)
+	checkDuration("kms.decrypt_timeout", c.KMS.DecryptTimeout, false)
+	checkDuration("kms.force_recheck_interval", c.KMS.ForceRecheckInterval, false)
+	checkDuration("kms.negative_cache_ttl", c.KMS.NegativeCacheTTL, false)
+	checkDuration("kms.multi_region_refresh_interval", c.KMS.MultiRegionRefresh, true)
+	checkDuration("data_key.rotation_interval", c.DataKey.RotationInterval, true)
+	checkDuration("data_key.pre_rotation_window", c.DataKey.PreRotationWindow, false)
+	checkDuration("data_key.clock_skew_tolerance", c.DataKey.ClockSkewTolerance, false)
+	checkDuration("data_key.force_new_key_min_interval", c.DataKey.ForceNewKeyMin, false)
+	checkDuration("cache.ttl", c.Cache.TTL, true)
+	checkDuration("cache.cleanup_interval", c.Cache.CleanupInterval, true)
+	checkDuration("cache.revocation_sync_interval", c.Cache.RevocationSync, true)
+	checkDuration("payloads.decode_max_age", c.Payloads.DecodeMaxAge, false)
+
+	if v := c.DataKey.Mode; v != nil {
+		check(*v == "symmetric" || *v == "key_pair", "data_key.mode must be symmetric or key_pair, not %q", *v)
+	}
+	if v := c.DataKey.Spec; v != nil {
+		check(*v == "AES_256" || *v == "AES_128", "data_key.spec must be AES_256 or AES_128, not %q", *v)
+	}
+	if v := c.DataKey.PairSpec; v != nil {
+		check(*v == "RSA_2048" || *v == "RSA_3072" || *v == "RSA_4096", "data_key.pair_spec must be RSA_2048, RSA_3072 or RSA_4096, not %q", *v)
+	}
+	if v := c.DataKey.PoolDepth; v != nil {
+		check(*v >= 0 && *v <= kmscodec.MaxKeyPoolDepth, "data_key.pool_depth must be between 0 and %d", kmscodec.MaxKeyPoolDepth)
+	}
+
+	if v := c.Cache.Backend; v != nil {
+		check(*v == "memory" || *v == "redis", "cache.backend must be memory or redis, not %q", *v)
+	}
+	if v := c.Cache.ShareCurrentKey; v != nil && *v {
+		check(c.Cache.Backend != nil && *c.Cache.Backend == "redis", "cache.share_current_key needs cache.backend redis")
+		check(c.DataKey.Mode == nil || *c.DataKey.Mode != "key_pair", "cache.share_current_key is not available in data_key.mode key_pair")
+	}
+	if v := c.Cache.RedisKEK; v != nil {
+		check(isBase64Key(*v), "cache.redis_kek must be a base64 encoded 32-byte key")
+	}
+
+	if v := c.Payloads.MaxPerRequest; v != nil {
+		check(*v >= 0, "payloads.max_per_request must not be negative")
+	}
+	if v := c.Payloads.Concurrency; v != nil {
+		check(*v >= 1, "payloads.concurrency must be at least 1")
+	}
+	if v := c.Payloads.EncodeDedupMaxEntries; v != nil {
+		check(*v >= 0, "payloads.encode_dedup_max_entries must not be negative")
+	}
+	if v := c.Payloads.Cipher; v != nil {
+		check(*v == kmscodec.AlgorithmAES256GCM || *v == kmscodec.AlgorithmAES256GCMSIV,
+			"payloads.cipher must be %s or %s, not %q", kmscodec.AlgorithmAES256GCM, kmscodec.AlgorithmAES256GCMSIV, *v)
+	}
+	if c.Payloads.Transforms != nil {
+		_, err := kmscodec.ParseTransforms(strings.Join(c.Payloads.Transforms, ","))
+		check(err == nil, "payloads.transforms: %v", err)
+	}
+	if c.Payloads.EncryptionPolicy != nil {
+		_, err := kmscodec.ParseEncryptionPolicy(strings.Join(c.Payloads.EncryptionPolicy, ","))
+		check(err == nil, "payloads.encryption_policy: %v", err)
+	}
+	if v := c.Payloads.ForeignEncryption; v != nil {
+		_, err := kmscodec.ParseForeignEncryptionPolicy(*v)
+		check(err == nil, "payloads.foreign_encryption_policy: %v", err)
+	}
+	if c.Payloads.ForeignMarkers != nil {
+		_, err := kmscodec.ParseForeignEncryptionMarkers(strings.Join(c.Payloads.ForeignMarkers, ","))
+		check(err == nil, "payloads.foreign_encryption_markers: %v", err)
+	}
+	if c.Payloads.Profiles != nil {
+		_, err := kmscodec.ParseCodecProfiles(strings.Join(c.Payloads.Profiles, ","))
+		check(err == nil, "payloads.profiles: %v", err)
+	}
+	if v := c.Payloads.LegacyStaticKey; v != nil {
+		check(isBase64Key(*v), "payloads.legacy_static_key must be a base64 encoded 32-byte key")
+		if key, err := base64.StdEncoding.DecodeString(*v); err == nil && c.Server.Environment != nil && *c.Server.Environment == "production" {
+			err = kmscodec.CheckStaticKeyStrength(key)
+			check(err == nil, "payloads.legacy_static_key: %v", err)
+		}
+	}
+
+	if v := c.Server.Port; v != nil {
+		port, err := strconv.Atoi(*v)
+		check(err == nil && port > 0 && port < 65536, "server.port must be a port number, not %q", *v)
+	}
+	check((c.Server.TLSCertFile == nil) == (c.Server.TLSKeyFile == nil), "server.tls_cert_file and server.tls_key_file must be set together")
+	if v := c.Server.ReadyCacheMaxEntries; v != nil {
+		check(*v >= 0, "server.ready_cache_max_entries must not be negative")
+	}
+	if c.Server.FleetPeers != nil {
+		_, err := kmscodec.ParseFleetPeers(strings.Join(c.Server.FleetPeers, ","))
+		check(err == nil, "server.fleet_peers: %v", err)
+	}
+
+	if v := c.Audit.Sink; v != nil {
+		check(*v == "stdout" || *v == "file" || *v == "sqs", "audit.sink must be stdout, file or sqs, not %q", *v)
+	}
+	if v := c.Audit.Buffer; v != nil {
+		check(*v > 0, "audit.buffer must be positive")
+	}
+
+	return errors.Join(errs...)
+}
+
+// isBase64Key reports whether s is a base64 encoded 32-byte key
+func isBase64Key(s string) bool {
+	key, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && len(key) == 32
+}
+
+// applyToEnv sets the environment variable of every setting in the file that the environment
+// doesn't already set, so the file fills in for the environment without overriding it. It
+// returns the variables it set.
+func (c *Config) applyToEnv() ([]string, error) {
+	var applied []string
+	var walk func(v reflect.Value) error
+	walk = func(v reflect.Value) error {
+		for i := range v.NumField() {
+			field, value := v.Type().Field(i), v.Field(i)
+			name, ok := field.Tag.Lookup("env")
+			if !ok {
+				if value.Kind() == reflect.Struct {
+					if err := walk(value); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if value.IsNil() {
+				continue
+			}
+			if _, set := os.LookupEnv(name); set {
+				continue
+			}
+			if err := os.Setenv(name, envValue(value)); err != nil {
+				return fmt.Errorf("failed to set %s: %w", name, err)
+			}
+			applied = append(applied, name)
+		}
+		return nil
+	}
+	return applied, walk(reflect.ValueOf(c).Elem())
+}
+
+// envValue formats a non-nil setting the way its environment variable is written
+func envValue(value reflect.Value) string {
+	switch v := value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	case *Duration:
+		return strconv.FormatInt(int64(time.Duration(*v)/time.Second), 10)
+	}
+	return fmt.Sprint(value.Elem().Interface())
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "codec.yaml", `
+kms:
+  key_alias: alias/prod-codec
+  tracked_key_arns: [arn:aws:kms:us-east-1:123456789012:key/a, arn:aws:kms:us-east-1:123456789012:key/b]
+  breaker_threshold: 0
+  decrypt_timeout: 2
+data_key:
+  rotation_interval: 30m
+cache:
+  memory_encryption: true
+payloads:
+  transforms: [gzip, encrypt]
+  encryption_policy:
+    - sensitivity=public:skip
+server:
+  port: "8080"
+  ready_checks: []
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if *cfg.KMS.KeyAlias != "alias/prod-codec" || len(cfg.KMS.TrackedKeyARNs) != 2 {
+		t.Fatalf("unexpected kms config %+v", cfg.KMS)
+	}
+	if time.Duration(*cfg.KMS.DecryptTimeout) != 2*time.Second || time.Duration(*cfg.DataKey.RotationInterval) != 30*time.Minute {
+		t.Fatalf("unexpected durations %v, %v", *cfg.KMS.DecryptTimeout, *cfg.DataKey.RotationInterval)
+	}
+	if cfg.Server.ReadyChecks == nil || cfg.Cache.TTL != nil {
+		t.Fatal("expected an explicitly empty list to be kept and a missing setting to stay unset")
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "codec.json", `{"data_key": {"spec": "AES_128", "pool_depth": 2}, "cache": {"ttl": "12h"}}`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if *cfg.DataKey.Spec != "AES_128" || *cfg.DataKey.PoolDepth != 2 || time.Duration(*cfg.Cache.TTL) != 12*time.Hour {
+		t.Fatalf("unexpected config %+v %+v", cfg.DataKey, cfg.Cache)
+	}
+}
+
+func TestLoadConfigRejectsInvalidSettings(t *testing.T) {
+	tests := map[string]string{
+		"unknown setting":     "kms:\n  key_alais: alias/x\n",
+		"unknown codec mode":  "kms:\n  mode: fake\n",
+		"local in production": "server:\n  environment: production\nkms:\n  mode: local\n",
+		"wrong type":          "payloads:\n  concurrency: many\n",
+		"bad duration":        "cache:\n  ttl: soon\n",
+		"fractional seconds":  "kms:\n  decrypt_timeout: 1500ms\n",
+		"zero rotation":       "data_key:\n  rotation_interval: 0\n",
+		"unknown spec":        "data_key:\n  spec: AES_512\n",
+		"pool too deep":       "data_key:\n  pool_depth: 100\n",
+		"unknown transform":   "payloads:\n  transforms: [zstd, encrypt]\n",
+		"invalid policy":      "payloads:\n  encryption_policy: [public]\n",
+		"unknown validation":  "kms:\n  encryption_context_validation: lenient\n",
+		"short static key":    "payloads:\n  legacy_static_key: c2hvcnQ=\n",
+		"weak static key":     "server:\n  environment: production\npayloads:\n  legacy_static_key: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n",
+		"tls without key":     "server:\n  tls_cert_file: /etc/codec/tls.crt\n",
+		"invalid port":        "server:\n  port: \"http\"\n",
+		"unsupported backend": "cache:\n  backend: memcached\n",
+		"unknown audit sink":  "audit:\n  sink: syslog\n",
+		"profile without key": "payloads:\n  profiles: [PaymentWorkflow]\n",
+		"shared key no redis": "cache:\n  share_current_key: true\n",
+		"foreign policy":      "payloads:\n  foreign_encryption_policy: drop\n",
+		"fleet peer scheme":   "server:\n  fleet_peers: [codec-1:8081]\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadConfig(writeConfig(t, "codec.yaml", content)); err == nil {
+				t.Fatal("expected the config to be rejected")
+			}
+		})
+	}
+}
+
+func TestApplyToEnvKeepsEnvironmentOverrides(t *testing.T) {
+	t.Setenv("KMS_KEY_ALIAS", "alias/from-env")
+	for _, name := range []string{"KMS_CACHE_TTL", "KMS_BREAKER_THRESHOLD", "PAYLOAD_TRANSFORMS", "DECODE_STRICT", "READY_CHECKS"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+
+	cfg, err := loadConfig(writeConfig(t, "codec.yaml", `
+kms:
+  key_alias: alias/from-file
+  breaker_threshold: 0
+cache:
+  ttl: 12h
+payloads:
+  transforms: [gzip, encrypt]
+  decode_strict: true
+server:
+  ready_checks: []
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	applied, err := cfg.applyToEnv()
+	if err != nil {
+		t.Fatalf("applyToEnv: %v", err)
+	}
+
+	if strings.Join(applied, ",") != "KMS_BREAKER_THRESHOLD,KMS_CACHE_TTL,PAYLOAD_TRANSFORMS,DECODE_STRICT,READY_CHECKS" {
+		t.Fatalf("unexpected applied variables %v", applied)
+	}
+	for name, want := range map[string]string{
+		"KMS_KEY_ALIAS":         "alias/from-env",
+		"KMS_BREAKER_THRESHOLD": "0",
+		"KMS_CACHE_TTL":         "43200",
+		"PAYLOAD_TRANSFORMS":    "gzip,encrypt",
+		"DECODE_STRICT":         "true",
+	} {
+		if got := os.Getenv(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	// An empty list is still set, e.g. READY_CHECKS empty disables every readiness check
+	if value, ok := os.LookupEnv("READY_CHECKS"); !ok || value != "" {
+		t.Errorf("expected READY_CHECKS to be set and empty, got %q, %t", value, ok)
+	}
+}
@@ -2,267 +2,708 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"temporal-key-rotation/kmscodec"
 	"temporal-key-rotation/shared"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/redis/go-redis/v9"
 )
 
-// KMSEncryptionCodec handles encryption/decryption of payloads using AWS KMS
-type KMSEncryptionCodec struct {
-	kmsManager *KMSManager
-}
+// Build information reported by /version, set at build time with
+// -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
 
-// NewKMSEncryptionCodec creates a new KMS encryption codec
-func NewKMSEncryptionCodec(kmsManager *KMSManager) *KMSEncryptionCodec {
-	return &KMSEncryptionCodec{
-		kmsManager: kmsManager,
+func main() {
+	// Optional config file; its settings fill in for environment variables that aren't set
+	var configApplied []string
+	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			log.Fatalf("Invalid CONFIG_FILE %s: %v", configFile, err)
+		}
+		if configApplied, err = cfg.applyToEnv(); err != nil {
+			log.Fatalf("Failed to apply CONFIG_FILE %s: %v", configFile, err)
+		}
 	}
-}
 
-// handleEncode handles the /encode endpoint
-func (c *KMSEncryptionCodec) handleEncode(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	// Mask PII such as names and emails in everything written to the log
+	log.SetOutput(shared.NewRedactingWriter(os.Stderr, shared.LogRedactFieldsFromEnv()))
+	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
+		log.Printf("Loaded %d settings from %s; environment variables override it", len(configApplied), configFile)
 	}
 
-	var req shared.CodecRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
-		return
-	}
+	// Local mode replaces KMS with an in-memory master key, for development and CI without AWS
+	var kmsClient kmscodec.KMSClient
+	var awsKMSClient *kms.Client // nil in local mode
+	var actualKeyARN string
+	clientConfig := kmscodec.KMSClientConfigFromEnv()
+	switch codecMode := os.Getenv("CODEC_MODE"); codecMode {
+	case "", "kms":
+		// Get alias from environment
+		keyAlias := os.Getenv("KMS_KEY_ALIAS")
+		if keyAlias == "" {
+			keyAlias = "alias/temporal-codec-latest" // Default
+		}
 
-	var response shared.CodecResponse
-	ctx := context.Background()
+		// Create the KMS client, honoring explicit region, endpoint and assume-role overrides
+		client, err := kmscodec.NewKMSClient(context.Background(), clientConfig)
+		if err != nil {
+			log.Fatalf("Failed to create KMS client: %v", err)
+		}
+		if clientConfig.AssumeRoleARN != "" {
+			log.Printf("Calling KMS as assumed role: %s", clientConfig.AssumeRoleARN)
+		}
+		if clientConfig.Endpoint != "" {
+			log.Printf("Using KMS endpoint override: %s", clientConfig.Endpoint)
+		}
 
-	for _, payload := range req.Payloads {
-		// Only process JSON payloads that aren't already encrypted
-		encoding, exists := payload.Metadata["encoding"]
-		if !exists || encoding == "json/plain" {
-			// Get current data key (with automatic rotation)
-			currentKey, err := c.kmsManager.GetCurrentDataKey(ctx)
-			if err != nil {
-				log.Printf("Failed to get current data key: %v", err)
-				http.Error(w, "Key retrieval failed: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
+		// Resolve alias to actual key ARN
+		actualKeyARN, err = kmscodec.ResolveKMSAlias(client, keyAlias)
+		if err != nil {
+			log.Fatalf("Failed to resolve KMS alias %s: %v", keyAlias, err)
+		}
+		kmsClient, awsKMSClient = client, client
 
-			// Prepare data to encrypt
-			var dataToEncrypt []byte
-			if payload.Data != "" {
-				// Try to decode as base64 first, if it fails, use as plain text
-				if decoded, err := base64.StdEncoding.DecodeString(payload.Data); err == nil {
-					dataToEncrypt = decoded
-				} else {
-					dataToEncrypt = []byte(payload.Data)
-				}
+		log.Printf("Using KMS alias: %s → %s", keyAlias, actualKeyARN)
+	case "local":
+		if os.Getenv("ENV") == "production" {
+			log.Fatalf("CODEC_MODE=local is not secure and cannot be used with ENV=production")
+		}
+		masterKey := make([]byte, 32)
+		if keyStr := os.Getenv("CODEC_LOCAL_MASTER_KEY"); keyStr != "" {
+			var err error
+			if masterKey, err = base64.StdEncoding.DecodeString(keyStr); err != nil || len(masterKey) != 32 {
+				log.Fatalf("CODEC_LOCAL_MASTER_KEY must be a base64 encoded 32-byte key")
 			}
+		} else if _, err := rand.Read(masterKey); err != nil {
+			log.Fatalf("Failed to generate local master key: %v", err)
+		} else {
+			log.Printf("No CODEC_LOCAL_MASTER_KEY: payloads encoded now cannot be decoded after a restart (generate one with go run ./keygen)")
+		}
+		localKMS, err := kmscodec.NewLocalKMS(masterKey)
+		clear(masterKey)
+		if err != nil {
+			log.Fatalf("Failed to create local KMS: %v", err)
+		}
+		kmsClient, actualKeyARN = localKMS, kmscodec.LocalKeyARN
+		log.Printf("WARNING: CODEC_MODE=local: KMS is simulated with an in-memory key. This is NOT secure; use it for development and tests only")
+	default:
+		log.Fatalf("Unsupported CODEC_MODE %q (use kms or local)", codecMode)
+	}
 
-			// Encrypt the data with the current data key
-			encryptedData, err := EncryptWithDataKey(dataToEncrypt, currentKey.PlaintextKey)
-			if err != nil {
-				log.Printf("Failed to encrypt data: %v", err)
-				http.Error(w, "Encryption failed: "+err.Error(), http.StatusInternalServerError)
-				return
+	// Parse cache TTL for old keys
+	cacheTTLStr := os.Getenv("KMS_CACHE_TTL")
+	cacheTTL := 24 * time.Hour // default - keep old keys cached for 24 hours
+	if cacheTTLStr != "" {
+		if ttl, err := strconv.Atoi(cacheTTLStr); err == nil {
+			cacheTTL = time.Duration(ttl) * time.Second
+		}
+	}
+
+	// Parse key rotation interval
+	rotationIntervalStr := os.Getenv("DATA_KEY_ROTATION_INTERVAL")
+	rotationInterval := 1 * time.Hour // default - rotate every hour
+	if rotationIntervalStr != "" {
+		if interval, err := strconv.Atoi(rotationIntervalStr); err == nil {
+			rotationInterval = time.Duration(interval) * time.Second
+		}
+	}
+
+	// Optional asymmetric data key pairs (encrypt locally with the public key only)
+	var managerOpts []kmscodec.KMSManagerOption
+	if os.Getenv("DATA_KEY_MODE") == "key_pair" {
+		spec := types.DataKeyPairSpecRsa2048
+		if specStr := os.Getenv("DATA_KEY_PAIR_SPEC"); specStr != "" {
+			spec = types.DataKeyPairSpec(specStr)
+		}
+		switch spec {
+		case types.DataKeyPairSpecRsa2048, types.DataKeyPairSpecRsa3072, types.DataKeyPairSpecRsa4096:
+		default:
+			log.Fatalf("Unsupported DATA_KEY_PAIR_SPEC %s (RSA_2048, RSA_3072 or RSA_4096)", spec)
+		}
+		managerOpts = append(managerOpts, kmscodec.WithKeyPairMode(spec))
+		log.Printf("Data key pair mode enabled (%s)", spec)
+	}
+
+	// Symmetric data key spec; AES_128 keys encrypt whole payloads with AES-128-GCM
+	dataKeySpec := kmscodec.DefaultDataKeySpec
+	if specStr := os.Getenv("DATA_KEY_SPEC"); specStr != "" {
+		dataKeySpec = types.DataKeySpec(specStr)
+	}
+	switch dataKeySpec {
+	case types.DataKeySpecAes256:
+	case types.DataKeySpecAes128:
+		managerOpts = append(managerOpts, kmscodec.WithDataKeySpec(dataKeySpec))
+		log.Printf("Data keys use %s", dataKeySpec)
+	default:
+		log.Fatalf("Unsupported DATA_KEY_SPEC %s (AES_256 or AES_128)", dataKeySpec)
+	}
+
+	// Parse KMS circuit breaker settings
+	breakerThreshold := kmscodec.DefaultBreakerThreshold
+	if thresholdStr := os.Getenv("KMS_BREAKER_THRESHOLD"); thresholdStr != "" {
+		if threshold, err := strconv.Atoi(thresholdStr); err == nil {
+			breakerThreshold = threshold
+		}
+	}
+	breakerCooldown := kmscodec.DefaultBreakerCooldown
+	if cooldownStr := os.Getenv("KMS_BREAKER_COOLDOWN"); cooldownStr != "" {
+		if cooldown, err := strconv.Atoi(cooldownStr); err == nil {
+			breakerCooldown = time.Duration(cooldown) * time.Second
+		}
+	}
+	managerOpts = append(managerOpts, kmscodec.WithCircuitBreaker(breakerThreshold, breakerCooldown))
+
+	// Optional per-call KMS timeouts, so a slow KMS can't hold a request indefinitely
+	var generateTimeout, decryptTimeout time.Duration
+	if timeoutStr := os.Getenv("KMS_GENERATE_TIMEOUT"); timeoutStr != "" {
+		if timeout, err := strconv.Atoi(timeoutStr); err == nil && timeout > 0 {
+			generateTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	if timeoutStr := os.Getenv("KMS_DECRYPT_TIMEOUT"); timeoutStr != "" {
+		if timeout, err := strconv.Atoi(timeoutStr); err == nil && timeout > 0 {
+			decryptTimeout = time.Duration(timeout) * time.Second
+		}
+	}
+	managerOpts = append(managerOpts, kmscodec.WithKMSTimeouts(generateTimeout, decryptTimeout))
+
+	// Decrypts under a multi-Region key fail over to its replica while the primary region is down
+	if replicaRegion := os.Getenv("KMS_REPLICA_REGION"); replicaRegion != "" {
+		if awsKMSClient == nil {
+			log.Fatalf("KMS_REPLICA_REGION cannot be used with CODEC_MODE=local")
+		}
+		replicaConfig := clientConfig
+		replicaConfig.Region = replicaRegion
+		replicaConfig.Endpoint = "" // endpoint overrides name the primary region's endpoint
+		replicaClient, err := kmscodec.NewKMSClient(context.Background(), replicaConfig)
+		if err != nil {
+			log.Fatalf("Failed to create KMS client for replica region %s: %v", replicaRegion, err)
+		}
+		managerOpts = append(managerOpts, kmscodec.WithReplicaRegion(replicaRegion, replicaClient))
+		log.Printf("KMS decrypts fail over to replica region %s for multi-Region keys", replicaRegion)
+	}
+
+	// Tolerate small clock skew across the fleet before treating the current key as expired
+	if skewStr := os.Getenv("CLOCK_SKEW_TOLERANCE"); skewStr != "" {
+		if skew, err := strconv.Atoi(skewStr); err == nil && skew > 0 {
+			tolerance := time.Duration(skew) * time.Second
+			if tolerance >= rotationInterval {
+				log.Fatalf("CLOCK_SKEW_TOLERANCE (%v) must be shorter than DATA_KEY_ROTATION_INTERVAL (%v)", tolerance, rotationInterval)
 			}
+			managerOpts = append(managerOpts, kmscodec.WithClockSkewTolerance(tolerance))
+		}
+	}
+
+	// Optional bound on how long a key stays usable without KMS re-authorizing it
+	if recheckStr := os.Getenv("FORCE_KMS_RECHECK_INTERVAL"); recheckStr != "" {
+		if recheck, err := strconv.Atoi(recheckStr); err == nil && recheck > 0 {
+			managerOpts = append(managerOpts, kmscodec.WithForceKMSRecheck(time.Duration(recheck)*time.Second))
+			log.Printf("Keys in memory are re-authorized with KMS every %ds", recheck)
+		}
+	}
+
+	// Keys KMS refuses to decrypt fail fast for a while instead of stalling every payload
+	if ttlStr := os.Getenv("NEGATIVE_CACHE_TTL"); ttlStr != "" {
+		if ttl, err := strconv.Atoi(ttlStr); err == nil && ttl >= 0 {
+			managerOpts = append(managerOpts, kmscodec.WithNegativeCacheTTL(time.Duration(ttl)*time.Second))
+		}
+	}
 
-			// Create response payload with KMS metadata
-			encodedPayload := shared.PayloadData{
-				Metadata: map[string]string{
-					"encoding": "binary/encrypted",
-				},
-				Data:             encryptedData,
-				KMSKeyID:         c.kmsManager.keyID,
-				EncryptedDataKey: currentKey.EncryptedKey,
-				Algorithm:        "AES-256-GCM",
+	// Optional pool of pre-generated data keys, so rotations never wait on KMS
+	if depthStr := os.Getenv("KEY_POOL_DEPTH"); depthStr != "" {
+		if depth, err := strconv.Atoi(depthStr); err == nil && depth > 0 {
+			if depth > kmscodec.MaxKeyPoolDepth {
+				log.Fatalf("KEY_POOL_DEPTH %d exceeds the maximum of %d", depth, kmscodec.MaxKeyPoolDepth)
 			}
+			managerOpts = append(managerOpts, kmscodec.WithKeyPool(depth))
+			log.Printf("Data key pool enabled (depth %d)", depth)
+		}
+	}
 
-			response.Payloads = append(response.Payloads, encodedPayload)
+	// Encode requests may force a rotation with force_new_key, at most once per interval;
+	// /encode is unauthenticated, so the flag stays off unless an interval is set
+	if intervalStr := os.Getenv("FORCE_NEW_KEY_MIN_INTERVAL"); intervalStr != "" {
+		if interval, err := strconv.Atoi(intervalStr); err == nil && interval > 0 {
+			managerOpts = append(managerOpts, kmscodec.WithForcedRotationInterval(time.Duration(interval)*time.Second))
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Failed to encode response: %v", err)
+	// Strict mode refuses payloads stored under any context other than the current one
+	contextValidation, err := kmscodec.ParseContextValidation(os.Getenv("ENCRYPTION_CONTEXT_VALIDATION"))
+	if err != nil {
+		log.Fatalf("Invalid ENCRYPTION_CONTEXT_VALIDATION: %v", err)
 	}
-}
+	managerOpts = append(managerOpts, kmscodec.WithEncryptionContextValidation(contextValidation))
 
-// handleDecode handles the /decode endpoint
-func (c *KMSEncryptionCodec) handleDecode(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	// Extra encryption context fields that KMS key policies can condition access on
+	if contextStr := os.Getenv("ENCRYPTION_CONTEXT"); contextStr != "" {
+		fields, err := kmscodec.ParseEncryptionContext(contextStr)
+		if err != nil {
+			log.Fatalf("Invalid ENCRYPTION_CONTEXT: %v", err)
+		}
+		managerOpts = append(managerOpts, kmscodec.WithEncryptionContext(fields))
+		log.Printf("Encryption context fields: %s", contextStr)
 	}
 
-	var req shared.CodecRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
-		return
+	// Cached data keys can be kept sealed in memory, outside of the moments they are used
+	if os.Getenv("MEMORY_CACHE_ENCRYPTION") == "true" {
+		managerOpts = append(managerOpts, kmscodec.WithSealedMemoryCache(true))
 	}
 
-	var response shared.CodecResponse
-	ctx := context.Background()
+	// Optional decryption cache shared across replicas
+	switch backend := os.Getenv("DECRYPTION_CACHE_BACKEND"); backend {
+	case "", "memory":
+	case "redis":
+		redisOpts, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+		kek, err := base64.StdEncoding.DecodeString(os.Getenv("REDIS_CACHE_KEK"))
+		if err != nil {
+			log.Fatalf("Invalid REDIS_CACHE_KEK: %v", err)
+		}
+		redisClient := redis.NewClient(redisOpts)
+		cache, err := kmscodec.NewRedisCache(redisClient, kek, os.Getenv("REDIS_CACHE_PREFIX"))
+		if err != nil {
+			log.Fatalf("Failed to create Redis decryption cache: %v", err)
+		}
+		managerOpts = append(managerOpts, kmscodec.WithDecryptionCache(cache))
+		log.Printf("Using Redis decryption cache at %s", redisOpts.Addr)
+
+		// Revocations reach every replica sharing the Redis and survive restarts
+		revocations := kmscodec.NewRedisRevocationStore(redisClient, os.Getenv("REDIS_REVOCATIONS_KEY"))
+		managerOpts = append(managerOpts, kmscodec.WithRevocationStore(revocations))
 
-	for _, payload := range req.Payloads {
-		// Check if this payload is encrypted
-		if payload.Metadata["encoding"] != "binary/encrypted" {
-			// Not encrypted, return as-is
-			response.Payloads = append(response.Payloads, payload)
-			continue
+		// Warm standbys take over the primary's current key instead of generating their own
+		if os.Getenv("SHARE_CURRENT_KEY") == "true" {
+			if os.Getenv("DATA_KEY_MODE") == "key_pair" {
+				log.Fatalf("SHARE_CURRENT_KEY is not available in key pair mode")
+			}
+			store, err := kmscodec.NewRedisKeyStore(redisClient, kek, "")
+			if err != nil {
+				log.Fatalf("Failed to create Redis key store: %v", err)
+			}
+			managerOpts = append(managerOpts, kmscodec.WithSharedCurrentKey(store))
+			log.Printf("Sharing the current data key with other replicas through Redis")
 		}
+		clear(kek)
+	default:
+		log.Fatalf("Unsupported DECRYPTION_CACHE_BACKEND %q (use memory or redis)", backend)
+	}
+	if os.Getenv("SHARE_CURRENT_KEY") == "true" && os.Getenv("DECRYPTION_CACHE_BACKEND") != "redis" {
+		log.Fatalf("SHARE_CURRENT_KEY needs DECRYPTION_CACHE_BACKEND=redis")
+	}
+	if os.Getenv("DECRYPTION_CACHE_BACKEND") != "redis" {
+		log.Printf("WARNING: data key revocations are kept in this replica's memory only; they are lost on restart and other replicas keep decrypting revoked keys (set DECRYPTION_CACHE_BACKEND=redis to share them)")
+	}
+	revocationSyncInterval := kmscodec.DefaultRevocationSyncInterval
+	if intervalStr := os.Getenv("REVOCATION_SYNC_INTERVAL"); intervalStr != "" {
+		if interval, err := strconv.Atoi(intervalStr); err == nil && interval > 0 {
+			revocationSyncInterval = time.Duration(interval) * time.Second
+		}
+	}
 
-		// For KMS encrypted payloads, we need the encrypted data key
-		if payload.EncryptedDataKey == "" {
-			log.Printf("Missing encrypted data key for encrypted payload")
-			http.Error(w, "Missing encrypted data key", http.StatusBadRequest)
-			return
+	// Extra master keys (fallback, retired or per-namespace) get their own KMS call counters
+	if arnsStr := os.Getenv("KMS_TRACKED_KEY_ARNS"); arnsStr != "" {
+		var arns []string
+		for _, arn := range strings.Split(arnsStr, ",") {
+			if arn = strings.TrimSpace(arn); arn != "" {
+				arns = append(arns, arn)
+			}
 		}
+		managerOpts = append(managerOpts, kmscodec.WithTrackedKeyARNs(arns))
+	}
 
-		// Decrypt the data key using KMS (with intelligent caching)
-		dataKey, err := c.kmsManager.DecryptDataKey(ctx, payload.EncryptedDataKey, payload.KMSKeyID)
+	// Rotations and key-state errors can be published to SNS for central audit
+	if topicARN := os.Getenv("ROTATION_SNS_TOPIC_ARN"); topicARN != "" {
+		snsClient, err := kmscodec.NewSNSClient(context.Background(), os.Getenv("AWS_REGION"))
 		if err != nil {
-			log.Printf("Failed to decrypt data key: %v", err)
-			http.Error(w, "Key decryption failed: "+err.Error(), http.StatusInternalServerError)
-			return
+			log.Fatalf("Failed to create SNS client: %v", err)
 		}
+		managerOpts = append(managerOpts, kmscodec.WithRotationNotifications(snsClient, topicARN))
+		log.Printf("Publishing rotation notifications to %s", topicARN)
+	}
 
-		// Decrypt the actual data
-		decryptedData, err := DecryptWithDataKey(payload.Data, dataKey)
-		if err != nil {
-			log.Printf("Failed to decrypt payload data: %v", err)
-			http.Error(w, "Data decryption failed: "+err.Error(), http.StatusInternalServerError)
-			return
+	// Initialize KMS manager with time-based rotation
+	kmsManager, err := kmscodec.NewKMSManagerWithClient(kmsClient, actualKeyARN, cacheTTL, rotationInterval, managerOpts...)
+	if err != nil {
+		log.Fatalf("Failed to initialize KMS manager: %v", err)
+	}
+
+	// Start background maintenance routines
+	cleanupInterval := kmscodec.DefaultCacheCleanupInterval
+	if intervalStr := os.Getenv("CACHE_CLEANUP_INTERVAL"); intervalStr != "" {
+		if interval, err := strconv.Atoi(intervalStr); err == nil && interval > 0 {
+			cleanupInterval = time.Duration(interval) * time.Second
+		}
+	}
+	kmsManager.StartCacheCleanup(cleanupInterval)
+	kmsManager.StartKeyPoolRefill()
+	kmsManager.StartRevocationSync(revocationSyncInterval)
+	managers := []*kmscodec.KMSManager{kmsManager}
+
+	// Replace the data key shortly before it expires so requests never wait on the rotation
+	preRotationWindow := min(kmscodec.DefaultPreRotationWindow, rotationInterval/4)
+	if windowStr := os.Getenv("PRE_ROTATION_WINDOW"); windowStr != "" {
+		if window, err := strconv.Atoi(windowStr); err == nil {
+			preRotationWindow = time.Duration(window) * time.Second
 		}
+	}
+	if preRotationWindow >= rotationInterval {
+		log.Fatalf("PRE_ROTATION_WINDOW (%v) must be shorter than DATA_KEY_ROTATION_INTERVAL (%v)", preRotationWindow, rotationInterval)
+	}
+	if preRotationWindow > 0 {
+		kmsManager.StartPreRotation(preRotationWindow, min(preRotationWindow/2, time.Minute))
+	}
 
-		// Note: dataKey is not zeroed here as it might be cached for reuse
-		// The KMSManager handles secure memory management
+	// Report the CMK's multi-Region replicas in /stats for DR checks; failures only lose the report
+	if err := kmsManager.RefreshMultiRegionInfo(context.Background()); err != nil {
+		log.Printf("Failed to read multi-Region key info: %v", err)
+	}
+	multiRegionRefresh := kmscodec.DefaultMultiRegionRefreshInterval
+	if refreshStr := os.Getenv("MULTI_REGION_REFRESH_INTERVAL"); refreshStr != "" {
+		if refresh, err := strconv.Atoi(refreshStr); err == nil && refresh > 0 {
+			multiRegionRefresh = time.Duration(refresh) * time.Second
+		}
+	}
+	kmsManager.StartMultiRegionRefresh(multiRegionRefresh)
 
-		// Create response payload with base64 encoded decrypted data
-		decodedPayload := shared.PayloadData{
-			Metadata: map[string]string{
-				"encoding": "json/plain",
-			},
-			Data: base64.StdEncoding.EncodeToString(decryptedData),
+	// Decrypt grants can only be created through the admin endpoints; retire them once they lapse
+	if os.Getenv("ADMIN_TOKEN") != "" {
+		kmsManager.StartGrantRetirement(kmscodec.DefaultGrantRetirementInterval)
+	}
+
+	// Parse per-request batch limit
+	maxPayloads := kmscodec.DefaultMaxPayloadsPerRequest
+	if maxPayloadsStr := os.Getenv("MAX_PAYLOADS_PER_REQUEST"); maxPayloadsStr != "" {
+		if limit, err := strconv.Atoi(maxPayloadsStr); err == nil {
+			maxPayloads = limit
 		}
+	}
 
-		response.Payloads = append(response.Payloads, decodedPayload)
+	// Parse per-request payload concurrency
+	concurrency := kmscodec.DefaultPayloadConcurrency
+	if concurrencyStr := os.Getenv("PAYLOAD_CONCURRENCY"); concurrencyStr != "" {
+		if n, err := strconv.Atoi(concurrencyStr); err == nil {
+			concurrency = n
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Failed to encode response: %v", err)
+	codecOpts := []kmscodec.CodecOption{kmscodec.WithMaxPayloadsPerRequest(maxPayloads), kmscodec.WithConcurrency(concurrency)}
+
+	// Lenient decode keeps one corrupt payload from blanking out a whole history in the Web UI
+	lenientDecode := os.Getenv("DECODE_LENIENT") == "true"
+	codecOpts = append(codecOpts, kmscodec.WithLenientDecode(lenientDecode))
+
+	// Partial decode returns what it can decode and lists the failures, server-side ones included
+	partialDecode := os.Getenv("DECODE_PARTIAL") == "true"
+	codecOpts = append(codecOpts, kmscodec.WithPartialDecode(partialDecode))
+
+	// Strict JSON catches misspelled request fields that would otherwise be ignored
+	codecOpts = append(codecOpts, kmscodec.WithStrictJSON(os.Getenv("STRICT_JSON_REQUESTS") == "true"))
+
+	// Strict decode rejects payloads with missing or inconsistent envelope fields up front
+	strictDecode := os.Getenv("DECODE_STRICT") == "true"
+	codecOpts = append(codecOpts, kmscodec.WithStrictDecode(strictDecode))
+
+	// Authenticated encode times let retention jobs trust a payload's age
+	encodeTimestamp := os.Getenv("ENCODE_TIMESTAMP") == "true"
+	codecOpts = append(codecOpts, kmscodec.WithEncodeTimestamp(encodeTimestamp))
+
+	// Replay protection: /decode refuses payloads encoded longer ago than this, unless an admin asks
+	if maxAgeStr := os.Getenv("DECODE_MAX_AGE"); maxAgeStr != "" {
+		if maxAge, err := strconv.Atoi(maxAgeStr); err == nil && maxAge > 0 {
+			codecOpts = append(codecOpts, kmscodec.WithDecodeMaxAge(time.Duration(maxAge)*time.Second))
+			log.Printf("Decode max age: %v", time.Duration(maxAge)*time.Second)
+		}
 	}
-}
 
-// handleStats handles the /stats endpoint for monitoring
-func (c *KMSEncryptionCodec) handleStats(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	// Opt-in encode deduplication; identical payloads then reveal that they are identical
+	if dedupStr := os.Getenv("ENCODE_DEDUP_MAX_ENTRIES"); dedupStr != "" {
+		if n, err := strconv.Atoi(dedupStr); err == nil && n > 0 {
+			codecOpts = append(codecOpts, kmscodec.WithEncodeDedup(n))
+			log.Printf("Encode deduplication enabled for the last %d distinct payloads", n)
+		}
 	}
 
-	stats := c.kmsManager.GetKeyStats()
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(stats); err != nil {
-		log.Printf("Failed to encode stats response: %v", err)
+	// Optional nonce-misuse-resistant cipher for whole payloads
+	switch payloadCipher := os.Getenv("PAYLOAD_CIPHER"); payloadCipher {
+	case "", kmscodec.AlgorithmAES256GCM:
+	case kmscodec.AlgorithmAES256GCMSIV:
+		if dataKeySpec != types.DataKeySpecAes256 {
+			log.Fatalf("PAYLOAD_CIPHER=%s needs DATA_KEY_SPEC=AES_256", payloadCipher)
+		}
+		codecOpts = append(codecOpts, kmscodec.WithCipher(payloadCipher))
+		log.Printf("Payloads are encrypted with %s", payloadCipher)
+	default:
+		log.Fatalf("Unsupported PAYLOAD_CIPHER %q (use %s or %s)", payloadCipher, kmscodec.AlgorithmAES256GCM, kmscodec.AlgorithmAES256GCMSIV)
 	}
-}
 
-func resolveKMSAlias(alias string) (string, error) {
-	// Create AWS config
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return "", fmt.Errorf("failed to load AWS config: %w", err)
+	// Hybrid migration: decode payloads of the legacy static-key codec alongside KMS payloads
+	if staticKeyStr := os.Getenv("LEGACY_STATIC_KEY"); staticKeyStr != "" {
+		staticKey, err := base64.StdEncoding.DecodeString(staticKeyStr)
+		if err != nil || len(staticKey) != 32 {
+			log.Fatalf("LEGACY_STATIC_KEY must be a base64 encoded 32-byte key")
+		}
+		// A zero, test or passphrase key left over from a test setup must not reach production
+		if os.Getenv("ENV") == "production" {
+			if err := kmscodec.CheckStaticKeyStrength(staticKey); err != nil {
+				log.Fatalf("Refusing LEGACY_STATIC_KEY in production: %v", err)
+			}
+		}
+		codecOpts = append(codecOpts, kmscodec.WithStaticKey(staticKey))
+		clear(staticKey)
+		log.Printf("Legacy static-key payloads (scheme: static) will be decoded; encode still uses KMS")
 	}
 
-	// Create KMS client
-	kmsClient := kms.NewFromConfig(cfg)
+	if encoding := os.Getenv("DECODE_DEFAULT_ENCODING"); encoding != "" {
+		codecOpts = append(codecOpts, kmscodec.WithDefaultDecodeEncoding(encoding))
+	}
+	// "default" labels empty plaintext like any other payload without an original encoding
+	if encoding := os.Getenv("DECODE_EMPTY_ENCODING"); encoding != "" {
+		if encoding == "default" {
+			encoding = ""
+		}
+		codecOpts = append(codecOpts, kmscodec.WithEmptyDecodeEncoding(encoding))
+	}
 
-	// Resolve the alias
-	result, err := kmsClient.DescribeKey(context.TODO(), &kms.DescribeKeyInput{
-		KeyId: aws.String(alias),
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to resolve alias %s: %w", alias, err)
+	// Field-level encryption keeps the rest of each JSON payload readable
+	encryptFields := kmscodec.ParseFieldPaths(os.Getenv("ENCRYPT_FIELDS"))
+	if len(encryptFields) > 0 && dataKeySpec != types.DataKeySpecAes256 {
+		log.Fatalf("ENCRYPT_FIELDS needs DATA_KEY_SPEC=AES_256")
 	}
+	codecOpts = append(codecOpts, kmscodec.WithEncryptFields(encryptFields))
 
-	return *result.KeyMetadata.Arn, nil
-}
+	// Metadata rules can exempt payloads from encryption; everything else is encrypted
+	policy, err := kmscodec.ParseEncryptionPolicy(os.Getenv("ENCRYPTION_POLICY"))
+	if err != nil {
+		log.Fatalf("Invalid ENCRYPTION_POLICY: %v", err)
+	}
+	codecOpts = append(codecOpts, kmscodec.WithEncryptionPolicy(policy))
 
-func main() {
-	// Get alias from environment
-	keyAlias := os.Getenv("KMS_KEY_ALIAS")
-	if keyAlias == "" {
-		keyAlias = "alias/temporal-codec-latest" // Default
+	// Only allowlisted metadata keys, besides the codec's own, leave encode and decode
+	if allowlist := kmscodec.ParseFieldPaths(os.Getenv("METADATA_ALLOWLIST")); len(allowlist) > 0 {
+		codecOpts = append(codecOpts, kmscodec.WithMetadataAllowlist(allowlist))
+		log.Printf("Metadata allowlist: %s", strings.Join(allowlist, ", "))
 	}
 
-	// Resolve alias to actual key ARN
-	actualKeyARN, err := resolveKMSAlias(keyAlias)
+	// Payloads another codec already encrypted can be passed through or refused instead of wrapped again
+	foreignPolicy, err := kmscodec.ParseForeignEncryptionPolicy(os.Getenv("FOREIGN_ENCRYPTION_POLICY"))
 	if err != nil {
-		log.Fatalf("Failed to resolve KMS alias %s: %v", keyAlias, err)
+		log.Fatalf("Invalid FOREIGN_ENCRYPTION_POLICY: %v", err)
+	}
+	if foreignPolicy != kmscodec.ForeignEncryptionOff {
+		markersStr := os.Getenv("FOREIGN_ENCRYPTION_MARKERS")
+		if markersStr == "" {
+			markersStr = kmscodec.DefaultForeignEncryptionMarkers
+		}
+		markers, err := kmscodec.ParseForeignEncryptionMarkers(markersStr)
+		if err != nil {
+			log.Fatalf("Invalid FOREIGN_ENCRYPTION_MARKERS: %v", err)
+		}
+		codecOpts = append(codecOpts, kmscodec.WithForeignEncryption(foreignPolicy, markers))
+		log.Printf("Foreign encryption policy: %s payloads matching %s", foreignPolicy, markersStr)
 	}
 
-	log.Printf("Using KMS alias: %s → %s", keyAlias, actualKeyARN)
-	// Parse cache TTL for old keys
-	cacheTTLStr := os.Getenv("KMS_CACHE_TTL")
-	cacheTTL := 24 * time.Hour // default - keep old keys cached for 24 hours
-	if cacheTTLStr != "" {
-		if ttl, err := strconv.Atoi(cacheTTLStr); err == nil {
-			cacheTTL = time.Duration(ttl) * time.Second
+	// Pipeline stages in encode order, e.g. gzip,encrypt to compress before encrypting
+	if transformsStr := os.Getenv("PAYLOAD_TRANSFORMS"); transformsStr != "" {
+		transforms, err := kmscodec.ParseTransforms(transformsStr)
+		if err != nil {
+			log.Fatalf("Invalid PAYLOAD_TRANSFORMS: %v", err)
 		}
+		codecOpts = append(codecOpts, kmscodec.WithTransforms(transforms))
+		log.Printf("Payload transforms: %s", strings.Join(transforms, " → "))
 	}
 
-	// Parse key rotation interval
-	rotationIntervalStr := os.Getenv("DATA_KEY_ROTATION_INTERVAL")
-	rotationInterval := 1 * time.Hour // default - rotate every hour
-	if rotationIntervalStr != "" {
-		if interval, err := strconv.Atoi(rotationIntervalStr); err == nil {
-			rotationInterval = time.Duration(interval) * time.Second
+	// Readiness checks for /ready; READY_CHECKS narrows the built-in set
+	readyCacheMaxEntries := kmscodec.DefaultReadyCacheMaxEntries
+	if maxStr := os.Getenv("READY_CACHE_MAX_ENTRIES"); maxStr != "" {
+		if n, err := strconv.Atoi(maxStr); err == nil {
+			readyCacheMaxEntries = n
 		}
 	}
+	readinessChecks := kmscodec.DefaultReadinessChecks(kmsManager, readyCacheMaxEntries)
+	if names, ok := os.LookupEnv("READY_CHECKS"); ok {
+		readinessChecks, err = kmscodec.SelectReadinessChecks(readinessChecks, names)
+		if err != nil {
+			log.Fatalf("Invalid READY_CHECKS: %v", err)
+		}
+	}
+	codecOpts = append(codecOpts, kmscodec.WithReadinessChecks(readinessChecks))
 
-	// Initialize KMS manager with time-based rotation
-	kmsManager, err := NewKMSManager(actualKeyARN, cacheTTL, rotationInterval)
-	if err != nil {
-		log.Fatalf("Failed to initialize KMS manager: %v", err)
+	// Optional protection profiles, selected per encode request by its codec context
+	if profilesStr := os.Getenv("CODEC_PROFILES"); profilesStr != "" {
+		attribute := os.Getenv("CODEC_PROFILE_ATTRIBUTE")
+		if attribute == "" {
+			log.Fatalf("CODEC_PROFILES needs CODEC_PROFILE_ATTRIBUTE")
+		}
+		specs, err := kmscodec.ParseCodecProfiles(profilesStr)
+		if err != nil {
+			log.Fatalf("Invalid CODEC_PROFILES: %v", err)
+		}
+		profiles := make(map[string]*kmscodec.KMSEncryptionCodec, len(specs))
+		for _, spec := range specs {
+			if spec.Cipher == kmscodec.AlgorithmAES256GCMSIV && dataKeySpec != types.DataKeySpecAes256 {
+				log.Fatalf("Codec profile %s: %s needs DATA_KEY_SPEC=AES_256", spec.Value, spec.Cipher)
+			}
+			if awsKMSClient == nil {
+				log.Fatalf("Codec profile %s: CODEC_PROFILES cannot be used with CODEC_MODE=local", spec.Value)
+			}
+			keyARN, err := kmscodec.ResolveKMSAlias(awsKMSClient, spec.KeyAlias)
+			if err != nil {
+				log.Fatalf("Codec profile %s: %v", spec.Value, err)
+			}
+			profileManager, err := kmscodec.NewKMSManagerWithClient(kmsClient, keyARN, cacheTTL, rotationInterval, managerOpts...)
+			if err != nil {
+				log.Fatalf("Codec profile %s: failed to initialize KMS manager: %v", spec.Value, err)
+			}
+			profileManager.StartCacheCleanup(cleanupInterval)
+			profileManager.StartKeyPoolRefill()
+			profileManager.StartRevocationSync(revocationSyncInterval)
+			if preRotationWindow > 0 {
+				profileManager.StartPreRotation(preRotationWindow, min(preRotationWindow/2, time.Minute))
+			}
+			profileOpts := slices.Clone(codecOpts)
+			if spec.Cipher != "" {
+				profileOpts = append(profileOpts, kmscodec.WithCipher(spec.Cipher))
+			}
+			profiles[spec.Value] = kmscodec.NewKMSEncryptionCodec(profileManager, profileOpts...)
+			managers = append(managers, profileManager)
+			log.Printf("Codec profile %s=%s: key %s", attribute, spec.Value, keyARN)
+		}
+		codecOpts = append(codecOpts, kmscodec.WithProfiles(attribute, profiles))
 	}
 
-	// Start background maintenance routines
-	kmsManager.StartCacheCleanup(15 * time.Minute)
+	// Optional audit record of every payload a decode returns in plaintext
+	if auditSink := os.Getenv("AUDIT_LOG_SINK"); auditSink != "" {
+		var sink kmscodec.AuditSink
+		switch auditSink {
+		case "stdout":
+			sink = kmscodec.NewWriterAuditSink(os.Stdout)
+		case "file":
+			sink, err = kmscodec.OpenFileAuditSink(os.Getenv("AUDIT_LOG_FILE"))
+		case "sqs":
+			sink, err = kmscodec.NewSQSAuditSink(context.Background(), os.Getenv("AUDIT_LOG_SQS_QUEUE_URL"), os.Getenv("AWS_REGION"))
+		default:
+			log.Fatalf("Unsupported AUDIT_LOG_SINK %q (use stdout, file or sqs)", auditSink)
+		}
+		if err != nil {
+			log.Fatalf("Failed to create %s audit log: %v", auditSink, err)
+		}
+		bufferSize := kmscodec.DefaultAuditBufferSize
+		if bufferStr := os.Getenv("AUDIT_LOG_BUFFER"); bufferStr != "" {
+			if n, err := strconv.Atoi(bufferStr); err == nil && n > 0 {
+				bufferSize = n
+			}
+		}
+		codecOpts = append(codecOpts, kmscodec.WithAuditLog(sink, bufferSize))
+		log.Printf("Decode audit log: %s (buffer %d)", auditSink, bufferSize)
+	}
 
-	codec := NewKMSEncryptionCodec(kmsManager)
+	// Optional fleet-wide view merging the /stats of every replica
+	if peersStr := os.Getenv("FLEET_PEERS"); peersStr != "" {
+		peers, err := kmscodec.ParseFleetPeers(peersStr)
+		if err != nil {
+			log.Fatalf("Invalid FLEET_PEERS: %v", err)
+		}
+		codecOpts = append(codecOpts, kmscodec.WithFleetStats(peers))
+		log.Printf("Fleet stats at /stats/fleet over %s", strings.Join(peers, ", "))
+	}
 
-	// Set up routes
-	http.HandleFunc("/encode", codec.handleEncode)
-	http.HandleFunc("/decode", codec.handleDecode)
-	http.HandleFunc("/stats", codec.handleStats)
+	codecOpts = append(codecOpts, kmscodec.WithBuildInfo(kmscodec.BuildInfo{Version: version, Commit: commit, BuildDate: buildDate}))
+	codec := kmscodec.NewKMSEncryptionCodec(kmsManager, codecOpts...)
 
-	// Health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	// Set up routes; admin endpoints are protected by a bearer token
+	codec.RegisterRoutes(http.DefaultServeMux, os.Getenv("ADMIN_TOKEN"))
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8081"
 	}
 
-	log.Printf("KMS Codec server starting on port %s", port)
+	log.Printf("KMS Codec server %s starting on port %s", version, port)
 	log.Printf("Using KMS Key: %s", actualKeyARN)
 	log.Printf("Data key rotation interval: %v", rotationInterval)
+	if preRotationWindow > 0 {
+		log.Printf("Data key pre-rotation: %v before expiry", preRotationWindow)
+	}
 	log.Printf("Decryption cache TTL: %v", cacheTTL)
-	log.Printf("Endpoints: /encode, /decode, /stats, /health")
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Printf("Payload processing: %s", concurrencyDescription(concurrency))
+	if len(encryptFields) > 0 {
+		log.Printf("Field-level encryption: %s", strings.Join(encryptFields, ", "))
+	}
+	if partialDecode {
+		log.Printf("Partial decode enabled: failed payloads are listed in the response's errors")
+	} else if lenientDecode {
+		log.Printf("Lenient decode enabled: corrupt payloads are replaced with error sentinels")
+	}
+	if encodeTimestamp {
+		log.Printf("Encode timestamps enabled: AES-256-GCM payloads carry an authenticated encode time")
+	}
+	log.Printf("Endpoints: /encode, /decode, /stats, /health, /ready, /version, /revoke (admin), /cache (admin)")
+
+	// HTTP/2 multiplexes concurrent codec requests over one connection: h2 over TLS, h2c in plaintext
+	server := &http.Server{Addr: ":" + port, Protocols: new(http.Protocols)}
+	server.Protocols.SetHTTP1(true)
+	if os.Getenv("CODEC_HTTP2") == "true" {
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		log.Printf("HTTP/2 enabled (h2 over TLS, h2c in plaintext)")
+	}
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	serveErr := make(chan error, 1)
+	go func() {
+		if certFile != "" || keyFile != "" {
+			serveErr <- server.ListenAndServeTLS(certFile, keyFile)
+			return
+		}
+		serveErr <- server.ListenAndServe()
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	// Finish in-flight requests, then stop every manager's background routines
+	log.Printf("Shutting down codec server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("unable to stop codec server: %v", err)
+	}
+	cancel()
+	for _, manager := range managers {
+		manager.Close()
+	}
+}
+
+// concurrencyDescription describes the concurrency setting for startup logs
+func concurrencyDescription(concurrency int) string {
+	if concurrency <= 1 {
+		return "sequential"
+	}
+	return fmt.Sprintf("%d payloads in parallel", concurrency)
 }
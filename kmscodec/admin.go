@@ -0,0 +1,338 @@
+package kmscodec
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+// RevokeRequest identifies a data key to revoke, either by its encrypted blob or fingerprint
+type RevokeRequest struct {
+	EncryptedDataKey string `json:"encrypted_data_key,omitempty"`
+	Fingerprint      string `json:"fingerprint,omitempty"`
+}
+
+// GrantRequest asks for a time-boxed decrypt grant for one principal
+type GrantRequest struct {
+	GranteePrincipal string `json:"grantee_principal"`
+	TTLSeconds       int    `json:"ttl_seconds,omitempty"` // zero means DefaultGrantTTL
+}
+
+// CacheEntryResponse describes one decryption cache entry in the /cache response
+type CacheEntryResponse struct {
+	Fingerprint  string `json:"fingerprint"`
+	Age          string `json:"age"`
+	TTLRemaining string `json:"ttl_remaining"`
+}
+
+// cacheEntryResponses describes cache entries relative to now
+func cacheEntryResponses(cached []CacheEntryInfo, now time.Time) []CacheEntryResponse {
+	entries := make([]CacheEntryResponse, 0, len(cached))
+	for _, entry := range cached {
+		entries = append(entries, CacheEntryResponse{
+			Fingerprint:  entry.Fingerprint,
+			Age:          now.Sub(entry.CachedAt).Round(time.Second).String(),
+			TTLRemaining: entry.ExpiresAt.Sub(now).Round(time.Second).String(),
+		})
+	}
+	return entries
+}
+
+// adminOnly guards an admin handler with a static bearer token.
+// Admin endpoints are disabled entirely when no token is configured.
+func adminOnly(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "Admin endpoints are disabled (ADMIN_TOKEN not set)", http.StatusForbidden)
+			return
+		}
+
+		provided, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// handleRevoke handles the /revoke admin endpoint. The key is revoked in the default
+// manager and every profile manager, whichever of them generated it.
+func (c *KMSEncryptionCodec) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RevokeRequest
+	if err := shared.DecodeJSON(r.Body, &req, c.strictJSON); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fingerprint := req.Fingerprint
+	if req.EncryptedDataKey != "" {
+		fingerprint = KeyFingerprint(req.EncryptedDataKey)
+	}
+	if fingerprint == "" {
+		http.Error(w, "encrypted_data_key or fingerprint is required", http.StatusBadRequest)
+		return
+	}
+	// A mistyped fingerprint would be denylisted without matching any key
+	if !isKeyFingerprint(fingerprint) {
+		http.Error(w, "fingerprint must be 16 lowercase hex digits", http.StatusBadRequest)
+		return
+	}
+
+	for _, manager := range c.allManagers() {
+		if err := manager.RevokeDataKey(r.Context(), fingerprint); err != nil {
+			log.Printf("Failed to revoke data key: %v", err)
+			http.Error(w, "Revocation failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"fingerprint": fingerprint,
+		"status":      "revoked",
+	}); err != nil {
+		log.Printf("Failed to encode revoke response: %v", err)
+	}
+}
+
+// handleCache handles the /cache admin endpoint, listing decryption cache metadata of the
+// default and profile managers. Plaintext key bytes are never part of the response.
+func (c *KMSEncryptionCodec) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var cached []CacheEntryInfo
+	for _, manager := range c.cacheManagers() {
+		cached = append(cached, manager.CachedKeys(r.Context())...)
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].CachedAt.Before(cached[j].CachedAt) })
+	entries := cacheEntryResponses(cached, c.kmsManager.clock.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"backend": c.kmsManager.decryptionCache.Backend(),
+		"count":   len(entries),
+		"entries": entries,
+	}); err != nil {
+		log.Printf("Failed to encode cache response: %v", err)
+	}
+}
+
+// handleCacheFlush handles the /cache/flush admin endpoint, emptying the decryption caches of
+// the default and profile managers
+func (c *KMSEncryptionCodec) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cleared := 0
+	for _, manager := range c.cacheManagers() {
+		cleared += manager.FlushDecryptionCache(r.Context())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"backend": c.kmsManager.decryptionCache.Backend(),
+		"cleared": cleared,
+	}); err != nil {
+		log.Printf("Failed to encode cache flush response: %v", err)
+	}
+}
+
+// handleGrants handles the /grants admin endpoint: POST creates a decrypt grant,
+// DELETE ?grant_id= retires one early
+func (c *KMSEncryptionCodec) handleGrants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req GrantRequest
+		if err := shared.DecodeJSON(r.Body, &req, c.strictJSON); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl := time.Duration(req.TTLSeconds) * time.Second
+		if req.GranteePrincipal == "" {
+			http.Error(w, "grantee_principal is required", http.StatusBadRequest)
+			return
+		}
+		if ttl < 0 || ttl > MaxGrantTTL {
+			http.Error(w, fmt.Sprintf("ttl_seconds must be between 0 and %d", int(MaxGrantTTL.Seconds())), http.StatusBadRequest)
+			return
+		}
+
+		grant, err := c.kmsManager.CreateDecryptGrant(r.Context(), req.GranteePrincipal, ttl)
+		if err != nil {
+			writeGrantError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(grant); err != nil {
+			log.Printf("Failed to encode grant response: %v", err)
+		}
+
+	case http.MethodDelete:
+		grantID := r.URL.Query().Get("grant_id")
+		if grantID == "" {
+			http.Error(w, "grant_id is required", http.StatusBadRequest)
+			return
+		}
+		if err := c.kmsManager.RetireGrant(r.Context(), grantID); err != nil {
+			writeGrantError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{
+			"grant_id": grantID,
+			"status":   "retired",
+		}); err != nil {
+			log.Printf("Failed to encode grant response: %v", err)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeGrantError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errGrantsUnsupported) {
+		http.Error(w, "Grants are not supported by this KMS client", http.StatusNotImplemented)
+		return
+	}
+	log.Printf("Grant operation failed: %v", err)
+	http.Error(w, "Grant operation failed: "+err.Error(), http.StatusInternalServerError)
+}
+
+// RetiredKeyResponse names a retired data key and the one that replaced it
+type RetiredKeyResponse struct {
+	Fingerprint        string `json:"fingerprint"`
+	CurrentFingerprint string `json:"current_fingerprint"`
+}
+
+// handleRetireCurrent handles the /retire-current admin endpoint, replacing the current data
+// key of the default and every profile manager while keeping them available for decryption
+func (c *KMSEncryptionCodec) handleRetireCurrent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	retire := func(manager *KMSManager) (RetiredKeyResponse, bool) {
+		retired, current, err := manager.RetireCurrentKey(r.Context())
+		if errors.Is(err, ErrRetireKeyPair) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return RetiredKeyResponse{}, false
+		}
+		if err != nil {
+			log.Printf("Failed to retire current data key: %v", err)
+			http.Error(w, "Retirement failed: "+err.Error(), http.StatusInternalServerError)
+			return RetiredKeyResponse{}, false
+		}
+		return RetiredKeyResponse{Fingerprint: retired, CurrentFingerprint: current}, true
+	}
+
+	retired, ok := retire(c.kmsManager)
+	if !ok {
+		return
+	}
+	response := map[string]interface{}{
+		"fingerprint":         retired.Fingerprint,
+		"current_fingerprint": retired.CurrentFingerprint,
+		"status":              "retired",
+	}
+	if len(c.profiles) > 0 {
+		profiles := make(map[string]RetiredKeyResponse, len(c.profiles))
+		for value, profile := range c.profiles {
+			if profiles[value], ok = retire(profile.kmsManager); !ok {
+				return
+			}
+		}
+		response["profiles"] = profiles
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode retire response: %v", err)
+	}
+}
+
+// RewrapResponse is the /rewrap response: the payloads in request order, and how many got a new data key ciphertext
+type RewrapResponse struct {
+	Payloads  []shared.PayloadData `json:"payloads"`
+	Rewrapped int                  `json:"rewrapped"`
+}
+
+// handleRewrap handles the /rewrap admin endpoint: POST a codec request with
+// ?destination_key_arn= to re-encrypt each payload's data key under that master key
+func (c *KMSEncryptionCodec) handleRewrap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	destination := r.URL.Query().Get("destination_key_arn")
+	if destination == "" {
+		http.Error(w, "destination_key_arn is required", http.StatusBadRequest)
+		return
+	}
+
+	var req shared.CodecRequest
+	if err := shared.DecodeJSON(r.Body, &req, c.strictJSON); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !c.checkBatchSize(w, req) {
+		return
+	}
+
+	response := RewrapResponse{Payloads: make([]shared.PayloadData, len(req.Payloads))}
+	for i, payload := range req.Payloads {
+		rewrapped, changed, err := c.kmsManager.RewrapPayload(r.Context(), payload, destination)
+		if err != nil {
+			writeRewrapError(w, i, err)
+			return
+		}
+		response.Payloads[i] = rewrapped
+		if changed {
+			response.Rewrapped++
+		}
+	}
+	log.Printf("Rewrapped %d of %d payloads under %s", response.Rewrapped, len(req.Payloads), destination)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode rewrap response: %v", err)
+	}
+}
+
+func writeRewrapError(w http.ResponseWriter, index int, err error) {
+	switch {
+	case errors.Is(err, errRewrapUnsupported):
+		http.Error(w, "Rewrap is not supported by this KMS client", http.StatusNotImplemented)
+	case errors.Is(err, ErrKeyRevoked):
+		log.Printf("Refused to rewrap payload %d: %v", index, err)
+		http.Error(w, fmt.Sprintf("Payload %d: key decryption refused", index), http.StatusForbidden)
+	case errors.Is(err, ErrMalformedDataKey), errors.Is(err, errEnvelopeMismatch):
+		http.Error(w, fmt.Sprintf("Payload %d is corrupt: %v", index, err), http.StatusBadRequest)
+	case errors.Is(err, ErrKMSUnavailable), errors.Is(err, ErrKeyUnavailable):
+		http.Error(w, fmt.Sprintf("Payload %d: %v", index, err), http.StatusServiceUnavailable)
+	default:
+		log.Printf("Failed to rewrap payload %d: %v", index, err)
+		http.Error(w, fmt.Sprintf("Rewrap of payload %d failed: %v", index, err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,296 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+func TestAdminOnlyRequiresToken(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	cases := []struct {
+		name       string
+		configured string
+		header     string
+		wantStatus int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusForbidden},
+		{"missing", "secret", "", http.StatusUnauthorized},
+		{"wrong", "secret", "Bearer nope", http.StatusUnauthorized},
+		{"no scheme", "secret", "secret", http.StatusUnauthorized},
+		{"valid", "secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			adminOnly(tc.configured, ok)(rec, req)
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("expected %d, got %d", tc.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestRevokeBlocksOnlyTheRevokedKey(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	// Encrypt one payload under the first key, rotate, then another under the second key
+	oldPayload := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	newPayload := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":2}`)},
+	})).Payloads[0]
+
+	// Warm the cache so revocation must evict it
+	decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{oldPayload},
+	}))
+
+	body, _ := json.Marshal(RevokeRequest{EncryptedDataKey: oldPayload.EncryptedDataKey})
+	rec := httptest.NewRecorder()
+	codec.handleRevoke(rec, httptest.NewRequest(http.MethodPost, "/revoke", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{oldPayload}})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for revoked key, got %d", rec.Code)
+	}
+	if len(memoryEntries(codec.kmsManager)) != 0 {
+		t.Fatal("expected the revoked key to be evicted from the cache")
+	}
+
+	decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{newPayload},
+	}))
+}
+
+func TestRevokeCurrentKeyRotates(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	current, _ := manager.GetCurrentDataKey(context.Background())
+	revokedKey := current.EncryptedKey
+	if err := manager.RevokeDataKey(context.Background(), KeyFingerprint(revokedKey)); err != nil {
+		t.Fatalf("RevokeDataKey: %v", err)
+	}
+
+	next, _ := manager.GetCurrentDataKey(context.Background())
+	if next.EncryptedKey == revokedKey {
+		t.Fatal("expected a fresh current key after revoking the current one")
+	}
+	if _, err := manager.DecryptDataKey(context.Background(), revokedKey, testKeyARN, nil); !errors.Is(err, ErrKeyRevoked) {
+		t.Fatalf("expected ErrKeyRevoked, got %v", err)
+	}
+}
+
+func TestRevokeRequiresIdentifier(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	rec := httptest.NewRecorder()
+	codec.handleRevoke(rec, httptest.NewRequest(http.MethodPost, "/revoke", bytes.NewReader([]byte(`{}`))))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestRevokeRejectsMalformedFingerprint(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	for _, fingerprint := range []string{"abc", "0123456789ABCDEF", "0123456789abcdeg", "0123456789abcdef0"} {
+		rec := httptest.NewRecorder()
+		body := []byte(`{"fingerprint":"` + fingerprint + `"}`)
+		codec.handleRevoke(rec, httptest.NewRequest(http.MethodPost, "/revoke", bytes.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", fingerprint, rec.Code)
+		}
+	}
+	if n := len(codec.kmsManager.revokedKeys); n != 0 {
+		t.Fatalf("expected nothing revoked, got %d keys", n)
+	}
+}
+
+func TestCacheEndpointListsMetadataOnly(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	manager := codec.kmsManager
+
+	old, _ := manager.GetCurrentDataKey(context.Background())
+	oldEncrypted, oldPlaintext := old.EncryptedKey, cloneKey(old.PlaintextKey)
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	codec.handleCache(rec, httptest.NewRequest(http.MethodGet, "/cache", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.Bytes()
+
+	var resp struct {
+		Backend string               `json:"backend"`
+		Count   int                  `json:"count"`
+		Entries []CacheEntryResponse `json:"entries"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Backend != "memory" || resp.Count != 1 || len(resp.Entries) != 1 {
+		t.Fatalf("unexpected response: %s", body)
+	}
+	if resp.Entries[0].Fingerprint != KeyFingerprint(oldEncrypted) {
+		t.Fatalf("expected fingerprint %s, got %s", KeyFingerprint(oldEncrypted), resp.Entries[0].Fingerprint)
+	}
+	if resp.Entries[0].TTLRemaining != "1h0m0s" {
+		t.Fatalf("expected the full cache TTL remaining, got %s", resp.Entries[0].TTLRemaining)
+	}
+
+	// Neither the key bytes nor the encrypted blob may leak
+	for _, secret := range []string{base64.StdEncoding.EncodeToString(oldPlaintext), oldEncrypted} {
+		if bytes.Contains(body, []byte(secret)) {
+			t.Fatalf("response leaks key material: %s", body)
+		}
+	}
+}
+
+func TestCacheFlushSendsDecryptsBackToKMS(t *testing.T) {
+	codec, fake := newTestCodec(t)
+	old := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	cached := memoryEntries(codec.kmsManager)[old.EncryptedDataKey].Key
+
+	rec := httptest.NewRecorder()
+	codec.handleCacheFlush(rec, httptest.NewRequest(http.MethodPost, "/cache/flush", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("flush failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var response struct {
+		Cleared int `json:"cleared"`
+	}
+	json.NewDecoder(rec.Body).Decode(&response)
+	if response.Cleared != 1 || codec.kmsManager.decryptionCache.Len(context.Background()) != 0 {
+		t.Fatalf("expected 1 entry cleared and an empty cache, got %d", response.Cleared)
+	}
+	if !bytes.Equal(cached, make([]byte, len(cached))) {
+		t.Fatal("expected the flushed key to be zeroed")
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{old},
+	})).Payloads[0]
+	if decoded.Metadata[shared.KeySourceMetadataKey] != KeySourceKMS {
+		t.Fatalf("expected the key to come from KMS after a flush, got %q", decoded.Metadata[shared.KeySourceMetadataKey])
+	}
+	if _, decrypts := fake.calls(); decrypts != 1 {
+		t.Fatalf("expected 1 KMS decrypt, got %d", decrypts)
+	}
+}
+
+func TestCacheFlushDuringDecodes(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	old := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{old}}); rec.Code != http.StatusOK {
+					t.Errorf("decode during flush failed: %d %s", rec.Code, rec.Body.String())
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				codec.kmsManager.FlushDecryptionCache(context.Background())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCacheFlushRequiresPost(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	rec := httptest.NewRecorder()
+	codec.handleCacheFlush(rec, httptest.NewRequest(http.MethodGet, "/cache/flush", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rec.Code)
+	}
+}
+
+func TestRetireCurrentKeyKeepsItDecryptableLocally(t *testing.T) {
+	codec, fake := newTestCodec(t)
+	before := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+
+	rec := httptest.NewRecorder()
+	codec.handleRetireCurrent(rec, httptest.NewRequest(http.MethodPost, "/retire-current", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("retire failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var response map[string]string
+	json.NewDecoder(rec.Body).Decode(&response)
+	if response["fingerprint"] != KeyFingerprint(before.EncryptedDataKey) || response["current_fingerprint"] == response["fingerprint"] {
+		t.Fatalf("unexpected retire response %v", response)
+	}
+
+	after := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":2}`)},
+	})).Payloads[0]
+	if after.EncryptedDataKey == before.EncryptedDataKey {
+		t.Fatal("expected encodes after retirement to use a fresh key")
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{before},
+	})).Payloads[0]
+	if decoded.Metadata[shared.KeySourceMetadataKey] != KeySourceCache {
+		t.Fatalf("expected the retired key to be served from the cache, got %q", decoded.Metadata[shared.KeySourceMetadataKey])
+	}
+	if _, decrypts := fake.calls(); decrypts != 0 {
+		t.Fatalf("expected no KMS decrypt for a payload under the retired key, got %d", decrypts)
+	}
+}
+
+func TestRetireCurrentKeyUnsupportedInKeyPairMode(t *testing.T) {
+	manager, err := NewKMSManagerWithClient(newFakeKMS(), testKeyARN, time.Hour, time.Hour, WithKeyPairMode(types.DataKeyPairSpecRsa2048))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	if _, _, err := manager.RetireCurrentKey(context.Background()); !errors.Is(err, ErrRetireKeyPair) {
+		t.Fatalf("expected ErrRetireKeyPair, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package kmscodec
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// EncryptWithPublicKey encrypts data for a KMS data key pair using hybrid encryption:
+// a fresh AES-256 content key encrypts the data with AES-GCM and is wrapped with RSA-OAEP.
+// It returns the base64 ciphertext and the base64 wrapped content key.
+func EncryptWithPublicKey(data []byte, publicKeyDER []byte) (string, string, error) {
+	parsed, err := x509.ParsePKIXPublicKey(publicKeyDER)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse public key: %w", err)
+	}
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return "", "", fmt.Errorf("unsupported public key type %T", parsed)
+	}
+
+	contentKey := make([]byte, 32)
+	if _, err := rand.Read(contentKey); err != nil {
+		return "", "", err
+	}
+	defer zeroKey(contentKey)
+
+	ciphertext, err := EncryptWithDataKey(data, contentKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, contentKey, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to wrap content key: %w", err)
+	}
+
+	return ciphertext, base64.StdEncoding.EncodeToString(wrappedKey), nil
+}
+
+// DecryptWithPrivateKey reverses EncryptWithPublicKey using the PKCS#8 private key returned by KMS
+func DecryptWithPrivateKey(encodedData string, encodedWrappedKey string, privateKeyDER []byte) ([]byte, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(privateKeyDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", parsed)
+	}
+
+	wrappedKey, err := decodeBase64(encodedWrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode of wrapped key failed: %w", err)
+	}
+
+	contentKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrappedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap content key: %w", err)
+	}
+	defer zeroKey(contentKey)
+
+	return DecryptWithDataKey(encodedData, contentKey)
+}
@@ -0,0 +1,94 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+func TestKeyPairModeRoundTrip(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithKeyPairMode(types.DataKeyPairSpecRsa2048))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+
+	if manager.currentDataKey.PlaintextKey != nil {
+		t.Fatal("key pair mode must not hold a plaintext key")
+	}
+
+	original := `{"id":1,"email":"a@b.c"}`
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(original)},
+	}))
+	payload := encoded.Payloads[0]
+	if payload.Algorithm != AlgorithmRSAOAEPAES256GCM || payload.WrappedKey == "" {
+		t.Fatalf("expected hybrid scheme to be recorded, got %+v", payload)
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: encoded.Payloads,
+	}))
+	data, _ := base64.StdEncoding.DecodeString(decoded.Payloads[0].Data)
+	if string(data) != original {
+		t.Fatalf("round trip mismatch: got %q", data)
+	}
+
+	// The private key is only obtainable through KMS
+	if _, decrypt := fake.calls(); decrypt != 1 {
+		t.Fatalf("expected 1 KMS decrypt for the private key, got %d", decrypt)
+	}
+}
+
+func TestMixedHistoryDecodesInKeyPairMode(t *testing.T) {
+	fake := newFakeKMS()
+	symmetric := NewKMSEncryptionCodec(newTestManager(t, fake))
+	legacy := decodeCodecResponse(t, doCodecRequest(t, symmetric.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":"symmetric"}`)},
+	})).Payloads[0]
+
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithKeyPairMode(types.DataKeyPairSpecRsa2048))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	pair := NewKMSEncryptionCodec(manager)
+	current := decodeCodecResponse(t, doCodecRequest(t, pair.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":"pair"}`)},
+	})).Payloads[0]
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, pair.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{legacy, current},
+	}))
+	for i, want := range []string{`{"v":"symmetric"}`, `{"v":"pair"}`} {
+		data, _ := base64.StdEncoding.DecodeString(decoded.Payloads[i].Data)
+		if string(data) != want {
+			t.Fatalf("payload %d: got %q want %q", i, data, want)
+		}
+	}
+}
+
+func TestDecryptWithPrivateKeyRejectsWrongKey(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithKeyPairMode(types.DataKeyPairSpecRsa2048))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	ciphertext, wrapped, err := EncryptWithPublicKey([]byte("secret"), manager.currentDataKey.PublicKey)
+	if err != nil {
+		t.Fatalf("EncryptWithPublicKey: %v", err)
+	}
+
+	// A different key pair's private key must not unwrap the content key
+	other, _ := fake.GenerateDataKeyPairWithoutPlaintext(context.Background(), &kms.GenerateDataKeyPairWithoutPlaintextInput{})
+	if _, err := DecryptWithPrivateKey(ciphertext, wrapped, fake.keys[string(other.PrivateKeyCiphertextBlob)]); err == nil {
+		t.Fatal("expected unwrap with the wrong private key to fail")
+	}
+}
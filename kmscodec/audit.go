@@ -0,0 +1,211 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+// Audit record events
+const (
+	AuditEventDecode       = "decode"
+	AuditEventPinnedDecode = "pinned_decode"
+)
+
+const (
+	// DefaultAuditBufferSize bounds the audit records waiting to be written; further records are dropped
+	DefaultAuditBufferSize = 1024
+	// auditWriteTimeout bounds each sink write, so a slow sink only delays later records
+	auditWriteTimeout = 10 * time.Second
+)
+
+// AuditSink receives audit records, each one a complete JSON document
+type AuditSink interface {
+	WriteAudit(ctx context.Context, record []byte) error
+}
+
+// AuditRecord describes one payload whose plaintext a decode returned. It says who asked,
+// when, and with which data key, and never carries the plaintext or any key material.
+type AuditRecord struct {
+	Timestamp      time.Time `json:"timestamp"`
+	Event          string    `json:"event"`
+	RemoteAddr     string    `json:"remote_addr"`
+	ForwardedFor   string    `json:"forwarded_for,omitempty"`
+	UserAgent      string    `json:"user_agent,omitempty"`
+	Namespace      string    `json:"namespace,omitempty"` // X-Namespace header set by the Temporal Web UI
+	CorrelationID  string    `json:"correlation_id,omitempty"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"` // empty for legacy static-key payloads
+	KMSKeyID       string    `json:"kms_key_id,omitempty"`
+	KeySource      string    `json:"key_source"`
+}
+
+// auditLogger writes audit records to its sink from its own goroutine
+type auditLogger struct {
+	sink     AuditSink
+	records  chan AuditRecord
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	written  atomic.Uint64
+	dropped  atomic.Uint64
+	failed   atomic.Uint64
+}
+
+// WithAuditLog writes an audit record to sink for every payload a decode returns in plaintext.
+// Writing happens in the background: decodes never wait on the sink, and records are dropped
+// (and counted) when more than bufferSize are waiting.
+func WithAuditLog(sink AuditSink, bufferSize int) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.audit = &auditLogger{
+			sink:    sink,
+			records: make(chan AuditRecord, max(bufferSize, 1)),
+			stopCh:  make(chan struct{}),
+		}
+	}
+}
+
+// start writes queued records until stop is called
+func (a *auditLogger) start() {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		for {
+			select {
+			case record := <-a.records:
+				a.write(record)
+			case <-a.stopCh:
+				// Write what was already queued before returning
+				for {
+					select {
+					case record := <-a.records:
+						a.write(record)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// stop writes the queued records and stops the writer
+func (a *auditLogger) stop() {
+	a.stopOnce.Do(func() {
+		close(a.stopCh)
+	})
+	a.wg.Wait()
+}
+
+// enqueue queues record for writing without blocking
+func (a *auditLogger) enqueue(record AuditRecord) {
+	select {
+	case a.records <- record:
+	default:
+		if a.dropped.Add(1) == 1 {
+			log.Printf("Audit log buffer full, dropping records (see audit_records_dropped)")
+		}
+	}
+}
+
+// write sends one record to the sink; failures are logged and counted
+func (a *auditLogger) write(record AuditRecord) {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		a.failed.Add(1)
+		log.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+	if err := a.sink.WriteAudit(ctx, encoded); err != nil {
+		a.failed.Add(1)
+		log.Printf("Failed to write audit record: %v", err)
+		return
+	}
+	a.written.Add(1)
+}
+
+// auditDecoded queues a record for each input payload decode returned in plaintext. Payloads
+// that passed through and lenient-mode sentinels carry no key source and are skipped.
+func (c *KMSEncryptionCodec) auditDecoded(r *http.Request, event string, inputs, outputs []shared.PayloadData) {
+	if c.audit == nil {
+		return
+	}
+	now := c.kmsManager.clock.Now().UTC()
+	for i, output := range outputs {
+		keySource := output.Metadata[shared.KeySourceMetadataKey]
+		if keySource == "" {
+			continue
+		}
+		c.audit.enqueue(AuditRecord{
+			Timestamp:      now,
+			Event:          event,
+			RemoteAddr:     r.RemoteAddr,
+			ForwardedFor:   r.Header.Get("X-Forwarded-For"),
+			UserAgent:      r.UserAgent(),
+			Namespace:      r.Header.Get("X-Namespace"),
+			CorrelationID:  output.Metadata[shared.CorrelationIDMetadataKey],
+			KeyFingerprint: output.Metadata[shared.KeyFingerprintMetadataKey],
+			KMSKeyID:       inputs[i].KMSKeyID,
+			KeySource:      keySource,
+		})
+	}
+}
+
+// addStats adds the audit log counters to a /stats map
+func (a *auditLogger) addStats(stats map[string]interface{}) {
+	stats["audit_records_written"] = int64(a.written.Load())
+	stats["audit_records_dropped"] = int64(a.dropped.Load())
+	stats["audit_write_failures"] = int64(a.failed.Load())
+}
+
+// writeMetrics renders the audit log counters in the Prometheus text exposition format
+func (a *auditLogger) writeMetrics(w io.Writer) {
+	for _, counter := range []struct {
+		name  string
+		value uint64
+	}{
+		{"codec_audit_records_written_total", a.written.Load()},
+		{"codec_audit_records_dropped_total", a.dropped.Load()},
+		{"codec_audit_write_failures_total", a.failed.Load()},
+	} {
+		fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", counter.name, counter.name, counter.value)
+	}
+}
+
+// writerAuditSink writes records as JSON lines
+type writerAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterAuditSink writes each audit record to w as one JSON line, e.g. to os.Stdout
+func NewWriterAuditSink(w io.Writer) AuditSink {
+	return &writerAuditSink{w: w}
+}
+
+// OpenFileAuditSink appends audit records as JSON lines to the file at path, creating it
+// readable by its owner only
+func OpenFileAuditSink(path string) (AuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return NewWriterAuditSink(f), nil
+}
+
+func (s *writerAuditSink) WriteAudit(ctx context.Context, record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(record, '\n'))
+	return err
+}
@@ -0,0 +1,102 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// sqsAuditSink sends each audit record as one SQS message. SendMessage is the only call it
+// makes, so it speaks the SQS JSON protocol directly with SigV4-signed requests rather than
+// pulling in the SQS SDK.
+type sqsAuditSink struct {
+	queueURL    string
+	endpoint    string // scheme and host of the queue URL, where SQS API calls are sent
+	region      string
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	client      *http.Client
+}
+
+// NewSQSAuditSink sends audit records to the SQS queue at queueURL with the default AWS
+// credentials. The region comes from region, else the AWS configuration, else the queue URL.
+func NewSQSAuditSink(ctx context.Context, queueURL, region string) (AuditSink, error) {
+	var loadOpts []func(*config.LoadOptions) error
+	if region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return newSQSAuditSink(queueURL, cfg.Region, cfg.Credentials, http.DefaultClient)
+}
+
+func newSQSAuditSink(queueURL, region string, credentials aws.CredentialsProvider, client *http.Client) (*sqsAuditSink, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid SQS queue URL %q", queueURL)
+	}
+	if region == "" {
+		// Queue URLs look like https://sqs.<region>.amazonaws.com/<account>/<queue>
+		if parts := strings.Split(u.Hostname(), "."); len(parts) > 2 && parts[0] == "sqs" {
+			region = parts[1]
+		}
+	}
+	if region == "" {
+		return nil, fmt.Errorf("no AWS region for SQS queue %s", queueURL)
+	}
+	return &sqsAuditSink{
+		queueURL:    queueURL,
+		endpoint:    u.Scheme + "://" + u.Host,
+		region:      region,
+		credentials: credentials,
+		signer:      v4.NewSigner(),
+		client:      client,
+	}, nil
+}
+
+func (s *sqsAuditSink) WriteAudit(ctx context.Context, record []byte) error {
+	body, err := json.Marshal(map[string]string{"QueueUrl": s.queueURL, "MessageBody": string(record)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS.SendMessage")
+
+	credentials, err := s.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(body)
+	if err := s.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), "sqs", s.region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign SQS request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("SQS SendMessage failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("SQS SendMessage failed: %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package kmscodec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func newAuditedCodec(t *testing.T, sink AuditSink, bufferSize int) *KMSEncryptionCodec {
+	t.Helper()
+	codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), WithAuditLog(sink, bufferSize))
+	t.Cleanup(codec.Close)
+	return codec
+}
+
+func TestAuditRecordsDecodesWithoutPlaintext(t *testing.T) {
+	const secret = `{"ssn":"123-45-6789"}`
+	var buf bytes.Buffer
+	codec := newAuditedCodec(t, NewWriterAuditSink(&buf), 16)
+
+	payload := plainPayload(secret)
+	payload.Metadata[shared.CorrelationIDMetadataKey] = "order-42"
+	encrypted := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{payload},
+	})).Payloads[0]
+
+	body, _ := json.Marshal(shared.CodecRequest{Payloads: []shared.PayloadData{encrypted, plainPayload(`"clear"`)}})
+	req := httptest.NewRequest(http.MethodPost, "/decode", bytes.NewReader(body))
+	req.Header.Set("X-Namespace", "payments")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	rec := httptest.NewRecorder()
+	codec.handleDecode(rec, req)
+	decodeCodecResponse(t, rec)
+	codec.Close()
+
+	// Only the encrypted payload is audited; the plaintext one passed through
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("audit line is not JSON: %v", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 audit record, got %d: %s", len(records), buf.String())
+	}
+	record := records[0]
+	if record.Event != AuditEventDecode || record.Namespace != "payments" || record.ForwardedFor != "203.0.113.7" ||
+		record.CorrelationID != "order-42" || record.KeySource != KeySourceCurrent ||
+		record.KeyFingerprint != KeyFingerprint(encrypted.EncryptedDataKey) || record.KMSKeyID != encrypted.KMSKeyID ||
+		record.RemoteAddr == "" || record.Timestamp.IsZero() {
+		t.Fatalf("unexpected audit record %+v", record)
+	}
+
+	for _, leaked := range []string{"123-45-6789", base64.StdEncoding.EncodeToString([]byte(secret)), encrypted.EncryptedDataKey, encrypted.Data} {
+		if strings.Contains(buf.String(), leaked) {
+			t.Fatalf("audit log contains %q", leaked)
+		}
+	}
+
+	stats := codec.kmsManager.GetKeyStats()
+	codec.audit.addStats(stats)
+	if stats["audit_records_written"] != int64(1) || stats["audit_records_dropped"] != int64(0) {
+		t.Fatalf("unexpected audit stats %v", stats)
+	}
+}
+
+func TestAuditRecordsPinnedDecodes(t *testing.T) {
+	var buf bytes.Buffer
+	codec := newAuditedCodec(t, NewWriterAuditSink(&buf), 16)
+	encrypted := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+
+	doPinnedDecode(t, http.HandlerFunc(codec.handlePinnedDecode), PinnedDecodeRequest{
+		EncryptedDataKey: encrypted.EncryptedDataKey,
+		Payloads:         []shared.PayloadData{encrypted},
+	})
+	codec.Close()
+
+	var record AuditRecord
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &record); err != nil || record.Event != AuditEventPinnedDecode {
+		t.Fatalf("expected one pinned_decode record, got %q (%v)", buf.String(), err)
+	}
+}
+
+// blockingSink holds every write until release is closed
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s *blockingSink) WriteAudit(ctx context.Context, record []byte) error {
+	<-s.release
+	return nil
+}
+
+func TestAuditDropsRecordsWhenBufferIsFull(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	codec := newAuditedCodec(t, sink, 2)
+
+	payloads := make([]shared.PayloadData, 10)
+	for i := range payloads {
+		payloads[i] = plainPayload(`{"v":1}`)
+	}
+	encrypted := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: payloads})).Payloads
+
+	// The decode must not wait on the stuck sink
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: encrypted}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("decode blocked on the audit sink")
+	}
+
+	close(sink.release)
+	codec.Close()
+	written, dropped := codec.audit.written.Load(), codec.audit.dropped.Load()
+	if dropped == 0 || written+dropped != 10 {
+		t.Fatalf("expected records to be dropped, got %d written and %d dropped", written, dropped)
+	}
+}
+
+func TestSQSAuditSinkSendsSignedMessages(t *testing.T) {
+	var got struct {
+		target, authorization string
+		body                  map[string]string
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.target, got.authorization = r.Header.Get("X-Amz-Target"), r.Header.Get("Authorization")
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &got.body)
+		w.Write([]byte(`{"MessageId":"1"}`))
+	}))
+	defer server.Close()
+
+	queueURL := server.URL + "/123456789012/codec-audit"
+	sink, err := newSQSAuditSink(queueURL, "us-west-2", credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""), server.Client())
+	if err != nil {
+		t.Fatalf("newSQSAuditSink: %v", err)
+	}
+	if err := sink.WriteAudit(context.Background(), []byte(`{"event":"decode"}`)); err != nil {
+		t.Fatalf("WriteAudit: %v", err)
+	}
+	if got.target != "AmazonSQS.SendMessage" || !strings.HasPrefix(got.authorization, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		!strings.Contains(got.authorization, "/us-west-2/sqs/") {
+		t.Fatalf("unexpected request headers: %q %q", got.target, got.authorization)
+	}
+	if got.body["QueueUrl"] != queueURL || got.body["MessageBody"] != `{"event":"decode"}` {
+		t.Fatalf("unexpected request body %v", got.body)
+	}
+
+	// Region comes from the queue URL when not configured
+	if s, err := newSQSAuditSink("https://sqs.eu-west-1.amazonaws.com/123456789012/q", "", nil, nil); err != nil || s.region != "eu-west-1" {
+		t.Fatalf("expected the region from the queue URL, got %+v, %v", s, err)
+	}
+}
@@ -0,0 +1,93 @@
+package kmscodec
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// assumeRoleSessionName identifies the codec server in CloudTrail when it assumes a role
+const assumeRoleSessionName = "temporal-codec-server"
+
+// KMSClientConfig holds the optional overrides applied on top of the default AWS configuration.
+// Empty fields keep default-chain behavior.
+type KMSClientConfig struct {
+	Region        string // overrides the region from the default chain
+	Endpoint      string // replaces the resolved KMS endpoint (VPC endpoints, GovCloud, FIPS URLs)
+	AssumeRoleARN string // role assumed through STS for KMS calls, e.g. a CMK owned by another account
+	ExternalID    string // external ID required by the assumed role's trust policy
+}
+
+// KMSClientConfigFromEnv reads the KMS client overrides from the environment
+func KMSClientConfigFromEnv() KMSClientConfig {
+	return KMSClientConfig{
+		Region:        os.Getenv("AWS_REGION"),
+		Endpoint:      os.Getenv("KMS_ENDPOINT_URL"),
+		AssumeRoleARN: os.Getenv("KMS_ASSUME_ROLE_ARN"),
+		ExternalID:    os.Getenv("KMS_ASSUME_ROLE_EXTERNAL_ID"),
+	}
+}
+
+// NewKMSClient creates a KMS client from the default AWS configuration with the given overrides.
+// With an assume-role ARN the default chain credentials (IRSA, instance role, env) are only
+// used to call STS, and KMS is called with the assumed role's refreshed credentials.
+func NewKMSClient(ctx context.Context, clientConfig KMSClientConfig) (*kms.Client, error) {
+	var loadOpts []func(*config.LoadOptions) error
+	if clientConfig.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(clientConfig.Region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	if clientConfig.AssumeRoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), clientConfig.AssumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = assumeRoleSessionName
+			if clientConfig.ExternalID != "" {
+				o.ExternalID = aws.String(clientConfig.ExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if clientConfig.Endpoint != "" {
+			o.BaseEndpoint = aws.String(clientConfig.Endpoint)
+		}
+	}), nil
+}
+
+// NewSNSClient creates an SNS client from the default AWS configuration, in region if set
+func NewSNSClient(ctx context.Context, region string) (*sns.Client, error) {
+	var loadOpts []func(*config.LoadOptions) error
+	if region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return sns.NewFromConfig(cfg), nil
+}
+
+// ResolveKMSAlias resolves a KMS key alias to the ARN of the key it currently points to
+func ResolveKMSAlias(kmsClient *kms.Client, alias string) (string, error) {
+	// Resolve the alias
+	result, err := kmsClient.DescribeKey(context.TODO(), &kms.DescribeKeyInput{
+		KeyId: aws.String(alias),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve alias %s: %w", alias, err)
+	}
+
+	return *result.KeyMetadata.Arn, nil
+}
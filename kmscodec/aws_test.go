@@ -0,0 +1,65 @@
+package kmscodec
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+)
+
+// setStaticAWSEnv keeps config loading offline and deterministic
+func setStaticAWSEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIATEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+}
+
+func TestNewKMSClientUsesDefaultChainWithoutRole(t *testing.T) {
+	setStaticAWSEnv(t)
+
+	client, err := NewKMSClient(context.Background(), KMSClientConfig{})
+	if err != nil {
+		t.Fatalf("NewKMSClient: %v", err)
+	}
+	creds, ok := client.Options().Credentials.(*aws.CredentialsCache)
+	if ok && creds.IsCredentialsProvider(&stscreds.AssumeRoleProvider{}) {
+		t.Fatal("expected default chain credentials when no role is configured")
+	}
+}
+
+func TestNewKMSClientAssumesConfiguredRole(t *testing.T) {
+	setStaticAWSEnv(t)
+
+	client, err := NewKMSClient(context.Background(), KMSClientConfig{
+		AssumeRoleARN: "arn:aws:iam::210987654321:role/codec-kms",
+		ExternalID:    "codec-external-id",
+	})
+	if err != nil {
+		t.Fatalf("NewKMSClient: %v", err)
+	}
+	creds, ok := client.Options().Credentials.(*aws.CredentialsCache)
+	if !ok || !creds.IsCredentialsProvider(&stscreds.AssumeRoleProvider{}) {
+		t.Fatalf("expected assume-role credentials, got %T", client.Options().Credentials)
+	}
+}
+
+func TestKMSClientConfigFromEnv(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("KMS_ENDPOINT_URL", "https://kms.example.com")
+	t.Setenv("KMS_ASSUME_ROLE_ARN", "arn:aws:iam::210987654321:role/codec-kms")
+	t.Setenv("KMS_ASSUME_ROLE_EXTERNAL_ID", "codec-external-id")
+
+	want := KMSClientConfig{
+		Region:        "eu-west-1",
+		Endpoint:      "https://kms.example.com",
+		AssumeRoleARN: "arn:aws:iam::210987654321:role/codec-kms",
+		ExternalID:    "codec-external-id",
+	}
+	if got := KMSClientConfigFromEnv(); got != want {
+		t.Fatalf("unexpected config: %+v", got)
+	}
+}
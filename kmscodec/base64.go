@@ -0,0 +1,27 @@
+package kmscodec
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// decodeBase64 decodes std or URL-safe base64, padded or not.
+// Clients and intermediaries do not agree on an alphabet, so decode accepts both;
+// everything the codec emits stays std base64.
+func decodeBase64(encoded string) ([]byte, error) {
+	unpadded := strings.TrimRight(encoded, "=")
+	if strings.ContainsAny(unpadded, "-_") {
+		return base64.RawURLEncoding.DecodeString(unpadded)
+	}
+	return base64.RawStdEncoding.DecodeString(unpadded)
+}
+
+// normalizeBase64 re-encodes any accepted base64 variant as padded std base64.
+// Values that do not decode are returned unchanged for the caller to reject.
+func normalizeBase64(encoded string) string {
+	decoded, err := decodeBase64(encoded)
+	if err != nil {
+		return encoded
+	}
+	return base64.StdEncoding.EncodeToString(decoded)
+}
@@ -0,0 +1,87 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestDecodeBase64AcceptsBothAlphabets(t *testing.T) {
+	// 0xfb 0xff forces '+' and '/' in std and '-' and '_' in URL-safe
+	raw := []byte{0xfb, 0xff, 0xbf, 0x01}
+	for name, encoded := range map[string]string{
+		"std":          base64.StdEncoding.EncodeToString(raw),
+		"std unpadded": base64.RawStdEncoding.EncodeToString(raw),
+		"url":          base64.URLEncoding.EncodeToString(raw),
+		"url unpadded": base64.RawURLEncoding.EncodeToString(raw),
+	} {
+		decoded, err := decodeBase64(encoded)
+		if err != nil || string(decoded) != string(raw) {
+			t.Errorf("%s (%q): got %x, %v", name, encoded, decoded, err)
+		}
+	}
+
+	if _, err := decodeBase64("+-mixed"); err == nil {
+		t.Error("expected mixed alphabets to be rejected")
+	}
+}
+
+// toURLSafe converts a std base64 payload's encoded fields to URL-safe base64
+func toURLSafe(payload shared.PayloadData) shared.PayloadData {
+	convert := func(s string) string {
+		return strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(s, "="))
+	}
+	payload.Data = convert(payload.Data)
+	payload.EncryptedDataKey = convert(payload.EncryptedDataKey)
+	payload.WrappedKey = convert(payload.WrappedKey)
+	return payload
+}
+
+func TestDecodeAcceptsURLSafeBase64(t *testing.T) {
+	for _, mode := range []string{"randomized", EncryptionModeDeterministic} {
+		codec, _ := newTestCodec(t)
+		original := `{"id":1,"name":"John"}`
+
+		input := plainPayload(original)
+		input.Metadata[EncryptionModeMetadataKey] = mode
+		encoded, err := codec.encodePayload(context.Background(), input)
+		if err != nil {
+			t.Fatalf("%s: encodePayload: %v", mode, err)
+		}
+
+		for name, payload := range map[string]shared.PayloadData{"std": encoded, "url": toURLSafe(encoded)} {
+			decoded, err := codec.decodePayload(context.Background(), payload)
+			if err != nil {
+				t.Fatalf("%s/%s: decodePayload: %v", mode, name, err)
+			}
+			data, err := base64.StdEncoding.DecodeString(decoded.Data)
+			if err != nil {
+				t.Fatalf("%s/%s: expected std base64 output: %v", mode, name, err)
+			}
+			if string(data) != original {
+				t.Fatalf("%s/%s: round trip mismatch: got %q", mode, name, data)
+			}
+		}
+	}
+}
+
+func TestURLSafeKeyCannotBypassRevocation(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	encoded, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	if err := codec.kmsManager.RevokeDataKey(context.Background(), KeyFingerprint(encoded.EncryptedDataKey)); err != nil {
+		t.Fatalf("RevokeDataKey: %v", err)
+	}
+
+	_, err = codec.kmsManager.DecryptDataKey(context.Background(), toURLSafe(encoded).EncryptedDataKey, testKeyARN, nil)
+	if !errors.Is(err, ErrKeyRevoked) {
+		t.Fatalf("expected the URL-safe form of a revoked key to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package kmscodec
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// ErrKMSUnavailable is returned without calling KMS while the circuit breaker is open
+var ErrKMSUnavailable = errors.New("KMS unavailable: circuit breaker open")
+
+// Circuit breaker defaults
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitBreaker fast-fails KMS calls after a run of consecutive failures.
+// After the cooldown a single probe call is let through; its outcome closes or reopens the circuit.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int // consecutive failures that open the circuit; zero or less disables the breaker
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether a call may proceed
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return true
+	}
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		// Only one probe at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of an allowed call
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.probing = false
+	if !countsAsKMSFailure(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns the current breaker state
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// countsAsKMSFailure reports whether an error indicates KMS itself is failing.
+// Errors caused by a specific bad ciphertext must not trip the breaker, or one
+// corrupt payload could block decryption for everyone. A disabled or pending-deletion
+// key is not a KMS outage either, and tripping would hide the key-state error.
+func countsAsKMSFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var invalidCiphertext *types.InvalidCiphertextException
+	var incorrectKey *types.IncorrectKeyException
+	var disabled *types.DisabledException
+	var invalidState *types.KMSInvalidStateException
+	return !errors.As(err, &invalidCiphertext) && !errors.As(err, &incorrectKey) &&
+		!errors.As(err, &disabled) && !errors.As(err, &invalidState)
+}
@@ -0,0 +1,115 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithCircuitBreaker(3, time.Hour))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	fake.decryptErr = errors.New("ServiceUnavailable")
+	for i := 0; i < 3; i++ {
+		if _, err := manager.DecryptDataKey(context.Background(), "dW5rbm93bg==", testKeyARN, nil); errors.Is(err, ErrKMSUnavailable) {
+			t.Fatalf("call %d: breaker opened before threshold", i+1)
+		}
+	}
+
+	_, err = manager.DecryptDataKey(context.Background(), "dW5rbm93bg==", testKeyARN, nil)
+	if !errors.Is(err, ErrKMSUnavailable) {
+		t.Fatalf("expected ErrKMSUnavailable once open, got %v", err)
+	}
+	if _, decrypt := fake.calls(); decrypt != 3 {
+		t.Fatalf("expected open breaker to skip KMS, got %d decrypt calls", decrypt)
+	}
+	if manager.KMSAvailable() {
+		t.Fatalf("expected KMSAvailable to be false while open")
+	}
+
+	// Rotation goes through the same breaker
+	if err := manager.rotateDataKey(context.Background()); !errors.Is(err, ErrKMSUnavailable) {
+		t.Fatalf("expected rotation to fast-fail, got %v", err)
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithCircuitBreaker(1, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	fake.generateErr = errors.New("ThrottlingException")
+	if err := manager.rotateDataKey(context.Background()); err == nil || errors.Is(err, ErrKMSUnavailable) {
+		t.Fatalf("expected the KMS error itself, got %v", err)
+	}
+	if state := manager.breaker.State(); state != breakerOpen {
+		t.Fatalf("expected breaker to be open, got %s", state)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// A failed probe reopens the circuit
+	if err := manager.rotateDataKey(context.Background()); err == nil || errors.Is(err, ErrKMSUnavailable) {
+		t.Fatalf("expected probe to reach KMS, got %v", err)
+	}
+	if state := manager.breaker.State(); state != breakerOpen {
+		t.Fatalf("expected failed probe to reopen the breaker, got %s", state)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// A successful probe closes it
+	fake.generateErr = nil
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("expected probe to succeed, got %v", err)
+	}
+	if state := manager.breaker.State(); state != breakerClosed {
+		t.Fatalf("expected breaker to be closed, got %s", state)
+	}
+}
+
+func TestCircuitBreakerIgnoresBadCiphertext(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithCircuitBreaker(1, time.Hour))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	fake.decryptErr = &types.InvalidCiphertextException{}
+	for i := 0; i < 3; i++ {
+		if _, err := manager.DecryptDataKey(context.Background(), "dW5rbm93bg==", testKeyARN, nil); errors.Is(err, ErrKMSUnavailable) {
+			t.Fatalf("invalid ciphertext should not open the breaker")
+		}
+	}
+}
+
+func TestHealthReportsOpenBreaker(t *testing.T) {
+	codec, fake := newTestCodec(t)
+	codec.kmsManager.breaker = newCircuitBreaker(1, time.Hour)
+
+	rec := httptest.NewRecorder()
+	codec.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 while closed, got %d", rec.Code)
+	}
+
+	fake.decryptErr = errors.New("ServiceUnavailable")
+	codec.kmsManager.DecryptDataKey(context.Background(), "dW5rbm93bg==", testKeyARN, nil)
+
+	rec = httptest.NewRecorder()
+	codec.handleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while open, got %d", rec.Code)
+	}
+}
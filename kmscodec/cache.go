@@ -0,0 +1,219 @@
+package kmscodec
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// DecryptionCache holds decrypted data keys of older payloads, keyed by encrypted data key.
+// Implementations must be safe for concurrent use. Get returns a copy owned by the caller;
+// Set takes ownership of key and may zero it.
+type DecryptionCache interface {
+	Get(ctx context.Context, encryptedKey string) ([]byte, bool)
+	Set(ctx context.Context, encryptedKey string, key []byte, ttl time.Duration)
+	// Evict removes every entry whose encrypted key has the given fingerprint
+	Evict(ctx context.Context, fingerprint string)
+	// Cleanup removes expired entries and returns how many were removed
+	Cleanup(ctx context.Context) int
+	// Flush removes every entry and returns how many were removed
+	Flush(ctx context.Context) int
+	Len(ctx context.Context) int
+	// Entries describes the cached keys without exposing key material
+	Entries(ctx context.Context) []CacheEntryInfo
+	// Backend names the implementation for stats
+	Backend() string
+}
+
+// clockedCache is implemented by caches that take the manager's clock, so their expiry agrees
+// with the rest of the manager, fake clocks included
+type clockedCache interface {
+	setClock(clock Clock)
+}
+
+// CacheEntryInfo is the non-sensitive metadata of one cached data key
+type CacheEntryInfo struct {
+	Fingerprint string
+	CachedAt    time.Time
+	ExpiresAt   time.Time
+}
+
+// Go maps never give back the memory of deleted entries, so after a replay fills the cache
+// its map stays at peak size however few keys remain. Cleanup rebuilds the map once it holds
+// at most 1/cacheCompactionRatio of its peak, if the peak was at least cacheCompactionMinPeak.
+const (
+	cacheCompactionRatio   = 4
+	cacheCompactionMinPeak = 1024
+)
+
+// memoryCache is the default per-instance DecryptionCache
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*CachedKey
+	peak    int // most entries the current map has held
+	clock   Clock
+	kek     cipher.AEAD // seals cached keys when set; nil stores them in the clear
+}
+
+func newMemoryCache(clock Clock) *memoryCache {
+	return &memoryCache{entries: make(map[string]*CachedKey), clock: clock}
+}
+
+// newSealedMemoryCache creates a memoryCache whose entries are sealed with AES-256-GCM
+// under a KEK generated here and never stored anywhere else, so cached keys are only
+// in plaintext between Get and the caller zeroing them
+func newSealedMemoryCache(clock Clock) (*memoryCache, error) {
+	kek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, kek); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	zeroKey(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	cache := newMemoryCache(clock)
+	cache.kek = aead
+	return cache, nil
+}
+
+func (c *memoryCache) Get(ctx context.Context, encryptedKey string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, exists := c.entries[encryptedKey]
+	if !exists {
+		return nil, false
+	}
+	if c.kek == nil {
+		return cloneKey(cached.Key), true
+	}
+
+	nonceSize := c.kek.NonceSize()
+	key, err := c.kek.Open(nil, cached.Key[:nonceSize], cached.Key[nonceSize:], []byte(encryptedKey))
+	if err != nil {
+		// Only memory corruption gets here; KMS can still supply the key
+		log.Printf("Failed to unseal cached data key %s: %v", KeyFingerprint(encryptedKey), err)
+		return nil, false
+	}
+	return key, true
+}
+
+func (c *memoryCache) Set(ctx context.Context, encryptedKey string, key []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if previous, exists := c.entries[encryptedKey]; exists {
+		zeroKey(previous.Key)
+	}
+	if c.kek != nil {
+		nonce := make([]byte, c.kek.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			log.Printf("Failed to seal data key for the cache, not caching it: %v", err)
+			zeroKey(key)
+			delete(c.entries, encryptedKey)
+			return
+		}
+		sealed := c.kek.Seal(nonce, nonce, key, []byte(encryptedKey))
+		zeroKey(key)
+		key = sealed
+	}
+	now := c.clock.Now()
+	c.entries[encryptedKey] = &CachedKey{
+		Key:       key,
+		CachedAt:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+	c.peak = max(c.peak, len(c.entries))
+}
+
+func (c *memoryCache) Evict(ctx context.Context, fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for encryptedKey, cached := range c.entries {
+		if KeyFingerprint(encryptedKey) == fingerprint {
+			zeroKey(cached.Key)
+			delete(c.entries, encryptedKey)
+		}
+	}
+}
+
+func (c *memoryCache) Cleanup(ctx context.Context) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	cleanedCount := 0
+	for encryptedKey, cached := range c.entries {
+		if now.After(cached.ExpiresAt) {
+			// Zero out the key before deleting
+			zeroKey(cached.Key)
+			delete(c.entries, encryptedKey)
+			cleanedCount++
+		}
+	}
+	c.compactLocked()
+	return cleanedCount
+}
+
+// compactLocked copies the entries into a right-sized map when the current one has shrunk
+// well below its peak, releasing the old map's memory
+func (c *memoryCache) compactLocked() {
+	if c.peak < cacheCompactionMinPeak || len(c.entries)*cacheCompactionRatio > c.peak {
+		return
+	}
+	compacted := make(map[string]*CachedKey, len(c.entries))
+	for encryptedKey, cached := range c.entries {
+		compacted[encryptedKey] = cached
+	}
+	log.Printf("Compacted decryption cache map: %d entries, down from a peak of %d", len(compacted), c.peak)
+	c.entries = compacted
+	c.peak = len(compacted)
+}
+
+func (c *memoryCache) Flush(ctx context.Context) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := len(c.entries)
+	for _, cached := range c.entries {
+		zeroKey(cached.Key)
+	}
+	clear(c.entries)
+	return count
+}
+
+func (c *memoryCache) Len(ctx context.Context) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *memoryCache) Entries(ctx context.Context) []CacheEntryInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]CacheEntryInfo, 0, len(c.entries))
+	for encryptedKey, cached := range c.entries {
+		entries = append(entries, CacheEntryInfo{
+			Fingerprint: KeyFingerprint(encryptedKey),
+			CachedAt:    cached.CachedAt,
+			ExpiresAt:   cached.ExpiresAt,
+		})
+	}
+	return entries
+}
+
+func (c *memoryCache) Backend() string {
+	return "memory"
+}
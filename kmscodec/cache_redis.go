@@ -0,0 +1,233 @@
+package kmscodec
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisCachePrefix namespaces data key entries in a shared Redis
+const DefaultRedisCachePrefix = "temporal-codec:dek:"
+
+// redisEntryHeaderSize is the length of the cached-at and expires-at timestamps prefixing each
+// Redis value
+const redisEntryHeaderSize = 16
+
+// redisIndexName is appended to the prefix to name the sorted set indexing the entries
+const redisIndexName = "index"
+
+// redisEntryAAD binds a sealed entry to its encrypted data key and header
+func redisEntryAAD(encryptedKey string, header []byte) []byte {
+	return append([]byte(normalizeBase64(encryptedKey)), header...)
+}
+
+// redisCache is a DecryptionCache shared by all codec replicas.
+// Keys are sealed with AES-256-GCM under a local KEK before they leave the process,
+// so Redis (and anyone who can read it) only ever sees ciphertext. The encrypted data
+// key is bound as additional data, so an entry can't be replayed under another key.
+// Each value is the 8-byte cached-at and expires-at timestamps, the GCM nonce, then the sealed
+// key. Expiry is checked against the clock like the in-memory cache does; the Redis TTL only
+// reclaims the space. A sorted set of fingerprints scored by expiry lets Len and Entries read the
+// live entries without scanning the keyspace.
+// Redis errors are logged and treated as cache misses; KMS remains the source of truth.
+type redisCache struct {
+	client redis.UniversalClient
+	kek    cipher.AEAD
+	prefix string
+	clock  Clock
+}
+
+// NewRedisCache creates a Redis-backed DecryptionCache sealing entries under a 32-byte KEK
+func NewRedisCache(client redis.UniversalClient, kek []byte, prefix string) (DecryptionCache, error) {
+	if len(kek) != 32 {
+		return nil, fmt.Errorf("cache KEK must be 32 bytes, got %d", len(kek))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = DefaultRedisCachePrefix
+	}
+	return &redisCache{client: client, kek: aead, prefix: prefix, clock: realClock{}}, nil
+}
+
+func (c *redisCache) setClock(clock Clock) {
+	c.clock = clock
+}
+
+// entryName is the Redis key for an encrypted data key; it uses the fingerprint so Evict needs no scan
+func (c *redisCache) entryName(fingerprint string) string {
+	return c.prefix + fingerprint
+}
+
+// indexName is the Redis key of the sorted set of live entries; fingerprints are hex, so it
+// never collides with an entry
+func (c *redisCache) indexName() string {
+	return c.prefix + redisIndexName
+}
+
+// indexScore is the sorted set score of an entry expiring at expiresAt
+func indexScore(expiresAt time.Time) string {
+	return strconv.FormatInt(expiresAt.UnixNano(), 10)
+}
+
+func (c *redisCache) Get(ctx context.Context, encryptedKey string) ([]byte, bool) {
+	sealed, err := c.client.Get(ctx, c.entryName(KeyFingerprint(encryptedKey))).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Redis cache get failed: %v", err)
+		return nil, false
+	}
+
+	nonceSize := c.kek.NonceSize()
+	if len(sealed) < redisEntryHeaderSize+nonceSize {
+		return nil, false
+	}
+	header, nonce, ciphertext := sealed[:redisEntryHeaderSize], sealed[redisEntryHeaderSize:redisEntryHeaderSize+nonceSize], sealed[redisEntryHeaderSize+nonceSize:]
+	key, err := c.kek.Open(nil, nonce, ciphertext, redisEntryAAD(encryptedKey, header))
+	if err != nil {
+		// Wrong KEK, a tampered entry, or a fingerprint collision; fall back to KMS
+		return nil, false
+	}
+	if _, expiresAt := entryTimes(header); c.clock.Now().After(expiresAt) {
+		zeroKey(key)
+		return nil, false
+	}
+	return key, true
+}
+
+// entryTimes reads the cached-at and expires-at timestamps of an entry header
+func entryTimes(header []byte) (cachedAt, expiresAt time.Time) {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(header[:8]))), time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16])))
+}
+
+func (c *redisCache) Set(ctx context.Context, encryptedKey string, key []byte, ttl time.Duration) {
+	defer zeroKey(key)
+
+	now := c.clock.Now()
+	expiresAt := now.Add(ttl)
+	header := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	header = binary.BigEndian.AppendUint64(header, uint64(expiresAt.UnixNano()))
+	nonce := make([]byte, c.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		log.Printf("Redis cache set failed: %v", err)
+		return
+	}
+	sealed := c.kek.Seal(append(header, nonce...), nonce, key, redisEntryAAD(encryptedKey, header))
+
+	fingerprint := KeyFingerprint(encryptedKey)
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, c.entryName(fingerprint), sealed, ttl)
+		pipe.ZAdd(ctx, c.indexName(), redis.Z{Score: float64(expiresAt.UnixNano()), Member: fingerprint})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Redis cache set failed: %v", err)
+	}
+}
+
+func (c *redisCache) Evict(ctx context.Context, fingerprint string) {
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, c.entryName(fingerprint))
+		pipe.ZRem(ctx, c.indexName(), fingerprint)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Redis cache evict failed: %v", err)
+	}
+}
+
+// Cleanup drops expired entries from the index; Redis expires the entries themselves by TTL
+func (c *redisCache) Cleanup(ctx context.Context) int {
+	removed, err := c.client.ZRemRangeByScore(ctx, c.indexName(), "-inf", "("+indexScore(c.clock.Now())).Result()
+	if err != nil {
+		log.Printf("Redis cache cleanup failed: %v", err)
+		return 0
+	}
+	return int(removed)
+}
+
+// Flush deletes every entry under the prefix, for all replicas sharing the cache
+func (c *redisCache) Flush(ctx context.Context) int {
+	count := 0
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if iter.Val() == c.indexName() {
+			continue
+		}
+		deleted, err := c.client.Del(ctx, iter.Val()).Result()
+		if err != nil {
+			log.Printf("Redis cache flush failed: %v", err)
+			continue
+		}
+		count += int(deleted)
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Redis cache scan failed: %v", err)
+	}
+	if err := c.client.Del(ctx, c.indexName()).Err(); err != nil {
+		log.Printf("Redis cache flush failed: %v", err)
+	}
+	return count
+}
+
+// Len counts the live entries in the index
+func (c *redisCache) Len(ctx context.Context) int {
+	count, err := c.client.ZCount(ctx, c.indexName(), indexScore(c.clock.Now()), "+inf").Result()
+	if err != nil {
+		log.Printf("Redis cache count failed: %v", err)
+		return 0
+	}
+	return int(count)
+}
+
+// Entries describes the live entries in the index, reading only their headers
+func (c *redisCache) Entries(ctx context.Context) []CacheEntryInfo {
+	fingerprints, err := c.client.ZRangeByScore(ctx, c.indexName(), &redis.ZRangeBy{Min: indexScore(c.clock.Now()), Max: "+inf"}).Result()
+	if err != nil {
+		log.Printf("Redis cache index read failed: %v", err)
+		return nil
+	}
+	headers := make([]*redis.StringCmd, len(fingerprints))
+	_, err = c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, fingerprint := range fingerprints {
+			headers[i] = pipe.GetRange(ctx, c.entryName(fingerprint), 0, redisEntryHeaderSize-1)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Redis cache entry read failed: %v", err)
+		return nil
+	}
+
+	entries := make([]CacheEntryInfo, 0, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		header, err := headers[i].Bytes()
+		if err != nil || len(header) != redisEntryHeaderSize {
+			continue // evicted or reclaimed by Redis since the index was read
+		}
+		cachedAt, expiresAt := entryTimes(header)
+		entries = append(entries, CacheEntryInfo{Fingerprint: fingerprint, CachedAt: cachedAt, ExpiresAt: expiresAt})
+	}
+	return entries
+}
+
+func (c *redisCache) Backend() string {
+	return "redis"
+}
@@ -0,0 +1,201 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisCache(t *testing.T, server *miniredis.Miniredis, kek []byte) DecryptionCache {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	cache, err := NewRedisCache(client, kek, "")
+	if err != nil {
+		t.Fatalf("NewRedisCache: %v", err)
+	}
+	return cache
+}
+
+func TestRedisCacheStoresKeysSealed(t *testing.T) {
+	server := miniredis.RunT(t)
+	cache := newTestRedisCache(t, server, bytes.Repeat([]byte{7}, 32))
+	ctx := context.Background()
+
+	plaintext := bytes.Repeat([]byte{0xAB}, 32)
+	cache.Set(ctx, "ZW5jcnlwdGVk", cloneKey(plaintext), time.Hour)
+
+	name := DefaultRedisCachePrefix + KeyFingerprint("ZW5jcnlwdGVk")
+	stored, err := server.Get(name)
+	if err != nil {
+		t.Fatalf("expected an entry under %s: %v", name, err)
+	}
+	if bytes.Contains([]byte(stored), plaintext) {
+		t.Fatal("plaintext data key must not be stored in Redis")
+	}
+	if ttl := server.TTL(name); ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("expected a TTL of at most 1h, got %v", ttl)
+	}
+
+	key, ok := cache.Get(ctx, "ZW5jcnlwdGVk")
+	if !ok || !bytes.Equal(key, plaintext) {
+		t.Fatalf("expected the cached key back, got %x, %t", key, ok)
+	}
+	if cache.Len(ctx) != 1 {
+		t.Fatalf("expected 1 entry, got %d", cache.Len(ctx))
+	}
+
+	entries := cache.Entries(ctx)
+	if len(entries) != 1 || entries[0].Fingerprint != KeyFingerprint("ZW5jcnlwdGVk") {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if time.Since(entries[0].CachedAt) > time.Minute || time.Until(entries[0].ExpiresAt) > time.Hour {
+		t.Fatalf("unexpected entry times: %+v", entries[0])
+	}
+
+	cache.Evict(ctx, KeyFingerprint("ZW5jcnlwdGVk"))
+	if _, ok := cache.Get(ctx, "ZW5jcnlwdGVk"); ok {
+		t.Fatal("expected the entry to be evicted")
+	}
+
+	cache.Set(ctx, "a2V5LWE=", cloneKey(plaintext), time.Hour)
+	cache.Set(ctx, "a2V5LWI=", cloneKey(plaintext), time.Hour)
+	server.Set("unrelated", "kept")
+	if flushed := cache.Flush(ctx); flushed != 2 || cache.Len(ctx) != 0 {
+		t.Fatalf("expected 2 entries flushed and none left, got %d and %d", flushed, cache.Len(ctx))
+	}
+	if !server.Exists("unrelated") {
+		t.Fatal("flush must only remove cache entries")
+	}
+}
+
+func TestRedisCacheExpiresByManagerClock(t *testing.T) {
+	server := miniredis.RunT(t)
+	clock := newFakeClock()
+	cache := newTestRedisCache(t, server, bytes.Repeat([]byte{7}, 32))
+	if _, err := NewKMSManagerWithClient(newFakeKMS(), testKeyARN, time.Hour, time.Hour, WithClock(clock), WithDecryptionCache(cache)); err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	ctx := context.Background()
+
+	cache.Set(ctx, "a2V5LWE=", bytes.Repeat([]byte{0xAB}, 32), time.Minute)
+	cache.Set(ctx, "a2V5LWI=", bytes.Repeat([]byte{0xCD}, 32), time.Hour)
+	entries := cache.Entries(ctx)
+	if len(entries) != 2 || !entries[0].CachedAt.Equal(clock.Now()) {
+		t.Fatalf("expected 2 entries cached at the fake clock's time, got %+v", entries)
+	}
+
+	// Redis has not expired the entry, but the manager's clock has moved past it
+	clock.Advance(time.Minute + time.Second)
+	if _, ok := cache.Get(ctx, "a2V5LWE="); ok {
+		t.Fatal("expected the entry to have expired by the manager's clock")
+	}
+	if _, ok := cache.Get(ctx, "a2V5LWB="); ok {
+		t.Fatal("expected a miss for a key that was never cached")
+	}
+	if _, ok := cache.Get(ctx, "a2V5LWI="); !ok {
+		t.Fatal("expected the longer-lived entry to still be cached")
+	}
+	if count := cache.Len(ctx); count != 1 {
+		t.Fatalf("expected 1 live entry, got %d", count)
+	}
+	if entries := cache.Entries(ctx); len(entries) != 1 || entries[0].Fingerprint != KeyFingerprint("a2V5LWI=") {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if removed := cache.Cleanup(ctx); removed != 1 {
+		t.Fatalf("expected cleanup to drop 1 expired index entry, got %d", removed)
+	}
+}
+
+func TestRedisCacheRejectsWrongKEKAndReplayedEntries(t *testing.T) {
+	server := miniredis.RunT(t)
+	ctx := context.Background()
+
+	writer := newTestRedisCache(t, server, bytes.Repeat([]byte{1}, 32))
+	writer.Set(ctx, "a2V5LWE=", bytes.Repeat([]byte{0xAB}, 32), time.Hour)
+
+	reader := newTestRedisCache(t, server, bytes.Repeat([]byte{2}, 32))
+	if _, ok := reader.Get(ctx, "a2V5LWE="); ok {
+		t.Fatal("expected a miss when the KEK differs")
+	}
+
+	// An entry copied under another key's name must not decrypt
+	server.Set(DefaultRedisCachePrefix+KeyFingerprint("a2V5LWI="), mustGet(t, server, DefaultRedisCachePrefix+KeyFingerprint("a2V5LWE=")))
+	if _, ok := writer.Get(ctx, "a2V5LWI="); ok {
+		t.Fatal("expected a replayed entry to be rejected")
+	}
+}
+
+func TestRedisCacheSharedAcrossManagers(t *testing.T) {
+	server := miniredis.RunT(t)
+	kek := bytes.Repeat([]byte{9}, 32)
+	fake := newFakeKMS()
+
+	first, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithDecryptionCache(newTestRedisCache(t, server, kek)))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	old, _ := first.GetCurrentDataKey(context.Background())
+	oldEncrypted, oldPlaintext := old.EncryptedKey, cloneKey(old.PlaintextKey)
+
+	// Rotation publishes the outgoing key to the shared cache
+	if err := first.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	second, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithDecryptionCache(newTestRedisCache(t, server, kek)))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	key, source, err := second.DecryptDataKeyWithSource(context.Background(), oldEncrypted, testKeyARN, nil)
+	if err != nil {
+		t.Fatalf("DecryptDataKeyWithSource: %v", err)
+	}
+	if source != KeySourceCache || !bytes.Equal(key, oldPlaintext) {
+		t.Fatalf("expected the other replica's key from the shared cache, got source %q", source)
+	}
+	if _, decrypt := fake.calls(); decrypt != 0 {
+		t.Fatalf("expected no KMS decrypts, got %d", decrypt)
+	}
+}
+
+func TestRedisCacheFallsBackToKMSWhenRedisIsDown(t *testing.T) {
+	server := miniredis.RunT(t)
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour,
+		WithDecryptionCache(newTestRedisCache(t, server, bytes.Repeat([]byte{9}, 32))))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	old, _ := manager.GetCurrentDataKey(context.Background())
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	server.Close()
+	if _, err := manager.DecryptDataKey(context.Background(), old.EncryptedKey, testKeyARN, old.EncryptionContext); err != nil {
+		t.Fatalf("expected KMS fallback, got %v", err)
+	}
+	if _, decrypt := fake.calls(); decrypt != 1 {
+		t.Fatalf("expected 1 KMS decrypt, got %d", decrypt)
+	}
+}
+
+func TestNewRedisCacheRequires32ByteKEK(t *testing.T) {
+	if _, err := NewRedisCache(redis.NewClient(&redis.Options{}), make([]byte, 16), ""); err == nil {
+		t.Fatal("expected a 16-byte KEK to be rejected")
+	}
+}
+
+func mustGet(t *testing.T, server *miniredis.Miniredis, name string) string {
+	t.Helper()
+	value, err := server.Get(name)
+	if err != nil {
+		t.Fatalf("get %s: %v", name, err)
+	}
+	return value
+}
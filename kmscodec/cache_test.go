@@ -0,0 +1,89 @@
+package kmscodec
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// heapInUse returns the live heap after a full collection
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestCleanupCompactsShrunkenCache(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+	cache := newMemoryCache(clock)
+	baseline := heapInUse()
+
+	// A replay caches many short-lived keys and a few long-lived ones
+	const replayed = 100_000
+	for i := range replayed {
+		cache.Set(ctx, fmt.Sprintf("replayed-%d", i), make([]byte, 32), time.Minute)
+	}
+	for i := range 10 {
+		cache.Set(ctx, fmt.Sprintf("kept-%d", i), make([]byte, 32), time.Hour)
+	}
+	peak := heapInUse() - baseline
+
+	clock.Advance(2 * time.Minute)
+	if removed := cache.Cleanup(ctx); removed != replayed {
+		t.Fatalf("expected %d expired entries removed, got %d", replayed, removed)
+	}
+	if cache.Len(ctx) != 10 || cache.peak != 10 {
+		t.Fatalf("expected 10 entries in a compacted map, got %d (peak %d)", cache.Len(ctx), cache.peak)
+	}
+	if _, ok := cache.Get(ctx, "kept-3"); !ok {
+		t.Fatal("expected live entries to survive compaction")
+	}
+
+	// Without compaction the emptied map would still hold its peak-sized buckets
+	if retained := int64(heapInUse()) - int64(baseline); retained > int64(peak/10) {
+		t.Fatalf("expected the map's memory to be released: %d bytes retained of a %d byte peak", retained, peak)
+	}
+	runtime.KeepAlive(cache)
+}
+
+func TestCleanupLeavesSmallOrFullCachesAlone(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock()
+
+	// Below the minimum peak, shrinking to nothing isn't worth a rebuild
+	small := newMemoryCache(clock)
+	for i := range cacheCompactionMinPeak - 1 {
+		small.Set(ctx, fmt.Sprintf("k-%d", i), make([]byte, 32), time.Minute)
+	}
+	clock.Advance(2 * time.Minute)
+	small.Cleanup(ctx)
+	if small.peak != cacheCompactionMinPeak-1 {
+		t.Fatalf("expected no compaction below the minimum peak, peak is %d", small.peak)
+	}
+
+	// A map that kept more than 1/cacheCompactionRatio of its peak isn't rebuilt
+	mostly := newMemoryCache(clock)
+	for i := range 2 * cacheCompactionMinPeak {
+		ttl := time.Hour
+		if i%2 == 0 {
+			ttl = time.Minute
+		}
+		mostly.Set(ctx, fmt.Sprintf("k-%d", i), make([]byte, 32), ttl)
+	}
+	clock.Advance(2 * time.Minute)
+	mostly.Cleanup(ctx)
+	if mostly.Len(ctx) != cacheCompactionMinPeak || mostly.peak != 2*cacheCompactionMinPeak {
+		t.Fatalf("expected no compaction at half the peak, got %d entries and peak %d", mostly.Len(ctx), mostly.peak)
+	}
+
+	// Flushing leaves the buckets behind, so the next cleanup compacts
+	mostly.Flush(ctx)
+	mostly.Cleanup(ctx)
+	if mostly.peak != 0 {
+		t.Fatalf("expected a flushed cache to be compacted on cleanup, peak is %d", mostly.peak)
+	}
+}
@@ -0,0 +1,16 @@
+package kmscodec
+
+import "time"
+
+// Clock tells the current time. KMSManager takes it as a dependency so tests can
+// drive rotation and cache expiry deterministically instead of sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the default Clock backed by the system time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
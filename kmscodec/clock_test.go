@@ -0,0 +1,239 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when a test advances it
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRotationHonoursInjectedClock(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	original, _ := manager.GetCurrentDataKey(context.Background())
+	if !original.ExpiresAt.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("expected expiry one rotation interval from the fake clock, got %v", original.ExpiresAt)
+	}
+
+	// Exactly at the expiry instant the key is still current
+	clock.Advance(time.Hour)
+	if key, _ := manager.GetCurrentDataKey(context.Background()); key.EncryptedKey != original.EncryptedKey {
+		t.Fatal("expected no rotation at the expiry instant")
+	}
+	if generate, _ := fake.calls(); generate != 1 {
+		t.Fatalf("expected 1 generate call, got %d", generate)
+	}
+
+	clock.Advance(time.Nanosecond)
+	if key, _ := manager.GetCurrentDataKey(context.Background()); key.EncryptedKey == original.EncryptedKey {
+		t.Fatal("expected rotation once the expiry has passed")
+	}
+	if generate, _ := fake.calls(); generate != 2 {
+		t.Fatalf("expected 2 generate calls, got %d", generate)
+	}
+}
+
+func TestClockSkewToleranceDelaysExpiry(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock), WithClockSkewTolerance(30*time.Second))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	original, _ := manager.GetCurrentDataKey(context.Background())
+
+	// A clock running 20s fast sees the key as past its expiry, but within the tolerance
+	clock.Advance(time.Hour + 20*time.Second)
+	if key, _ := manager.GetCurrentDataKey(context.Background()); key.EncryptedKey != original.EncryptedKey {
+		t.Fatal("expected no rotation within the skew tolerance")
+	}
+	if expired := manager.GetKeyStats()["current_key_expired"]; expired != false {
+		t.Fatalf("expected the key not to be reported expired within the tolerance, got %v", expired)
+	}
+
+	clock.Advance(10*time.Second + time.Nanosecond)
+	if key, _ := manager.GetCurrentDataKey(context.Background()); key.EncryptedKey == original.EncryptedKey {
+		t.Fatal("expected rotation once the tolerance has passed")
+	}
+	if generate, _ := fake.calls(); generate != 2 {
+		t.Fatalf("expected 2 generate calls, got %d", generate)
+	}
+}
+
+func TestCacheExpiryHonoursInjectedClock(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, 10*time.Minute, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	old, _ := manager.GetCurrentDataKey(context.Background())
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	clock.Advance(10 * time.Minute)
+	manager.CleanupCache()
+	if _, cached := memoryEntries(manager)[old.EncryptedKey]; !cached {
+		t.Fatal("expected the outgoing key to survive until its TTL has passed")
+	}
+
+	clock.Advance(time.Nanosecond)
+	manager.CleanupCache()
+	if _, cached := memoryEntries(manager)[old.EncryptedKey]; cached {
+		t.Fatal("expected the outgoing key to be cleaned up after its TTL")
+	}
+}
+
+func TestPreRotateOnlyWithinWindow(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	original, _ := manager.GetCurrentDataKey(context.Background())
+
+	clock.Advance(50 * time.Minute)
+	if err := manager.preRotate(context.Background(), 5*time.Minute); err != nil {
+		t.Fatalf("preRotate: %v", err)
+	}
+	if generate, _ := fake.calls(); generate != 1 {
+		t.Fatalf("expected no rotation outside the window, got %d generate calls", generate)
+	}
+
+	clock.Advance(6 * time.Minute)
+	if err := manager.preRotate(context.Background(), 5*time.Minute); err != nil {
+		t.Fatalf("preRotate: %v", err)
+	}
+	rotated, _ := manager.GetCurrentDataKey(context.Background())
+	if rotated.EncryptedKey == original.EncryptedKey {
+		t.Fatal("expected the key to be replaced inside the window")
+	}
+	if _, cached := memoryEntries(manager)[original.EncryptedKey]; !cached {
+		t.Fatal("expected the outgoing key to move into the decryption cache")
+	}
+}
+
+func TestPreRotationRoutineRotatesBeforeExpiry(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	defer manager.Close()
+	original, _ := manager.GetCurrentDataKey(context.Background())
+
+	// Inside the window but not yet expired
+	clock.Advance(58 * time.Minute)
+	manager.StartPreRotation(5*time.Minute, time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if generate, _ := fake.calls(); generate == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background routine did not pre-rotate the key")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The request path finds a fresh key without generating one itself
+	current, _ := manager.GetCurrentDataKey(context.Background())
+	if current.EncryptedKey == original.EncryptedKey || !clock.Now().Before(original.ExpiresAt) {
+		t.Fatal("expected the key to be replaced before the old one expired")
+	}
+	if generate, _ := fake.calls(); generate != 2 {
+		t.Fatalf("expected exactly one pre-rotation, got %d generate calls", generate)
+	}
+}
+
+func TestForceKMSRecheckReauthorizesKeysInMemory(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, 2*time.Hour, WithClock(clock), WithForceKMSRecheck(10*time.Minute))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	ctx := context.Background()
+
+	old, _ := manager.GetCurrentDataKey(ctx)
+	if err := manager.rotateDataKey(ctx); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	current, _ := manager.GetCurrentDataKey(ctx)
+
+	// Within the interval both keys are served from memory
+	if _, source, err := manager.DecryptDataKeyWithSource(ctx, old.EncryptedKey, testKeyARN, old.EncryptionContext); err != nil || source != KeySourceCache {
+		t.Fatalf("expected a cache hit, got source %q, err %v", source, err)
+	}
+
+	// Past the interval the next decrypt goes back to KMS, then caching resumes
+	clock.Advance(10 * time.Minute)
+	for _, key := range []*CurrentDataKey{old, current} {
+		if _, source, err := manager.DecryptDataKeyWithSource(ctx, key.EncryptedKey, testKeyARN, key.EncryptionContext); err != nil || source != KeySourceKMS {
+			t.Fatalf("expected a KMS recheck, got source %q, err %v", source, err)
+		}
+		if _, source, err := manager.DecryptDataKeyWithSource(ctx, key.EncryptedKey, testKeyARN, key.EncryptionContext); err != nil || source == KeySourceKMS {
+			t.Fatalf("expected the rechecked key to be served from memory, got source %q, err %v", source, err)
+		}
+	}
+	if _, decrypt := fake.calls(); decrypt != 2 {
+		t.Fatalf("expected 2 KMS decrypts, got %d", decrypt)
+	}
+
+	// Once KMS stops authorizing the key, the cached copy no longer decrypts
+	clock.Advance(10 * time.Minute)
+	fake.decryptErr = errors.New("AccessDeniedException")
+	if _, err := manager.DecryptDataKey(ctx, old.EncryptedKey, testKeyARN, old.EncryptionContext); err == nil {
+		t.Fatal("expected the recheck to surface the KMS denial")
+	}
+	if _, cached := memoryEntries(manager)[old.EncryptedKey]; !cached {
+		t.Fatal("expected the key to stay cached; only its authorization lapsed")
+	}
+}
+
+func TestCleanupDropsLapsedAuthorizations(t *testing.T) {
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(newFakeKMS(), testKeyARN, time.Hour, time.Hour, WithClock(clock), WithForceKMSRecheck(10*time.Minute))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	clock.Advance(10 * time.Minute)
+	manager.CleanupCache()
+	if len(manager.authorizedAt) != 0 {
+		t.Fatalf("expected lapsed authorizations to be dropped, %d left", len(manager.authorizedAt))
+	}
+}
@@ -0,0 +1,434 @@
+// Package kmscodec implements the KMS envelope encryption codec: data key management,
+// payload encryption and the HTTP handlers served by the codec server.
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+// Payload metadata used to opt into deterministic encryption or sign-only mode
+const (
+	EncryptionModeMetadataKey   = "encryption-mode"
+	EncryptionModeDeterministic = "deterministic"
+	EncryptionModeSignOnly      = "sign-only"
+)
+
+// OriginalEncodingMetadataKey is reserved on encrypted payloads for the encoding the payload had before encryption
+const OriginalEncodingMetadataKey = "original-encoding"
+
+// DefaultDecodeEncoding labels decoded payloads that carry no original encoding
+const DefaultDecodeEncoding = "json/plain"
+
+// DecodeEncodingSniff as the default decode encoding labels payloads without an original
+// encoding json/plain if their plaintext is valid JSON and binary/plain otherwise
+const DecodeEncodingSniff = "sniff"
+
+// DefaultEmptyDecodeEncoding labels decoded payloads with empty plaintext that do not record
+// their original encoding. Empty data is not a JSON document; an empty value is what Temporal
+// writes as binary/null.
+const DefaultEmptyDecodeEncoding = shared.NullEncoding
+
+// DefaultMaxPayloadsPerRequest caps the batch size of a single /encode or /decode request
+const DefaultMaxPayloadsPerRequest = 1000
+
+// KMSEncryptionCodec handles encryption/decryption of payloads using AWS KMS
+type KMSEncryptionCodec struct {
+	kmsManager            *KMSManager
+	maxPayloadsPerRequest int
+	concurrency           int
+	lenientDecode         bool
+	partialDecode         bool // decode every payload it can and report the rest per payload
+	strictJSON            bool // reject unknown fields in JSON request bodies
+	strictDecode          bool // validate every encrypted payload's envelope fields before decrypting
+	defaultDecodeEncoding string
+	emptyDecodeEncoding   string       // label for empty plaintext without an original encoding; empty uses defaultDecodeEncoding
+	encryptFields         []string     // dotted JSON paths for field-level encryption; empty encrypts whole payloads
+	encryptionPolicy      []PolicyRule // metadata rules deciding which payloads are encrypted
+	readinessChecks       []ReadinessCheck
+	encodeTimestamp       bool     // embed an authenticated encode time in AES-256-GCM(-SIV) payloads
+	cipher                string   // whole-payload algorithm: AES-256-GCM or AES-256-GCM-SIV
+	staticKey             []byte   // legacy static key for scheme: static payloads; nil rejects them
+	transforms            []string // pipeline stage names in encode order
+	pipeline              *pipeline
+	sizeMetrics           *payloadSizeMetrics
+	audit                 *auditLogger // nil unless WithAuditLog is set
+	dedup                 *encodeDedup // nil unless WithEncodeDedup is set
+	profileAttribute      string       // codec context key selecting a profile; empty disables profiles
+	profiles              map[string]*KMSEncryptionCodec
+	foreignPolicy         string           // what encode does with payloads another system encrypted; empty is off
+	foreignMarkers        []MetadataMarker // metadata signatures of foreign encryption
+	foreignSkipped        atomic.Int64
+	foreignRejected       atomic.Int64
+	decodeMaxAge          time.Duration // /decode refuses payloads encoded longer ago; zero disables it
+	decodeAgeRejections   atomic.Int64
+	buildInfo             BuildInfo       // reported by /version
+	fleet                 *fleetStats     // nil unless WithFleetStats is set
+	metadataAllowlist     map[string]bool // metadata keys returned besides the codec's own; nil returns all
+	metadataKeysDropped   atomic.Int64
+	partialDecodeFailures atomic.Int64
+}
+
+// CodecOption configures optional KMSEncryptionCodec behavior
+type CodecOption func(*KMSEncryptionCodec)
+
+// WithMaxPayloadsPerRequest sets the batch size limit; zero or less disables the limit
+func WithMaxPayloadsPerRequest(limit int) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.maxPayloadsPerRequest = limit
+	}
+}
+
+// WithConcurrency sets how many payloads of one request are processed in parallel
+func WithConcurrency(concurrency int) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.concurrency = concurrency
+	}
+}
+
+// WithLenientDecode replaces payloads that fail to decode because they are corrupt
+// with an error sentinel instead of failing the whole batch
+func WithLenientDecode(lenient bool) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.lenientDecode = lenient
+	}
+}
+
+// WithPartialDecode makes /decode return every payload it can decode even when others fail,
+// listing the failures in the response's Errors with the status each would have failed the
+// batch with. Unlike lenient decode, KMS and server failures are reported per payload too.
+func WithPartialDecode(partial bool) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.partialDecode = partial
+	}
+}
+
+// WithStrictJSON rejects JSON request bodies with fields the endpoint does not know, so a
+// misspelled field name fails with a 400 naming it instead of being silently ignored
+func WithStrictJSON(strict bool) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.strictJSON = strict
+	}
+}
+
+// WithDefaultDecodeEncoding sets the encoding label for decoded payloads that do not record their original encoding.
+// DecodeEncodingSniff chooses the label from the plaintext instead.
+func WithDefaultDecodeEncoding(encoding string) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.defaultDecodeEncoding = encoding
+	}
+}
+
+// WithEmptyDecodeEncoding sets the encoding label for decoded payloads whose plaintext is empty
+// and that do not record their original encoding, DefaultEmptyDecodeEncoding unless set. An
+// empty encoding labels them like other payloads, following WithDefaultDecodeEncoding.
+func WithEmptyDecodeEncoding(encoding string) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.emptyDecodeEncoding = encoding
+	}
+}
+
+// WithEncryptFields enables field-level encryption of the given dotted JSON paths
+func WithEncryptFields(paths []string) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.encryptFields = paths
+	}
+}
+
+// WithEncodeTimestamp records the encode time in AES-256-GCM payloads, bound to the
+// ciphertext as additional data so it cannot be changed without failing decryption
+func WithEncodeTimestamp(enabled bool) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.encodeTimestamp = enabled
+	}
+}
+
+// WithCipher selects the algorithm for whole-payload encryption: AlgorithmAES256GCM (the
+// default) or the nonce-misuse-resistant AlgorithmAES256GCMSIV. Decode handles both either way.
+func WithCipher(algorithm string) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.cipher = algorithm
+	}
+}
+
+// WithTransforms sets the pipeline stages payloads go through, in encode order, e.g.
+// gzip then encrypt; decode reverses them. Names come from ParseTransforms.
+func WithTransforms(names []string) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.transforms = names
+	}
+}
+
+// WithReadinessChecks replaces the checks run by /ready; an empty set is always ready
+func WithReadinessChecks(checks []ReadinessCheck) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.readinessChecks = checks
+	}
+}
+
+// NewKMSEncryptionCodec creates a new KMS encryption codec
+func NewKMSEncryptionCodec(kmsManager *KMSManager, opts ...CodecOption) *KMSEncryptionCodec {
+	codec := &KMSEncryptionCodec{
+		kmsManager:            kmsManager,
+		maxPayloadsPerRequest: DefaultMaxPayloadsPerRequest,
+		concurrency:           DefaultPayloadConcurrency,
+		defaultDecodeEncoding: DefaultDecodeEncoding,
+		emptyDecodeEncoding:   DefaultEmptyDecodeEncoding,
+		cipher:                AlgorithmAES256GCM,
+		transforms:            DefaultTransforms,
+		sizeMetrics:           newPayloadSizeMetrics(),
+	}
+	for _, opt := range opts {
+		opt(codec)
+	}
+	var stages []PayloadTransformer
+	for _, name := range codec.transforms {
+		if stage, ok := builtinTransformer(codec, name); ok {
+			stages = append(stages, stage)
+		} else {
+			log.Printf("Ignoring unknown transform %q", name)
+		}
+	}
+	codec.pipeline = newPipeline(stages)
+	if codec.readinessChecks == nil {
+		codec.readinessChecks = DefaultReadinessChecks(kmsManager, DefaultReadyCacheMaxEntries)
+	}
+	if codec.audit != nil {
+		codec.audit.start()
+	}
+	return codec
+}
+
+// Close writes the audit records still queued and stops the audit writer
+func (c *KMSEncryptionCodec) Close() {
+	if c.audit != nil {
+		c.audit.stop()
+	}
+}
+
+// checkBatchSize rejects requests with more payloads than the configured limit
+func (c *KMSEncryptionCodec) checkBatchSize(w http.ResponseWriter, req shared.CodecRequest) bool {
+	if c.maxPayloadsPerRequest > 0 && len(req.Payloads) > c.maxPayloadsPerRequest {
+		http.Error(w, fmt.Sprintf("Too many payloads: %d exceeds the limit of %d per request",
+			len(req.Payloads), c.maxPayloadsPerRequest), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// handleEncode handles the /encode endpoint
+func (c *KMSEncryptionCodec) handleEncode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := c.readCodecRequest(w, r)
+	if !ok || !c.checkBatchSize(w, req) {
+		return
+	}
+
+	// The codec context can select another profile's master key and cipher
+	encoder := c.encoderFor(req.Context)
+
+	if req.ForceNewKey {
+		fingerprint, err := encoder.kmsManager.ForceRotation(r.Context())
+		switch {
+		case errors.Is(err, ErrForcedRotationDisabled):
+			http.Error(w, "force_new_key is disabled on this codec server", http.StatusForbidden)
+			return
+		case errors.Is(err, ErrForcedRotationRateLimited):
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case err != nil:
+			log.Printf("Forced rotation requested from %s failed: %v", r.RemoteAddr, err)
+			http.Error(w, "Forced data key rotation failed", http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("Encode request from %s forced a new data key %s", r.RemoteAddr, fingerprint)
+	}
+
+	// Every input payload produces exactly one output payload, in order
+	payloads, err := c.processPayloads(context.Background(), req.Payloads, encoder.encode)
+	c.filterMetadata(payloads)
+	if err == nil {
+		err = tagCorrelationIDs(r.Header.Get(shared.CorrelationIDHeader), req.Payloads, payloads)
+	}
+	if err != nil {
+		writeCodecError(w, err)
+		return
+	}
+	c.sizeMetrics.record(req.Payloads, payloads)
+	writeCodecResponse(w, r, shared.CodecResponse{Payloads: payloads})
+}
+
+// handleDecode handles the /decode endpoint
+func (c *KMSEncryptionCodec) handleDecode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := c.readCodecRequest(w, r)
+	if !ok || !c.checkBatchSize(w, req) {
+		return
+	}
+
+	decode := c.decodeRouted
+	if c.lenientDecode && !c.partialDecode {
+		decode = c.decodePayloadLenient
+	}
+	// Per-payload timing is diagnostic only, so it is left out unless asked for
+	if r.URL.Query().Get("debug") == "true" {
+		decode = withDecodeTiming(decode)
+	}
+
+	// RegisterRoutes only lets admins lift the max age to view older history
+	ctx := context.Background()
+	if c.decodeMaxAge > 0 && r.URL.Query().Get("history") != "true" {
+		now := c.kmsManager.clock.Now()
+		ctx = withDecodeWindow(ctx, now.Add(-c.decodeMaxAge), now.Add(c.kmsManager.clockSkewTolerance))
+	}
+
+	var resp shared.CodecResponse
+	if c.partialDecode {
+		var errs []error
+		resp.Payloads, errs = c.processPayloadsPartial(ctx, req.Payloads, decode)
+		resp.Errors = payloadErrors(errs)
+		c.partialDecodeFailures.Add(int64(len(resp.Errors)))
+	} else {
+		var err error
+		if resp.Payloads, err = c.processPayloads(ctx, req.Payloads, decode); err != nil {
+			writeCodecError(w, err)
+			return
+		}
+	}
+	c.filterMetadata(resp.Payloads)
+	c.sizeMetrics.record(resp.Payloads, req.Payloads)
+	c.auditDecoded(r, AuditEventDecode, req.Payloads, resp.Payloads)
+	writeCodecResponse(w, r, resp)
+}
+
+// handleHealth handles the /health endpoint, reporting unhealthy while the KMS circuit is open
+func (c *KMSEncryptionCodec) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !c.kmsManager.KMSAvailable() {
+		http.Error(w, "KMS unavailable: circuit breaker open", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handleStats handles the /stats endpoint for monitoring
+func (c *KMSEncryptionCodec) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "prometheus" {
+		http.Error(w, fmt.Sprintf("Unsupported format %q (use json or prometheus)", format), http.StatusBadRequest)
+		return
+	}
+
+	stats := c.kmsManager.GetKeyStats()
+	stats["max_payloads_per_request"] = c.maxPayloadsPerRequest
+	if c.audit != nil {
+		c.audit.addStats(stats)
+	}
+	if c.dedup != nil {
+		c.dedup.addStats(stats)
+	}
+	if c.foreignPolicy != "" && c.foreignPolicy != ForeignEncryptionOff {
+		stats["foreign_encryption_policy"] = c.foreignPolicy
+		stats["foreign_encryption_skipped"] = c.foreignSkipped.Load()
+		stats["foreign_encryption_rejected"] = c.foreignRejected.Load()
+	}
+	if c.metadataAllowlist != nil {
+		stats["metadata_keys_dropped"] = c.metadataKeysDropped.Load()
+	}
+	if c.partialDecode {
+		stats["partial_decode_failures"] = c.partialDecodeFailures.Load()
+	}
+	if c.decodeMaxAge > 0 {
+		stats["decode_max_age"] = c.decodeMaxAge.String()
+		stats["decode_max_age_rejections"] = c.decodeAgeRejections.Load()
+	}
+	if c.profileAttribute != "" {
+		stats["codec_profile_attribute"] = c.profileAttribute
+		stats["codec_profiles"] = slices.Sorted(maps.Keys(c.profiles))
+	}
+
+	// Verbose output adds per-entry cache metadata; RegisterRoutes only allows it for admins
+	verbose := query.Get("verbose") == "true"
+	var entries []CacheEntryInfo
+	if verbose {
+		entries = c.kmsManager.CachedKeys(r.Context())
+	}
+	now := c.kmsManager.clock.Now()
+
+	if format == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheusStats(w, stats, entries, now)
+		return
+	}
+
+	if verbose {
+		stats["cache_entries"] = cacheEntryResponses(entries, now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("Failed to encode stats response: %v", err)
+	}
+}
+
+// RegisterRoutes registers the codec, monitoring and admin endpoints on mux.
+// Admin endpoints require adminToken as a bearer token and are disabled when it is empty.
+func (c *KMSEncryptionCodec) RegisterRoutes(mux *http.ServeMux, adminToken string) {
+	mux.HandleFunc("/encode", c.handleEncode)
+	mux.HandleFunc("/decode", func(w http.ResponseWriter, r *http.Request) {
+		// Decoding past the max age is what it exists to prevent, so only admins may
+		if r.URL.Query().Get("history") == "true" {
+			adminOnly(adminToken, c.handleDecode)(w, r)
+			return
+		}
+		c.handleDecode(w, r)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		// Per-entry cache metadata is as sensitive as /cache
+		if r.URL.Query().Get("verbose") == "true" {
+			adminOnly(adminToken, c.handleStats)(w, r)
+			return
+		}
+		c.handleStats(w, r)
+	})
+	mux.HandleFunc("/stats/fleet", c.handleFleetStats)
+	mux.HandleFunc("/metrics", c.handleMetrics)
+
+	// Admin endpoints, protected by a bearer token
+	mux.HandleFunc("/revoke", adminOnly(adminToken, c.handleRevoke))
+	mux.HandleFunc("/retire-current", adminOnly(adminToken, c.handleRetireCurrent))
+	mux.HandleFunc("/cache", adminOnly(adminToken, c.handleCache))
+	mux.HandleFunc("/cache/flush", adminOnly(adminToken, c.handleCacheFlush))
+	mux.HandleFunc("/grants", adminOnly(adminToken, c.handleGrants))
+	mux.HandleFunc("/rewrap", adminOnly(adminToken, c.handleRewrap))
+	mux.HandleFunc("/decode/pinned", adminOnly(adminToken, c.handlePinnedDecode))
+	mux.HandleFunc("/key-info", adminOnly(adminToken, c.handleKeyInfo))
+
+	// Health check, readiness and version endpoints
+	mux.HandleFunc("/health", c.handleHealth)
+	mux.HandleFunc("/ready", c.handleReady)
+	mux.HandleFunc("/version", c.handleVersion)
+}
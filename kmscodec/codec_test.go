@@ -0,0 +1,275 @@
+package kmscodec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func newTestCodec(t testing.TB) (*KMSEncryptionCodec, *fakeKMS) {
+	t.Helper()
+	fake := newFakeKMS()
+	return NewKMSEncryptionCodec(newTestManager(t, fake)), fake
+}
+
+// doCodecRequest sends a codec request to the given handler and returns the recorder
+func doCodecRequest(t testing.TB, handler http.HandlerFunc, req shared.CodecRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal request: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	return rec
+}
+
+// decodeCodecResponse parses a successful codec response
+func decodeCodecResponse(t testing.TB, rec *httptest.ResponseRecorder) shared.CodecResponse {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp shared.CodecResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return resp
+}
+
+func plainPayload(data string) shared.PayloadData {
+	return shared.PayloadData{
+		Metadata: map[string]string{"encoding": "json/plain"},
+		Data:     base64.StdEncoding.EncodeToString([]byte(data)),
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	original := `{"id":1,"name":"John"}`
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(original)},
+	}))
+	if len(encoded.Payloads) != 1 || encoded.Payloads[0].Metadata["encoding"] != "binary/encrypted" {
+		t.Fatalf("unexpected encode response: %+v", encoded)
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: encoded.Payloads,
+	}))
+	data, _ := base64.StdEncoding.DecodeString(decoded.Payloads[0].Data)
+	if string(data) != original {
+		t.Fatalf("round trip mismatch: got %q", data)
+	}
+}
+
+func TestCodecHandlersRejectWrongMethod(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	for _, handler := range []http.HandlerFunc{codec.handleEncode, codec.handleDecode} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected 405, got %d", rec.Code)
+		}
+	}
+}
+
+func TestEncodePassesThroughEncryptedPayloads(t *testing.T) {
+	codec, fake := newTestCodec(t)
+
+	encrypted := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"id":1}`)},
+	})).Payloads[0]
+
+	reencoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{encrypted},
+	}))
+
+	if len(reencoded.Payloads) != 1 {
+		t.Fatalf("expected the encrypted payload to be preserved, got %d payloads", len(reencoded.Payloads))
+	}
+	if !reflect.DeepEqual(reencoded.Payloads[0], encrypted) {
+		t.Fatalf("expected payload unchanged:\n got: %+v\nwant: %+v", reencoded.Payloads[0], encrypted)
+	}
+	if generate, _ := fake.calls(); generate != 1 {
+		t.Fatalf("expected no extra key generation, got %d calls", generate)
+	}
+}
+
+func TestEncodePreservesCountAndOrderForMixedEncodings(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	protobuf := shared.PayloadData{Metadata: map[string]string{"encoding": "json/protobuf"}, Data: "cHJvdG8="}
+	null := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/null"}}
+	metadataOnly := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/plain", "x": "y"}}
+	input := []shared.PayloadData{plainPayload(`{"a":1}`), protobuf, null, plainPayload(`{"b":2}`), metadataOnly}
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: input}))
+
+	if len(encoded.Payloads) != len(input) {
+		t.Fatalf("expected %d payloads, got %d", len(input), len(encoded.Payloads))
+	}
+	for _, i := range []int{0, 3} {
+		if encoded.Payloads[i].Metadata["encoding"] != "binary/encrypted" {
+			t.Errorf("payload %d: expected JSON payload to be encrypted", i)
+		}
+	}
+	for i, want := range map[int]shared.PayloadData{1: protobuf, 2: null, 4: metadataOnly} {
+		if !reflect.DeepEqual(encoded.Payloads[i], want) {
+			t.Errorf("payload %d: expected pass-through, got %+v", i, encoded.Payloads[i])
+		}
+	}
+}
+
+func TestHandlersRejectOversizedBatches(t *testing.T) {
+	fake := newFakeKMS()
+	codec := NewKMSEncryptionCodec(newTestManager(t, fake), WithMaxPayloadsPerRequest(2))
+
+	batch := shared.CodecRequest{Payloads: []shared.PayloadData{plainPayload("1"), plainPayload("2"), plainPayload("3")}}
+	for name, handler := range map[string]http.HandlerFunc{"encode": codec.handleEncode, "decode": codec.handleDecode} {
+		if rec := doCodecRequest(t, handler, batch); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 for oversized batch, got %d", name, rec.Code)
+		}
+	}
+
+	batch.Payloads = batch.Payloads[:2]
+	decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, batch))
+
+	rec := httptest.NewRecorder()
+	codec.handleStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats map[string]interface{}
+	json.NewDecoder(rec.Body).Decode(&stats)
+	if stats["max_payloads_per_request"] != float64(2) {
+		t.Fatalf("expected limit in /stats, got %v", stats["max_payloads_per_request"])
+	}
+}
+
+func TestDecodeRestoresOriginalEncoding(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	codec.defaultDecodeEncoding = "binary/plain"
+
+	labelled := plainPayload(`{"id":1}`)
+	unlabelled := shared.PayloadData{Data: base64.StdEncoding.EncodeToString([]byte{0x00, 0xff})}
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{labelled, unlabelled},
+	}))
+	if got := encoded.Payloads[0].Metadata[OriginalEncodingMetadataKey]; got != "json/plain" {
+		t.Fatalf("expected encode to record the original encoding, got %q", got)
+	}
+	if _, ok := encoded.Payloads[1].Metadata[OriginalEncodingMetadataKey]; ok {
+		t.Fatal("expected no original encoding for an unlabelled payload")
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: encoded.Payloads,
+	}))
+	if got := decoded.Payloads[0].Metadata["encoding"]; got != "json/plain" {
+		t.Fatalf("expected the recorded encoding to win over the default, got %q", got)
+	}
+	if got := decoded.Payloads[1].Metadata["encoding"]; got != "binary/plain" {
+		t.Fatalf("expected the default decode encoding, got %q", got)
+	}
+}
+
+func TestDecodeSniffsEncodingOfUnlabelledPayloads(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	codec.defaultDecodeEncoding = DecodeEncodingSniff
+
+	unlabelled := func(data []byte) shared.PayloadData {
+		return shared.PayloadData{Data: base64.StdEncoding.EncodeToString(data)}
+	}
+	input := []shared.PayloadData{
+		unlabelled([]byte(`{"id":1}`)),
+		unlabelled([]byte(" [1, 2]\n")),
+		unlabelled([]byte{0x00, 0xff, 0x10}),
+		unlabelled([]byte(`{"truncated":`)),
+		plainPayload("not json"), // the recorded encoding wins over the sniffed one
+	}
+	want := []string{"json/plain", "json/plain", "binary/plain", "binary/plain", "json/plain"}
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: input}))
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: encoded.Payloads}))
+	for i, payload := range decoded.Payloads {
+		if got := payload.Metadata["encoding"]; got != want[i] {
+			t.Errorf("payload %d: expected %q, got %q", i, want[i], got)
+		}
+		if payload.Data != input[i].Data {
+			t.Errorf("payload %d: expected the data unchanged, got %q", i, payload.Data)
+		}
+	}
+}
+
+// quietLogs discards log output for the rest of a benchmark so numbers are not interleaved with key rotation logs
+func quietLogs(b *testing.B) {
+	b.Helper()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// benchmarkBatch builds a batch of count JSON payloads of roughly size bytes each
+func benchmarkBatch(size, count int) shared.CodecRequest {
+	data := `{"data":"` + strings.Repeat("x", size-11) + `"}`
+	req := shared.CodecRequest{Payloads: make([]shared.PayloadData, count)}
+	for i := range req.Payloads {
+		req.Payloads[i] = plainPayload(data)
+	}
+	return req
+}
+
+// benchmarkHandler measures one handler over every payload and batch size combination.
+// KMS is faked and the data key stays current, so only crypto and serialization are measured.
+func benchmarkHandler(b *testing.B, prepare func(*KMSEncryptionCodec, shared.CodecRequest) (http.HandlerFunc, shared.CodecRequest)) {
+	quietLogs(b)
+	for _, tc := range benchmarkPayloadSizes {
+		for _, count := range []int{1, 10, 100} {
+			if tc.size*count > 16<<20 {
+				continue
+			}
+			b.Run(fmt.Sprintf("%s/batch=%d", tc.name, count), func(b *testing.B) {
+				codec, _ := newTestCodec(b)
+				handler, req := prepare(codec, benchmarkBatch(tc.size, count))
+				body, err := json.Marshal(req)
+				if err != nil {
+					b.Fatalf("marshal request: %v", err)
+				}
+
+				b.SetBytes(int64(tc.size * count))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					rec := httptest.NewRecorder()
+					handler(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+					if rec.Code != http.StatusOK {
+						b.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkHandleEncode(b *testing.B) {
+	benchmarkHandler(b, func(codec *KMSEncryptionCodec, req shared.CodecRequest) (http.HandlerFunc, shared.CodecRequest) {
+		return codec.handleEncode, req
+	})
+}
+
+func BenchmarkHandleDecode(b *testing.B) {
+	benchmarkHandler(b, func(codec *KMSEncryptionCodec, req shared.CodecRequest) (http.HandlerFunc, shared.CodecRequest) {
+		encoded := decodeCodecResponse(b, doCodecRequest(b, codec.handleEncode, req))
+		return codec.handleDecode, shared.CodecRequest{Payloads: encoded.Payloads}
+	})
+}
@@ -0,0 +1,121 @@
+package kmscodec
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Encryption context validation modes, chosen with WithEncryptionContextValidation
+const (
+	// ContextValidationPermissive passes a payload's stored context to KMS verbatim, whatever it
+	// holds. KMS only decrypts with the exact context the key was generated with, so this is
+	// what lets payloads written under an older context (e.g. version 1.0) keep decoding.
+	ContextValidationPermissive = "permissive"
+	// ContextValidationStrict rejects payloads whose stored context differs from the one this
+	// manager generates keys with, before any lookup or KMS call
+	ContextValidationStrict = "strict"
+)
+
+// ErrEncryptionContextMismatch is returned in strict validation when a payload's stored
+// encryption context differs from the current one
+var ErrEncryptionContextMismatch = errors.New("encryption context does not match the current context")
+
+// encryptionContextTimestampKey is the per-key field of the context; every other field is
+// fixed for all keys the manager generates
+const encryptionContextTimestampKey = "timestamp"
+
+// WithEncryptionContext adds fields, such as a cost center or data classification, to the KMS
+// encryption context of every data key the manager generates, so KMS key policies can grant or
+// deny on them with kms:EncryptionContext conditions. The fields are merged with the fixed ones
+// and stored in each payload like the rest of the context, so decrypt sends the exact context
+// the key was generated with even after the fields change. Build fields with ParseEncryptionContext.
+func WithEncryptionContext(fields map[string]string) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.contextFields = maps.Clone(fields)
+	}
+}
+
+// ParseEncryptionContext parses a comma-separated list of key=value encryption context fields.
+// The codec's own fields and the aws prefix KMS reserves cannot be set.
+func ParseEncryptionContext(spec string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid encryption context field %q (use key=value)", entry)
+		}
+		if _, reserved := legacyEncryptionContext()[key]; reserved || key == encryptionContextTimestampKey {
+			return nil, fmt.Errorf("encryption context field %q is set by the codec", key)
+		}
+		if strings.HasPrefix(strings.ToLower(key), "aws") {
+			return nil, fmt.Errorf("encryption context field %q uses the prefix reserved by KMS", key)
+		}
+		if _, dup := fields[key]; dup {
+			return nil, fmt.Errorf("duplicate encryption context field %q", key)
+		}
+		fields[key] = value
+	}
+	return fields, nil
+}
+
+// WithEncryptionContextValidation sets how decrypt treats the encryption context stored in a
+// payload: ContextValidationPermissive, the default, or ContextValidationStrict
+func WithEncryptionContextValidation(mode string) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.contextValidation = mode
+	}
+}
+
+// ParseContextValidation validates an encryption context validation mode; empty means permissive
+func ParseContextValidation(mode string) (string, error) {
+	switch mode {
+	case "", ContextValidationPermissive:
+		return ContextValidationPermissive, nil
+	case ContextValidationStrict:
+		return ContextValidationStrict, nil
+	}
+	return "", fmt.Errorf("unknown encryption context validation %q (use %s or %s)", mode, ContextValidationPermissive, ContextValidationStrict)
+}
+
+// validateEncryptionContext applies the validation mode to a payload's stored context. In
+// strict mode the context must have exactly the fixed and configured fields of
+// newEncryptionContext with their current values, plus the key's timestamp. Payloads without a
+// stored context use the legacy context, which holds the fixed fields alone, and are always accepted.
+func (k *KMSManager) validateEncryptionContext(encryptionContext map[string]string) error {
+	if k.contextValidation != ContextValidationStrict || encryptionContext == nil {
+		return nil
+	}
+
+	expected := legacyEncryptionContext()
+	maps.Copy(expected, k.contextFields)
+	for _, field := range slices.Sorted(maps.Keys(encryptionContext)) {
+		value := encryptionContext[field]
+		if field == encryptionContextTimestampKey {
+			continue
+		}
+		want, ok := expected[field]
+		if !ok {
+			return fmt.Errorf("%w: unexpected field %q", ErrEncryptionContextMismatch, field)
+		}
+		if value != want {
+			return fmt.Errorf("%w: %s is %q, want %q", ErrEncryptionContextMismatch, field, value, want)
+		}
+	}
+	for _, field := range slices.Sorted(maps.Keys(expected)) {
+		if _, ok := encryptionContext[field]; !ok {
+			return fmt.Errorf("%w: missing field %q", ErrEncryptionContextMismatch, field)
+		}
+	}
+	if _, ok := encryptionContext[encryptionContextTimestampKey]; !ok {
+		return fmt.Errorf("%w: missing field %q", ErrEncryptionContextMismatch, encryptionContextTimestampKey)
+	}
+	return nil
+}
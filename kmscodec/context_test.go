@@ -0,0 +1,184 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestValidateEncryptionContext(t *testing.T) {
+	current := newEncryptionContext(time.Now(), nil)
+	with := func(change func(map[string]string)) map[string]string {
+		c := maps.Clone(current)
+		change(c)
+		return c
+	}
+
+	cases := []struct {
+		name        string
+		context     map[string]string
+		strictValid bool
+	}{
+		{"current", current, true},
+		{"legacy payload without a context", nil, true},
+		{"older version", with(func(c map[string]string) { c["version"] = "0.9" }), false},
+		{"other service", with(func(c map[string]string) { c["service"] = "other" }), false},
+		{"extra field", with(func(c map[string]string) { c["tenant"] = "acme" }), false},
+		{"missing field", with(func(c map[string]string) { delete(c, "version") }), false},
+		{"missing timestamp", with(func(c map[string]string) { delete(c, "timestamp") }), false},
+	}
+	permissive := &KMSManager{contextValidation: ContextValidationPermissive}
+	strict := &KMSManager{contextValidation: ContextValidationStrict}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := permissive.validateEncryptionContext(tc.context); err != nil {
+				t.Fatalf("permissive: unexpected error %v", err)
+			}
+			err := strict.validateEncryptionContext(tc.context)
+			if tc.strictValid && err != nil {
+				t.Fatalf("strict: unexpected error %v", err)
+			}
+			if !tc.strictValid && !errors.Is(err, ErrEncryptionContextMismatch) {
+				t.Fatalf("strict: expected ErrEncryptionContextMismatch, got %v", err)
+			}
+		})
+	}
+}
+
+// oldVersionPayload encrypts a payload, then rewrites its data key's context as if the key had been
+// generated under an older context version, then rotates and flushes the cache so decode has to go to KMS
+func oldVersionPayload(t *testing.T, codec *KMSEncryptionCodec, fake *fakeKMS) shared.PayloadData {
+	t.Helper()
+	payload := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+
+	oldContext := maps.Clone(payload.EncryptionContext)
+	oldContext["version"] = "0.9"
+	blob, _ := decodeBase64(payload.EncryptedDataKey)
+	fake.mu.Lock()
+	fake.contexts[string(blob)] = oldContext
+	fake.mu.Unlock()
+
+	payload.EncryptionContext = oldContext
+	var err error
+	if payload.EnvelopeChecksum, err = envelopeChecksum(payload); err != nil {
+		t.Fatalf("envelopeChecksum: %v", err)
+	}
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	codec.kmsManager.FlushDecryptionCache(context.Background())
+	return payload
+}
+
+func TestPermissiveValidationPassesStoredContextToKMS(t *testing.T) {
+	codec, fake := newTestCodec(t)
+	payload := oldVersionPayload(t, codec, fake)
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{payload},
+	})).Payloads[0]
+	if data, _ := decodeBase64(decoded.Data); string(data) != `{"v":1}` {
+		t.Fatalf("unexpected plaintext %q", data)
+	}
+	if _, decrypt := fake.calls(); decrypt != 1 {
+		t.Fatalf("expected the stored context to be sent to KMS, got %d decrypts", decrypt)
+	}
+}
+
+func TestStrictValidationRejectsOutdatedContext(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+	WithEncryptionContextValidation(ContextValidationStrict)(manager)
+	codec := NewKMSEncryptionCodec(manager)
+	payload := oldVersionPayload(t, codec, fake)
+
+	if rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, decrypt := fake.calls(); decrypt != 0 {
+		t.Fatalf("expected no KMS call for a rejected context, got %d", decrypt)
+	}
+
+	// Payloads under the current context still decode
+	current := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":2}`)},
+	})).Payloads[0]
+	decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{current}}))
+}
+
+func TestParseContextValidation(t *testing.T) {
+	for spec, want := range map[string]string{"": ContextValidationPermissive, "permissive": ContextValidationPermissive, "strict": ContextValidationStrict} {
+		if got, err := ParseContextValidation(spec); err != nil || got != want {
+			t.Fatalf("ParseContextValidation(%q) = %q, %v", spec, got, err)
+		}
+	}
+	if _, err := ParseContextValidation("lenient"); err == nil {
+		t.Fatal("expected an unknown mode to be rejected")
+	}
+}
+
+func TestCustomEncryptionContextIsUsedAndStored(t *testing.T) {
+	fake := newFakeKMS()
+	fields := map[string]string{"cost-center": "1234", "data-classification": "confidential"}
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithEncryptionContext(fields))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+
+	payload := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	stored := payload.EncryptionContext
+	if stored["cost-center"] != "1234" || stored["data-classification"] != "confidential" ||
+		stored["service"] != "temporal-codec" || stored[encryptionContextTimestampKey] == "" {
+		t.Fatalf("expected the custom fields merged with the defaults, got %v", stored)
+	}
+	blob, _ := decodeBase64(payload.EncryptedDataKey)
+	fake.mu.Lock()
+	generated := fake.contexts[string(blob)]
+	fake.mu.Unlock()
+	if !maps.Equal(generated, stored) {
+		t.Fatalf("expected the stored context %v to be the one sent to KMS, got %v", stored, generated)
+	}
+
+	// Strict validation expects the custom fields, and the stored context decrypts through KMS
+	WithEncryptionContextValidation(ContextValidationStrict)(manager)
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	manager.FlushDecryptionCache(context.Background())
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{payload},
+	})).Payloads[0]
+	if data, _ := decodeBase64(decoded.Data); string(data) != `{"v":1}` {
+		t.Fatalf("unexpected plaintext %q", data)
+	}
+	if _, decrypt := fake.calls(); decrypt != 1 {
+		t.Fatalf("expected one KMS decrypt, got %d", decrypt)
+	}
+	withoutFields := maps.Clone(stored)
+	delete(withoutFields, "cost-center")
+	if err := manager.validateEncryptionContext(withoutFields); !errors.Is(err, ErrEncryptionContextMismatch) {
+		t.Fatalf("expected a context missing a custom field to be rejected, got %v", err)
+	}
+}
+
+func TestParseEncryptionContext(t *testing.T) {
+	fields, err := ParseEncryptionContext("cost-center=1234, data-classification = confidential")
+	if err != nil || len(fields) != 2 || fields["cost-center"] != "1234" || fields["data-classification"] != "confidential" {
+		t.Fatalf("unexpected fields %v (%v)", fields, err)
+	}
+	for _, spec := range []string{"cost-center", "=1234", "cost-center=", "service=other", "timestamp=0", "aws:tag=x", "a=1,a=2"} {
+		if _, err := ParseEncryptionContext(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
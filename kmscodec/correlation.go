@@ -0,0 +1,26 @@
+package kmscodec
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+
+	"temporal-key-rotation/shared"
+)
+
+// tagCorrelationIDs records a correlation ID on each payload this encode produced. The ID
+// comes from the input payload's metadata, or else from the request header. Payloads that
+// passed through unchanged keep the metadata they arrived with.
+func tagCorrelationIDs(headerID string, inputs, outputs []shared.PayloadData) error {
+	for i, input := range inputs {
+		id := cmp.Or(input.Metadata[shared.CorrelationIDMetadataKey], headerID)
+		if id == "" || outputs[i].Metadata["encoding"] == input.Metadata["encoding"] {
+			continue
+		}
+		if !shared.ValidCorrelationID(id) {
+			return &codecError{http.StatusBadRequest, fmt.Sprintf("Invalid correlation ID: at most %d printable ASCII characters without spaces", shared.MaxCorrelationIDLength), nil}
+		}
+		outputs[i].Metadata[shared.CorrelationIDMetadataKey] = id
+	}
+	return nil
+}
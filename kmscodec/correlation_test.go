@@ -0,0 +1,74 @@
+package kmscodec
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+// encodeWithCorrelationID encodes req with id in the correlation header
+func encodeWithCorrelationID(t *testing.T, codec *KMSEncryptionCodec, id string, req shared.CodecRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal request: %v", err)
+	}
+	httpReq := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	httpReq.Header.Set(shared.CorrelationIDHeader, id)
+	rec := httptest.NewRecorder()
+	codec.handleEncode(rec, httpReq)
+	return rec
+}
+
+func TestEncodeRecordsCorrelationIDAndDecodeEchoesIt(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	tagged := plainPayload(`{"b":2}`)
+	tagged.Metadata[shared.CorrelationIDMetadataKey] = "from-metadata"
+	encrypted := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/encrypted"}, Data: "eA=="}
+	encoded := decodeCodecResponse(t, encodeWithCorrelationID(t, codec, "from-header", shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"a":1}`), tagged, encrypted},
+	}))
+
+	if got := encoded.Payloads[0].Metadata[shared.CorrelationIDMetadataKey]; got != "from-header" {
+		t.Errorf("expected the header's correlation ID, got %q", got)
+	}
+	if got := encoded.Payloads[1].Metadata[shared.CorrelationIDMetadataKey]; got != "from-metadata" {
+		t.Errorf("expected payload metadata to override the header, got %q", got)
+	}
+	if _, ok := encoded.Payloads[2].Metadata[shared.CorrelationIDMetadataKey]; ok {
+		t.Errorf("pass-through payload should be left as it arrived, got %v", encoded.Payloads[2].Metadata)
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: encoded.Payloads[:2]}))
+	if got := decoded.Payloads[0].Metadata[shared.CorrelationIDMetadataKey]; got != "from-header" {
+		t.Errorf("expected decode to echo the correlation ID, got %q", got)
+	}
+}
+
+func TestEncodeWithoutCorrelationIDAddsNone(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"a":1}`)},
+	}))
+	if _, ok := encoded.Payloads[0].Metadata[shared.CorrelationIDMetadataKey]; ok {
+		t.Errorf("expected no correlation ID, got %v", encoded.Payloads[0].Metadata)
+	}
+}
+
+func TestEncodeRejectsInvalidCorrelationID(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	for _, id := range []string{"has space", "tab\there", strings.Repeat("a", shared.MaxCorrelationIDLength+1)} {
+		rec := encodeWithCorrelationID(t, codec, id, shared.CodecRequest{Payloads: []shared.PayloadData{plainPayload(`{"a":1}`)}})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("correlation ID %q: expected 400, got %d", id, rec.Code)
+		}
+	}
+}
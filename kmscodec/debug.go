@@ -0,0 +1,45 @@
+package kmscodec
+
+import (
+	"context"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+// decodeTiming collects the timing of one payload's decode; each payload gets its own
+type decodeTiming struct {
+	keyResolution time.Duration
+	resolved      bool
+}
+
+type decodeTimingKey struct{}
+
+// recordKeyResolution notes how long obtaining a data key took, when ctx is timing a debug decode
+func recordKeyResolution(ctx context.Context, elapsed time.Duration) {
+	if timing, ok := ctx.Value(decodeTimingKey{}).(*decodeTiming); ok {
+		timing.keyResolution += elapsed
+		timing.resolved = true
+	}
+}
+
+// withDecodeTiming wraps a decode function so each decoded payload reports how long its data key
+// and its whole decode took. Payloads that were not decrypted (passed through, or lenient-mode
+// sentinels) are left as they are.
+func withDecodeTiming(decode func(context.Context, shared.PayloadData) (shared.PayloadData, error)) func(context.Context, shared.PayloadData) (shared.PayloadData, error) {
+	return func(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+		timing := &decodeTiming{}
+		start := time.Now()
+		decoded, err := decode(context.WithValue(ctx, decodeTimingKey{}, timing), payload)
+		elapsed := time.Since(start)
+		if err != nil || decoded.Metadata[shared.KeySourceMetadataKey] == "" {
+			return decoded, err
+		}
+
+		decoded.Metadata[shared.DecodeTimeMetadataKey] = elapsed.String()
+		if timing.resolved {
+			decoded.Metadata[shared.KeyResolutionTimeMetadataKey] = timing.keyResolution.String()
+		}
+		return decoded, nil
+	}
+}
@@ -0,0 +1,55 @@
+package kmscodec
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestDecodeTimingOnlyWhenRequested(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`), {Metadata: map[string]string{"encoding": "binary/plain"}, Data: "AAE="}},
+	})).Payloads
+
+	plain := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: encoded})).Payloads
+	for _, key := range []string{shared.DecodeTimeMetadataKey, shared.KeyResolutionTimeMetadataKey} {
+		if _, ok := plain[0].Metadata[key]; ok {
+			t.Fatalf("expected no %s without ?debug=true", key)
+		}
+	}
+
+	body, _ := json.Marshal(shared.CodecRequest{Payloads: encoded})
+	rec := httptest.NewRecorder()
+	codec.handleDecode(rec, httptest.NewRequest(http.MethodPost, "/decode?debug=true", bytes.NewReader(body)))
+	debug := decodeCodecResponse(t, rec).Payloads
+
+	if debug[0].Metadata[shared.KeySourceMetadataKey] != KeySourceCurrent {
+		t.Fatalf("expected key-source current, got %q", debug[0].Metadata[shared.KeySourceMetadataKey])
+	}
+	for _, key := range []string{shared.DecodeTimeMetadataKey, shared.KeyResolutionTimeMetadataKey} {
+		if _, err := time.ParseDuration(debug[0].Metadata[key]); err != nil {
+			t.Fatalf("expected a duration in %s, got %q", key, debug[0].Metadata[key])
+		}
+	}
+	if debug[0].Data != plain[0].Data {
+		t.Fatal("debug decode changed the payload data")
+	}
+	// Payloads that pass through undecrypted are returned untouched
+	if _, ok := debug[1].Metadata[shared.DecodeTimeMetadataKey]; ok {
+		t.Fatalf("unexpected timing on a pass-through payload: %v", debug[1].Metadata)
+	}
+}
+
+func TestDecodeTimingIsCodecOnlyMetadata(t *testing.T) {
+	for _, key := range []string{shared.DecodeTimeMetadataKey, shared.KeyResolutionTimeMetadataKey} {
+		if !shared.IsCodecOnlyMetadata(key) {
+			t.Fatalf("%s must be stripped before payloads reach Temporal", key)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package kmscodec
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"temporal-key-rotation/shared"
+)
+
+// Encode deduplication hashes each plaintext payload and, when the same content was encrypted
+// recently under the current data key, returns the earlier ciphertext instead of encrypting it
+// again. Identical inputs then yield identical payloads, which keeps workflow histories stable
+// and saves the encryption work, but it tells anyone who sees the payloads which ones are equal,
+// much like deterministic encryption. It is off unless WithEncodeDedup is set.
+
+// encodeDedup remembers the encode output of recently seen payloads, keyed by a hash of the
+// current data key and the payload, and evicts the oldest entry once it is full
+type encodeDedup struct {
+	mu         sync.Mutex
+	entries    map[[sha256.Size]byte]shared.PayloadData
+	order      [][sha256.Size]byte // insertion order, oldest first
+	maxEntries int
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// WithEncodeDedup makes encode reuse the ciphertext of the last maxEntries distinct payloads
+// while the data key that encrypted them is still current. Zero or less disables it.
+func WithEncodeDedup(maxEntries int) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.dedup = nil
+		if maxEntries > 0 {
+			c.dedup = &encodeDedup{entries: make(map[[sha256.Size]byte]shared.PayloadData), maxEntries: maxEntries}
+		}
+	}
+}
+
+// dedupKey hashes everything that decides the encode output: the data key, the metadata and
+// the data. Fields are length-prefixed so different payloads can't hash the same input.
+func dedupKey(encryptedKey string, payload shared.PayloadData) [sha256.Size]byte {
+	h := sha256.New()
+	write := func(s string) {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(s))))
+		h.Write([]byte(s))
+	}
+	write(encryptedKey)
+	for _, key := range slices.Sorted(maps.Keys(payload.Metadata)) {
+		write(key)
+		write(payload.Metadata[key])
+	}
+	write(payload.Data)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// get returns a copy of the output stored for key, which callers may modify
+func (d *encodeDedup) get(key [sha256.Size]byte) (shared.PayloadData, bool) {
+	d.mu.Lock()
+	encoded, ok := d.entries[key]
+	d.mu.Unlock()
+	if !ok {
+		d.misses.Add(1)
+		return shared.PayloadData{}, false
+	}
+	d.hits.Add(1)
+	encoded.Metadata = maps.Clone(encoded.Metadata)
+	return encoded, true
+}
+
+func (d *encodeDedup) put(key [sha256.Size]byte, encoded shared.PayloadData) {
+	encoded.Metadata = maps.Clone(encoded.Metadata)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.entries[key]; ok {
+		return
+	}
+	if len(d.order) >= d.maxEntries {
+		delete(d.entries, d.order[0])
+		d.order = d.order[1:]
+	}
+	d.entries[key] = encoded
+	d.order = append(d.order, key)
+}
+
+// encode runs payload through the encode pipeline, reusing the earlier output for content
+// already encrypted under the current data key when deduplication is enabled. Payloads another
+// system encrypted are skipped or rejected first, as the foreign encryption policy says.
+func (c *KMSEncryptionCodec) encode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	skip, err := c.checkForeignEncryption(payload)
+	if err != nil {
+		return shared.PayloadData{}, err
+	}
+	if skip {
+		return payload, nil
+	}
+	if c.dedup == nil || shared.IsControlEncoding(payload.Metadata["encoding"]) {
+		return c.pipeline.Encode(ctx, payload)
+	}
+	// A key error is left for the pipeline to report
+	currentKey, err := c.kmsManager.GetCurrentDataKey(ctx)
+	if err != nil {
+		return c.pipeline.Encode(ctx, payload)
+	}
+
+	key := dedupKey(currentKey.EncryptedKey, payload)
+	if encoded, ok := c.dedup.get(key); ok {
+		return encoded, nil
+	}
+	encoded, err := c.pipeline.Encode(ctx, payload)
+	if err != nil {
+		return shared.PayloadData{}, err
+	}
+	// Only payloads encrypted with the key the hash names are worth remembering
+	if encoded.EncryptedDataKey == currentKey.EncryptedKey {
+		c.dedup.put(key, encoded)
+	}
+	return encoded, nil
+}
+
+// addStats adds the deduplication counters to a /stats response
+func (d *encodeDedup) addStats(stats map[string]interface{}) {
+	d.mu.Lock()
+	entries := len(d.entries)
+	d.mu.Unlock()
+	stats["encode_dedup_entries"] = entries
+	stats["encode_dedup_hits"] = d.hits.Load()
+	stats["encode_dedup_misses"] = d.misses.Load()
+}
@@ -0,0 +1,63 @@
+package kmscodec
+
+import (
+	"context"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestEncodeDedupReusesCiphertext(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+	codec := NewKMSEncryptionCodec(manager, WithEncodeDedup(2))
+
+	encode := func(data string) shared.PayloadData {
+		return decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+			Payloads: []shared.PayloadData{plainPayload(data)},
+		})).Payloads[0]
+	}
+
+	first := encode(`{"rates":[1,2,3]}`)
+	again := encode(`{"rates":[1,2,3]}`)
+	if again.Data != first.Data || again.EncryptedDataKey != first.EncryptedDataKey {
+		t.Fatal("expected identical input to reuse the earlier ciphertext")
+	}
+	if other := encode(`{"rates":[4]}`); other.Data == first.Data {
+		t.Fatal("expected different input to be encrypted on its own")
+	}
+
+	// A new data key starts over, so nothing is reused across keys
+	if _, _, err := manager.RetireCurrentKey(context.Background()); err != nil {
+		t.Fatalf("RetireCurrentKey: %v", err)
+	}
+	if rotated := encode(`{"rates":[1,2,3]}`); rotated.EncryptedDataKey == first.EncryptedDataKey || rotated.Data == first.Data {
+		t.Fatal("expected a fresh ciphertext under the new data key")
+	}
+
+	stats := manager.GetKeyStats()
+	codec.dedup.addStats(stats)
+	if stats["encode_dedup_hits"] != int64(1) || stats["encode_dedup_misses"] != int64(3) || stats["encode_dedup_entries"] != 2 {
+		t.Fatalf("unexpected dedup stats %v", stats)
+	}
+
+	// Reused payloads still decode
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{again}}))
+	if data, _ := decodeBase64(decoded.Payloads[0].Data); string(data) != `{"rates":[1,2,3]}` {
+		t.Fatalf("unexpected plaintext %q", data)
+	}
+}
+
+func TestEncodeWithoutDedupIsRandomized(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	var encoded []string
+	for range 2 {
+		resp := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+			Payloads: []shared.PayloadData{plainPayload(`{"rates":[1,2,3]}`)},
+		}))
+		encoded = append(encoded, resp.Payloads[0].Data)
+	}
+	if encoded[0] == encoded[1] {
+		t.Fatal("expected identical inputs to encrypt differently without deduplication")
+	}
+}
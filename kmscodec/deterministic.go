@@ -0,0 +1,107 @@
+package kmscodec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// Deterministic encryption derives the GCM nonce from the plaintext (a synthetic IV),
+// so equal plaintexts under the same data key produce equal ciphertexts. This leaks
+// equality of values, which is the point for lookups but must stay opt-in.
+
+// deriveDeterministicKeys splits a data key into independent MAC and encryption subkeys
+func deriveDeterministicKeys(key []byte) (macKey []byte, encKey []byte, err error) {
+	macKey, err = hkdf.Key(sha256.New, key, nil, "temporal-codec deterministic mac", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	encKey, err = hkdf.Key(sha256.New, key, nil, "temporal-codec deterministic enc", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return macKey, encKey, nil
+}
+
+// syntheticNonce computes the nonce for a plaintext
+func syntheticNonce(macKey []byte, data []byte, size int) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	return mac.Sum(nil)[:size]
+}
+
+// EncryptDeterministic encrypts data so that identical inputs yield identical output
+func EncryptDeterministic(data []byte, key []byte) (string, error) {
+	if want := algorithmKeyLength(AlgorithmAES256GCMDet); len(key) != want {
+		return "", fmt.Errorf("key must be %d bytes for %s", want, AlgorithmAES256GCMDet)
+	}
+
+	macKey, encKey, err := deriveDeterministicKeys(key)
+	if err != nil {
+		return "", err
+	}
+	defer zeroKey(macKey)
+	defer zeroKey(encKey)
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := syntheticNonce(macKey, data, gcm.NonceSize())
+	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptDeterministic decrypts EncryptDeterministic output and verifies the synthetic nonce
+func DecryptDeterministic(encodedData string, key []byte) ([]byte, error) {
+	if want := algorithmKeyLength(AlgorithmAES256GCMDet); len(key) != want {
+		return nil, fmt.Errorf("key must be %d bytes for %s", want, AlgorithmAES256GCMDet)
+	}
+
+	data, err := decodeBase64(encodedData)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode failed: %w", err)
+	}
+
+	macKey, encKey, err := deriveDeterministicKeys(key)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(macKey)
+	defer zeroKey(encKey)
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(nonce, syntheticNonce(macKey, plaintext, nonceSize)) {
+		return nil, fmt.Errorf("synthetic nonce mismatch")
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,81 @@
+package kmscodec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestEncryptDeterministicIsStableAndReversible(t *testing.T) {
+	key := bytes.Repeat([]byte{0x07}, 32)
+
+	first, err := EncryptDeterministic([]byte("alice@example.com"), key)
+	if err != nil {
+		t.Fatalf("EncryptDeterministic: %v", err)
+	}
+	second, _ := EncryptDeterministic([]byte("alice@example.com"), key)
+	other, _ := EncryptDeterministic([]byte("bob@example.com"), key)
+
+	if first != second {
+		t.Fatal("equal plaintexts must produce equal ciphertexts")
+	}
+	if first == other {
+		t.Fatal("different plaintexts must produce different ciphertexts")
+	}
+
+	plaintext, err := DecryptDeterministic(first, key)
+	if err != nil {
+		t.Fatalf("DecryptDeterministic: %v", err)
+	}
+	if string(plaintext) != "alice@example.com" {
+		t.Fatalf("round trip mismatch: got %q", plaintext)
+	}
+}
+
+func TestDecryptDeterministicRejectsTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{0x07}, 32)
+	encoded, _ := EncryptDeterministic([]byte("alice@example.com"), key)
+
+	raw, _ := base64.StdEncoding.DecodeString(encoded)
+	raw[len(raw)-1] ^= 0x01
+	if _, err := DecryptDeterministic(base64.StdEncoding.EncodeToString(raw), key); err == nil {
+		t.Fatal("expected tampered ciphertext to be rejected")
+	}
+
+	if _, err := DecryptDeterministic(encoded, bytes.Repeat([]byte{0x08}, 32)); err == nil {
+		t.Fatal("expected decryption with the wrong key to fail")
+	}
+}
+
+func TestEncodeSelectsDeterministicModeFromMetadata(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	deterministic := plainPayload(`"alice@example.com"`)
+	deterministic.Metadata[EncryptionModeMetadataKey] = EncryptionModeDeterministic
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{deterministic, deterministic, plainPayload(`"alice@example.com"`)},
+	}))
+
+	if encoded.Payloads[0].Algorithm != AlgorithmAES256GCMDet {
+		t.Fatalf("expected deterministic algorithm, got %s", encoded.Payloads[0].Algorithm)
+	}
+	if encoded.Payloads[0].Data != encoded.Payloads[1].Data {
+		t.Fatal("expected identical ciphertexts for identical deterministic payloads")
+	}
+	if encoded.Payloads[2].Algorithm != AlgorithmAES256GCM || encoded.Payloads[2].Data == encoded.Payloads[0].Data {
+		t.Fatal("payloads without the flag must use randomized encryption")
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: encoded.Payloads,
+	}))
+	for i := range decoded.Payloads {
+		data, _ := base64.StdEncoding.DecodeString(decoded.Payloads[i].Data)
+		if string(data) != `"alice@example.com"` {
+			t.Fatalf("payload %d: round trip mismatch: got %q", i, data)
+		}
+	}
+}
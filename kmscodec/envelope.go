@@ -0,0 +1,58 @@
+package kmscodec
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"temporal-key-rotation/shared"
+)
+
+// envelopeChecksumSize is the number of SHA-256 bytes kept in the envelope checksum
+const envelopeChecksumSize = 16
+
+// errEnvelopeMismatch reports a payload whose envelope no longer matches its checksum
+var errEnvelopeMismatch = errors.New("envelope checksum mismatch")
+
+// envelopeChecksum digests the envelope fields of an encrypted payload: key ID, algorithm,
+// encrypted data key, wrapped key and ciphertext length. It is not keyed, so it only catches
+// corruption and truncation; GCM remains the real integrity check. Its purpose is to reject
+// such payloads before the KMS call for their data key.
+func envelopeChecksum(payload shared.PayloadData) (string, error) {
+	ciphertext, err := decodeBase64(payload.Data)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, field := range []string{
+		payload.KMSKeyID,
+		payload.Algorithm,
+		normalizeBase64(payload.EncryptedDataKey),
+		normalizeBase64(payload.WrappedKey),
+	} {
+		// Length-prefix each field so no two envelopes hash the same input
+		binary.Write(hash, binary.BigEndian, uint32(len(field)))
+		hash.Write([]byte(field))
+	}
+	binary.Write(hash, binary.BigEndian, uint64(len(ciphertext)))
+
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)[:envelopeChecksumSize]), nil
+}
+
+// verifyEnvelope checks a payload's envelope checksum.
+// Payloads encrypted before the checksum was recorded carry none and are accepted.
+func verifyEnvelope(payload shared.PayloadData) error {
+	if payload.EnvelopeChecksum == "" {
+		return nil
+	}
+	checksum, err := envelopeChecksum(payload)
+	if err != nil {
+		return err
+	}
+	if checksum != normalizeBase64(payload.EnvelopeChecksum) {
+		return errEnvelopeMismatch
+	}
+	return nil
+}
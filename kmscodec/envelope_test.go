@@ -0,0 +1,86 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+// encodeUnderRetiredKey encrypts a payload and rotates away from its key with an empty
+// cache, so decoding it would need a KMS call
+func encodeUnderRetiredKey(t *testing.T, codec *KMSEncryptionCodec) shared.PayloadData {
+	t.Helper()
+	encoded, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	clearDecryptionCache(codec.kmsManager)
+	return encoded
+}
+
+func TestDecodeRejectsTamperedEnvelopeWithoutKMS(t *testing.T) {
+	cases := map[string]func(*shared.PayloadData){
+		"truncated ciphertext": func(p *shared.PayloadData) {
+			data, _ := base64.StdEncoding.DecodeString(p.Data)
+			p.Data = base64.StdEncoding.EncodeToString(data[:len(data)-4])
+		},
+		"swapped data key": func(p *shared.PayloadData) {
+			p.EncryptedDataKey = base64.StdEncoding.EncodeToString([]byte("blob-2"))
+		},
+		"changed key id": func(p *shared.PayloadData) {
+			p.KMSKeyID = "arn:aws:kms:us-east-1:123456789012:key/other-key"
+		},
+		"relabelled algorithm": func(p *shared.PayloadData) {
+			p.Algorithm = AlgorithmAES256GCMDet
+		},
+	}
+
+	for name, tamper := range cases {
+		t.Run(name, func(t *testing.T) {
+			codec, fake := newTestCodec(t)
+			payload := encodeUnderRetiredKey(t, codec)
+			tamper(&payload)
+
+			rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}})
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), "Corrupt payload") {
+				t.Fatalf("expected the error to identify a corrupt payload, got %q", rec.Body.String())
+			}
+			if _, decrypt := fake.calls(); decrypt != 0 {
+				t.Fatalf("expected no KMS call for a tampered envelope, got %d", decrypt)
+			}
+		})
+	}
+}
+
+func TestDecodeAcceptsEnvelopeInAnyBase64Variant(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	payload := toURLSafe(encodeUnderRetiredKey(t, codec))
+	payload.EnvelopeChecksum = strings.TrimRight(payload.EnvelopeChecksum, "=")
+
+	if _, err := codec.decodePayload(context.Background(), payload); err != nil {
+		t.Fatalf("decodePayload: %v", err)
+	}
+}
+
+func TestDecodeAcceptsPayloadWithoutChecksum(t *testing.T) {
+	codec, fake := newTestCodec(t)
+	payload := encodeUnderRetiredKey(t, codec)
+	payload.EnvelopeChecksum = ""
+
+	if _, err := codec.decodePayload(context.Background(), payload); err != nil {
+		t.Fatalf("expected a payload from before the checksum to decode, got %v", err)
+	}
+	if _, decrypt := fake.calls(); decrypt != 1 {
+		t.Fatalf("expected one KMS decrypt, got %d", decrypt)
+	}
+}
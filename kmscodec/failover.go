@@ -0,0 +1,89 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// multiRegionKeyPrefix starts the key ID of every multi-Region KMS key
+const multiRegionKeyPrefix = "mrk-"
+
+// WithReplicaRegion lets decrypts of data keys under a multi-Region master key fail over to
+// its replica in region, through client, when the primary region is down: KMS unreachable or
+// failing with a server error, the decrypt timing out, or the circuit breaker open. A replica
+// of a multi-Region key decrypts the same ciphertext. Other errors, such as a refused
+// ciphertext or a disabled key, and single-Region keys never fail over.
+func WithReplicaRegion(region string, client KMSClient) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.replicaRegion = region
+		k.replicaClient = client
+	}
+}
+
+// replicaKeyARN returns the ARN of the replica of a multi-Region key in region, or false when
+// masterKeyARN is not a multi-Region key ARN
+func replicaKeyARN(masterKeyARN, region string) (string, bool) {
+	parsed, err := arn.Parse(masterKeyARN)
+	if err != nil || parsed.Service != "kms" || !strings.HasPrefix(parsed.Resource, "key/"+multiRegionKeyPrefix) {
+		return "", false
+	}
+	parsed.Region = region
+	return parsed.String(), true
+}
+
+// isRegionFailure reports whether a KMS decrypt failed because the region's KMS could not
+// serve it, as opposed to KMS refusing the request
+func isRegionFailure(err error) bool {
+	if errors.Is(err, ErrKMSUnavailable) || errors.Is(err, ErrKMSTimeout) {
+		return true
+	}
+	var internal *types.KMSInternalException
+	var dependencyTimeout *types.DependencyTimeoutException
+	if errors.As(err, &internal) || errors.As(err, &dependencyTimeout) {
+		return true
+	}
+	var status interface{ HTTPStatusCode() int }
+	if errors.As(err, &status) {
+		return status.HTTPStatusCode() >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// decryptInReplicaRegion retries a decrypt that failed with primaryErr against the replica
+// region, when primaryErr is a region failure and the master key has a replica there. It
+// returns primaryErr, noting the replica's error, if the replica fails too.
+func (k *KMSManager) decryptInReplicaRegion(ctx context.Context, input *kms.DecryptInput, primaryErr error) (*kms.DecryptOutput, error) {
+	if k.replicaClient == nil || !isRegionFailure(primaryErr) {
+		return nil, primaryErr
+	}
+	replicaARN, ok := replicaKeyARN(aws.ToString(input.KeyId), k.replicaRegion)
+	if !ok {
+		return nil, primaryErr
+	}
+
+	replicaInput := *input
+	replicaInput.KeyId = aws.String(replicaARN)
+	k.replicaDecrypts.Add(1)
+	callCtx, cancel := kmsCallContext(ctx, k.decryptTimeout)
+	result, err := k.replicaClient.Decrypt(callCtx, &replicaInput)
+	err = kmsTimeoutError(ctx, callCtx, k.decryptTimeout, err)
+	cancel()
+	k.keyARNMetrics.recordDecrypt(replicaARN, err)
+	if err != nil {
+		log.Printf("Replica region %s failed to decrypt data key too: %v", k.replicaRegion, err)
+		return nil, fmt.Errorf("%w (replica region %s: %v)", primaryErr, k.replicaRegion, err)
+	}
+	log.Printf("Decrypted data key through replica region %s: %v", k.replicaRegion, primaryErr)
+	return result, nil
+}
@@ -0,0 +1,130 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const testMultiRegionKeyARN = "arn:aws:kms:us-east-1:123456789012:key/mrk-1234abcd12ab34cd56ef1234567890ab"
+
+// replicaKMS decrypts what primary generated, like the replica of a multi-Region key, and
+// records the key IDs it was asked for
+type replicaKMS struct {
+	*fakeKMS
+	primary *fakeKMS
+	mu      sync.Mutex
+	keyIDs  []string
+}
+
+func (r *replicaKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	r.mu.Lock()
+	r.keyIDs = append(r.keyIDs, aws.ToString(params.KeyId))
+	r.mu.Unlock()
+	r.primary.mu.Lock()
+	plaintext, ok := r.primary.keys[string(params.CiphertextBlob)]
+	r.primary.mu.Unlock()
+	if !ok {
+		return nil, &types.InvalidCiphertextException{Message: aws.String("unknown ciphertext")}
+	}
+	return &kms.DecryptOutput{Plaintext: append([]byte(nil), plaintext...), KeyId: params.KeyId}, nil
+}
+
+func TestDecryptFailsOverToReplicaRegion(t *testing.T) {
+	primary := newFakeKMS()
+	replica := &replicaKMS{fakeKMS: newFakeKMS(), primary: primary}
+
+	// Another replica of the codec encrypted with a data key this one has never seen
+	encoder, err := NewKMSManagerWithClient(primary, testMultiRegionKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	dataKey, err := encoder.GetCurrentDataKey(context.Background())
+	if err != nil {
+		t.Fatalf("GetCurrentDataKey: %v", err)
+	}
+
+	manager, err := NewKMSManagerWithClient(primary, testMultiRegionKeyARN, time.Hour, time.Hour, WithReplicaRegion("eu-west-1", replica))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	// The primary region is down
+	primary.mu.Lock()
+	primary.decryptErr = &types.KMSInternalException{Message: aws.String("internal error")}
+	primary.mu.Unlock()
+
+	key, err := manager.DecryptDataKey(context.Background(), dataKey.EncryptedKey, testMultiRegionKeyARN, dataKey.EncryptionContext)
+	if err != nil {
+		t.Fatalf("expected the replica region to decrypt, got %v", err)
+	}
+	if string(key) != string(dataKey.PlaintextKey) {
+		t.Fatal("replica returned the wrong data key")
+	}
+	if len(replica.keyIDs) != 1 || replica.keyIDs[0] != "arn:aws:kms:eu-west-1:123456789012:key/mrk-1234abcd12ab34cd56ef1234567890ab" {
+		t.Fatalf("expected a decrypt under the replica key ARN, got %v", replica.keyIDs)
+	}
+	if stats := manager.GetKeyStats(); stats["kms_replica_decrypts"] != int64(1) || stats["kms_replica_region"] != "eu-west-1" {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
+
+func TestDecryptDoesNotFailOverWhenKMSRefuses(t *testing.T) {
+	primary := newFakeKMS()
+	replica := &replicaKMS{fakeKMS: newFakeKMS(), primary: primary}
+	encoder, err := NewKMSManagerWithClient(primary, testMultiRegionKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	dataKey, _ := encoder.GetCurrentDataKey(context.Background())
+	manager, err := NewKMSManagerWithClient(primary, testMultiRegionKeyARN, time.Hour, time.Hour, WithReplicaRegion("eu-west-1", replica))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	// A refusal is the key's answer in every region
+	primary.mu.Lock()
+	primary.decryptErr = &types.DisabledException{Message: aws.String("key disabled")}
+	primary.mu.Unlock()
+	if _, err := manager.DecryptDataKey(context.Background(), dataKey.EncryptedKey, testMultiRegionKeyARN, dataKey.EncryptionContext); !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("expected ErrKeyUnavailable, got %v", err)
+	}
+	if len(replica.keyIDs) != 0 {
+		t.Fatalf("expected no replica decrypt, got %v", replica.keyIDs)
+	}
+}
+
+func TestReplicaKeyARN(t *testing.T) {
+	if got, ok := replicaKeyARN(testMultiRegionKeyARN, "eu-west-1"); !ok || got != "arn:aws:kms:eu-west-1:123456789012:key/mrk-1234abcd12ab34cd56ef1234567890ab" {
+		t.Fatalf("unexpected replica ARN %q", got)
+	}
+	// Single-Region keys and aliases have no replica
+	for _, keyARN := range []string{testKeyARN, "arn:aws:kms:us-east-1:123456789012:alias/mrk-codec", "mrk-1234"} {
+		if _, ok := replicaKeyARN(keyARN, "eu-west-1"); ok {
+			t.Fatalf("expected no replica ARN for %q", keyARN)
+		}
+	}
+}
+
+func TestIsRegionFailure(t *testing.T) {
+	tests := map[error]bool{
+		ErrKMSUnavailable:                   true,
+		ErrKMSTimeout:                       true,
+		&types.DependencyTimeoutException{}: true,
+		&types.KMSInternalException{}:       true,
+		&types.InvalidCiphertextException{}: false,
+		&types.NotFoundException{}:          false,
+		errors.New("AccessDeniedException"): false,
+	}
+	for err, want := range tests {
+		if got := isRegionFailure(err); got != want {
+			t.Errorf("isRegionFailure(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package kmscodec
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Field-level encryption replaces selected values of a JSON object with ciphertext
+// strings and leaves the rest of the document in plaintext. Each field is sealed
+// with its path as additional data, so ciphertexts can't be swapped between fields.
+
+// errFieldNotFound means a configured path is absent from the document
+var errFieldNotFound = errors.New("field not found")
+
+// EncryptedFieldsMetadataKey lists the comma separated paths encrypted in a field-level payload
+const EncryptedFieldsMetadataKey = "encrypted-fields"
+
+// ParseFieldPaths splits a comma separated list of dotted JSON paths
+func ParseFieldPaths(list string) []string {
+	var paths []string
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// EncryptFields encrypts the values at paths in a JSON object.
+// It returns the rewritten document and the paths that were present and encrypted.
+// Data that is not a JSON object is reported as an error so the caller can fall back.
+func EncryptFields(data []byte, paths []string, key []byte) ([]byte, []string, error) {
+	gcm, err := newFieldCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var document map[string]json.RawMessage
+	if err := unmarshalObject(data, &document); err != nil {
+		return nil, nil, err
+	}
+
+	var encrypted []string
+	for _, path := range paths {
+		err := updateField(document, strings.Split(path, "."), func(value json.RawMessage) (json.RawMessage, error) {
+			nonce := make([]byte, gcm.NonceSize())
+			if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+				return nil, err
+			}
+			sealed := gcm.Seal(nonce, nonce, value, []byte(path))
+			return json.Marshal(base64.StdEncoding.EncodeToString(sealed))
+		})
+		if errors.Is(err, errFieldNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("field %s: %w", path, err)
+		}
+		encrypted = append(encrypted, path)
+	}
+
+	output, err := json.Marshal(document)
+	if err != nil {
+		return nil, nil, err
+	}
+	return output, encrypted, nil
+}
+
+// DecryptFields reverses EncryptFields for the given paths
+func DecryptFields(data []byte, paths []string, key []byte) ([]byte, error) {
+	gcm, err := newFieldCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var document map[string]json.RawMessage
+	if err := unmarshalObject(data, &document); err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		err := updateField(document, strings.Split(path, "."), func(value json.RawMessage) (json.RawMessage, error) {
+			var encoded string
+			if err := json.Unmarshal(value, &encoded); err != nil {
+				return nil, fmt.Errorf("expected an encrypted string: %w", err)
+			}
+			sealed, err := decodeBase64(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("base64 decode failed: %w", err)
+			}
+			if len(sealed) < gcm.NonceSize() {
+				return nil, fmt.Errorf("ciphertext too short")
+			}
+			return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(path))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", path, err)
+		}
+	}
+
+	return json.Marshal(document)
+}
+
+func newFieldCipher(key []byte) (cipher.AEAD, error) {
+	if want := algorithmKeyLength(AlgorithmAES256GCMFields); len(key) != want {
+		return nil, fmt.Errorf("key must be %d bytes for %s", want, AlgorithmAES256GCMFields)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// unmarshalObject decodes a JSON object, keeping values raw so numbers and nested documents survive unchanged
+func unmarshalObject(data []byte, document *map[string]json.RawMessage) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return fmt.Errorf("payload is not a JSON object")
+	}
+	return json.Unmarshal(data, document)
+}
+
+// updateField replaces the value at path in document with fn's result
+func updateField(document map[string]json.RawMessage, path []string, fn func(json.RawMessage) (json.RawMessage, error)) error {
+	value, exists := document[path[0]]
+	if !exists {
+		return errFieldNotFound
+	}
+
+	if len(path) == 1 {
+		updated, err := fn(value)
+		if err != nil {
+			return err
+		}
+		document[path[0]] = updated
+		return nil
+	}
+
+	var nested map[string]json.RawMessage
+	if err := unmarshalObject(value, &nested); err != nil {
+		return errFieldNotFound
+	}
+	if err := updateField(nested, path[1:], fn); err != nil {
+		return err
+	}
+	updated, err := json.Marshal(nested)
+	if err != nil {
+		return err
+	}
+	document[path[0]] = updated
+	return nil
+}
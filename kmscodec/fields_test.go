@@ -0,0 +1,107 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncryptFieldsRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	original := `{"id":7,"name":"John","email":"john@example.com","address":{"zip":"10115","city":"Berlin"}}`
+
+	encrypted, fields, err := EncryptFields([]byte(original), []string{"email", "address.zip", "missing"}, key)
+	if err != nil {
+		t.Fatalf("EncryptFields: %v", err)
+	}
+	if !reflect.DeepEqual(fields, []string{"email", "address.zip"}) {
+		t.Fatalf("expected only present fields to be reported, got %v", fields)
+	}
+	for _, secret := range []string{"john@example.com", "10115"} {
+		if strings.Contains(string(encrypted), secret) {
+			t.Fatalf("expected %q to be encrypted: %s", secret, encrypted)
+		}
+	}
+	for _, visible := range []string{`"id":7`, `"name":"John"`, `"city":"Berlin"`} {
+		if !strings.Contains(string(encrypted), visible) {
+			t.Fatalf("expected %s to stay in plaintext: %s", visible, encrypted)
+		}
+	}
+
+	decrypted, err := DecryptFields(encrypted, fields, key)
+	if err != nil {
+		t.Fatalf("DecryptFields: %v", err)
+	}
+	var got, want interface{}
+	json.Unmarshal(decrypted, &got)
+	json.Unmarshal([]byte(original), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip mismatch:\n got: %s\nwant: %s", decrypted, original)
+	}
+}
+
+func TestDecryptFieldsRejectsSwappedCiphertexts(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+
+	encrypted, fields, err := EncryptFields([]byte(`{"email":"a@example.com","ssn":"123-45-6789"}`), []string{"email", "ssn"}, key)
+	if err != nil {
+		t.Fatalf("EncryptFields: %v", err)
+	}
+	var document map[string]json.RawMessage
+	json.Unmarshal(encrypted, &document)
+	document["email"], document["ssn"] = document["ssn"], document["email"]
+	swapped, _ := json.Marshal(document)
+
+	if _, err := DecryptFields(swapped, fields, key); err == nil {
+		t.Fatal("expected ciphertexts moved between fields to fail")
+	}
+}
+
+func TestEncryptFieldsRejectsNonObjects(t *testing.T) {
+	for _, data := range []string{`["email"]`, `"email"`, `not json`} {
+		if _, _, err := EncryptFields([]byte(data), []string{"email"}, bytes.Repeat([]byte{3}, 32)); err == nil {
+			t.Errorf("expected %s to be rejected", data)
+		}
+	}
+}
+
+func TestCodecFieldLevelEncryption(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	codec.encryptFields = []string{"email"}
+
+	encoded, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1,"email":"john@example.com"}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	if encoded.Algorithm != AlgorithmAES256GCMFields || encoded.Metadata[EncryptedFieldsMetadataKey] != "email" {
+		t.Fatalf("expected a field-level payload, got %+v", encoded)
+	}
+	document, _ := base64.StdEncoding.DecodeString(encoded.Data)
+	if !strings.Contains(string(document), `"id":1`) || strings.Contains(string(document), "john@example.com") {
+		t.Fatalf("expected only email to be encrypted: %s", document)
+	}
+
+	decoded, err := codec.decodePayload(context.Background(), encoded)
+	if err != nil {
+		t.Fatalf("decodePayload: %v", err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(decoded.Data)
+	if string(data) != `{"email":"john@example.com","id":1}` {
+		t.Fatalf("unexpected decoded data %s", data)
+	}
+
+	// Payloads without the field, or that are not JSON objects, are encrypted whole
+	for _, plain := range []string{`{"id":2}`, `[1,2,3]`} {
+		encoded, err := codec.encodePayload(context.Background(), plainPayload(plain))
+		if err != nil {
+			t.Fatalf("encodePayload: %v", err)
+		}
+		if encoded.Algorithm != AlgorithmAES256GCM {
+			t.Fatalf("expected whole-payload encryption for %s, got %s", plain, encoded.Algorithm)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFleetStatsTimeout bounds the /stats request to each peer behind /stats/fleet
+const DefaultFleetStatsTimeout = 2 * time.Second
+
+// fleetDNSPrefix marks a peer whose host name resolves to every replica, e.g. a headless service
+const fleetDNSPrefix = "dns+"
+
+// fleetSummedGauges are the /stats gauges that add up across replicas, next to statsCounters
+var fleetSummedGauges = map[string]bool{
+	"cached_keys_count":    true,
+	"negative_cached_keys": true,
+	"key_pool_size":        true,
+	"encode_dedup_entries": true,
+}
+
+// fleetStats polls the codec replicas' /stats for /stats/fleet
+type fleetStats struct {
+	peers      []string
+	client     *http.Client
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+// FleetInstanceStats is one replica's part of a /stats/fleet response
+type FleetInstanceStats struct {
+	Stats map[string]interface{} `json:"stats,omitempty"`
+	Error string                 `json:"error,omitempty"`
+}
+
+// FleetStats is the /stats/fleet response
+type FleetStats struct {
+	Replicas  int                           `json:"replicas"`
+	Reachable int                           `json:"reachable"`
+	Totals    map[string]float64            `json:"totals"`
+	Instances map[string]FleetInstanceStats `json:"instances"`
+}
+
+// ParseFleetPeers parses comma separated peer base URLs for /stats/fleet. A dns+ prefix, as in
+// dns+http://codec-headless:8081, makes every address the host name resolves to a peer.
+func ParseFleetPeers(spec string) ([]string, error) {
+	var peers []string
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parsed, err := url.Parse(strings.TrimPrefix(entry, fleetDNSPrefix))
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid fleet peer %q: want http(s)://host:port, optionally prefixed with %s", entry, fleetDNSPrefix)
+		}
+		peers = append(peers, strings.TrimSuffix(entry, "/"))
+	}
+	return peers, nil
+}
+
+// WithFleetStats serves /stats/fleet, merging the /stats of peers: every replica of the fleet,
+// this one included, as returned by ParseFleetPeers. Counters and the gauges that add up are
+// summed; each replica's full stats are returned alongside.
+func WithFleetStats(peers []string) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.fleet = &fleetStats{
+			peers:      peers,
+			client:     &http.Client{Timeout: DefaultFleetStatsTimeout},
+			lookupHost: net.DefaultResolver.LookupHost,
+		}
+	}
+}
+
+// instances resolves the peers to the base URLs of the replicas, keeping failed lookups as errors
+func (f *fleetStats) instances(ctx context.Context) ([]string, map[string]FleetInstanceStats) {
+	var urls []string
+	failed := make(map[string]FleetInstanceStats)
+	for _, peer := range f.peers {
+		if !strings.HasPrefix(peer, fleetDNSPrefix) {
+			urls = append(urls, peer)
+			continue
+		}
+		parsed, _ := url.Parse(strings.TrimPrefix(peer, fleetDNSPrefix))
+		addrs, err := f.lookupHost(ctx, parsed.Hostname())
+		if err != nil {
+			failed[peer] = FleetInstanceStats{Error: err.Error()}
+			continue
+		}
+		for _, addr := range addrs {
+			resolved := *parsed
+			resolved.Host = net.JoinHostPort(addr, parsed.Port())
+			if parsed.Port() == "" {
+				resolved.Host = addr
+				if strings.Contains(addr, ":") {
+					resolved.Host = "[" + addr + "]"
+				}
+			}
+			urls = append(urls, resolved.String())
+		}
+	}
+	slices.Sort(urls)
+	return slices.Compact(urls), failed
+}
+
+// collect fetches every replica's /stats concurrently and merges them
+func (f *fleetStats) collect(ctx context.Context) FleetStats {
+	urls, instances := f.instances(ctx)
+	results := make([]FleetInstanceStats, len(urls))
+	var wg sync.WaitGroup
+	for i, base := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats, err := f.fetch(ctx, base)
+			if err != nil {
+				log.Printf("Fleet stats from %s unavailable: %v", base, err)
+				results[i] = FleetInstanceStats{Error: err.Error()}
+				return
+			}
+			results[i] = FleetInstanceStats{Stats: stats}
+		}()
+	}
+	wg.Wait()
+
+	fleet := FleetStats{Totals: make(map[string]float64), Instances: instances}
+	for i, base := range urls {
+		fleet.Instances[base] = results[i]
+		if results[i].Stats == nil {
+			continue
+		}
+		fleet.Reachable++
+		for key, value := range results[i].Stats {
+			if number, ok := value.(float64); ok && (statsCounters[key] || fleetSummedGauges[key]) {
+				fleet.Totals[key] += number
+			}
+		}
+	}
+	fleet.Replicas = len(fleet.Instances)
+	return fleet
+}
+
+// fetch returns the /stats of the replica at base
+func (f *fleetStats) fetch(ctx context.Context, base string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("/stats returned %d", resp.StatusCode)
+	}
+	var stats map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("invalid /stats response: %w", err)
+	}
+	return stats, nil
+}
+
+// handleFleetStats handles the /stats/fleet endpoint, the merged /stats of the codec fleet
+func (c *KMSEncryptionCodec) handleFleetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.fleet == nil {
+		http.Error(w, "Fleet stats are not configured (FLEET_PEERS not set)", http.StatusNotFound)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "prometheus" {
+		http.Error(w, fmt.Sprintf("Unsupported format %q (use json or prometheus)", format), http.StatusBadRequest)
+		return
+	}
+
+	fleet := c.fleet.collect(r.Context())
+	if format == "prometheus" {
+		stats := map[string]interface{}{"fleet_replicas": fleet.Replicas, "fleet_reachable": fleet.Reachable}
+		for key, total := range fleet.Totals {
+			stats["fleet_"+key] = total
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheusStats(w, stats, nil, c.kmsManager.clock.Now())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(fleet); err != nil {
+		log.Printf("Failed to encode fleet stats response: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newStatsPeer serves a fixed /stats response, standing in for a codec replica
+func newStatsPeer(t *testing.T, stats map[string]interface{}) *httptest.Server {
+	t.Helper()
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stats" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(stats)
+	}))
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+func TestFleetStatsMergesPeers(t *testing.T) {
+	first := newStatsPeer(t, map[string]interface{}{
+		"cached_keys_count": 3, "kms_decrypts": 10, "forced_rotations": 1,
+		"max_payloads_per_request": 1000, "data_key_spec": "AES_256",
+	})
+	second := newStatsPeer(t, map[string]interface{}{
+		"cached_keys_count": 2, "kms_decrypts": 5, "current_key_hits": 7,
+		"max_payloads_per_request": 1000,
+	})
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	t.Cleanup(broken.Close)
+
+	codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), WithFleetStats([]string{first.URL, second.URL, broken.URL}))
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "")
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats/fleet", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var fleet FleetStats
+	if err := json.NewDecoder(rec.Body).Decode(&fleet); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if fleet.Replicas != 3 || fleet.Reachable != 2 {
+		t.Fatalf("expected 2 of 3 replicas reachable, got %d of %d", fleet.Reachable, fleet.Replicas)
+	}
+	want := map[string]float64{"cached_keys_count": 5, "kms_decrypts": 15, "forced_rotations": 1, "current_key_hits": 7}
+	if len(fleet.Totals) != len(want) {
+		t.Fatalf("unexpected totals %v", fleet.Totals)
+	}
+	for key, total := range want {
+		if fleet.Totals[key] != total {
+			t.Fatalf("expected %s total %v, got %v", key, total, fleet.Totals[key])
+		}
+	}
+	if fleet.Instances[first.URL].Stats["data_key_spec"] != "AES_256" || !strings.Contains(fleet.Instances[broken.URL].Error, "500") {
+		t.Fatalf("unexpected instances %+v", fleet.Instances)
+	}
+
+	// Per-instance /stats is untouched
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil || stats["replicas"] != nil {
+		t.Fatalf("unexpected /stats %v (%v)", stats, err)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats/fleet?format=prometheus", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "# TYPE temporal_codec_fleet_kms_decrypts counter\ntemporal_codec_fleet_kms_decrypts 15\n") ||
+		!strings.Contains(body, "temporal_codec_fleet_reachable 2\n") {
+		t.Fatalf("unexpected prometheus output:\n%s", body)
+	}
+}
+
+func TestFleetStatsResolvesDNSPeers(t *testing.T) {
+	peer := newStatsPeer(t, map[string]interface{}{"kms_decrypts": 4})
+	peerURL, _ := url.Parse(peer.URL)
+
+	peers, err := ParseFleetPeers("dns+http://codec-headless:" + peerURL.Port() + ", dns+http://missing:8081")
+	if err != nil {
+		t.Fatalf("ParseFleetPeers: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), WithFleetStats(peers))
+	codec.fleet.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host == "codec-headless" {
+			// Two records for the same replica count once
+			return []string{peerURL.Hostname(), peerURL.Hostname()}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	fleet := codec.fleet.collect(context.Background())
+	if fleet.Replicas != 2 || fleet.Reachable != 1 || fleet.Totals["kms_decrypts"] != 4 {
+		t.Fatalf("unexpected fleet stats %+v", fleet)
+	}
+	if fleet.Instances["dns+http://missing:8081"].Error == "" {
+		t.Fatalf("expected the failed lookup to be reported, got %+v", fleet.Instances)
+	}
+}
+
+func TestParseFleetPeersRejectsInvalidPeers(t *testing.T) {
+	for _, spec := range []string{"codec-1:8081", "ftp://codec-1", "dns+codec-1"} {
+		if _, err := ParseFleetPeers(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
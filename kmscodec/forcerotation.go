@@ -0,0 +1,53 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrForcedRotationDisabled is returned when an encode request asks for a new key but forced rotations are disabled
+var ErrForcedRotationDisabled = errors.New("forced data key rotation is disabled")
+
+// ErrForcedRotationRateLimited is returned when a forced rotation comes too soon after the previous one
+var ErrForcedRotationRateLimited = errors.New("forced data key rotation rate limited")
+
+// WithForcedRotationInterval enables rotations forced by encode requests with force_new_key,
+// at most one per interval. Requests sooner than that are refused rather than queued, so a
+// client can't make the codec call GenerateDataKey in a loop. Forced rotations are disabled
+// unless this is set; zero or less keeps them disabled.
+func WithForcedRotationInterval(interval time.Duration) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.forceRotateInterval = interval
+	}
+}
+
+// ForceRotation replaces the current data key ahead of schedule, for testing and canaries that
+// need payloads under distinct keys. At most one forced rotation happens per interval; a
+// failed rotation still uses up the slot, so a failing KMS isn't retried at request rate.
+// Scheduled rotations are not limited. It returns the fingerprint of the new key.
+func (k *KMSManager) ForceRotation(ctx context.Context) (string, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	if k.forceRotateInterval <= 0 {
+		return "", ErrForcedRotationDisabled
+	}
+	now := k.clock.Now()
+	if !k.lastForcedRotation.IsZero() {
+		if wait := k.lastForcedRotation.Add(k.forceRotateInterval).Sub(now); wait > 0 {
+			return "", fmt.Errorf("%w: retry in %v", ErrForcedRotationRateLimited, wait.Round(time.Second))
+		}
+	}
+	k.lastForcedRotation = now
+
+	if err := k.rotateDataKeyLocked(ctx); err != nil {
+		return "", fmt.Errorf("failed to rotate the data key: %w", err)
+	}
+	k.forcedRotations.Add(1)
+	fingerprint := KeyFingerprint(k.currentDataKey.EncryptedKey)
+	log.Printf("Forced data key rotation, now encrypting with %s", fingerprint)
+	return fingerprint, nil
+}
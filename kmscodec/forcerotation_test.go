@@ -0,0 +1,86 @@
+package kmscodec
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestForceNewKeyEncodesUnderDistinctKeys(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock), WithForcedRotationInterval(time.Minute))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+
+	encode := func(force bool) *shared.PayloadData {
+		rec := doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+			Payloads:    []shared.PayloadData{plainPayload(`{"v":1}`)},
+			ForceNewKey: force,
+		})
+		if rec.Code != http.StatusOK {
+			return nil
+		}
+		return &decodeCodecResponse(t, rec).Payloads[0]
+	}
+
+	first := encode(false)
+	forced := encode(true)
+	if forced == nil || forced.EncryptedDataKey == first.EncryptedDataKey {
+		t.Fatal("expected force_new_key to encrypt under a new data key")
+	}
+	if generate, _ := fake.calls(); generate != 2 {
+		t.Fatalf("expected 1 extra GenerateDataKey call, got %d in total", generate)
+	}
+
+	// A second forced rotation within the interval is refused, and the key is left alone
+	rec := doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{plainPayload(`{}`)}, ForceNewKey: true})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if generate, _ := fake.calls(); generate != 2 {
+		t.Fatalf("expected no KMS call for a rate limited request, got %d in total", generate)
+	}
+	if next := encode(false); next.EncryptedDataKey != forced.EncryptedDataKey {
+		t.Fatal("expected unforced encodes to keep using the forced key")
+	}
+
+	clock.Advance(time.Minute)
+	if again := encode(true); again == nil || again.EncryptedDataKey == forced.EncryptedDataKey {
+		t.Fatal("expected a forced rotation once the interval has passed")
+	}
+
+	// Payloads under the earlier keys still decode
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{*first, *forced},
+	}))
+	for _, payload := range decoded.Payloads {
+		if data, _ := decodeBase64(payload.Data); string(data) != `{"v":1}` {
+			t.Fatalf("unexpected plaintext %q", data)
+		}
+	}
+	if stats := manager.GetKeyStats(); stats["forced_rotations"] != int64(2) {
+		t.Fatalf("expected 2 forced rotations in stats, got %v", stats["forced_rotations"])
+	}
+}
+
+func TestForceNewKeyDisabledByDefault(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+
+	rec := doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{plainPayload(`{}`)}, ForceNewKey: true})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	if generate, _ := fake.calls(); generate != 1 {
+		t.Fatalf("expected only the initial GenerateDataKey call, got %d", generate)
+	}
+}
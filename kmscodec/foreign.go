@@ -0,0 +1,110 @@
+package kmscodec
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"temporal-key-rotation/shared"
+)
+
+// Foreign encryption policies: what encode does with a payload another system already encrypted
+const (
+	ForeignEncryptionOff    = "off"    // no detection; such payloads are encrypted if they look like JSON
+	ForeignEncryptionSkip   = "skip"   // return them unchanged
+	ForeignEncryptionReject = "reject" // fail the request with 400
+)
+
+// DefaultForeignEncryptionMarkers are the metadata signatures of the encryption codec from the
+// Temporal samples, the usual other codec in a chain
+const DefaultForeignEncryptionMarkers = "encryption-key-id=*,encoding=binary/encrypted"
+
+// MetadataMarker matches payloads whose metadata has Key set to Value, or to anything for "*"
+type MetadataMarker struct {
+	Key   string
+	Value string
+}
+
+func (m MetadataMarker) String() string {
+	return m.Key + "=" + m.Value
+}
+
+func (m MetadataMarker) matches(metadata map[string]string) bool {
+	value, ok := metadata[m.Key]
+	return ok && (m.Value == policyAnyValue || value == m.Value)
+}
+
+// ParseForeignEncryptionMarkers parses comma separated key=value metadata signatures, e.g.
+// "encryption-key-id=*,encoding=binary/x-vault". A key alone matches any value.
+func ParseForeignEncryptionMarkers(spec string) ([]MetadataMarker, error) {
+	var markers []MetadataMarker
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, value, hasValue := strings.Cut(entry, "=")
+		if !hasValue {
+			value = policyAnyValue
+		}
+		if key == "" || value == "" {
+			return nil, fmt.Errorf("invalid foreign encryption marker %q: want key[=value]", entry)
+		}
+		markers = append(markers, MetadataMarker{Key: key, Value: value})
+	}
+	return markers, nil
+}
+
+// ParseForeignEncryptionPolicy validates a foreign encryption policy name; empty means off
+func ParseForeignEncryptionPolicy(policy string) (string, error) {
+	switch policy {
+	case "", ForeignEncryptionOff:
+		return ForeignEncryptionOff, nil
+	case ForeignEncryptionSkip, ForeignEncryptionReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown foreign encryption policy %q (use %s, %s or %s)", policy, ForeignEncryptionOff, ForeignEncryptionSkip, ForeignEncryptionReject)
+}
+
+// WithForeignEncryption makes encode look for payloads already encrypted by another system,
+// recognized by any of markers in their metadata, and skip or reject them instead of wrapping
+// them again. Payloads this codec produced are never taken for foreign ones.
+func WithForeignEncryption(policy string, markers []MetadataMarker) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.foreignPolicy = policy
+		c.foreignMarkers = markers
+	}
+}
+
+// foreignMarker returns the marker payload matches if another system encrypted it
+func (c *KMSEncryptionCodec) foreignMarker(payload shared.PayloadData) (MetadataMarker, bool) {
+	if c.foreignPolicy == "" || c.foreignPolicy == ForeignEncryptionOff || shared.IsControlEncoding(payload.Metadata["encoding"]) {
+		return MetadataMarker{}, false
+	}
+	// Our own payloads carry an envelope, a scheme or a pipeline record; encode passes them through
+	if payload.EncryptedDataKey != "" || payload.Metadata[SchemeMetadataKey] != "" || payload.Metadata[TransformsMetadataKey] != "" {
+		return MetadataMarker{}, false
+	}
+	for _, marker := range c.foreignMarkers {
+		if marker.matches(payload.Metadata) {
+			return marker, true
+		}
+	}
+	return MetadataMarker{}, false
+}
+
+// checkForeignEncryption applies the foreign encryption policy to payload, reporting whether
+// encode should return it unchanged
+func (c *KMSEncryptionCodec) checkForeignEncryption(payload shared.PayloadData) (skip bool, err error) {
+	marker, ok := c.foreignMarker(payload)
+	if !ok {
+		return false, nil
+	}
+	if c.foreignPolicy == ForeignEncryptionReject {
+		c.foreignRejected.Add(1)
+		log.Printf("Rejected payload already encrypted by another system (%s)", marker)
+		return false, &codecError{http.StatusBadRequest, fmt.Sprintf("Payload is already encrypted by another system (metadata %s); refusing to encrypt it again", marker), nil}
+	}
+	c.foreignSkipped.Add(1)
+	return true, nil
+}
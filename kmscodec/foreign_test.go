@@ -0,0 +1,103 @@
+package kmscodec
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+// foreignPayload is a payload as the encryption codec from the Temporal samples produces it
+func foreignPayload() shared.PayloadData {
+	return shared.PayloadData{
+		Metadata: map[string]string{"encoding": "binary/encrypted", "encryption-key-id": "test-key"},
+		Data:     base64.StdEncoding.EncodeToString([]byte("sealed elsewhere")),
+	}
+}
+
+func newForeignTestCodec(t *testing.T, policy string) *KMSEncryptionCodec {
+	t.Helper()
+	markers, err := ParseForeignEncryptionMarkers(DefaultForeignEncryptionMarkers + ",x-vault-key")
+	if err != nil {
+		t.Fatalf("ParseForeignEncryptionMarkers: %v", err)
+	}
+	return NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), WithForeignEncryption(policy, markers))
+}
+
+func TestForeignEncryptionSkip(t *testing.T) {
+	codec := newForeignTestCodec(t, ForeignEncryptionSkip)
+
+	// Labelled JSON, but the marker says another system encrypted it
+	vaulted := plainPayload(`"vault:v1:abc"`)
+	vaulted.Metadata["x-vault-key"] = "orders"
+	payloads := []shared.PayloadData{foreignPayload(), vaulted, plainPayload(`{"order":1}`)}
+
+	resp := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: payloads}))
+	for i, payload := range resp.Payloads[:2] {
+		if payload.EncryptedDataKey != "" || payload.Data != payloads[i].Data {
+			t.Fatalf("expected foreign payload %d to be returned unchanged, got %+v", i, payload)
+		}
+	}
+	if resp.Payloads[2].EncryptedDataKey == "" {
+		t.Fatal("expected the plain payload to be encrypted")
+	}
+
+	// Our own payloads are never mistaken for foreign ones, whatever their encoding
+	again := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: resp.Payloads[2:]}))
+	if again.Payloads[0].Data != resp.Payloads[2].Data {
+		t.Fatal("expected an encrypted payload to pass through encode")
+	}
+	if skipped := codec.foreignSkipped.Load(); skipped != 2 {
+		t.Fatalf("expected 2 skipped payloads, got %d", skipped)
+	}
+}
+
+func TestForeignEncryptionReject(t *testing.T) {
+	codec := newForeignTestCodec(t, ForeignEncryptionReject)
+
+	rec := doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"order":1}`), foreignPayload()},
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "already encrypted by another system") || !strings.Contains(rec.Body.String(), "encryption-key-id=*") {
+		t.Fatalf("expected the matching marker in the error, got %q", rec.Body.String())
+	}
+	if rejected := codec.foreignRejected.Load(); rejected != 1 {
+		t.Fatalf("expected 1 rejected payload, got %d", rejected)
+	}
+
+	// Plain payloads are still encrypted
+	resp := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"order":1}`)},
+	}))
+	if resp.Payloads[0].EncryptedDataKey == "" {
+		t.Fatal("expected the plain payload to be encrypted")
+	}
+}
+
+func TestParseForeignEncryptionSettings(t *testing.T) {
+	markers, err := ParseForeignEncryptionMarkers(" encryption-key-id , encoding=binary/x-vault ")
+	if err != nil {
+		t.Fatalf("ParseForeignEncryptionMarkers: %v", err)
+	}
+	want := []MetadataMarker{{Key: "encryption-key-id", Value: "*"}, {Key: "encoding", Value: "binary/x-vault"}}
+	if len(markers) != len(want) || markers[0] != want[0] || markers[1] != want[1] {
+		t.Fatalf("unexpected markers %+v", markers)
+	}
+	for _, spec := range []string{"=x", "encoding="} {
+		if _, err := ParseForeignEncryptionMarkers(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+
+	if policy, err := ParseForeignEncryptionPolicy(""); err != nil || policy != ForeignEncryptionOff {
+		t.Fatalf("expected an empty policy to mean off, got %q, %v", policy, err)
+	}
+	if _, err := ParseForeignEncryptionPolicy("drop"); err == nil {
+		t.Fatal("expected an unknown policy to be rejected")
+	}
+}
@@ -0,0 +1,104 @@
+package kmscodec
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"temporal-key-rotation/shared"
+)
+
+// PinnedDecodeRequest asks for payloads to be decoded with a given encrypted data key in place
+// of the one each payload embeds, to test whether a payload was encrypted under another key
+type PinnedDecodeRequest struct {
+	EncryptedDataKey string               `json:"encrypted_data_key"`
+	KMSKeyID         string               `json:"kms_key_id,omitempty"` // also overrides the master key when set
+	Payloads         []shared.PayloadData `json:"payloads"`
+}
+
+// PinnedDecodeResult is the outcome for one payload: the decoded payload, or the status and
+// error decode returned with the pinned key
+type PinnedDecodeResult struct {
+	EmbeddedFingerprint string              `json:"embedded_fingerprint"`
+	Payload             *shared.PayloadData `json:"payload,omitempty"`
+	Status              int                 `json:"status"`
+	Error               string              `json:"error,omitempty"`
+}
+
+// PinnedDecodeResponse is the /decode/pinned response, with one result per payload in request order
+type PinnedDecodeResponse struct {
+	PinnedFingerprint string               `json:"pinned_fingerprint"`
+	Results           []PinnedDecodeResult `json:"results"`
+}
+
+// handlePinnedDecode handles the /decode/pinned admin endpoint. Every payload is decoded through
+// the usual path with its encrypted data key replaced by the pinned one, so the data key still
+// comes from DecryptDataKey and revocation, grants and the envelope checks all apply. A failure
+// is reported for its payload instead of failing the request, since a payload the pinned key
+// can't decrypt is an answer, not an error. Every use is logged.
+func (c *KMSEncryptionCodec) handlePinnedDecode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PinnedDecodeRequest
+	if err := shared.DecodeJSON(r.Body, &req, c.strictJSON); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.EncryptedDataKey == "" {
+		http.Error(w, "encrypted_data_key is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := decodeBase64(req.EncryptedDataKey); err != nil {
+		http.Error(w, "encrypted_data_key is not valid base64", http.StatusBadRequest)
+		return
+	}
+	if !c.checkBatchSize(w, shared.CodecRequest{Payloads: req.Payloads}) {
+		return
+	}
+
+	response := PinnedDecodeResponse{
+		PinnedFingerprint: KeyFingerprint(req.EncryptedDataKey),
+		Results:           make([]PinnedDecodeResult, len(req.Payloads)),
+	}
+	log.Printf("Pinned decode of %d payloads with data key %s (master key override %q) requested from %s",
+		len(req.Payloads), response.PinnedFingerprint, req.KMSKeyID, r.RemoteAddr)
+
+	for i, payload := range req.Payloads {
+		result := &response.Results[i]
+		if payload.EncryptedDataKey != "" {
+			result.EmbeddedFingerprint = KeyFingerprint(payload.EncryptedDataKey)
+		}
+		if encoding := payload.Metadata["encoding"]; encoding != "binary/encrypted" && encoding != SignedEncoding {
+			result.Status = http.StatusBadRequest
+			result.Error = "Payload is not encrypted or signed"
+			continue
+		}
+
+		payload.EncryptedDataKey = req.EncryptedDataKey
+		if req.KMSKeyID != "" {
+			payload.KMSKeyID = req.KMSKeyID
+		}
+		decoded, err := c.pipeline.Decode(r.Context(), payload)
+		if err != nil {
+			result.Status, result.Error = http.StatusInternalServerError, "Decode failed"
+			var ce *codecError
+			if errors.As(err, &ce) {
+				result.Status, result.Error = ce.status, ce.message
+			}
+		} else {
+			result.Status, result.Payload = http.StatusOK, &decoded
+			c.auditDecoded(r, AuditEventPinnedDecode, []shared.PayloadData{payload}, []shared.PayloadData{decoded})
+		}
+		log.Printf("Pinned decode of payload %d (embedded key %s) with data key %s: %d %s",
+			i, result.EmbeddedFingerprint, response.PinnedFingerprint, result.Status, result.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Failed to encode pinned decode response: %v", err)
+	}
+}
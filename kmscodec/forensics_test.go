@@ -0,0 +1,127 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func doPinnedDecode(t *testing.T, handler http.Handler, req PinnedDecodeRequest) PinnedDecodeResponse {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest(http.MethodPost, "/decode/pinned", bytes.NewReader(body))
+	httpReq.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httpReq)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp PinnedDecodeResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return resp
+}
+
+func TestPinnedDecodeOverridesEmbeddedKey(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "secret")
+
+	first := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	second := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":2}`)},
+	})).Payloads[0]
+
+	// A mis-encrypted payload: its data was encrypted under the second key but it names the first
+	confused := second
+	confused.EncryptedDataKey = first.EncryptedDataKey
+	if rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{confused}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the confused payload to fail a normal decode, got %d", rec.Code)
+	}
+
+	resp := doPinnedDecode(t, mux, PinnedDecodeRequest{
+		EncryptedDataKey: second.EncryptedDataKey,
+		Payloads:         []shared.PayloadData{confused, first},
+	})
+	if resp.PinnedFingerprint != KeyFingerprint(second.EncryptedDataKey) || len(resp.Results) != 2 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	decoded := resp.Results[0]
+	if decoded.Status != http.StatusOK || decoded.Payload == nil || decoded.EmbeddedFingerprint != KeyFingerprint(first.EncryptedDataKey) {
+		t.Fatalf("expected the pinned key to decode the confused payload, got %+v", decoded)
+	}
+	if data, _ := decodeBase64(decoded.Payload.Data); string(data) != `{"v":2}` {
+		t.Fatalf("unexpected plaintext %q", data)
+	}
+
+	// The first payload really is under the first key, so the pinned key can't open it
+	if wrong := resp.Results[1]; wrong.Status != http.StatusBadRequest || wrong.Payload != nil || wrong.Error == "" {
+		t.Fatalf("expected the pinned key to fail on the other payload, got %+v", wrong)
+	}
+}
+
+func TestPinnedDecodeHonorsRevocation(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	if err := codec.kmsManager.RevokeDataKey(context.Background(), KeyFingerprint(encoded.EncryptedDataKey)); err != nil {
+		t.Fatalf("RevokeDataKey: %v", err)
+	}
+
+	resp := doPinnedDecode(t, http.HandlerFunc(codec.handlePinnedDecode), PinnedDecodeRequest{
+		EncryptedDataKey: encoded.EncryptedDataKey,
+		Payloads:         []shared.PayloadData{encoded},
+	})
+	if resp.Results[0].Status != http.StatusForbidden {
+		t.Fatalf("expected a revoked pinned key to be refused, got %+v", resp.Results[0])
+	}
+}
+
+func TestPinnedDecodeRejectsInvalidRequests(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "secret")
+
+	cases := map[string]struct {
+		body   string
+		header string
+		want   int
+	}{
+		"no token":     {`{"encrypted_data_key":"a2V5","payloads":[]}`, "", http.StatusUnauthorized},
+		"missing key":  {`{"payloads":[]}`, "Bearer secret", http.StatusBadRequest},
+		"invalid key":  {`{"encrypted_data_key":"not base64!","payloads":[]}`, "Bearer secret", http.StatusBadRequest},
+		"invalid JSON": {`{`, "Bearer secret", http.StatusBadRequest},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/decode/pinned", bytes.NewReader([]byte(tc.body)))
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, rec.Code)
+			}
+		})
+	}
+
+	// Plaintext payloads are reported, not decoded
+	resp := doPinnedDecode(t, mux, PinnedDecodeRequest{EncryptedDataKey: "a2V5", Payloads: []shared.PayloadData{plainPayload(`{}`)}})
+	if resp.Results[0].Status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a plaintext payload, got %+v", resp.Results[0])
+	}
+}
@@ -0,0 +1,213 @@
+package kmscodec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// AES-GCM-SIV (RFC 8452) is a nonce-misuse-resistant AEAD: encrypting twice under the same
+// key and nonce only reveals whether the two plaintexts were equal, where plain GCM would
+// leak their XOR and the authentication key. The standard library and x/crypto don't provide it;
+// github.com/secure-io/siv-go does, and its siv.NewGCM is meant to replace this implementation
+// once that module can be added to go.mod. Until then this is a small implementation checked
+// against the RFC 8452 test vectors, which stay as the cross-check for the swap. newGCMSIV is its
+// only entry point and the payload format is the RFC's, so swapping it changes no payload.
+// POLYVAL is computed bit by bit with masks instead of branches, so its timing does not depend
+// on the key or the data, at the cost of being markedly slower than hardware-accelerated GCM.
+
+const (
+	gcmSIVNonceSize = 12
+	gcmSIVTagSize   = 16
+)
+
+var errGCMSIVOpen = errors.New("cipher: message authentication failed")
+
+// gcmSIV implements cipher.AEAD for AES-256-GCM-SIV
+type gcmSIV struct {
+	block cipher.Block // key-generating key
+}
+
+// newGCMSIV returns AES-GCM-SIV with a 32-byte key-generating key
+func newGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes for AES-256-GCM-SIV")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmSIV{block: block}, nil
+}
+
+func (g *gcmSIV) NonceSize() int { return gcmSIVNonceSize }
+func (g *gcmSIV) Overhead() int  { return gcmSIVTagSize }
+
+// deriveKeys derives the per-nonce POLYVAL and AES-256 keys (RFC 8452 section 4)
+func (g *gcmSIV) deriveKeys(nonce []byte) (authKey [16]byte, encBlock cipher.Block) {
+	var derived [48]byte
+	var in, out [16]byte
+	copy(in[4:], nonce)
+	for i := range 6 {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		g.block.Encrypt(out[:], in[:])
+		copy(derived[i*8:], out[:8])
+	}
+	copy(authKey[:], derived[:16])
+	encBlock, _ = aes.NewCipher(derived[16:48]) // always 32 bytes
+	clear(derived[:])
+	return authKey, encBlock
+}
+
+// tag computes the authentication tag of plaintext and additionalData
+func (g *gcmSIV) tag(authKey [16]byte, encBlock cipher.Block, nonce, plaintext, additionalData []byte) [16]byte {
+	var p polyval
+	p.init(authKey)
+	p.update(additionalData)
+	p.update(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	encBlock.Encrypt(s[:], s[:])
+	return s
+}
+
+// ctr XORs in with the keystream starting at the counter block derived from tag
+func ctr(encBlock cipher.Block, tag [16]byte, out, in []byte) {
+	counter := tag
+	counter[15] |= 0x80
+	var keystream [16]byte
+	for len(in) > 0 {
+		encBlock.Encrypt(keystream[:], counter[:])
+		n := subtle.XORBytes(out, in, keystream[:])
+		out, in = out[n:], in[n:]
+		binary.LittleEndian.PutUint32(counter[:4], binary.LittleEndian.Uint32(counter[:4])+1)
+	}
+}
+
+func (g *gcmSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("cipher: incorrect nonce length given to GCM-SIV")
+	}
+	authKey, encBlock := g.deriveKeys(nonce)
+	tag := g.tag(authKey, encBlock, nonce, plaintext, additionalData)
+
+	ret, out := sliceForAppend(dst, len(plaintext)+gcmSIVTagSize)
+	ctr(encBlock, tag, out, plaintext)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("cipher: incorrect nonce length given to GCM-SIV")
+	}
+	if len(ciphertext) < gcmSIVTagSize {
+		return nil, errGCMSIVOpen
+	}
+	var tag [16]byte
+	copy(tag[:], ciphertext[len(ciphertext)-gcmSIVTagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-gcmSIVTagSize]
+
+	authKey, encBlock := g.deriveKeys(nonce)
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	ctr(encBlock, tag, out, ciphertext)
+
+	expected := g.tag(authKey, encBlock, nonce, out, additionalData)
+	if subtle.ConstantTimeCompare(expected[:], tag[:]) != 1 {
+		clear(out)
+		return nil, errGCMSIVOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the new tail
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	head = append(in, make([]byte, n)...)
+	return head, head[len(in):]
+}
+
+// polyval accumulates POLYVAL (RFC 8452 section 3) over zero-padded 16-byte blocks.
+// It uses the GHASH equivalence from RFC 8452 appendix A: POLYVAL is GHASH over
+// byte-reversed blocks with the key multiplied by x.
+type polyval struct {
+	h   ghashElement
+	acc ghashElement
+}
+
+// ghashElement is a GF(2^128) element in GHASH bit order, hi holding the first 8 bytes
+type ghashElement struct {
+	hi, lo uint64
+}
+
+// reversedElement reads a 16-byte POLYVAL block as a GHASH element
+func reversedElement(block []byte) ghashElement {
+	var reversed [16]byte
+	for i := range 16 {
+		reversed[i] = block[15-i]
+	}
+	return ghashElement{binary.BigEndian.Uint64(reversed[:8]), binary.BigEndian.Uint64(reversed[8:])}
+}
+
+// mulX multiplies by x in GHASH's reflected representation. The reduction is masked
+// rather than branched on, so it runs in constant time.
+func (e ghashElement) mulX() ghashElement {
+	mask := -(e.lo & 1) // all ones when the bit shifted out is set
+	e.lo = e.lo>>1 | e.hi<<63
+	e.hi = e.hi>>1 ^ 0xe1<<56&mask
+	return e
+}
+
+// mul is GCM multiplication (NIST SP 800-38D algorithm 1). Every bit of e selects whether v is
+// added through a mask, so the running time is the same for every key and input.
+func (e ghashElement) mul(y ghashElement) ghashElement {
+	var z ghashElement
+	v := y
+	for _, word := range [2]uint64{e.hi, e.lo} {
+		for bit := 63; bit >= 0; bit-- {
+			mask := -(word >> uint(bit) & 1)
+			z.hi ^= v.hi & mask
+			z.lo ^= v.lo & mask
+			v = v.mulX()
+		}
+	}
+	return z
+}
+
+func (p *polyval) init(key [16]byte) {
+	p.h = reversedElement(key[:]).mulX()
+	p.acc = ghashElement{}
+}
+
+// update absorbs data, zero-padding it to a whole number of blocks
+func (p *polyval) update(data []byte) {
+	for len(data) > 0 {
+		var block [16]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		x := reversedElement(block[:])
+		p.acc.hi ^= x.hi
+		p.acc.lo ^= x.lo
+		p.acc = p.acc.mul(p.h)
+	}
+}
+
+// sum returns the POLYVAL value in its own byte order
+func (p *polyval) sum() [16]byte {
+	var be, out [16]byte
+	binary.BigEndian.PutUint64(be[:8], p.acc.hi)
+	binary.BigEndian.PutUint64(be[8:], p.acc.lo)
+	for i := range 16 {
+		out[i] = be[15-i]
+	}
+	return out
+}
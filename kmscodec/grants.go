@@ -0,0 +1,175 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// Lifetime bounds for decrypt grants
+const (
+	DefaultGrantTTL = time.Hour
+	MaxGrantTTL     = 24 * time.Hour
+)
+
+// DefaultGrantRetirementInterval is how often expired decrypt grants are looked for and retired
+const DefaultGrantRetirementInterval = 5 * time.Minute
+
+// decryptGrantNamePrefix names the grants made by CreateDecryptGrant; the name ends in the
+// expiry as Unix seconds, so retirement needs no state and survives restarts
+const decryptGrantNamePrefix = "temporal-codec-decrypt-"
+
+// KeyGranter is implemented by KMS clients that can manage grants, such as *kms.Client
+type KeyGranter interface {
+	CreateGrant(ctx context.Context, params *kms.CreateGrantInput, optFns ...func(*kms.Options)) (*kms.CreateGrantOutput, error)
+	RetireGrant(ctx context.Context, params *kms.RetireGrantInput, optFns ...func(*kms.Options)) (*kms.RetireGrantOutput, error)
+	ListGrants(ctx context.Context, params *kms.ListGrantsInput, optFns ...func(*kms.Options)) (*kms.ListGrantsOutput, error)
+}
+
+// errGrantsUnsupported reports a KMS client that cannot manage grants
+var errGrantsUnsupported = errors.New("KMS client does not support grants")
+
+// DecryptGrant is a time-boxed grant letting one principal decrypt data keys under the CMK
+type DecryptGrant struct {
+	GrantID          string    `json:"grant_id"`
+	GrantToken       string    `json:"grant_token"` // usable before the grant has propagated
+	GranteePrincipal string    `json:"grantee_principal"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+func (k *KMSManager) granter() (KeyGranter, error) {
+	granter, ok := k.client.(KeyGranter)
+	if !ok {
+		return nil, errGrantsUnsupported
+	}
+	return granter, nil
+}
+
+// CreateDecryptGrant grants granteePrincipal permission to call Decrypt, and nothing else,
+// with the CMK for ttl (DefaultGrantTTL if zero, at most MaxGrantTTL). KMS grants do not
+// expire by themselves; RetireExpiredGrants retires the grant once ttl has passed.
+func (k *KMSManager) CreateDecryptGrant(ctx context.Context, granteePrincipal string, ttl time.Duration) (*DecryptGrant, error) {
+	granter, err := k.granter()
+	if err != nil {
+		return nil, err
+	}
+	if granteePrincipal == "" {
+		return nil, errors.New("grantee principal is required")
+	}
+	if ttl == 0 {
+		ttl = DefaultGrantTTL
+	}
+	if ttl < 0 || ttl > MaxGrantTTL {
+		return nil, fmt.Errorf("grant TTL must be between 0 and %v", MaxGrantTTL)
+	}
+
+	expiresAt := k.clock.Now().Add(ttl).Truncate(time.Second)
+	result, err := granter.CreateGrant(ctx, &kms.CreateGrantInput{
+		KeyId:            aws.String(k.keyID),
+		GranteePrincipal: aws.String(granteePrincipal),
+		Operations:       []types.GrantOperation{types.GrantOperationDecrypt},
+		Name:             aws.String(decryptGrantNamePrefix + strconv.FormatInt(expiresAt.Unix(), 10)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create grant: %w", err)
+	}
+
+	grant := &DecryptGrant{
+		GrantID:          aws.ToString(result.GrantId),
+		GrantToken:       aws.ToString(result.GrantToken),
+		GranteePrincipal: granteePrincipal,
+		ExpiresAt:        expiresAt,
+	}
+	log.Printf("Created decrypt grant %s for %s, expires %s", grant.GrantID, granteePrincipal, expiresAt.Format(time.RFC3339))
+	return grant, nil
+}
+
+// RetireGrant retires a grant on the CMK, ending the grantee's access at once
+func (k *KMSManager) RetireGrant(ctx context.Context, grantID string) error {
+	granter, err := k.granter()
+	if err != nil {
+		return err
+	}
+	if _, err := granter.RetireGrant(ctx, &kms.RetireGrantInput{
+		KeyId:   aws.String(k.keyID),
+		GrantId: aws.String(grantID),
+	}); err != nil {
+		return fmt.Errorf("failed to retire grant %s: %w", grantID, err)
+	}
+	log.Printf("Retired grant %s", grantID)
+	return nil
+}
+
+// RetireExpiredGrants retires the decrypt grants made by CreateDecryptGrant whose TTL has
+// passed and returns how many it retired. Grants made any other way are left alone.
+func (k *KMSManager) RetireExpiredGrants(ctx context.Context) (int, error) {
+	granter, err := k.granter()
+	if err != nil {
+		return 0, err
+	}
+
+	now := k.clock.Now()
+	retired := 0
+	input := &kms.ListGrantsInput{KeyId: aws.String(k.keyID)}
+	for {
+		page, err := granter.ListGrants(ctx, input)
+		if err != nil {
+			return retired, fmt.Errorf("failed to list grants: %w", err)
+		}
+		for _, grant := range page.Grants {
+			expiresAt, ok := decryptGrantExpiry(aws.ToString(grant.Name))
+			if !ok || now.Before(expiresAt) {
+				continue
+			}
+			if err := k.RetireGrant(ctx, aws.ToString(grant.GrantId)); err != nil {
+				return retired, err
+			}
+			retired++
+		}
+		if !page.Truncated {
+			return retired, nil
+		}
+		input.Marker = page.NextMarker
+	}
+}
+
+// decryptGrantExpiry parses the expiry from a CreateDecryptGrant grant name
+func decryptGrantExpiry(name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, decryptGrantNamePrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(suffix, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// StartGrantRetirement retires expired decrypt grants every interval until Close is called
+func (k *KMSManager) StartGrantRetirement(interval time.Duration) {
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := k.RetireExpiredGrants(context.Background()); err != nil {
+					log.Printf("Failed to retire expired grants: %v", err)
+				}
+			case <-k.stopCh:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,201 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// grantingKMS is a fakeKMS that also manages grants, returning one grant per ListGrants page
+type grantingKMS struct {
+	*fakeKMS
+	grantMu sync.Mutex
+	grants  []types.GrantListEntry
+	nextID  int
+}
+
+func (g *grantingKMS) CreateGrant(ctx context.Context, params *kms.CreateGrantInput, optFns ...func(*kms.Options)) (*kms.CreateGrantOutput, error) {
+	g.grantMu.Lock()
+	defer g.grantMu.Unlock()
+	g.nextID++
+	id := fmt.Sprintf("grant-%d", g.nextID)
+	g.grants = append(g.grants, types.GrantListEntry{
+		GrantId:          aws.String(id),
+		Name:             params.Name,
+		GranteePrincipal: params.GranteePrincipal,
+		Operations:       params.Operations,
+		KeyId:            params.KeyId,
+	})
+	return &kms.CreateGrantOutput{GrantId: aws.String(id), GrantToken: aws.String("token-" + id)}, nil
+}
+
+func (g *grantingKMS) RetireGrant(ctx context.Context, params *kms.RetireGrantInput, optFns ...func(*kms.Options)) (*kms.RetireGrantOutput, error) {
+	g.grantMu.Lock()
+	defer g.grantMu.Unlock()
+	for i, grant := range g.grants {
+		if aws.ToString(grant.GrantId) == aws.ToString(params.GrantId) {
+			g.grants = slices.Delete(g.grants, i, i+1)
+			return &kms.RetireGrantOutput{}, nil
+		}
+	}
+	return nil, &types.NotFoundException{Message: aws.String("grant not found")}
+}
+
+func (g *grantingKMS) ListGrants(ctx context.Context, params *kms.ListGrantsInput, optFns ...func(*kms.Options)) (*kms.ListGrantsOutput, error) {
+	g.grantMu.Lock()
+	defer g.grantMu.Unlock()
+	start := 0
+	if params.Marker != nil {
+		fmt.Sscan(aws.ToString(params.Marker), &start)
+	}
+	if start >= len(g.grants) {
+		return &kms.ListGrantsOutput{}, nil
+	}
+	output := &kms.ListGrantsOutput{Grants: []types.GrantListEntry{g.grants[start]}}
+	if start+1 < len(g.grants) {
+		output.Truncated = true
+		output.NextMarker = aws.String(fmt.Sprint(start + 1))
+	}
+	return output, nil
+}
+
+func (g *grantingKMS) grantIDs() []string {
+	g.grantMu.Lock()
+	defer g.grantMu.Unlock()
+	ids := make([]string, 0, len(g.grants))
+	for _, grant := range g.grants {
+		ids = append(ids, aws.ToString(grant.GrantId))
+	}
+	return ids
+}
+
+func newGrantingManager(t *testing.T, clock Clock) (*KMSManager, *grantingKMS) {
+	t.Helper()
+	client := &grantingKMS{fakeKMS: newFakeKMS()}
+	manager, err := NewKMSManagerWithClient(client, testKeyARN, time.Hour, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	return manager, client
+}
+
+func TestCreateDecryptGrantIsDecryptOnly(t *testing.T) {
+	clock := newFakeClock()
+	manager, client := newGrantingManager(t, clock)
+
+	grant, err := manager.CreateDecryptGrant(context.Background(), "arn:aws:iam::123456789012:role/migration", 0)
+	if err != nil {
+		t.Fatalf("CreateDecryptGrant: %v", err)
+	}
+	if grant.GrantToken == "" || !grant.ExpiresAt.Equal(clock.Now().Add(DefaultGrantTTL).Truncate(time.Second)) {
+		t.Fatalf("unexpected grant %+v", grant)
+	}
+
+	created := client.grants[0]
+	if !slices.Equal(created.Operations, []types.GrantOperation{types.GrantOperationDecrypt}) {
+		t.Fatalf("expected a Decrypt-only grant, got %v", created.Operations)
+	}
+	if aws.ToString(created.KeyId) != testKeyARN {
+		t.Fatalf("expected the grant on the CMK, got %q", aws.ToString(created.KeyId))
+	}
+
+	for _, ttl := range []time.Duration{-time.Second, MaxGrantTTL + time.Second} {
+		if _, err := manager.CreateDecryptGrant(context.Background(), "arn:aws:iam::123456789012:role/migration", ttl); err == nil {
+			t.Fatalf("expected TTL %v to be rejected", ttl)
+		}
+	}
+	if _, err := manager.CreateDecryptGrant(context.Background(), "", time.Minute); err == nil {
+		t.Fatal("expected a missing grantee to be rejected")
+	}
+}
+
+func TestRetireExpiredGrantsRetiresOnlyLapsedCodecGrants(t *testing.T) {
+	clock := newFakeClock()
+	manager, client := newGrantingManager(t, clock)
+	ctx := context.Background()
+
+	short, err := manager.CreateDecryptGrant(ctx, "role/short", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("CreateDecryptGrant: %v", err)
+	}
+	long, err := manager.CreateDecryptGrant(ctx, "role/long", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("CreateDecryptGrant: %v", err)
+	}
+	// A grant made outside the codec must survive the sweep
+	if _, err := client.CreateGrant(ctx, &kms.CreateGrantInput{KeyId: aws.String(testKeyARN), Name: aws.String("ops-grant")}); err != nil {
+		t.Fatalf("CreateGrant: %v", err)
+	}
+
+	if retired, err := manager.RetireExpiredGrants(ctx); err != nil || retired != 0 {
+		t.Fatalf("expected nothing to retire yet, got %d, %v", retired, err)
+	}
+
+	clock.Advance(time.Hour)
+	if retired, err := manager.RetireExpiredGrants(ctx); err != nil || retired != 1 {
+		t.Fatalf("expected one lapsed grant to be retired, got %d, %v", retired, err)
+	}
+	ids := client.grantIDs()
+	if slices.Contains(ids, short.GrantID) || !slices.Contains(ids, long.GrantID) || len(ids) != 2 {
+		t.Fatalf("unexpected remaining grants %v", ids)
+	}
+}
+
+func TestGrantsUnsupportedByClient(t *testing.T) {
+	manager := newTestManager(t, newFakeKMS())
+	if _, err := manager.CreateDecryptGrant(context.Background(), "role/job", time.Minute); err != errGrantsUnsupported {
+		t.Fatalf("expected errGrantsUnsupported, got %v", err)
+	}
+}
+
+func TestGrantsEndpoint(t *testing.T) {
+	manager, client := newGrantingManager(t, newFakeClock())
+	codec := NewKMSEncryptionCodec(manager)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "s3cr3t")
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(http.MethodPost, "/grants", `{"ttl_seconds": 60}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a grantee, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPost, "/grants", `{"grantee_principal": "role/job", "ttl_seconds": 999999}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an over-long TTL, got %d", rec.Code)
+	}
+
+	rec := serve(http.MethodPost, "/grants", `{"grantee_principal": "role/job", "ttl_seconds": 60}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var grant DecryptGrant
+	if err := json.NewDecoder(rec.Body).Decode(&grant); err != nil {
+		t.Fatalf("decode grant: %v", err)
+	}
+	if grant.GrantID == "" || grant.GranteePrincipal != "role/job" {
+		t.Fatalf("unexpected grant %+v", grant)
+	}
+
+	if rec := serve(http.MethodDelete, "/grants?grant_id="+grant.GrantID, ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 retiring the grant, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ids := client.grantIDs(); len(ids) != 0 {
+		t.Fatalf("expected the grant to be retired, got %v", ids)
+	}
+}
@@ -0,0 +1,77 @@
+package kmscodec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+
+	"temporal-key-rotation/shared"
+)
+
+// MaxDecompressedPayloadSize bounds what a gzip payload may expand to on decode, so a small
+// crafted payload cannot exhaust memory
+const MaxDecompressedPayloadSize = 64 << 20
+
+// gzipTransformer is the gzip compression stage. It compresses the same payloads the encrypt
+// stage would encrypt, and only when that makes them smaller. The encoding label is kept, as
+// the payload's TransformsMetadataKey already records the compression.
+type gzipTransformer struct{}
+
+func (gzipTransformer) Name() string {
+	return TransformGzip
+}
+
+func (gzipTransformer) Encode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, bool, error) {
+	if encoding, exists := payload.Metadata["encoding"]; exists && encoding != "json/plain" {
+		return payload, false, nil
+	}
+
+	// Same reading of the data as encode: base64 when it decodes, plain text otherwise
+	data, err := decodeBase64(payload.Data)
+	if err != nil {
+		data = []byte(payload.Data)
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return shared.PayloadData{}, false, &codecError{http.StatusInternalServerError, "Compression failed", err}
+	}
+	if err := writer.Close(); err != nil {
+		return shared.PayloadData{}, false, &codecError{http.StatusInternalServerError, "Compression failed", err}
+	}
+	if compressed.Len() >= len(data) {
+		return payload, false, nil
+	}
+
+	payload.Metadata = maps.Clone(payload.Metadata)
+	payload.Data = base64.StdEncoding.EncodeToString(compressed.Bytes())
+	return payload, true, nil
+}
+
+func (gzipTransformer) Decode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	compressed, err := decodeBase64(payload.Data)
+	if err != nil {
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Corrupt payload: compressed data is not valid base64", err}
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Corrupt payload: invalid gzip data", err}
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, MaxDecompressedPayloadSize+1))
+	if err != nil {
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Corrupt payload: invalid gzip data", err}
+	}
+	if len(data) > MaxDecompressedPayloadSize {
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, fmt.Sprintf("Payload decompresses to more than %d bytes", MaxDecompressedPayloadSize), nil}
+	}
+
+	payload.Metadata = maps.Clone(payload.Metadata)
+	payload.Data = base64.StdEncoding.EncodeToString(data)
+	return payload, nil
+}
@@ -0,0 +1,170 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// DefaultKeyInfoTTL is how long /key-info reuses a CMK description before calling KMS again
+const DefaultKeyInfoTTL = 5 * time.Minute
+
+// maxKeyInfoEntries bounds the CMK description cache; expired entries are dropped when it fills
+const maxKeyInfoEntries = 256
+
+// KeyRotationStatusGetter is implemented by KMS clients that report automatic key rotation, such as *kms.Client
+type KeyRotationStatusGetter interface {
+	GetKeyRotationStatus(ctx context.Context, params *kms.GetKeyRotationStatusInput, optFns ...func(*kms.Options)) (*kms.GetKeyRotationStatusOutput, error)
+}
+
+// ErrKeyNotFound is returned when KMS does not know the CMK, or it is not visible to the codec server
+var ErrKeyNotFound = errors.New("KMS key not found")
+
+// KeyInfo is the non-sensitive metadata of a CMK, as returned by /key-info
+type KeyInfo struct {
+	KeyID           string     `json:"key_id"`
+	ARN             string     `json:"arn"`
+	Region          string     `json:"region,omitempty"`
+	AccountID       string     `json:"account_id,omitempty"`
+	KeyState        string     `json:"key_state"` // Enabled, Disabled, PendingDeletion, ...
+	Enabled         bool       `json:"enabled"`
+	KeySpec         string     `json:"key_spec,omitempty"`
+	KeyUsage        string     `json:"key_usage,omitempty"`
+	KeyManager      string     `json:"key_manager,omitempty"` // AWS or CUSTOMER
+	Origin          string     `json:"origin,omitempty"`
+	CreationDate    *time.Time `json:"creation_date,omitempty"`
+	DeletionDate    *time.Time `json:"deletion_date,omitempty"`
+	MultiRegion     bool       `json:"multi_region"`
+	MultiRegionType string     `json:"multi_region_type,omitempty"` // PRIMARY or REPLICA
+	PrimaryRegion   string     `json:"primary_region,omitempty"`
+	// RotationEnabled is nil when the rotation status could not be read, e.g. for asymmetric
+	// keys or without kms:GetKeyRotationStatus
+	RotationEnabled  *bool      `json:"rotation_enabled,omitempty"`
+	NextRotationDate *time.Time `json:"next_rotation_date,omitempty"`
+	CodecMasterKey   bool       `json:"codec_master_key"` // the key this codec server encrypts with
+	RetrievedAt      time.Time  `json:"retrieved_at"`
+}
+
+// DescribeMasterKey returns the metadata of the CMK keyID, an ID, alias or ARN, from
+// DescribeKey and GetKeyRotationStatus. Results are cached for DefaultKeyInfoTTL, so
+// repeated lookups while triaging don't add KMS calls; failures are not cached.
+func (k *KMSManager) DescribeMasterKey(ctx context.Context, keyID string) (*KeyInfo, error) {
+	now := k.clock.Now()
+	k.mux.RLock()
+	cached, ok := k.keyInfoCache[keyID]
+	k.mux.RUnlock()
+	if ok && now.Sub(cached.RetrievedAt) < DefaultKeyInfoTTL {
+		return cached, nil
+	}
+
+	describer, ok := k.client.(KeyDescriber)
+	if !ok {
+		return nil, errDescribeUnsupported
+	}
+	result, err := describer.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(keyID)})
+	var notFound *types.NotFoundException
+	if errors.As(err, &notFound) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, keyID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe key: %w", err)
+	}
+	metadata := result.KeyMetadata
+	if metadata == nil {
+		return nil, fmt.Errorf("failed to describe key: no metadata for %s", keyID)
+	}
+
+	info := &KeyInfo{
+		KeyID:        aws.ToString(metadata.KeyId),
+		ARN:          aws.ToString(metadata.Arn),
+		KeyState:     string(metadata.KeyState),
+		Enabled:      metadata.Enabled,
+		KeySpec:      string(metadata.KeySpec),
+		KeyUsage:     string(metadata.KeyUsage),
+		KeyManager:   string(metadata.KeyManager),
+		Origin:       string(metadata.Origin),
+		CreationDate: metadata.CreationDate,
+		DeletionDate: metadata.DeletionDate,
+		MultiRegion:  aws.ToBool(metadata.MultiRegion),
+		RetrievedAt:  now,
+	}
+	if parsed, err := arn.Parse(info.ARN); err == nil {
+		info.Region = parsed.Region
+		info.AccountID = parsed.AccountID
+	}
+	if config := metadata.MultiRegionConfiguration; config != nil {
+		info.MultiRegionType = string(config.MultiRegionKeyType)
+		if config.PrimaryKey != nil {
+			info.PrimaryRegion = aws.ToString(config.PrimaryKey.Region)
+		}
+	}
+	info.CodecMasterKey = keyID == k.keyID || info.ARN == k.keyID || info.KeyID == k.keyID
+
+	if getter, ok := k.client.(KeyRotationStatusGetter); ok {
+		status, err := getter.GetKeyRotationStatus(ctx, &kms.GetKeyRotationStatusInput{KeyId: aws.String(info.KeyID)})
+		if err == nil {
+			info.RotationEnabled = aws.Bool(status.KeyRotationEnabled)
+			info.NextRotationDate = status.NextRotationDate
+		} else {
+			log.Printf("Rotation status of %s unavailable: %v", info.KeyID, err)
+		}
+	}
+
+	k.mux.Lock()
+	if k.keyInfoCache == nil || len(k.keyInfoCache) >= maxKeyInfoEntries {
+		fresh := make(map[string]*KeyInfo)
+		for id, entry := range k.keyInfoCache {
+			if now.Sub(entry.RetrievedAt) < DefaultKeyInfoTTL {
+				fresh[id] = entry
+			}
+		}
+		k.keyInfoCache = fresh
+	}
+	if len(k.keyInfoCache) < maxKeyInfoEntries {
+		k.keyInfoCache[keyID] = info
+	}
+	k.mux.Unlock()
+	return info, nil
+}
+
+// handleKeyInfo handles the /key-info admin endpoint, describing the CMK named by ?kms_key_id=
+// (the kms_key_id of a payload) or, without it, the codec server's own master key
+func (c *KMSEncryptionCodec) handleKeyInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyID := r.URL.Query().Get("kms_key_id")
+	if keyID == "" {
+		keyID = c.kmsManager.keyID
+	}
+
+	info, err := c.kmsManager.DescribeMasterKey(r.Context(), keyID)
+	switch {
+	case errors.Is(err, errDescribeUnsupported):
+		http.Error(w, "Key introspection is not supported by this KMS client", http.StatusNotImplemented)
+		return
+	case errors.Is(err, ErrKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Key introspection of %s failed: %v", keyID, err)
+		http.Error(w, "Key introspection failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Printf("Failed to encode key info response: %v", err)
+	}
+}
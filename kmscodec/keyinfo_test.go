@@ -0,0 +1,127 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const disabledKeyARN = "arn:aws:kms:eu-west-1:210987654321:key/disabled-key"
+
+// introspectableKMS answers DescribeKey and GetKeyRotationStatus from fixed key metadata
+type introspectableKMS struct {
+	*fakeKMS
+	keys      map[string]types.KeyMetadata
+	describes int
+}
+
+func (f *introspectableKMS) DescribeKey(ctx context.Context, params *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error) {
+	f.describes++
+	metadata, ok := f.keys[aws.ToString(params.KeyId)]
+	if !ok {
+		return nil, &types.NotFoundException{Message: aws.String("key not found")}
+	}
+	return &kms.DescribeKeyOutput{KeyMetadata: &metadata}, nil
+}
+
+func (f *introspectableKMS) GetKeyRotationStatus(ctx context.Context, params *kms.GetKeyRotationStatusInput, optFns ...func(*kms.Options)) (*kms.GetKeyRotationStatusOutput, error) {
+	if aws.ToString(params.KeyId) == "disabled-key" {
+		return nil, errors.New("AccessDeniedException")
+	}
+	return &kms.GetKeyRotationStatusOutput{KeyRotationEnabled: true}, nil
+}
+
+func newIntrospectableCodec(t *testing.T, clock Clock) (*KMSEncryptionCodec, *introspectableKMS) {
+	t.Helper()
+	client := &introspectableKMS{fakeKMS: newFakeKMS(), keys: map[string]types.KeyMetadata{
+		testKeyARN: {
+			KeyId: aws.String("test-key"), Arn: aws.String(testKeyARN),
+			KeyState: types.KeyStateEnabled, Enabled: true, KeySpec: types.KeySpecSymmetricDefault,
+		},
+		disabledKeyARN: {
+			KeyId: aws.String("disabled-key"), Arn: aws.String(disabledKeyARN),
+			KeyState: types.KeyStateDisabled,
+		},
+	}}
+	manager, err := NewKMSManagerWithClient(client, testKeyARN, time.Hour, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	return NewKMSEncryptionCodec(manager), client
+}
+
+func getKeyInfo(t *testing.T, codec *KMSEncryptionCodec, query string) (*httptest.ResponseRecorder, KeyInfo) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	codec.handleKeyInfo(rec, httptest.NewRequest(http.MethodGet, "/key-info"+query, nil))
+	var info KeyInfo
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+	}
+	return rec, info
+}
+
+func TestKeyInfoDescribesPayloadMasterKey(t *testing.T) {
+	clock := newFakeClock()
+	codec, client := newIntrospectableCodec(t, clock)
+
+	// A payload under a disabled key in another account and region explains itself
+	rec, info := getKeyInfo(t, codec, "?kms_key_id="+disabledKeyARN)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if info.KeyState != "Disabled" || info.Enabled || info.Region != "eu-west-1" || info.AccountID != "210987654321" {
+		t.Fatalf("unexpected key info %+v", info)
+	}
+	if info.CodecMasterKey || info.RotationEnabled != nil {
+		t.Fatalf("expected a foreign key with unknown rotation status, got %+v", info)
+	}
+
+	// Without kms_key_id the codec server's own key is described
+	_, own := getKeyInfo(t, codec, "")
+	if !own.CodecMasterKey || own.Region != "us-east-1" || own.RotationEnabled == nil || !*own.RotationEnabled {
+		t.Fatalf("unexpected own key info %+v", own)
+	}
+
+	// Descriptions are cached until DefaultKeyInfoTTL passes
+	getKeyInfo(t, codec, "?kms_key_id="+disabledKeyARN)
+	if client.describes != 2 {
+		t.Fatalf("expected cached descriptions, got %d DescribeKey calls", client.describes)
+	}
+	clock.Advance(DefaultKeyInfoTTL)
+	getKeyInfo(t, codec, "?kms_key_id="+disabledKeyARN)
+	if client.describes != 3 {
+		t.Fatalf("expected an expired description to be refreshed, got %d DescribeKey calls", client.describes)
+	}
+}
+
+func TestKeyInfoErrors(t *testing.T) {
+	codec, _ := newIntrospectableCodec(t, newFakeClock())
+	if rec, _ := getKeyInfo(t, codec, "?kms_key_id=alias/missing"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown key, got %d", rec.Code)
+	}
+
+	// The plain fake KMS cannot describe keys
+	plain, _ := newTestCodec(t)
+	if rec, _ := getKeyInfo(t, plain, ""); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", rec.Code)
+	}
+
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "secret")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/key-info", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected /key-info to need the admin token, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package kmscodec
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync/atomic"
+)
+
+// OtherKeyARN labels KMS calls for master keys outside the configured set, so a payload
+// naming an arbitrary key ARN cannot add a label value
+const OtherKeyARN = "other"
+
+// KeyARNStats counts the KMS calls made with one master key
+type KeyARNStats struct {
+	Generates int64 `json:"generates"`
+	Decrypts  int64 `json:"decrypts"`
+	Errors    int64 `json:"errors"`
+}
+
+type keyARNCounters struct {
+	generates atomic.Int64
+	decrypts  atomic.Int64
+	errors    atomic.Int64
+}
+
+// keyARNMetrics holds per-ARN counters for a fixed set of ARNs. The map is never written
+// after construction, so lookups need no lock.
+type keyARNMetrics map[string]*keyARNCounters
+
+func newKeyARNMetrics(arns []string) keyARNMetrics {
+	m := keyARNMetrics{OtherKeyARN: {}}
+	for _, arn := range arns {
+		if arn != "" {
+			m[arn] = &keyARNCounters{}
+		}
+	}
+	return m
+}
+
+func (m keyARNMetrics) counters(arn string) *keyARNCounters {
+	if c, ok := m[arn]; ok {
+		return c
+	}
+	return m[OtherKeyARN]
+}
+
+// recordGenerate counts a GenerateDataKey(PairWithoutPlaintext) call and its outcome
+func (m keyARNMetrics) recordGenerate(arn string, err error) {
+	c := m.counters(arn)
+	c.generates.Add(1)
+	if err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// recordDecrypt counts a Decrypt call, or a ReEncrypt that decrypts under arn, and its outcome
+func (m keyARNMetrics) recordDecrypt(arn string, err error) {
+	c := m.counters(arn)
+	c.decrypts.Add(1)
+	if err != nil {
+		c.errors.Add(1)
+	}
+}
+
+func (m keyARNMetrics) snapshot() map[string]KeyARNStats {
+	stats := make(map[string]KeyARNStats, len(m))
+	for arn, c := range m {
+		stats[arn] = KeyARNStats{Generates: c.generates.Load(), Decrypts: c.decrypts.Load(), Errors: c.errors.Load()}
+	}
+	return stats
+}
+
+// WithTrackedKeyARNs adds master key ARNs, such as fallback or retired keys, that get their
+// own KMS call counters. The manager's own key is always tracked; calls for any other ARN
+// are counted under OtherKeyARN.
+func WithTrackedKeyARNs(arns []string) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.trackedKeyARNs = append(k.trackedKeyARNs, arns...)
+	}
+}
+
+// KeyARNStats returns the KMS call counts per tracked master key ARN
+func (k *KMSManager) KeyARNStats() map[string]KeyARNStats {
+	return k.keyARNMetrics.snapshot()
+}
+
+// writeKeyARNMetrics renders per-ARN KMS call counters in the Prometheus text exposition format
+func writeKeyARNMetrics(w io.Writer, stats map[string]KeyARNStats) {
+	arns := slices.Sorted(maps.Keys(stats))
+	for _, counter := range []struct {
+		name  string
+		value func(KeyARNStats) int64
+	}{
+		{"codec_kms_generate_total", func(s KeyARNStats) int64 { return s.Generates }},
+		{"codec_kms_decrypt_total", func(s KeyARNStats) int64 { return s.Decrypts }},
+		{"codec_kms_errors_total", func(s KeyARNStats) int64 { return s.Errors }},
+	} {
+		fmt.Fprintf(w, "# TYPE %s counter\n", counter.name)
+		for _, arn := range arns {
+			fmt.Fprintf(w, "%s{key_arn=%q} %d\n", counter.name, arn, counter.value(stats[arn]))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fallbackKeyARN = "arn:aws:kms:us-west-2:123456789012:key/fallback-key"
+
+func TestKeyARNStatsCountCallsPerConfiguredKey(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithTrackedKeyARNs([]string{fallbackKeyARN}))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+	ctx := context.Background()
+
+	// Three retired payloads whose data key is read back through KMS, each naming a different master key
+	for _, arn := range []string{testKeyARN, fallbackKeyARN, "arn:aws:kms:eu-west-1:999999999999:key/unknown"} {
+		payload := encodeUnderRetiredKey(t, codec)
+		payload.KMSKeyID = arn
+		payload.EnvelopeChecksum = ""
+		if _, err := codec.decodePayload(ctx, payload); err != nil {
+			t.Fatalf("decodePayload under %s: %v", arn, err)
+		}
+	}
+
+	fake.decryptErr = errors.New("throttled")
+	payload := encodeUnderRetiredKey(t, codec)
+	if _, err := codec.decodePayload(ctx, payload); err == nil {
+		t.Fatal("expected the KMS failure to fail the decode")
+	}
+
+	stats := manager.KeyARNStats()
+	if len(stats) != 3 {
+		t.Fatalf("expected the own key, the tracked key and other, got %v", stats)
+	}
+	// One initial generate plus one rotation per retired payload
+	if got := stats[testKeyARN]; got != (KeyARNStats{Generates: 5, Decrypts: 2, Errors: 1}) {
+		t.Errorf("unexpected own key counts %+v", got)
+	}
+	if got := stats[fallbackKeyARN]; got != (KeyARNStats{Decrypts: 1}) {
+		t.Errorf("unexpected fallback key counts %+v", got)
+	}
+	if got := stats[OtherKeyARN]; got != (KeyARNStats{Decrypts: 1}) {
+		t.Errorf("unexpected other key counts %+v", got)
+	}
+	if _, ok := manager.GetKeyStats()["key_arns"]; !ok {
+		t.Error("expected key_arns in /stats")
+	}
+}
+
+func TestMetricsExposeKeyARNCounters(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "")
+
+	body := getStats(t, mux, "/metrics", "").Body.String()
+	for _, want := range []string{
+		"# TYPE codec_kms_generate_total counter\n",
+		`codec_kms_generate_total{key_arn="` + testKeyARN + `"} 1` + "\n",
+		`codec_kms_decrypt_total{key_arn="other"} 0` + "\n",
+		"# TYPE codec_kms_errors_total counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package kmscodec
+
+import (
+	"context"
+	"log"
+)
+
+// MaxKeyPoolDepth caps the number of pre-generated data keys held in memory
+const MaxKeyPoolDepth = 16
+
+// WithKeyPool keeps up to depth pre-generated data keys that rotation installs without
+// waiting on KMS. The depth is capped at MaxKeyPoolDepth; zero disables the pool.
+// StartKeyPoolRefill must be running for the pool to fill.
+func WithKeyPool(depth int) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.keyPoolDepth = max(0, min(depth, MaxKeyPoolDepth))
+	}
+}
+
+// takePooledKeyLocked removes and returns the oldest pooled key, or nil when the pool is empty.
+// A pooled key does not age: like a key generated inline, it expires one rotation interval after
+// it is installed, so the pool is never discarded and regenerated wholesale. Callers must hold
+// k.mux for writing.
+func (k *KMSManager) takePooledKeyLocked() *CurrentDataKey {
+	defer k.signalKeyPoolRefill()
+
+	if len(k.keyPool) == 0 {
+		return nil
+	}
+	next := k.keyPool[0]
+	k.keyPool[0] = nil
+	k.keyPool = k.keyPool[1:]
+	return next
+}
+
+// signalKeyPoolRefill wakes the refill routine without blocking
+func (k *KMSManager) signalKeyPoolRefill() {
+	if k.keyPoolDepth == 0 {
+		return
+	}
+	select {
+	case k.keyPoolRefill <- struct{}{}:
+	default:
+	}
+}
+
+// refillKeyPool generates keys until the pool is full. Keys are generated without the lock,
+// so encodes and rotations are never blocked on KMS by the refill.
+func (k *KMSManager) refillKeyPool(ctx context.Context) error {
+	for {
+		k.mux.RLock()
+		full := len(k.keyPool) >= k.keyPoolDepth
+		k.mux.RUnlock()
+		if full {
+			return nil
+		}
+
+		next, err := k.generateDataKey(ctx)
+		if err != nil {
+			return err
+		}
+
+		k.mux.Lock()
+		if len(k.keyPool) >= k.keyPoolDepth {
+			k.mux.Unlock()
+			zeroKey(next.PlaintextKey)
+			return nil
+		}
+		k.keyPool = append(k.keyPool, next)
+		k.mux.Unlock()
+	}
+}
+
+// StartKeyPoolRefill fills the key pool and tops it up whenever rotation draws from it,
+// until Close is called. It does nothing when the pool is disabled.
+func (k *KMSManager) StartKeyPoolRefill() {
+	if k.keyPoolDepth == 0 {
+		return
+	}
+	k.signalKeyPoolRefill()
+
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		for {
+			select {
+			case <-k.keyPoolRefill:
+				if err := k.refillKeyPool(context.Background()); err != nil {
+					log.Printf("Failed to refill data key pool, will retry on next rotation: %v", err)
+				}
+			case <-k.stopCh:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,154 @@
+package kmscodec
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeyPoolServesRotationsUntilExhausted(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithKeyPool(2))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := manager.refillKeyPool(ctx); err != nil {
+		t.Fatalf("refillKeyPool: %v", err)
+	}
+	if generate, _ := fake.calls(); generate != 3 {
+		t.Fatalf("expected the initial key plus 2 pooled keys, got %d generate calls", generate)
+	}
+	pooled := []string{manager.keyPool[0].EncryptedKey, manager.keyPool[1].EncryptedKey}
+
+	// Rotations take pooled keys, oldest first, without calling KMS
+	for i, want := range pooled {
+		if err := manager.rotateDataKey(ctx); err != nil {
+			t.Fatalf("rotateDataKey: %v", err)
+		}
+		if current, _ := manager.GetCurrentDataKey(ctx); current.EncryptedKey != want {
+			t.Fatalf("rotation %d: expected pooled key %d to become current", i, i)
+		}
+	}
+	if generate, _ := fake.calls(); generate != 3 {
+		t.Fatalf("expected no KMS calls while the pool lasts, got %d generate calls", generate)
+	}
+
+	// An exhausted pool falls back to generating inline
+	if err := manager.rotateDataKey(ctx); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	if generate, _ := fake.calls(); generate != 4 {
+		t.Fatalf("expected an inline generate once the pool is empty, got %d generate calls", generate)
+	}
+
+	// Refilling tops the pool back up to its depth and no further
+	if err := manager.refillKeyPool(ctx); err != nil {
+		t.Fatalf("refillKeyPool: %v", err)
+	}
+	if size := manager.GetKeyStats()["key_pool_size"]; size != 2 {
+		t.Fatalf("expected a full pool of 2, got %v", size)
+	}
+	if generate, _ := fake.calls(); generate != 6 {
+		t.Fatalf("expected 2 refill generates, got %d generate calls", generate)
+	}
+}
+
+func TestPooledKeyExpiresOneIntervalAfterInstall(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock), WithKeyPool(1))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	ctx := context.Background()
+	if err := manager.refillKeyPool(ctx); err != nil {
+		t.Fatalf("refillKeyPool: %v", err)
+	}
+	pooled := manager.keyPool[0].EncryptedKey
+
+	// A key that sat in the pool for longer than an interval is still installed
+	clock.Advance(time.Hour + time.Second)
+	current, err := manager.GetCurrentDataKey(ctx)
+	if err != nil {
+		t.Fatalf("GetCurrentDataKey: %v", err)
+	}
+	if current.EncryptedKey != pooled {
+		t.Fatal("expected the pooled key to become current")
+	}
+	if want := clock.Now().Add(time.Hour); !current.ExpiresAt.Equal(want) {
+		t.Fatalf("expected the pooled key to expire at %v, got %v", want, current.ExpiresAt)
+	}
+}
+
+func TestDeepKeyPoolGeneratesOneKeyPerRotation(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock), WithKeyPool(3))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	ctx := context.Background()
+	if err := manager.refillKeyPool(ctx); err != nil {
+		t.Fatalf("refillKeyPool: %v", err)
+	}
+
+	// Each expiry installs one pooled key and the refill replaces just that one
+	const rotations = 5
+	for i := 0; i < rotations; i++ {
+		clock.Advance(time.Hour + time.Second)
+		if _, err := manager.GetCurrentDataKey(ctx); err != nil {
+			t.Fatalf("GetCurrentDataKey: %v", err)
+		}
+		if err := manager.refillKeyPool(ctx); err != nil {
+			t.Fatalf("refillKeyPool: %v", err)
+		}
+	}
+	if generate, _ := fake.calls(); generate != 1+3+rotations {
+		t.Fatalf("expected the initial key, 3 pooled keys and %d refills, got %d generate calls", rotations, generate)
+	}
+}
+
+func TestKeyPoolRefillRoutine(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithKeyPool(2))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	defer manager.Close()
+	manager.StartKeyPoolRefill()
+
+	waitForPool := func(size int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if manager.GetKeyStats()["key_pool_size"] == size {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("pool did not reach %d keys", size)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitForPool(2)
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	waitForPool(2)
+	if generate, _ := fake.calls(); generate != 4 {
+		t.Fatalf("expected the initial key, 2 pooled keys and 1 refill, got %d generate calls", generate)
+	}
+}
+
+func TestKeyPoolDepthIsCapped(t *testing.T) {
+	manager, err := NewKMSManagerWithClient(newFakeKMS(), testKeyARN, time.Hour, time.Hour, WithKeyPool(1000))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	if manager.keyPoolDepth != MaxKeyPoolDepth {
+		t.Fatalf("expected depth capped at %d, got %d", MaxKeyPoolDepth, manager.keyPoolDepth)
+	}
+}
@@ -0,0 +1,1009 @@
+package kmscodec
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"golang.org/x/sync/singleflight"
+)
+
+// CurrentDataKey represents the current active data key.
+// In key pair mode PlaintextKey is nil and PublicKey holds the DER encoded public key,
+// so this process can encrypt but only KMS can recover the private key.
+type CurrentDataKey struct {
+	PlaintextKey []byte
+	PublicKey    []byte
+	EncryptedKey string
+	// EncryptionContext is the KMS context the key was generated with; encode stores it in each payload
+	EncryptionContext map[string]string
+	GeneratedAt       time.Time
+	ExpiresAt         time.Time
+}
+
+// CachedKey represents a cached decrypted data key (for decryption of old data)
+type CachedKey struct {
+	Key       []byte
+	CachedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// ErrKeyRevoked is returned when a payload's data key has been revoked
+var ErrKeyRevoked = errors.New("data key has been revoked")
+
+// ErrKeyUnavailable is returned when KMS refuses to use the master key because it is disabled or pending deletion
+var ErrKeyUnavailable = errors.New("KMS key unavailable: disabled or pending deletion")
+
+// ErrMalformedDataKey is returned when an encrypted data key is not valid base64, which means the payload is corrupt
+var ErrMalformedDataKey = errors.New("malformed encrypted data key")
+
+// KMSClient is the subset of the AWS KMS API used by KMSManager
+type KMSClient interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	GenerateDataKeyPairWithoutPlaintext(ctx context.Context, params *kms.GenerateDataKeyPairWithoutPlaintextInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyPairWithoutPlaintextOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// KMSManagerOption configures optional KMSManager behavior
+type KMSManagerOption func(*KMSManager)
+
+// WithKeyPairMode makes the manager generate asymmetric data key pairs instead of
+// symmetric data keys. Only the public half is held in memory for encryption.
+func WithKeyPairMode(spec types.DataKeyPairSpec) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.keyPairSpec = spec
+	}
+}
+
+// WithDataKeySpec sets the KMS key spec of symmetric data keys, DefaultDataKeySpec unless set.
+// Payloads record the matching algorithm, so decrypt knows the key length whatever the setting.
+func WithDataKeySpec(spec types.DataKeySpec) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.dataKeySpec = spec
+	}
+}
+
+// KMSManager handles KMS operations with time-based key rotation
+type KMSManager struct {
+	client              KMSClient
+	keyID               string
+	currentDataKey      *CurrentDataKey
+	decryptionCache     DecryptionCache
+	sealMemoryCache     bool                 // seal the default in-memory cache under an ephemeral KEK
+	revokedKeys         map[string]time.Time // fingerprint -> revocation time
+	revocations         RevocationStore      // nil keeps revocations in this process only
+	authorizedAt        map[string]time.Time // encrypted key -> last time KMS released it to us
+	kmsRecheckInterval  time.Duration        // zero means keys in memory never need re-authorizing
+	decryptGroup        singleflight.Group   // dedups concurrent KMS decrypts per key
+	breaker             *circuitBreaker
+	clock               Clock
+	mux                 sync.RWMutex
+	cacheTTL            time.Duration
+	keyRotationInterval time.Duration
+	clockSkewTolerance  time.Duration            // grace past ExpiresAt before a key counts as expired
+	keyPairSpec         types.DataKeyPairSpec    // empty means symmetric data keys
+	dataKeySpec         types.DataKeySpec        // spec of symmetric data keys
+	generateTimeout     time.Duration            // bound on one KMS data key generation; zero means none
+	decryptTimeout      time.Duration            // bound on one KMS decrypt; zero means none
+	contextValidation   string                   // ContextValidationPermissive or ContextValidationStrict
+	contextFields       map[string]string        // added to the context of generated keys
+	multiRegionInfo     *MultiRegionInfo         // nil until RefreshMultiRegionInfo succeeds
+	sharedKeys          SharedKeyStore           // nil unless replicas share the current key
+	sharedKeyAdoptions  atomic.Int64             // current keys taken over from other replicas
+	replicaRegion       string                   // region of the multi-Region key replica decrypts fail over to
+	replicaClient       KMSClient                // nil disables failover
+	replicaDecrypts     atomic.Int64             // decrypts retried in the replica region
+	keyInfoCache        map[string]*KeyInfo      // CMK descriptions for /key-info, by requested key ID
+	keyPool             []*CurrentDataKey        // pre-generated keys, oldest first
+	keyPoolDepth        int                      // zero disables the pool
+	keyPoolRefill       chan struct{}            // wakes the refill routine
+	currentKeyHits      atomic.Int64             // decrypts served by the current data key
+	cacheHits           atomic.Int64             // decrypts served by the decryption cache
+	kmsDecrypts         atomic.Int64             // decrypts that required a KMS call
+	negativeCache       map[string]negativeEntry // decrypt requests KMS recently refused
+	negativeCacheTTL    time.Duration            // zero disables negative caching
+	negativeCacheHits   atomic.Int64             // decrypts refused from the negative cache
+	forceRotateInterval time.Duration            // minimum time between forced rotations; zero disables them
+	lastForcedRotation  time.Time
+	forcedRotations     atomic.Int64      // rotations forced by encode requests
+	trackedKeyARNs      []string          // extra master keys with their own call counters
+	keyARNMetrics       keyARNMetrics     // KMS calls per master key ARN
+	notifier            *rotationNotifier // nil unless rotation notifications are enabled
+	stopCh              chan struct{}
+	stopOnce            sync.Once
+	wg                  sync.WaitGroup
+}
+
+// WithCircuitBreaker configures the KMS circuit breaker; a threshold of zero disables it
+func WithCircuitBreaker(threshold int, cooldown time.Duration) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.breaker = newCircuitBreaker(threshold, cooldown)
+	}
+}
+
+// WithDecryptionCache replaces the default in-memory decryption cache, e.g. with a cache shared across replicas
+func WithDecryptionCache(cache DecryptionCache) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.decryptionCache = cache
+	}
+}
+
+// WithSealedMemoryCache keeps the keys in the default in-memory decryption cache sealed
+// under a random KEK generated at startup, decrypting them only when they are used.
+// It has no effect when WithDecryptionCache supplies another cache.
+func WithSealedMemoryCache(sealed bool) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.sealMemoryCache = sealed
+	}
+}
+
+// WithForceKMSRecheck makes a key that KMS last authorized more than interval ago go
+// through KMS again on its next decrypt, even if it is still in memory, so IAM policy
+// changes take effect within a bounded time. The key is cached again afterwards.
+// A zero interval disables the recheck.
+func WithForceKMSRecheck(interval time.Duration) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.kmsRecheckInterval = interval
+	}
+}
+
+// WithClockSkewTolerance lets the current data key stay in use for up to tolerance past its
+// expiry, so replicas whose clocks run slightly ahead don't rotate earlier than the rest
+// of the fleet. Pre-rotation still replaces the key ahead of its nominal expiry.
+func WithClockSkewTolerance(tolerance time.Duration) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.clockSkewTolerance = tolerance
+	}
+}
+
+// WithClock replaces the system clock used for rotation and cache expiry
+func WithClock(clock Clock) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.clock = clock
+	}
+}
+
+// NewKMSManager creates a new KMS manager with time-based rotation, using a KMS client configured from the environment
+func NewKMSManager(keyID string, cacheTTL time.Duration, rotationInterval time.Duration, opts ...KMSManagerOption) (*KMSManager, error) {
+	client, err := NewKMSClient(context.TODO(), KMSClientConfigFromEnv())
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKMSManagerWithClient(client, keyID, cacheTTL, rotationInterval, opts...)
+}
+
+// NewKMSManagerWithClient creates a new KMS manager using the provided KMS client
+func NewKMSManagerWithClient(client KMSClient, keyID string, cacheTTL time.Duration, rotationInterval time.Duration, opts ...KMSManagerOption) (*KMSManager, error) {
+	manager := &KMSManager{
+		client:              client,
+		keyID:               keyID,
+		clock:               realClock{},
+		revokedKeys:         make(map[string]time.Time),
+		authorizedAt:        make(map[string]time.Time),
+		negativeCache:       make(map[string]negativeEntry),
+		negativeCacheTTL:    DefaultNegativeCacheTTL,
+		cacheTTL:            cacheTTL,
+		keyRotationInterval: rotationInterval,
+		dataKeySpec:         DefaultDataKeySpec,
+		contextValidation:   ContextValidationPermissive,
+		stopCh:              make(chan struct{}),
+		keyPoolRefill:       make(chan struct{}, 1),
+		breaker:             newCircuitBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown),
+	}
+	for _, opt := range opts {
+		opt(manager)
+	}
+	if cache, ok := manager.decryptionCache.(clockedCache); ok {
+		cache.setClock(manager.clock)
+	}
+	if manager.decryptionCache == nil {
+		if manager.sealMemoryCache {
+			cache, err := newSealedMemoryCache(manager.clock)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create sealed decryption cache: %w", err)
+			}
+			manager.decryptionCache = cache
+		} else {
+			manager.decryptionCache = newMemoryCache(manager.clock)
+		}
+	}
+	manager.keyARNMetrics = newKeyARNMetrics(append([]string{keyID}, manager.trackedKeyARNs...))
+
+	// Generate initial data key, or take over the one other replicas share
+	ctx := context.Background()
+	manager.mux.Lock()
+	err := manager.scheduledRotationLocked(ctx)
+	manager.mux.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate initial data key: %w", err)
+	}
+	manager.startNotifier()
+
+	return manager, nil
+}
+
+// GetCurrentDataKey returns the current data key, rotating if necessary
+func (k *KMSManager) GetCurrentDataKey(ctx context.Context) (*CurrentDataKey, error) {
+	k.mux.RLock()
+	currentKey := k.currentDataKey
+	k.mux.RUnlock()
+
+	// Check if rotation is needed
+	if currentKey == nil || k.keyExpired(currentKey) {
+		k.mux.Lock()
+		// Double-check after acquiring write lock
+		if k.currentDataKey == nil || k.keyExpired(k.currentDataKey) {
+			if err := k.scheduledRotationLocked(ctx); err != nil {
+				k.mux.Unlock()
+				return nil, err
+			}
+		}
+		currentKey = k.currentDataKey
+		k.mux.Unlock()
+	}
+
+	return currentKey, nil
+}
+
+// keyExpired reports whether key is past its expiry by more than the clock skew tolerance
+func (k *KMSManager) keyExpired(key *CurrentDataKey) bool {
+	return k.clock.Now().After(key.ExpiresAt.Add(k.clockSkewTolerance))
+}
+
+// newEncryptionContext builds the KMS encryption context for a data key generated at now, with
+// the configured fields added. KMS only decrypts with the exact same map, so it is stored in
+// every payload the key encrypts.
+func newEncryptionContext(now time.Time, fields map[string]string) map[string]string {
+	encryptionContext := legacyEncryptionContext()
+	maps.Copy(encryptionContext, fields)
+	encryptionContext[encryptionContextTimestampKey] = fmt.Sprintf("%d", now.Unix())
+	return encryptionContext
+}
+
+// legacyEncryptionContext is the context assumed for payloads that carry none.
+// Keys from before the context was stored in payloads were generated with these stable values alone.
+func legacyEncryptionContext() map[string]string {
+	return map[string]string{
+		"service": "temporal-codec",
+		"version": "1.0",
+	}
+}
+
+// rotateDataKey rotates the current data key (public method)
+func (k *KMSManager) rotateDataKey(ctx context.Context) error {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	return k.rotateDataKeyLocked(ctx)
+}
+
+// rotateDataKeyLocked rotates the current data key (assumes lock is held).
+// A pre-generated key from the pool is used when one is available.
+func (k *KMSManager) rotateDataKeyLocked(ctx context.Context) error {
+	if next := k.takePooledKeyLocked(); next != nil {
+		k.installDataKeyLocked(ctx, next)
+		return nil
+	}
+
+	next, err := k.generateDataKey(ctx)
+	if err != nil {
+		return err
+	}
+	k.installDataKeyLocked(ctx, next)
+	return nil
+}
+
+// generateDataKey asks KMS for a new data key. It does not touch the manager's state,
+// so it can run without the lock.
+func (k *KMSManager) generateDataKey(ctx context.Context) (*CurrentDataKey, error) {
+	log.Printf("Generating new data key...")
+
+	encryptionContext := newEncryptionContext(k.clock.Now(), k.contextFields)
+
+	var next *CurrentDataKey
+	if k.keyPairSpec != "" {
+		if !k.breaker.allow() {
+			return nil, ErrKMSUnavailable
+		}
+		callCtx, cancel := kmsCallContext(ctx, k.generateTimeout)
+		result, err := k.client.GenerateDataKeyPairWithoutPlaintext(callCtx, &kms.GenerateDataKeyPairWithoutPlaintextInput{
+			KeyId:             aws.String(k.keyID),
+			KeyPairSpec:       k.keyPairSpec,
+			EncryptionContext: encryptionContext,
+		})
+		err = kmsTimeoutError(ctx, callCtx, k.generateTimeout, err)
+		cancel()
+		k.breaker.record(err)
+		k.keyARNMetrics.recordGenerate(k.keyID, err)
+		if err != nil {
+			err = keyStateError(err)
+			k.notifyKeyStateError(k.keyID, err)
+			return nil, fmt.Errorf("failed to generate data key pair: %w", err)
+		}
+		next = &CurrentDataKey{
+			PublicKey:         result.PublicKey,
+			EncryptedKey:      base64.StdEncoding.EncodeToString(result.PrivateKeyCiphertextBlob),
+			EncryptionContext: encryptionContext,
+		}
+	} else {
+		if !k.breaker.allow() {
+			return nil, ErrKMSUnavailable
+		}
+		callCtx, cancel := kmsCallContext(ctx, k.generateTimeout)
+		result, err := k.client.GenerateDataKey(callCtx, &kms.GenerateDataKeyInput{
+			KeyId:             aws.String(k.keyID),
+			KeySpec:           k.dataKeySpec,
+			EncryptionContext: encryptionContext,
+		})
+		err = kmsTimeoutError(ctx, callCtx, k.generateTimeout, err)
+		cancel()
+		k.breaker.record(err)
+		k.keyARNMetrics.recordGenerate(k.keyID, err)
+		if err != nil {
+			err = keyStateError(err)
+			k.notifyKeyStateError(k.keyID, err)
+			return nil, fmt.Errorf("failed to generate data key: %w", err)
+		}
+		// Catch a bad key here rather than as a confusing failure on every later encrypt
+		if want := dataKeyLength(k.dataKeySpec); len(result.Plaintext) != want {
+			zeroKey(result.Plaintext)
+			return nil, fmt.Errorf("failed to generate data key: KMS returned a %d-byte key for %s, expected %d bytes",
+				len(result.Plaintext), k.dataKeySpec, want)
+		}
+		next = &CurrentDataKey{
+			PlaintextKey:      result.Plaintext,
+			EncryptedKey:      base64.StdEncoding.EncodeToString(result.CiphertextBlob),
+			EncryptionContext: encryptionContext,
+		}
+	}
+	return next, nil
+}
+
+// installDataKeyLocked makes next the current data key (assumes lock is held)
+func (k *KMSManager) installDataKeyLocked(ctx context.Context, next *CurrentDataKey) {
+	// Keep the outgoing key decryptable locally so payloads encrypted just before the
+	// rotation don't need a KMS call; revoked keys are zeroed instead
+	if old := k.currentDataKey; old != nil && old.PlaintextKey != nil {
+		if _, revoked := k.revokedKeys[KeyFingerprint(old.EncryptedKey)]; revoked {
+			zeroKey(old.PlaintextKey)
+		} else {
+			// Encodes may still hold old, so the cache gets its own copy
+			k.decryptionCache.Set(ctx, old.EncryptedKey, cloneKey(old.PlaintextKey), k.cacheTTL)
+		}
+	}
+
+	// Set new current data key; a key adopted from another replica keeps its own times
+	adopted := !next.ExpiresAt.IsZero()
+	if !adopted {
+		now := k.clock.Now()
+		next.GeneratedAt = now
+		next.ExpiresAt = now.Add(k.keyRotationInterval)
+	}
+	k.notifyKeyRotated(k.currentDataKey, next)
+	k.currentDataKey = next
+	k.recordAuthorizationLocked(next.EncryptedKey, next.GeneratedAt)
+	if adopted {
+		return
+	}
+	k.publishDataKeyLocked(ctx, next)
+
+	log.Printf("New data key generated, expires at: %v", k.currentDataKey.ExpiresAt)
+}
+
+// DecryptDataKey decrypts an encrypted data key using KMS with caching.
+// The returned slice is a copy owned by the caller, who should zero it after use;
+// the current key and cached keys are never handed out directly.
+// encryptionContext is the context stored in the payload; nil means the legacy context.
+func (k *KMSManager) DecryptDataKey(ctx context.Context, encryptedKey string, masterKeyARN string, encryptionContext map[string]string) ([]byte, error) {
+	key, _, err := k.DecryptDataKeyWithSource(ctx, encryptedKey, masterKeyARN, encryptionContext)
+	return key, err
+}
+
+// DecryptDataKeyWithSource is DecryptDataKey that also reports which tier served the key
+func (k *KMSManager) DecryptDataKeyWithSource(ctx context.Context, encryptedKey string, masterKeyARN string, encryptionContext map[string]string) ([]byte, string, error) {
+	// A stored context the validation mode refuses never reaches a lookup or KMS
+	if err := k.validateEncryptionContext(encryptionContext); err != nil {
+		return nil, "", err
+	}
+
+	// Lookups are keyed by the std base64 form, whatever variant the client sent
+	encryptedKey = normalizeBase64(encryptedKey)
+
+	// Refuse revoked keys before any other lookup
+	fingerprint := KeyFingerprint(encryptedKey)
+	k.mux.RLock()
+	_, revoked := k.revokedKeys[fingerprint]
+	k.mux.RUnlock()
+	if revoked {
+		return nil, "", fmt.Errorf("%w (fingerprint %s)", ErrKeyRevoked, fingerprint)
+	}
+
+	// Keys KMS hasn't authorized recently skip the in-memory tiers
+	k.mux.RLock()
+	recheck := k.needsKMSRecheckLocked(encryptedKey)
+	k.mux.RUnlock()
+
+	if !recheck {
+		// Check if this is the current key (most common case)
+		k.mux.RLock()
+		if k.currentDataKey != nil && k.currentDataKey.PlaintextKey != nil && k.currentDataKey.EncryptedKey == encryptedKey {
+			key := cloneKey(k.currentDataKey.PlaintextKey)
+			k.mux.RUnlock()
+			k.currentKeyHits.Add(1)
+			return key, KeySourceCurrent, nil
+		}
+		k.mux.RUnlock()
+
+		// Check decryption cache for older keys
+		if key, exists := k.decryptionCache.Get(ctx, encryptedKey); exists {
+			k.cacheHits.Add(1)
+			return key, KeySourceCache, nil
+		}
+	}
+
+	// Keys KMS just refused fail fast, so one bad key doesn't stall a replay on every payload
+	negativeKey := negativeCacheKey(encryptedKey, masterKeyARN, encryptionContext)
+	if err := k.negativeCacheErr(negativeKey); err != nil {
+		return nil, "", err
+	}
+
+	// Decrypt using KMS (for older keys); concurrent lookups of the same key share one call
+	key, err, _ := k.decryptGroup.Do(encryptedKey, func() (interface{}, error) {
+		return k.decryptWithKMS(ctx, encryptedKey, masterKeyARN, encryptionContext, fingerprint)
+	})
+	if err != nil {
+		k.rememberDecryptFailure(negativeKey, err)
+		return nil, "", err
+	}
+	return cloneKey(key.([]byte)), KeySourceKMS, nil
+}
+
+// needsKMSRecheckLocked reports whether encryptedKey must be re-authorized by KMS before use.
+// Keys with no recorded authorization, e.g. ones another replica put in a shared cache,
+// are rechecked too. Callers must hold k.mux.
+func (k *KMSManager) needsKMSRecheckLocked(encryptedKey string) bool {
+	if k.kmsRecheckInterval <= 0 {
+		return false
+	}
+	authorized, ok := k.authorizedAt[encryptedKey]
+	return !ok || k.clock.Now().Sub(authorized) >= k.kmsRecheckInterval
+}
+
+// recordAuthorizationLocked notes that KMS released encryptedKey at the given time.
+// Nothing is recorded while the recheck is disabled. Callers must hold k.mux for writing.
+func (k *KMSManager) recordAuthorizationLocked(encryptedKey string, at time.Time) {
+	if k.kmsRecheckInterval > 0 {
+		k.authorizedAt[encryptedKey] = at
+	}
+}
+
+// decryptWithKMS decrypts a data key through KMS and caches it.
+// The returned slice is separate from the cached copy and is shared by singleflight waiters.
+func (k *KMSManager) decryptWithKMS(ctx context.Context, encryptedKey string, masterKeyARN string, encryptionContext map[string]string, fingerprint string) ([]byte, error) {
+	encryptedBlob, err := decodeBase64(encryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedDataKey, err)
+	}
+	if encryptionContext == nil {
+		encryptionContext = legacyEncryptionContext()
+	}
+
+	// KMS only decrypts when the context matches the one the key was generated with
+	input := &kms.DecryptInput{
+		CiphertextBlob:    encryptedBlob,
+		KeyId:             aws.String(masterKeyARN),
+		EncryptionContext: encryptionContext,
+	}
+
+	var result *kms.DecryptOutput
+	if k.breaker.allow() {
+		k.kmsDecrypts.Add(1)
+		callCtx, cancel := kmsCallContext(ctx, k.decryptTimeout)
+		result, err = k.client.Decrypt(callCtx, input)
+		err = kmsTimeoutError(ctx, callCtx, k.decryptTimeout, err)
+		cancel()
+		k.breaker.record(err)
+		k.keyARNMetrics.recordDecrypt(masterKeyARN, err)
+	} else {
+		err = ErrKMSUnavailable
+	}
+	// A multi-Region key's replica decrypts the same ciphertext while the primary region is down
+	if err != nil {
+		result, err = k.decryptInReplicaRegion(ctx, input, err)
+	}
+	if err != nil {
+		err = keyStateError(err)
+		k.notifyKeyStateError(masterKeyARN, err)
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+
+	// Cache the decrypted key for future use, unless it was revoked while KMS was working
+	k.mux.Lock()
+	if _, revoked := k.revokedKeys[fingerprint]; revoked {
+		k.mux.Unlock()
+		zeroKey(result.Plaintext)
+		return nil, fmt.Errorf("%w (fingerprint %s)", ErrKeyRevoked, fingerprint)
+	}
+	key := cloneKey(result.Plaintext)
+	k.decryptionCache.Set(ctx, encryptedKey, result.Plaintext, k.cacheTTL)
+	k.recordAuthorizationLocked(encryptedKey, k.clock.Now())
+	k.mux.Unlock()
+
+	log.Printf("Decrypted and cached older data key")
+	return key, nil
+}
+
+// keyStateError marks KMS errors caused by the master key's state with ErrKeyUnavailable
+func keyStateError(err error) error {
+	var disabled *types.DisabledException
+	var invalidState *types.KMSInvalidStateException
+	if errors.As(err, &disabled) || errors.As(err, &invalidState) {
+		return fmt.Errorf("%w: %w", ErrKeyUnavailable, err)
+	}
+	return err
+}
+
+// KMSAvailable reports whether KMS calls are currently allowed by the circuit breaker
+func (k *KMSManager) KMSAvailable() bool {
+	return k.breaker.State() != breakerOpen
+}
+
+// RevokeDataKey adds a data key to the denylist so it can no longer decrypt payloads.
+// The key is identified by its fingerprint; any cached copy is zeroed and evicted, and
+// if it is the current key a fresh data key is generated so it stops being used to encrypt.
+// With a revocation store the revocation is also recorded there for the other replicas;
+// if that fails the key is still revoked here and the error says so.
+func (k *KMSManager) RevokeDataKey(ctx context.Context, fingerprint string) error {
+	revokedAt := k.clock.Now()
+	k.mux.Lock()
+	err := k.revokeLocked(ctx, fingerprint, revokedAt)
+	k.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if k.revocations != nil {
+		if err := k.revocations.StoreRevocation(ctx, fingerprint, revokedAt); err != nil {
+			return fmt.Errorf("revoked data key on this replica but failed to share the revocation: %w", err)
+		}
+	}
+	return nil
+}
+
+// revokeLocked denylists a data key, evicts it and rotates away from it if it is the
+// current key (assumes lock is held)
+func (k *KMSManager) revokeLocked(ctx context.Context, fingerprint string, revokedAt time.Time) error {
+	k.revokedKeys[fingerprint] = revokedAt
+
+	k.decryptionCache.Evict(ctx, fingerprint)
+
+	log.Printf("Revoked data key %s", fingerprint)
+
+	if k.currentDataKey != nil && KeyFingerprint(k.currentDataKey.EncryptedKey) == fingerprint {
+		if err := k.rotateDataKeyLocked(ctx); err != nil {
+			return fmt.Errorf("revoked current data key but rotation failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ErrRetireKeyPair is returned by RetireCurrentKey in key pair mode, where the current key
+// has no plaintext half that could be kept for decryption
+var ErrRetireKeyPair = errors.New("the current key cannot be retired in key pair mode")
+
+// RetireCurrentKey stops encrypting with the current data key straight away and installs a
+// fresh one. Unlike a revocation the retired key stays usable for decryption: it moves into
+// the decryption cache like a key rotated out on expiry, so payloads it encrypted still
+// decode without a KMS call. It returns the fingerprints of the retired and the new key.
+func (k *KMSManager) RetireCurrentKey(ctx context.Context) (retired, current string, err error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	if k.keyPairSpec != "" {
+		return "", "", ErrRetireKeyPair
+	}
+	if k.currentDataKey == nil {
+		return "", "", errors.New("no current data key to retire")
+	}
+	retired = KeyFingerprint(k.currentDataKey.EncryptedKey)
+
+	if err := k.rotateDataKeyLocked(ctx); err != nil {
+		return "", "", fmt.Errorf("failed to replace the current data key: %w", err)
+	}
+	current = KeyFingerprint(k.currentDataKey.EncryptedKey)
+	log.Printf("Retired current data key %s, now encrypting with %s", retired, current)
+	return retired, current, nil
+}
+
+// FlushDecryptionCache zeroes and removes every decryption cache entry, so older data keys are
+// fetched from KMS, and re-authorized by it, on their next use. The current data key is kept.
+// It returns the number of entries removed.
+func (k *KMSManager) FlushDecryptionCache(ctx context.Context) int {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	flushed := k.decryptionCache.Flush(ctx)
+	log.Printf("Flushed %d keys from the decryption cache", flushed)
+	return flushed
+}
+
+// CachedKeys describes the decryption cache entries, oldest first. Key material is never included.
+func (k *KMSManager) CachedKeys(ctx context.Context) []CacheEntryInfo {
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	entries := k.decryptionCache.Entries(ctx)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CachedAt.Before(entries[j].CachedAt)
+	})
+	return entries
+}
+
+// CleanupCache removes expired keys from cache and compacts the in-memory cache once it has
+// shrunk well below its peak
+func (k *KMSManager) CleanupCache() {
+	cleanedCount := k.decryptionCache.Cleanup(context.Background())
+	if cleanedCount > 0 {
+		log.Printf("Cleaned up %d expired cached keys", cleanedCount)
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.pruneNegativeCacheLocked()
+
+	// Authorizations past the recheck interval force a KMS call either way, so drop them
+	if k.kmsRecheckInterval > 0 {
+		now := k.clock.Now()
+		for encryptedKey, authorized := range k.authorizedAt {
+			if now.Sub(authorized) >= k.kmsRecheckInterval {
+				delete(k.authorizedAt, encryptedKey)
+			}
+		}
+	}
+}
+
+// DefaultCacheCleanupInterval is how often the background routine runs CleanupCache
+const DefaultCacheCleanupInterval = 15 * time.Minute
+
+// StartCacheCleanup starts background routines for cache cleanup and key rotation monitoring.
+// The routines run until Close is called.
+func (k *KMSManager) StartCacheCleanup(cleanupInterval time.Duration) {
+	k.wg.Add(2)
+
+	// Cache cleanup routine
+	go func() {
+		defer k.wg.Done()
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				k.CleanupCache()
+			case <-k.stopCh:
+				return
+			}
+		}
+	}()
+
+	// Key rotation monitoring routine
+	go func() {
+		defer k.wg.Done()
+		ticker := time.NewTicker(1 * time.Minute) // Check every minute
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				k.mux.RLock()
+				if k.currentDataKey != nil && k.currentDataKey.ExpiresAt.Sub(k.clock.Now()) < 5*time.Minute {
+					expiresIn := k.currentDataKey.ExpiresAt.Sub(k.clock.Now())
+					log.Printf("Current data key expires in %v", expiresIn)
+				}
+				k.mux.RUnlock()
+			case <-k.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// StartPreRotation starts a background routine that replaces the current data key once it is
+// within window of expiring, so no request waits on KMS for a rotation. It checks every
+// checkInterval and runs until Close is called. If pre-rotation fails, the key is still
+// rotated on first use after it expires.
+func (k *KMSManager) StartPreRotation(window time.Duration, checkInterval time.Duration) {
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := k.preRotate(context.Background(), window); err != nil {
+					log.Printf("Pre-rotation failed, will retry: %v", err)
+				}
+			case <-k.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// preRotate rotates the current data key if it expires within window.
+// The new key is generated without the lock, so encodes keep using the old key meanwhile.
+func (k *KMSManager) preRotate(ctx context.Context, window time.Duration) error {
+	k.mux.RLock()
+	current := k.currentDataKey
+	k.mux.RUnlock()
+	if current != nil && current.ExpiresAt.Sub(k.clock.Now()) > window {
+		return nil
+	}
+
+	// A shared or pooled key needs no KMS call, so it can be installed straight away
+	k.mux.Lock()
+	if k.currentDataKey == current {
+		if k.adoptSharedKeyLocked(ctx, k.clock.Now().Add(window)) {
+			k.mux.Unlock()
+			return nil
+		}
+		if next := k.takePooledKeyLocked(); next != nil {
+			k.installDataKeyLocked(ctx, next)
+			k.mux.Unlock()
+			return nil
+		}
+	}
+	k.mux.Unlock()
+
+	next, err := k.generateDataKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if k.currentDataKey != current {
+		// Rotated by a request or revocation meanwhile; keep that key
+		zeroKey(next.PlaintextKey)
+		return nil
+	}
+	k.installDataKeyLocked(ctx, next)
+	return nil
+}
+
+// Close stops the background routines and waits for them to exit.
+// It is safe to call Close more than once.
+func (k *KMSManager) Close() {
+	k.stopOnce.Do(func() {
+		close(k.stopCh)
+	})
+	k.wg.Wait()
+}
+
+// GetKeyStats returns statistics about current key usage
+func (k *KMSManager) GetKeyStats() map[string]interface{} {
+	cachedKeys := k.decryptionCache.Len(context.Background())
+
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	stats := map[string]interface{}{
+		"cached_keys_count":             cachedKeys,
+		"cache_backend":                 k.decryptionCache.Backend(),
+		"revoked_keys_count":            len(k.revokedKeys),
+		"revocations_shared":            k.revocations != nil,
+		"current_key_hits":              k.currentKeyHits.Load(),
+		"cache_hits":                    k.cacheHits.Load(),
+		"kms_decrypts":                  k.kmsDecrypts.Load(),
+		"negative_cache_hits":           k.negativeCacheHits.Load(),
+		"negative_cached_keys":          len(k.negativeCache),
+		"forced_rotations":              k.forcedRotations.Load(),
+		"data_key_mode":                 "symmetric",
+		"data_key_spec":                 string(k.dataKeySpec),
+		"encryption_context_validation": k.contextValidation,
+		"kms_circuit_state":             k.breaker.State(),
+	}
+	if k.keyPairSpec != "" {
+		stats["data_key_mode"] = "key_pair:" + string(k.keyPairSpec)
+	}
+	if _, local := k.client.(*LocalKMS); local {
+		stats["kms_mode"] = "local-insecure"
+	}
+	if len(k.contextFields) > 0 {
+		stats["encryption_context_fields"] = slices.Sorted(maps.Keys(k.contextFields))
+	}
+
+	if k.currentDataKey != nil {
+		now := k.clock.Now()
+		stats["current_key_age"] = now.Sub(k.currentDataKey.GeneratedAt).String()
+		stats["current_key_expires_in"] = k.currentDataKey.ExpiresAt.Sub(now).String()
+		stats["current_key_expired"] = k.keyExpired(k.currentDataKey)
+	}
+	if k.multiRegionInfo != nil {
+		stats["multi_region"] = k.multiRegionInfo
+	}
+	if k.sharedKeys != nil {
+		stats["shared_key_adoptions"] = k.sharedKeyAdoptions.Load()
+	}
+	if k.replicaClient != nil {
+		stats["kms_replica_region"] = k.replicaRegion
+		stats["kms_replica_decrypts"] = k.replicaDecrypts.Load()
+	}
+	if k.keyPoolDepth > 0 {
+		stats["key_pool_size"] = len(k.keyPool)
+		stats["key_pool_depth"] = k.keyPoolDepth
+	}
+	stats["key_arns"] = k.keyARNMetrics.snapshot()
+
+	return stats
+}
+
+// DefaultPreRotationWindow is how long before expiry the background routine replaces the data key
+const DefaultPreRotationWindow = 5 * time.Minute
+
+// DefaultDataKeySpec is the KMS key spec of symmetric data keys unless WithDataKeySpec says otherwise
+const DefaultDataKeySpec = types.DataKeySpecAes256
+
+// dataKeyLength returns the plaintext length in bytes of a data key with the given spec
+func dataKeyLength(spec types.DataKeySpec) int {
+	switch spec {
+	case types.DataKeySpecAes128:
+		return 16
+	default:
+		return 32
+	}
+}
+
+// Data key sources reported by DecryptDataKeyWithSource
+const (
+	KeySourceCurrent = "current"
+	KeySourceCache   = "cache"
+	KeySourceKMS     = "kms"
+)
+
+// KeyFingerprint returns a short, non-sensitive identifier for an encrypted data key
+func KeyFingerprint(encryptedKey string) string {
+	sum := sha256.Sum256([]byte(normalizeBase64(encryptedKey)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// cloneKey returns an independent copy of key material
+func cloneKey(key []byte) []byte {
+	return append([]byte(nil), key...)
+}
+
+// zeroKey overwrites key material in place
+func zeroKey(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
+
+// Algorithm identifiers recorded in PayloadData.Algorithm
+const (
+	AlgorithmAES256GCM        = "AES-256-GCM"
+	AlgorithmAES256GCMDet     = "AES-256-GCM-DETERMINISTIC"
+	AlgorithmRSAOAEPAES256GCM = "RSA-OAEP-256+AES-256-GCM"
+	AlgorithmAES256GCMFields  = "AES-256-GCM-FIELDS"
+	AlgorithmAES256GCMSIV     = "AES-256-GCM-SIV"
+	AlgorithmAES128GCM        = "AES-128-GCM"
+)
+
+// algorithmKeyLength returns the data key length in bytes an algorithm needs. Only whole-payload
+// AES-128-GCM uses AES_128 data keys; every other algorithm needs AES_256 ones.
+func algorithmKeyLength(algorithm string) int {
+	if algorithm == AlgorithmAES128GCM {
+		return dataKeyLength(types.DataKeySpecAes128)
+	}
+	return dataKeyLength(types.DataKeySpecAes256)
+}
+
+// PayloadAlgorithm returns the whole-payload algorithm for data keys of spec: AlgorithmAES128GCM
+// for AES_128 keys, and cipher (AES-256-GCM or AES-256-GCM-SIV) otherwise
+func PayloadAlgorithm(spec types.DataKeySpec, cipher string) string {
+	if spec == types.DataKeySpecAes128 {
+		return AlgorithmAES128GCM
+	}
+	return cipher
+}
+
+// EncryptWithDataKey encrypts data using AES-GCM with the provided key
+func EncryptWithDataKey(data []byte, key []byte) (string, error) {
+	return EncryptWithDataKeyAAD(data, key, nil)
+}
+
+// EncryptWithDataKeyAAD is EncryptWithDataKey that also authenticates additionalData,
+// which is not stored in the ciphertext and must be passed again to decrypt
+func EncryptWithDataKeyAAD(data []byte, key []byte, additionalData []byte) (string, error) {
+	return EncryptWithAlgorithm(AlgorithmAES256GCM, data, key, additionalData)
+}
+
+// dataKeyAEAD returns the AEAD for a whole-payload algorithm: AES-256-GCM, AES-128-GCM or AES-256-GCM-SIV
+func dataKeyAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	if want := algorithmKeyLength(algorithm); len(key) != want {
+		return nil, fmt.Errorf("key must be %d bytes for %s", want, algorithm)
+	}
+
+	switch algorithm {
+	case AlgorithmAES256GCM, AlgorithmAES128GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AlgorithmAES256GCMSIV:
+		return newGCMSIV(key)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+}
+
+// EncryptWithAlgorithm encrypts data with a random nonce under algorithm, which is
+// AlgorithmAES256GCM, AlgorithmAES128GCM or AlgorithmAES256GCMSIV, authenticating additionalData
+func EncryptWithAlgorithm(algorithm string, data []byte, key []byte, additionalData []byte) (string, error) {
+	gcm, err := dataKeyAEAD(algorithm, key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, data, additionalData)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptWithDataKey decrypts base64 encoded data using AES-GCM with the provided key
+func DecryptWithDataKey(encodedData string, key []byte) ([]byte, error) {
+	return DecryptWithDataKeyAAD(encodedData, key, nil)
+}
+
+// DecryptWithDataKeyAAD decrypts data made by EncryptWithDataKeyAAD with the same additional data
+func DecryptWithDataKeyAAD(encodedData string, key []byte, additionalData []byte) ([]byte, error) {
+	return DecryptWithAlgorithm(AlgorithmAES256GCM, encodedData, key, additionalData)
+}
+
+// DecryptWithAlgorithm decrypts data made by EncryptWithAlgorithm with the same algorithm and additional data
+func DecryptWithAlgorithm(algorithm string, encodedData string, key []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := dataKeyAEAD(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := decodeBase64(encodedData)
+	if err != nil {
+		return nil, fmt.Errorf("base64 decode failed: %w", err)
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
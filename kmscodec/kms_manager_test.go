@@ -0,0 +1,732 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const testKeyARN = "arn:aws:kms:us-east-1:123456789012:key/test-key"
+
+// fakeKMS is an in-memory KMSClient that hands out deterministic data keys
+type fakeKMS struct {
+	mu            sync.Mutex
+	keys          map[string][]byte            // ciphertext blob -> plaintext key
+	contexts      map[string]map[string]string // ciphertext blob -> encryption context at generate time
+	generateCalls int
+	decryptCalls  int
+	generateErr   error
+	decryptErr    error
+	decryptDelay  time.Duration // simulated KMS latency
+	generateDelay time.Duration
+	keyLength     int // plaintext data key length; zero means the requested spec's length
+}
+
+func newFakeKMS() *fakeKMS {
+	return &fakeKMS{keys: make(map[string][]byte), contexts: make(map[string]map[string]string)}
+}
+
+// simulateLatency waits for delay like a slow KMS call, giving up when ctx is done
+func simulateLatency(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeKMS) GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	f.mu.Lock()
+	delay := f.generateDelay
+	f.mu.Unlock()
+	if err := simulateLatency(ctx, delay); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.generateCalls++
+	if f.generateErr != nil {
+		return nil, f.generateErr
+	}
+
+	keyLength := f.keyLength
+	if keyLength == 0 {
+		keyLength = dataKeyLength(params.KeySpec)
+	}
+	plaintext := bytes.Repeat([]byte{byte(f.generateCalls)}, keyLength)
+	blob := []byte(fmt.Sprintf("blob-%d", f.generateCalls))
+	f.keys[string(blob)] = append([]byte(nil), plaintext...)
+	f.contexts[string(blob)] = params.EncryptionContext
+
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      plaintext,
+		CiphertextBlob: blob,
+		KeyId:          params.KeyId,
+	}, nil
+}
+
+func (f *fakeKMS) GenerateDataKeyPairWithoutPlaintext(ctx context.Context, params *kms.GenerateDataKeyPairWithoutPlaintextInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyPairWithoutPlaintextOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.generateCalls++
+	if f.generateErr != nil {
+		return nil, f.generateErr
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := []byte(fmt.Sprintf("pair-blob-%d", f.generateCalls))
+	f.keys[string(blob)] = privateDER
+	f.contexts[string(blob)] = params.EncryptionContext
+
+	return &kms.GenerateDataKeyPairWithoutPlaintextOutput{
+		PublicKey:                publicDER,
+		PrivateKeyCiphertextBlob: blob,
+		KeyId:                    params.KeyId,
+		KeyPairSpec:              params.KeyPairSpec,
+	}, nil
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	f.mu.Lock()
+	delay := f.decryptDelay
+	f.mu.Unlock()
+	if err := simulateLatency(ctx, delay); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.decryptCalls++
+	if f.decryptErr != nil {
+		return nil, f.decryptErr
+	}
+
+	plaintext, ok := f.keys[string(params.CiphertextBlob)]
+	if !ok {
+		return nil, errors.New("InvalidCiphertextException: unknown ciphertext")
+	}
+	// Like KMS, refuse to decrypt unless the encryption context matches exactly
+	if !maps.Equal(f.contexts[string(params.CiphertextBlob)], params.EncryptionContext) {
+		return nil, errors.New("InvalidCiphertextException: encryption context mismatch")
+	}
+
+	return &kms.DecryptOutput{
+		Plaintext: append([]byte(nil), plaintext...),
+		KeyId:     params.KeyId,
+	}, nil
+}
+
+func (f *fakeKMS) calls() (generate, decrypt int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.generateCalls, f.decryptCalls
+}
+
+// memoryEntries exposes the default in-memory cache's entries; callers must not run concurrently with the manager
+func memoryEntries(manager *KMSManager) map[string]*CachedKey {
+	return manager.decryptionCache.(*memoryCache).entries
+}
+
+func newTestManager(t testing.TB, fake *fakeKMS) *KMSManager {
+	t.Helper()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	return manager
+}
+
+func TestNewKMSManagerGeneratesInitialKey(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	if generate, _ := fake.calls(); generate != 1 {
+		t.Fatalf("expected 1 GenerateDataKey call, got %d", generate)
+	}
+	if manager.currentDataKey == nil || len(manager.currentDataKey.PlaintextKey) != 32 {
+		t.Fatalf("expected a 32-byte initial data key")
+	}
+}
+
+func TestNewKMSManagerFailsWhenGenerateFails(t *testing.T) {
+	fake := newFakeKMS()
+	fake.generateErr = errors.New("ThrottlingException: rate exceeded")
+
+	if _, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour); err == nil {
+		t.Fatal("expected an error when the initial data key cannot be generated")
+	}
+}
+
+func TestGetCurrentDataKeyReusesUnexpiredKey(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	first, err := manager.GetCurrentDataKey(context.Background())
+	if err != nil {
+		t.Fatalf("GetCurrentDataKey: %v", err)
+	}
+	second, err := manager.GetCurrentDataKey(context.Background())
+	if err != nil {
+		t.Fatalf("GetCurrentDataKey: %v", err)
+	}
+
+	if first.EncryptedKey != second.EncryptedKey {
+		t.Fatal("expected the same data key before expiry")
+	}
+	if generate, _ := fake.calls(); generate != 1 {
+		t.Fatalf("expected no rotation before expiry, got %d generate calls", generate)
+	}
+}
+
+func TestGetCurrentDataKeyRotatesAfterExpiry(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	original, _ := manager.GetCurrentDataKey(context.Background())
+	manager.currentDataKey.ExpiresAt = time.Now().Add(-time.Second)
+
+	rotated, err := manager.GetCurrentDataKey(context.Background())
+	if err != nil {
+		t.Fatalf("GetCurrentDataKey: %v", err)
+	}
+
+	if rotated.EncryptedKey == original.EncryptedKey {
+		t.Fatal("expected a new data key after expiry")
+	}
+	if generate, _ := fake.calls(); generate != 2 {
+		t.Fatalf("expected 2 generate calls, got %d", generate)
+	}
+	if _, cached := memoryEntries(manager)[original.EncryptedKey]; !cached {
+		t.Fatal("expected the outgoing data key to move into the decryption cache")
+	}
+}
+
+func TestRotationKeepsOutgoingKeyDecryptableWithoutKMS(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	before, _ := manager.GetCurrentDataKey(context.Background())
+	encrypted, err := EncryptWithDataKey([]byte("in flight"), before.PlaintextKey)
+	if err != nil {
+		t.Fatalf("EncryptWithDataKey: %v", err)
+	}
+
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	key, err := manager.DecryptDataKey(context.Background(), before.EncryptedKey, testKeyARN, before.EncryptionContext)
+	if err != nil {
+		t.Fatalf("DecryptDataKey: %v", err)
+	}
+	plaintext, err := DecryptWithDataKey(encrypted, key)
+	if err != nil || string(plaintext) != "in flight" {
+		t.Fatalf("failed to decrypt payload made before rotation: %v", err)
+	}
+	if _, decrypt := fake.calls(); decrypt != 0 {
+		t.Fatalf("expected no KMS decrypt for the previous key, got %d", decrypt)
+	}
+}
+
+func TestGetCurrentDataKeyReturnsRotationError(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	manager.currentDataKey.ExpiresAt = time.Now().Add(-time.Second)
+	fake.generateErr = errors.New("ThrottlingException: rate exceeded")
+
+	if _, err := manager.GetCurrentDataKey(context.Background()); err == nil {
+		t.Fatal("expected rotation error to be returned")
+	}
+}
+
+func TestDecryptDataKeyPassesStoredEncryptionContext(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	original, _ := manager.GetCurrentDataKey(context.Background())
+	want := cloneKey(original.PlaintextKey)
+	if got := original.EncryptionContext["timestamp"]; got != fmt.Sprintf("%d", clock.Now().Unix()) {
+		t.Fatalf("expected the generate-time timestamp in the context, got %q", got)
+	}
+	if !maps.Equal(fake.contexts["blob-1"], original.EncryptionContext) {
+		t.Fatalf("expected the stored context to match the one sent to KMS, got %v", fake.contexts["blob-1"])
+	}
+
+	clock.Advance(time.Minute)
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	clearDecryptionCache(manager)
+
+	// The fake, like KMS, refuses a decrypt whose context differs from the generate-time one
+	if _, err := manager.DecryptDataKey(context.Background(), original.EncryptedKey, testKeyARN, nil); err == nil {
+		t.Fatal("expected decrypt without the stored context to fail")
+	}
+	key, source, err := manager.DecryptDataKeyWithSource(context.Background(), original.EncryptedKey, testKeyARN, original.EncryptionContext)
+	if err != nil {
+		t.Fatalf("DecryptDataKeyWithSource: %v", err)
+	}
+	if source != KeySourceKMS || !bytes.Equal(key, want) {
+		t.Fatalf("expected the original key from KMS, got source %q", source)
+	}
+}
+
+func TestDecryptDataKeyCurrentKeyFastPath(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	current, _ := manager.GetCurrentDataKey(context.Background())
+	key, err := manager.DecryptDataKey(context.Background(), current.EncryptedKey, testKeyARN, nil)
+	if err != nil {
+		t.Fatalf("DecryptDataKey: %v", err)
+	}
+
+	if !bytes.Equal(key, current.PlaintextKey) {
+		t.Fatal("expected the current plaintext key")
+	}
+	if _, decrypt := fake.calls(); decrypt != 0 {
+		t.Fatalf("expected no KMS decrypt for the current key, got %d", decrypt)
+	}
+}
+
+func TestDecryptDataKeyCachesOlderKeys(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	old, _ := manager.GetCurrentDataKey(context.Background())
+	oldEncrypted := old.EncryptedKey
+	oldPlaintext := append([]byte(nil), old.PlaintextKey...)
+
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	delete(memoryEntries(manager), oldEncrypted) // force the KMS path
+
+	for i := 0; i < 3; i++ {
+		key, err := manager.DecryptDataKey(context.Background(), oldEncrypted, testKeyARN, old.EncryptionContext)
+		if err != nil {
+			t.Fatalf("DecryptDataKey: %v", err)
+		}
+		if !bytes.Equal(key, oldPlaintext) {
+			t.Fatal("decrypted key does not match the original data key")
+		}
+	}
+
+	if _, decrypt := fake.calls(); decrypt != 1 {
+		t.Fatalf("expected 1 KMS decrypt with caching, got %d", decrypt)
+	}
+	if len(memoryEntries(manager)) != 1 {
+		t.Fatalf("expected 1 cached key, got %d", len(memoryEntries(manager)))
+	}
+}
+
+func TestDecryptDataKeyReturnsKMSError(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+	fake.decryptErr = errors.New("ThrottlingException: rate exceeded")
+
+	encrypted := base64.StdEncoding.EncodeToString([]byte("blob-unknown"))
+	if _, err := manager.DecryptDataKey(context.Background(), encrypted, testKeyARN, nil); err == nil {
+		t.Fatal("expected KMS decrypt error to be returned")
+	}
+	if len(memoryEntries(manager)) != 0 {
+		t.Fatal("failed decrypts must not be cached")
+	}
+}
+
+func TestDecryptDataKeyRejectsInvalidBase64(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	if _, err := manager.DecryptDataKey(context.Background(), "not base64!", testKeyARN, nil); err == nil {
+		t.Fatal("expected an error for malformed encrypted key")
+	}
+}
+
+func TestCleanupCacheZeroesExpiredKeys(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	expired := bytes.Repeat([]byte{0xAA}, 32)
+	live := bytes.Repeat([]byte{0xBB}, 32)
+	memoryEntries(manager)["expired"] = &CachedKey{Key: expired, ExpiresAt: time.Now().Add(-time.Minute)}
+	memoryEntries(manager)["live"] = &CachedKey{Key: live, ExpiresAt: time.Now().Add(time.Minute)}
+
+	manager.CleanupCache()
+
+	if _, exists := memoryEntries(manager)["expired"]; exists {
+		t.Fatal("expected expired entry to be removed")
+	}
+	if _, exists := memoryEntries(manager)["live"]; !exists {
+		t.Fatal("expected live entry to be kept")
+	}
+	if !bytes.Equal(expired, make([]byte, 32)) {
+		t.Fatal("expected expired key bytes to be zeroed")
+	}
+	if !bytes.Equal(live, bytes.Repeat([]byte{0xBB}, 32)) {
+		t.Fatal("live key bytes must not be modified")
+	}
+}
+
+func TestKMSManagerConcurrentAccess(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	old, _ := manager.GetCurrentDataKey(context.Background())
+	oldEncrypted := old.EncryptedKey
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := manager.GetCurrentDataKey(context.Background()); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := manager.DecryptDataKey(context.Background(), oldEncrypted, testKeyARN, old.EncryptionContext); err != nil {
+				errs <- err
+			}
+			manager.CleanupCache()
+			manager.GetKeyStats()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent operation failed: %v", err)
+	}
+}
+
+func TestEncryptDecryptWithDataKeyRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	plaintext := []byte(`{"id":1,"name":"John"}`)
+
+	encrypted, err := EncryptWithDataKey(plaintext, key)
+	if err != nil {
+		t.Fatalf("EncryptWithDataKey: %v", err)
+	}
+	decrypted, err := DecryptWithDataKey(encrypted, key)
+	if err != nil {
+		t.Fatalf("DecryptWithDataKey: %v", err)
+	}
+
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("round trip mismatch: got %q", decrypted)
+	}
+}
+
+func TestEncryptWithDataKeyRejectsShortKey(t *testing.T) {
+	if _, err := EncryptWithDataKey([]byte("data"), make([]byte, 16)); err == nil {
+		t.Fatal("expected an error for a 16-byte key")
+	}
+}
+
+func TestCloseStopsBackgroundRoutines(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+	manager.StartCacheCleanup(time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		manager.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not stop the background routines")
+	}
+
+	// A second Close must not panic or block
+	manager.Close()
+}
+
+func TestDecryptDataKeyCountsEachPath(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	old, _ := manager.GetCurrentDataKey(context.Background())
+	oldEncrypted := old.EncryptedKey
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	delete(memoryEntries(manager), oldEncrypted) // force the KMS path
+	current, _ := manager.GetCurrentDataKey(context.Background())
+
+	manager.DecryptDataKey(context.Background(), current.EncryptedKey, testKeyARN, nil)           // current key
+	manager.DecryptDataKey(context.Background(), oldEncrypted, testKeyARN, old.EncryptionContext) // KMS
+	manager.DecryptDataKey(context.Background(), oldEncrypted, testKeyARN, old.EncryptionContext) // cache
+	manager.DecryptDataKey(context.Background(), oldEncrypted, testKeyARN, old.EncryptionContext) // cache
+
+	stats := manager.GetKeyStats()
+	if stats["current_key_hits"] != int64(1) || stats["kms_decrypts"] != int64(1) || stats["cache_hits"] != int64(2) {
+		t.Fatalf("unexpected counters: current=%v kms=%v cache=%v",
+			stats["current_key_hits"], stats["kms_decrypts"], stats["cache_hits"])
+	}
+}
+
+func TestDecryptDataKeyReturnsCallerOwnedCopy(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	current, _ := manager.GetCurrentDataKey(context.Background())
+	before, _ := EncryptWithDataKey([]byte("before"), current.PlaintextKey)
+
+	key, err := manager.DecryptDataKey(context.Background(), current.EncryptedKey, testKeyARN, nil)
+	if err != nil {
+		t.Fatalf("DecryptDataKey: %v", err)
+	}
+	zeroKey(key)
+
+	// The live current key must be unaffected by the caller zeroing its copy
+	current, _ = manager.GetCurrentDataKey(context.Background())
+	after, err := EncryptWithDataKey([]byte("after"), current.PlaintextKey)
+	if err != nil {
+		t.Fatalf("EncryptWithDataKey: %v", err)
+	}
+	for _, encrypted := range []string{before, after} {
+		key, _ := manager.DecryptDataKey(context.Background(), current.EncryptedKey, testKeyARN, nil)
+		if _, err := DecryptWithDataKey(encrypted, key); err != nil {
+			t.Fatalf("current key was corrupted by caller mutation: %v", err)
+		}
+	}
+
+	// Same guarantee for cached keys
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	cachedCopy, _ := manager.DecryptDataKey(context.Background(), current.EncryptedKey, testKeyARN, nil)
+	zeroKey(cachedCopy)
+	cachedAgain, _ := manager.DecryptDataKey(context.Background(), current.EncryptedKey, testKeyARN, nil)
+	if _, err := DecryptWithDataKey(before, cachedAgain); err != nil {
+		t.Fatalf("cached key was corrupted by caller mutation: %v", err)
+	}
+}
+
+func TestRotationRejectsWrongLengthDataKey(t *testing.T) {
+	fake := newFakeKMS()
+	fake.keyLength = 16
+
+	_, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "16-byte key") {
+		t.Fatalf("expected a descriptive key length error, got %v", err)
+	}
+
+	// A running manager keeps its current key when a rotation returns a bad key
+	fake.keyLength = 0
+	manager := newTestManager(t, fake)
+	before := manager.currentDataKey
+
+	fake.keyLength = 16
+	if err := manager.rotateDataKey(context.Background()); err == nil {
+		t.Fatal("expected rotation to fail")
+	}
+	if manager.currentDataKey != before {
+		t.Fatal("expected the previous data key to stay current")
+	}
+}
+
+func TestDataKeySpecDrivesKeyLengthAndAlgorithm(t *testing.T) {
+	cases := []struct {
+		spec          types.DataKeySpec
+		wantLength    int
+		wantAlgorithm string
+	}{
+		{types.DataKeySpecAes256, 32, AlgorithmAES256GCM},
+		{types.DataKeySpecAes128, 16, AlgorithmAES128GCM},
+	}
+
+	for _, tc := range cases {
+		t.Run(string(tc.spec), func(t *testing.T) {
+			manager, err := NewKMSManagerWithClient(newFakeKMS(), testKeyARN, time.Hour, time.Hour, WithDataKeySpec(tc.spec))
+			if err != nil {
+				t.Fatalf("NewKMSManagerWithClient: %v", err)
+			}
+			if got := len(manager.currentDataKey.PlaintextKey); got != tc.wantLength {
+				t.Fatalf("expected a %d-byte data key, got %d", tc.wantLength, got)
+			}
+			if got := manager.GetKeyStats()["data_key_spec"]; got != string(tc.spec) {
+				t.Fatalf("expected data_key_spec %s, got %v", tc.spec, got)
+			}
+
+			codec := NewKMSEncryptionCodec(manager)
+			encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+				Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+			})).Payloads[0]
+			if encoded.Algorithm != tc.wantAlgorithm {
+				t.Fatalf("expected algorithm %s, got %s", tc.wantAlgorithm, encoded.Algorithm)
+			}
+
+			// Decode picks the key length from the recorded algorithm, through KMS as well as the current key
+			if err := manager.rotateDataKey(context.Background()); err != nil {
+				t.Fatalf("rotateDataKey: %v", err)
+			}
+			manager.decryptionCache.Evict(context.Background(), KeyFingerprint(encoded.EncryptedDataKey))
+			decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+				Payloads: []shared.PayloadData{encoded},
+			})).Payloads[0]
+			if data, _ := decodeBase64(decoded.Data); string(data) != `{"v":1}` {
+				t.Fatalf("unexpected decoded data %q", data)
+			}
+		})
+	}
+}
+
+func TestAlgorithmRejectsKeyOfOtherSpec(t *testing.T) {
+	if _, err := EncryptWithAlgorithm(AlgorithmAES128GCM, []byte("data"), make([]byte, 32), nil); err == nil {
+		t.Fatal("expected AES-128-GCM to reject a 32-byte key")
+	}
+	encrypted, err := EncryptWithAlgorithm(AlgorithmAES128GCM, []byte("data"), make([]byte, 16), nil)
+	if err != nil {
+		t.Fatalf("EncryptWithAlgorithm: %v", err)
+	}
+	// A payload relabelled as AES-256-GCM must not decrypt with the 16-byte key
+	if _, err := DecryptWithAlgorithm(AlgorithmAES256GCM, encrypted, make([]byte, 16), nil); err == nil {
+		t.Fatal("expected AES-256-GCM to reject a 16-byte key")
+	}
+}
+
+func TestDeterministicEncodeNeedsAES256DataKeys(t *testing.T) {
+	manager, err := NewKMSManagerWithClient(newFakeKMS(), testKeyARN, time.Hour, time.Hour, WithDataKeySpec(types.DataKeySpecAes128))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	payload := plainPayload(`{"v":1}`)
+	payload.Metadata[EncryptionModeMetadataKey] = EncryptionModeDeterministic
+
+	rec := doCodecRequest(t, NewKMSEncryptionCodec(manager).handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+// benchmarkPayloadSizes are the plaintext sizes used by the crypto and handler benchmarks
+var benchmarkPayloadSizes = []struct {
+	name string
+	size int
+}{
+	{"1KB", 1 << 10},
+	{"64KB", 64 << 10},
+	{"1MB", 1 << 20},
+}
+
+func BenchmarkEncryptWithDataKey(b *testing.B) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for _, tc := range benchmarkPayloadSizes {
+		b.Run(tc.name, func(b *testing.B) {
+			data := bytes.Repeat([]byte("x"), tc.size)
+			b.SetBytes(int64(tc.size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := EncryptWithDataKey(data, key); err != nil {
+					b.Fatalf("EncryptWithDataKey: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecryptWithDataKey(b *testing.B) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for _, tc := range benchmarkPayloadSizes {
+		b.Run(tc.name, func(b *testing.B) {
+			encrypted, err := EncryptWithDataKey(bytes.Repeat([]byte("x"), tc.size), key)
+			if err != nil {
+				b.Fatalf("EncryptWithDataKey: %v", err)
+			}
+			b.SetBytes(int64(tc.size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := DecryptWithDataKey(encrypted, key); err != nil {
+					b.Fatalf("DecryptWithDataKey: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSealedMemoryCacheNeverStoresPlaintextKeys(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithSealedMemoryCache(true))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	original := manager.currentDataKey
+	plaintext := cloneKey(original.PlaintextKey)
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	cached, ok := memoryEntries(manager)[original.EncryptedKey]
+	if !ok {
+		t.Fatal("expected the outgoing key to be cached")
+	}
+	if bytes.Contains(cached.Key, plaintext) {
+		t.Fatal("cache entry holds the plaintext key")
+	}
+
+	key, err := manager.DecryptDataKey(context.Background(), original.EncryptedKey, testKeyARN, original.EncryptionContext)
+	if err != nil || !bytes.Equal(key, plaintext) {
+		t.Fatalf("expected the sealed entry to unseal to the original key, got %x, %v", key, err)
+	}
+	if _, decrypts := fake.calls(); decrypts != 0 {
+		t.Fatalf("expected a cache hit, got %d KMS decrypts", decrypts)
+	}
+
+	// An entry moved to another encrypted key fails to unseal and falls back to KMS
+	memoryEntries(manager)["moved"] = cached
+	if _, ok := manager.decryptionCache.Get(context.Background(), "moved"); ok {
+		t.Fatal("expected an entry under the wrong encrypted key to fail to unseal")
+	}
+}
@@ -0,0 +1,132 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"temporal-key-rotation/shared"
+
+	commonpb "go.temporal.io/api/common/v1"
+)
+
+// LocalCodec implements the Temporal PayloadCodec interface in-process, calling KMS
+// directly instead of going through the codec server. Its payloads use the same wire
+// format as RemoteCodecClient, so the codec server can still decode them for the Web UI.
+type LocalCodec struct {
+	codec *KMSEncryptionCodec
+}
+
+// NewLocalCodec creates an in-process codec around codec
+func NewLocalCodec(codec *KMSEncryptionCodec) *LocalCodec {
+	return &LocalCodec{codec: codec}
+}
+
+// Encode implements the PayloadCodec interface
+func (l *LocalCodec) Encode(payloads []*commonpb.Payload) ([]*commonpb.Payload, error) {
+	if len(payloads) == 0 {
+		return payloads, nil
+	}
+
+	// Temporal control payloads, such as nil values, are returned as-is, in place
+	result := make([]*commonpb.Payload, len(payloads))
+	var request []shared.PayloadData
+	var positions []int
+	for i, payload := range payloads {
+		if shared.IsControlEncoding(string(payload.Metadata["encoding"])) {
+			result[i] = payload
+			continue
+		}
+		metadata := make(map[string]string)
+		for key, value := range payload.Metadata {
+			metadata[key] = string(value)
+		}
+		request = append(request, shared.PayloadData{
+			Metadata: metadata,
+			Data:     base64.StdEncoding.EncodeToString(payload.Data),
+		})
+		positions = append(positions, i)
+	}
+
+	if len(request) == 0 {
+		return result, nil
+	}
+
+	encoded, err := l.codec.processPayloads(context.Background(), request, l.codec.encode)
+	if err != nil {
+		return nil, fmt.Errorf("encode failed: %w", err)
+	}
+	l.codec.filterMetadata(encoded)
+
+	for i, payloadData := range encoded {
+		serializedPayload, err := json.Marshal(payloadData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize payload data: %w", err)
+		}
+		result[positions[i]] = &commonpb.Payload{
+			Metadata: map[string][]byte{
+				"encoding": []byte("temporal-codec"),
+			},
+			Data: serializedPayload,
+		}
+	}
+	return result, nil
+}
+
+// Decode implements the PayloadCodec interface
+func (l *LocalCodec) Decode(payloads []*commonpb.Payload) ([]*commonpb.Payload, error) {
+	if len(payloads) == 0 {
+		return payloads, nil
+	}
+
+	// Payloads not processed by our codec are returned as-is, in place
+	result := make([]*commonpb.Payload, len(payloads))
+	var request []shared.PayloadData
+	var positions []int
+	for i, payload := range payloads {
+		if string(payload.Metadata["encoding"]) != "temporal-codec" {
+			result[i] = payload
+			continue
+		}
+		var payloadData shared.PayloadData
+		if err := json.Unmarshal(payload.Data, &payloadData); err != nil {
+			return nil, fmt.Errorf("failed to deserialize payload data: %w", err)
+		}
+		request = append(request, payloadData)
+		positions = append(positions, i)
+	}
+
+	if len(request) == 0 {
+		return result, nil
+	}
+
+	// Always strict: workflows must never see a lenient-mode sentinel
+	decoded, err := l.codec.processPayloads(context.Background(), request, l.codec.decodeRouted)
+	if err != nil {
+		return nil, fmt.Errorf("decode failed: %w", err)
+	}
+	l.codec.filterMetadata(decoded)
+
+	for i, payloadData := range decoded {
+		metadata := make(map[string][]byte)
+		for key, value := range payloadData.Metadata {
+			// Provenance metadata is for the Web UI; Temporal gets the original payload shape
+			if shared.IsCodecOnlyMetadata(key) {
+				continue
+			}
+			metadata[key] = []byte(value)
+		}
+
+		data, err := base64.StdEncoding.DecodeString(payloadData.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 data: %w", err)
+		}
+
+		result[positions[i]] = &commonpb.Payload{
+			Metadata: metadata,
+			Data:     data,
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,129 @@
+package kmscodec
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"temporal-key-rotation/shared"
+
+	commonpb "go.temporal.io/api/common/v1"
+)
+
+func TestLocalCodecRoundTrip(t *testing.T) {
+	codec, fake := newTestCodec(t)
+	local := NewLocalCodec(codec)
+
+	original := &commonpb.Payload{
+		Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+		Data:     []byte(`{"id":1}`),
+	}
+	encoded, err := local.Encode([]*commonpb.Payload{original})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if string(encoded[0].Metadata["encoding"]) != "temporal-codec" {
+		t.Fatalf("expected the remote client's wire format, got encoding %q", encoded[0].Metadata["encoding"])
+	}
+
+	decoded, err := local.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if string(decoded[0].Data) != `{"id":1}` || string(decoded[0].Metadata["encoding"]) != "json/plain" {
+		t.Fatalf("unexpected round trip: %s %v", decoded[0].Data, decoded[0].Metadata)
+	}
+	if _, ok := decoded[0].Metadata[shared.KeySourceMetadataKey]; ok {
+		t.Fatal("expected provenance metadata to be stripped")
+	}
+	if _, decrypt := fake.calls(); decrypt != 0 {
+		t.Fatalf("expected the current key fast path, got %d KMS decrypts", decrypt)
+	}
+}
+
+func TestLocalCodecPayloadsDecodeOnTheServer(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	encoded, err := NewLocalCodec(codec).Encode([]*commonpb.Payload{{
+		Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+		Data:     []byte(`{"id":2}`),
+	}})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	// The Web UI sends the stored PayloadData to the codec server's /decode
+	var payload shared.PayloadData
+	if err := json.Unmarshal(encoded[0].Data, &payload); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	resp := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{payload},
+	}))
+	if data, _ := base64.StdEncoding.DecodeString(resp.Payloads[0].Data); string(data) != `{"id":2}` {
+		t.Fatalf("unexpected server decode: %s", data)
+	}
+}
+
+func TestLocalCodecDecodePassesThroughForeignPayloads(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	foreign := &commonpb.Payload{
+		Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+		Data:     []byte(`"plain"`),
+	}
+	decoded, err := NewLocalCodec(codec).Decode([]*commonpb.Payload{foreign})
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if decoded[0] != foreign {
+		t.Fatal("expected a payload not produced by the codec to be returned unchanged")
+	}
+}
+
+func TestLocalCodecPassesThroughNullPayloads(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	local := NewLocalCodec(codec)
+
+	null := &commonpb.Payload{Metadata: map[string][]byte{"encoding": []byte(shared.NullEncoding)}}
+	original := &commonpb.Payload{
+		Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+		Data:     []byte(`{"id":3}`),
+	}
+	encoded, err := local.Encode([]*commonpb.Payload{null, original, null})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if len(encoded) != 3 || encoded[0] != null || encoded[2] != null {
+		t.Fatalf("expected the nil values to be returned unchanged in place, got %v", encoded)
+	}
+	if string(encoded[1].Metadata["encoding"]) != "temporal-codec" {
+		t.Fatalf("expected the JSON payload to be encoded, got %v", encoded[1].Metadata)
+	}
+
+	decoded, err := local.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if decoded[0] != null || decoded[2] != null || string(decoded[1].Data) != `{"id":3}` {
+		t.Fatalf("unexpected round trip: %v", decoded)
+	}
+}
+
+func TestLocalCodecRoundTripsEmptyPayload(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	local := NewLocalCodec(codec)
+
+	// An empty value without an encoding comes back as Temporal's representation of one
+	encoded, err := local.Encode([]*commonpb.Payload{{}})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	decoded, err := local.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(decoded[0].Data) != 0 || string(decoded[0].Metadata["encoding"]) != shared.NullEncoding {
+		t.Fatalf("unexpected round trip: %q %v", decoded[0].Data, decoded[0].Metadata)
+	}
+}
@@ -0,0 +1,108 @@
+package kmscodec
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// LocalKeyARN is the master key ARN of LocalKMS; payloads encoded in local mode carry it
+const LocalKeyARN = "arn:aws:kms:local:000000000000:key/" + localKeyID
+
+// localKeyID is the key ID in LocalKeyARN
+const localKeyID = "local-insecure"
+
+// LocalKMS stands in for KMS in local development and CI, where there are no AWS credentials.
+// Data keys are wrapped with AES-256-GCM under a master key held in memory, bound to the
+// encryption context like KMS binds them, so the codec works exactly as it does against KMS.
+// It is NOT secure: whoever has the master key can read every payload, and there is no
+// access control, audit trail or key rotation. Never use it in production.
+type LocalKMS struct {
+	masterKey []byte
+}
+
+// NewLocalKMS creates a LocalKMS under a 32-byte master key, such as one from keygen.
+// It keeps its own copy of the key.
+func NewLocalKMS(masterKey []byte) (*LocalKMS, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("local master key must be 32 bytes, got %d", len(masterKey))
+	}
+	return &LocalKMS{masterKey: cloneKey(masterKey)}, nil
+}
+
+// wrapAAD binds a wrapped data key to its master key ID and encryption context.
+// json.Marshal sorts map keys, so equal contexts always give the same bytes.
+func wrapAAD(keyID string, encryptionContext map[string]string) []byte {
+	aad, _ := json.Marshal(struct {
+		KeyID   string            `json:"key_id"`
+		Context map[string]string `json:"context"`
+	}{keyID, encryptionContext})
+	return aad
+}
+
+// GenerateDataKey returns a random data key and its wrapped form
+func (l *LocalKMS) GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	plaintext := make([]byte, dataKeyLength(params.KeySpec))
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+	gcm, err := dataKeyAEAD(AlgorithmAES256GCM, l.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	keyID := aws.ToString(params.KeyId)
+	blob := gcm.Seal(nonce, nonce, plaintext, wrapAAD(keyID, params.EncryptionContext))
+	return &kms.GenerateDataKeyOutput{Plaintext: plaintext, CiphertextBlob: blob, KeyId: aws.String(keyID)}, nil
+}
+
+// GenerateDataKeyPairWithoutPlaintext is not supported; local mode uses symmetric data keys
+func (l *LocalKMS) GenerateDataKeyPairWithoutPlaintext(ctx context.Context, params *kms.GenerateDataKeyPairWithoutPlaintextInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyPairWithoutPlaintextOutput, error) {
+	return nil, &types.UnsupportedOperationException{Message: aws.String("data key pairs are not supported in local mode")}
+}
+
+// Decrypt unwraps a data key, refusing it like KMS does when the key ID or encryption context
+// differs from the ones it was generated with
+func (l *LocalKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	gcm, err := dataKeyAEAD(AlgorithmAES256GCM, l.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	blob := params.CiphertextBlob
+	invalid := &types.InvalidCiphertextException{Message: aws.String("ciphertext was not wrapped by this local key with this encryption context")}
+	if len(blob) < gcm.NonceSize() {
+		return nil, invalid
+	}
+	keyID := aws.ToString(params.KeyId)
+	plaintext, err := gcm.Open(nil, blob[:gcm.NonceSize()], blob[gcm.NonceSize():], wrapAAD(keyID, params.EncryptionContext))
+	if err != nil {
+		return nil, invalid
+	}
+	return &kms.DecryptOutput{Plaintext: plaintext, KeyId: aws.String(keyID)}, nil
+}
+
+// DescribeKey describes the local master key, so /key-info and the multi-Region refresh work
+func (l *LocalKMS) DescribeKey(ctx context.Context, params *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error) {
+	if keyID := aws.ToString(params.KeyId); keyID != LocalKeyARN && keyID != localKeyID {
+		return nil, &types.NotFoundException{Message: aws.String(fmt.Sprintf("%s is not the local key", keyID))}
+	}
+	return &kms.DescribeKeyOutput{KeyMetadata: &types.KeyMetadata{
+		Arn:         aws.String(LocalKeyARN),
+		KeyId:       aws.String(localKeyID),
+		Description: aws.String("local development key; not secure"),
+		Enabled:     true,
+		KeyState:    types.KeyStateEnabled,
+		KeyManager:  types.KeyManagerTypeCustomer,
+		KeySpec:     types.KeySpecSymmetricDefault,
+		KeyUsage:    types.KeyUsageTypeEncryptDecrypt,
+		MultiRegion: aws.Bool(false),
+	}}, nil
+}
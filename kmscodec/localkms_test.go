@@ -0,0 +1,108 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+
+	"temporal-key-rotation/shared"
+)
+
+func newLocalCodec(t *testing.T, masterKey []byte) *KMSEncryptionCodec {
+	t.Helper()
+	localKMS, err := NewLocalKMS(masterKey)
+	if err != nil {
+		t.Fatalf("NewLocalKMS: %v", err)
+	}
+	manager, err := NewKMSManagerWithClient(localKMS, LocalKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	return NewKMSEncryptionCodec(manager)
+}
+
+func TestLocalModeEncodesAndDecodesWithoutAWS(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{0x42}, 32)
+	codec := newLocalCodec(t, masterKey)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "")
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"id":1}`)},
+	})).Payloads[0]
+	if encoded.KMSKeyID != LocalKeyARN || encoded.EncryptedDataKey == "" {
+		t.Fatalf("expected a payload under the local key, got %+v", encoded)
+	}
+
+	// A restarted server with the same master key unwraps the data key again
+	restarted := newLocalCodec(t, masterKey)
+	decoded := decodeCodecResponse(t, doCodecRequest(t, restarted.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{encoded},
+	})).Payloads[0]
+	if data, _ := decodeBase64(decoded.Data); string(data) != `{"id":1}` {
+		t.Fatalf("unexpected plaintext %q", data)
+	}
+	if decoded.Metadata[shared.KeySourceMetadataKey] != KeySourceKMS {
+		t.Fatalf("expected the data key to be unwrapped by the local KMS, got %v", decoded.Metadata)
+	}
+
+	// Another master key cannot
+	other := newLocalCodec(t, bytes.Repeat([]byte{0x43}, 32))
+	if rec := doCodecRequest(t, other.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{encoded}}); rec.Code == http.StatusOK {
+		t.Fatal("expected a different master key to fail")
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	if stats["kms_mode"] != "local-insecure" {
+		t.Fatalf("expected stats to flag local mode, got %v", stats["kms_mode"])
+	}
+}
+
+func TestLocalKMSBindsEncryptionContext(t *testing.T) {
+	localKMS, err := NewLocalKMS(bytes.Repeat([]byte{1, 2}, 16))
+	if err != nil {
+		t.Fatalf("NewLocalKMS: %v", err)
+	}
+	encryptionContext := map[string]string{"service": "temporal-codec", "timestamp": "1"}
+	generated, err := localKMS.GenerateDataKey(context.Background(), &kms.GenerateDataKeyInput{
+		KeyId: aws.String(LocalKeyARN), KeySpec: types.DataKeySpecAes128, EncryptionContext: encryptionContext,
+	})
+	if err != nil || len(generated.Plaintext) != 16 {
+		t.Fatalf("GenerateDataKey: %v", err)
+	}
+
+	decrypt := func(keyID string, encryptionContext map[string]string) error {
+		_, err := localKMS.Decrypt(context.Background(), &kms.DecryptInput{
+			CiphertextBlob: generated.CiphertextBlob, KeyId: aws.String(keyID), EncryptionContext: encryptionContext,
+		})
+		return err
+	}
+	if err := decrypt(LocalKeyARN, encryptionContext); err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	var invalid *types.InvalidCiphertextException
+	if err := decrypt(LocalKeyARN, map[string]string{"service": "temporal-codec", "timestamp": "2"}); !errors.As(err, &invalid) {
+		t.Fatalf("expected another context to be refused, got %v", err)
+	}
+	if err := decrypt(testKeyARN, encryptionContext); !errors.As(err, &invalid) {
+		t.Fatalf("expected another key ID to be refused, got %v", err)
+	}
+
+	if _, err := NewLocalKMS(make([]byte, 16)); err == nil {
+		t.Fatal("expected a 16-byte master key to be rejected")
+	}
+}
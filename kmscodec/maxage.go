@@ -0,0 +1,62 @@
+package kmscodec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+// WithDecodeMaxAge makes /decode refuse payloads encoded more than maxAge ago, limiting how long
+// a stolen payload can be replayed through it to read the plaintext. The age comes from the
+// authenticated encode time (WithEncodeTimestamp); payloads without one decode as before.
+// Admins viewing older history pass history=true with the admin token. Zero or less disables it.
+func WithDecodeMaxAge(maxAge time.Duration) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.decodeMaxAge = maxAge
+	}
+}
+
+type decodeWindowKey struct{}
+
+// decodeWindow bounds the encode times a decode accepts
+type decodeWindow struct {
+	notBefore time.Time // the max age cutoff
+	notAfter  time.Time // now plus the clock skew tolerance
+}
+
+// withDecodeWindow makes decodes under ctx refuse payloads encoded before notBefore, or after
+// notAfter on a clock running ahead of ours
+func withDecodeWindow(ctx context.Context, notBefore, notAfter time.Time) context.Context {
+	return context.WithValue(ctx, decodeWindowKey{}, decodeWindow{notBefore: notBefore, notAfter: notAfter})
+}
+
+// checkDecodeAge refuses payload if ctx carries a decode window and payload was encoded outside
+// it. Encode times ahead of ours by up to the clock skew tolerance are another replica's clock
+// running fast and are accepted; further ahead they would stretch the max age. The encode time
+// is checked before it is authenticated: a forged later time fails decryption, and removing it
+// does too, so only genuinely recent payloads get through.
+func (c *KMSEncryptionCodec) checkDecodeAge(ctx context.Context, payload shared.PayloadData) error {
+	window, ok := ctx.Value(decodeWindowKey{}).(decodeWindow)
+	if !ok || payload.EncodedAt == "" {
+		return nil
+	}
+	encodedAt, err := time.Parse(time.RFC3339, payload.EncodedAt)
+	if err != nil {
+		return &codecError{http.StatusBadRequest, "Corrupt payload: invalid encoded_at", err}
+	}
+	switch {
+	case encodedAt.Before(window.notBefore):
+		c.decodeAgeRejections.Add(1)
+		log.Printf("Refused to decode payload encoded at %s, before the decode max age cutoff %s", payload.EncodedAt, window.notBefore.UTC().Format(time.RFC3339))
+		return &codecError{http.StatusForbidden, fmt.Sprintf("Payload was encoded at %s, longer ago than the decode max age of %s; admins can decode it with history=true", payload.EncodedAt, c.decodeMaxAge), nil}
+	case encodedAt.After(window.notAfter):
+		c.decodeAgeRejections.Add(1)
+		log.Printf("Refused to decode payload encoded at %s, ahead of this server's clock by more than the skew tolerance", payload.EncodedAt)
+		return &codecError{http.StatusForbidden, fmt.Sprintf("Payload was encoded at %s, further ahead of this server's clock than the clock skew tolerance of %s; check the encoding replica's clock, or admins can decode it with history=true", payload.EncodedAt, c.kmsManager.clockSkewTolerance), nil}
+	}
+	return nil
+}
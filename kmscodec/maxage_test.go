@@ -0,0 +1,124 @@
+package kmscodec
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestDecodeMaxAge(t *testing.T) {
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(newFakeKMS(), testKeyARN, time.Hour, time.Hour, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager, WithEncodeTimestamp(true), WithDecodeMaxAge(2*time.Hour))
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "secret")
+
+	decode := func(token, query string, payload shared.PayloadData) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(shared.CodecRequest{Payloads: []shared.PayloadData{payload}})
+		req := httptest.NewRequest(http.MethodPost, "/decode"+query, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	payload := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"card":"4111"}`)},
+	})).Payloads[0]
+	// Without an encode time there is no age to check
+	untimed := decodeCodecResponse(t, doCodecRequest(t, NewKMSEncryptionCodec(manager).handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"card":"4111"}`)},
+	})).Payloads[0]
+
+	// In the window
+	clock.Advance(90 * time.Minute)
+	if rec := decode("", "", payload); rec.Code != http.StatusOK {
+		t.Fatalf("expected a payload inside the max age to decode, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Out of the window
+	clock.Advance(time.Hour)
+	if rec := decode("", "", payload); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 past the max age, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := decode("", "", untimed); rec.Code != http.StatusOK {
+		t.Fatalf("expected a payload without an encode time to decode, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A later encode time is not authenticated, so it can't make an old payload look recent
+	forged := payload
+	forged.EncodedAt = clock.Now().UTC().Format(time.RFC3339)
+	if rec := decode("", "", forged); rec.Code == http.StatusOK {
+		t.Fatal("expected a forged encode time to fail decryption")
+	}
+
+	// Viewing older history is for admins
+	if rec := decode("", "?history=true", payload); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for history without the admin token, got %d", rec.Code)
+	}
+	rec := decode("secret", "?history=true", payload)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected admins to decode older history, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if data, _ := decodeBase64(decodeCodecResponse(t, rec).Payloads[0].Data); string(data) != `{"card":"4111"}` {
+		t.Fatalf("unexpected plaintext %q", data)
+	}
+
+	if rejections := codec.decodeAgeRejections.Load(); rejections != 1 {
+		t.Fatalf("expected 1 max age rejection, got %d", rejections)
+	}
+}
+
+func TestDecodeMaxAgeToleratesClockSkew(t *testing.T) {
+	fake := newFakeKMS()
+	localClock := newFakeClock()
+	local, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(localClock), WithClockSkewTolerance(30*time.Second))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	decoder := NewKMSEncryptionCodec(local, WithDecodeMaxAge(time.Hour))
+
+	// encodeAhead encodes a payload on a replica whose clock runs ahead of ours by skew
+	encodeAhead := func(skew time.Duration) shared.PayloadData {
+		clock := newFakeClock()
+		clock.Advance(skew)
+		remote, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock))
+		if err != nil {
+			t.Fatalf("NewKMSManagerWithClient: %v", err)
+		}
+		return decodeCodecResponse(t, doCodecRequest(t, NewKMSEncryptionCodec(remote, WithEncodeTimestamp(true)).handleEncode, shared.CodecRequest{
+			Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+		})).Payloads[0]
+	}
+
+	within := encodeAhead(20 * time.Second)
+	if rec := doCodecRequest(t, decoder.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{within}}); rec.Code != http.StatusOK {
+		t.Fatalf("expected a payload ahead within the skew tolerance to decode, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	beyond := encodeAhead(5 * time.Minute)
+	if rec := doCodecRequest(t, decoder.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{beyond}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a payload ahead beyond the skew tolerance, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// Once our clock catches up it decodes like any other
+	localClock.Advance(5 * time.Minute)
+	if rec := doCodecRequest(t, decoder.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{beyond}}); rec.Code != http.StatusOK {
+		t.Fatalf("expected the payload to decode once the clocks agree, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Without a max age nothing checks the encode time at all
+	unlimited := NewKMSEncryptionCodec(local)
+	if rec := doCodecRequest(t, unlimited.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{encodeAhead(time.Hour)}}); rec.Code != http.StatusOK {
+		t.Fatalf("expected decode without a max age to ignore the encode time, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,65 @@
+package kmscodec
+
+import (
+	"maps"
+
+	"temporal-key-rotation/shared"
+)
+
+// codecMetadataKeys are the metadata keys the codec writes itself; an allowlist never drops them
+var codecMetadataKeys = map[string]bool{
+	"encoding":                    true,
+	OriginalEncodingMetadataKey:   true,
+	SchemeMetadataKey:             true,
+	EncryptedFieldsMetadataKey:    true,
+	TransformsMetadataKey:         true,
+	SignatureMetadataKey:          true,
+	SigningSchemeMetadataKey:      true,
+	shared.DecodeErrorMetadataKey: true,
+}
+
+// WithMetadataAllowlist limits the metadata encode and decode return to keys, besides the
+// codec's own. Payloads the codec passes through, unencrypted or skipped, otherwise carry
+// whatever metadata they came with, and metadata stored in history is not authenticated, so
+// someone able to edit history could plant keys that downstream code trusts. An empty
+// allowlist returns all metadata.
+func WithMetadataAllowlist(keys []string) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.metadataAllowlist = nil
+		if len(keys) > 0 {
+			c.metadataAllowlist = make(map[string]bool, len(keys))
+			for _, key := range keys {
+				c.metadataAllowlist[key] = true
+			}
+		}
+	}
+}
+
+// allowedMetadataKey reports whether the allowlist lets key through
+func (c *KMSEncryptionCodec) allowedMetadataKey(key string) bool {
+	return c.metadataAllowlist == nil || c.metadataAllowlist[key] || codecMetadataKeys[key] || shared.IsCodecOnlyMetadata(key)
+}
+
+// filterMetadata drops the metadata keys the allowlist does not let through from payloads,
+// leaving the maps of the payloads it changes unshared
+func (c *KMSEncryptionCodec) filterMetadata(payloads []shared.PayloadData) {
+	if c.metadataAllowlist == nil {
+		return
+	}
+	for i, payload := range payloads {
+		var filtered map[string]string
+		for key := range payload.Metadata {
+			if c.allowedMetadataKey(key) {
+				continue
+			}
+			if filtered == nil {
+				filtered = maps.Clone(payload.Metadata)
+			}
+			delete(filtered, key)
+			c.metadataKeysDropped.Add(1)
+		}
+		if filtered != nil {
+			payloads[i].Metadata = filtered
+		}
+	}
+}
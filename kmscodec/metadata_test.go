@@ -0,0 +1,55 @@
+package kmscodec
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestMetadataAllowlistDropsUnknownKeys(t *testing.T) {
+	codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), WithMetadataAllowlist([]string{"messageType"}))
+
+	// Protobuf payloads pass through encode unencrypted, metadata and all
+	protobuf := shared.PayloadData{
+		Metadata: map[string]string{"encoding": "binary/protobuf", "messageType": "orders.Order", "x-approved-by": "admin"},
+		Data:     base64.StdEncoding.EncodeToString([]byte{0x0a, 0x02}),
+	}
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{protobuf, plainPayload(`{"order":1}`)},
+	})).Payloads
+	if got := encoded[0].Metadata; len(got) != 2 || got["encoding"] != "binary/protobuf" || got["messageType"] != "orders.Order" {
+		t.Fatalf("expected only allowlisted metadata on encode, got %v", got)
+	}
+	if encoded[1].Metadata[SchemeMetadataKey] != SchemeKMS || encoded[1].Metadata[OriginalEncodingMetadataKey] != "json/plain" {
+		t.Fatalf("expected the codec's own metadata to be kept, got %v", encoded[1].Metadata)
+	}
+
+	// Keys planted in history are dropped on decode too
+	encoded[0].Metadata = map[string]string{"encoding": "binary/protobuf", "messageType": "orders.Order", "x-approved-by": "admin"}
+	encoded[1].Metadata["x-approved-by"] = "admin"
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: encoded})).Payloads
+	for i, payload := range decoded {
+		if _, ok := payload.Metadata["x-approved-by"]; ok {
+			t.Fatalf("expected payload %d to lose the planted key, got %v", i, payload.Metadata)
+		}
+	}
+	if decoded[0].Metadata["messageType"] != "orders.Order" || decoded[1].Metadata[shared.KeyFingerprintMetadataKey] == "" {
+		t.Fatalf("unexpected decoded metadata %v, %v", decoded[0].Metadata, decoded[1].Metadata)
+	}
+	if dropped := codec.metadataKeysDropped.Load(); dropped != 2 {
+		t.Fatalf("expected 2 dropped keys, got %d", dropped)
+	}
+}
+
+func TestWithoutMetadataAllowlistAllMetadataPasses(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	payload := shared.PayloadData{
+		Metadata: map[string]string{"encoding": "binary/protobuf", "x-approved-by": "admin"},
+		Data:     base64.StdEncoding.EncodeToString([]byte{0x0a}),
+	}
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}})).Payloads[0]
+	if encoded.Metadata["x-approved-by"] != "admin" {
+		t.Fatalf("expected all metadata without an allowlist, got %v", encoded.Metadata)
+	}
+}
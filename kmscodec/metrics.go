@@ -0,0 +1,95 @@
+package kmscodec
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"temporal-key-rotation/shared"
+)
+
+// payloadSizeBuckets are the upper bounds, in bytes, of the payload size histogram buckets
+var payloadSizeBuckets = []int{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// sizeHistogram counts observed sizes into payloadSizeBuckets. Observations only touch
+// atomics, so recording on the request path never takes a lock.
+type sizeHistogram struct {
+	counts []atomic.Uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    atomic.Uint64
+}
+
+func newSizeHistogram() *sizeHistogram {
+	return &sizeHistogram{counts: make([]atomic.Uint64, len(payloadSizeBuckets)+1)}
+}
+
+func (h *sizeHistogram) observe(size int) {
+	i := len(payloadSizeBuckets)
+	for j, bound := range payloadSizeBuckets {
+		if size <= bound {
+			i = j
+			break
+		}
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(uint64(size))
+}
+
+// write renders the histogram in the Prometheus text exposition format
+func (h *sizeHistogram) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(payloadSizeBuckets) {
+			le = strconv.Itoa(payloadSizeBuckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, cumulative)
+	}
+	// The sum is loaded after the counts, so under concurrent observes it can run slightly ahead of them
+	fmt.Fprintf(w, "%s_sum %d\n%s_count %d\n", name, h.sum.Load(), name, cumulative)
+}
+
+// payloadSizeMetrics are the size distributions of payloads seen by /encode and /decode
+type payloadSizeMetrics struct {
+	plaintext  *sizeHistogram
+	ciphertext *sizeHistogram
+}
+
+func newPayloadSizeMetrics() *payloadSizeMetrics {
+	return &payloadSizeMetrics{plaintext: newSizeHistogram(), ciphertext: newSizeHistogram()}
+}
+
+// record observes the decoded Data size of each plaintext and ciphertext payload
+func (m *payloadSizeMetrics) record(plaintext, ciphertext []shared.PayloadData) {
+	for _, payload := range plaintext {
+		m.plaintext.observe(base64DataSize(payload.Data))
+	}
+	for _, payload := range ciphertext {
+		m.ciphertext.observe(base64DataSize(payload.Data))
+	}
+}
+
+// base64DataSize is the byte length of standard base64 data, computed without decoding it
+func base64DataSize(data string) int {
+	padding := len(data) - len(strings.TrimRight(data, "="))
+	return max(0, len(data)/4*3-padding)
+}
+
+// handleMetrics handles the /metrics endpoint, serving the payload size histograms, per-ARN KMS call counters and audit log counters
+func (c *KMSEncryptionCodec) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.sizeMetrics.plaintext.write(w, "codec_plaintext_bytes")
+	c.sizeMetrics.ciphertext.write(w, "codec_ciphertext_bytes")
+	writeKeyARNMetrics(w, c.kmsManager.KeyARNStats())
+	if c.audit != nil {
+		c.audit.writeMetrics(w)
+	}
+}
@@ -0,0 +1,75 @@
+package kmscodec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestSizeHistogramBuckets(t *testing.T) {
+	h := newSizeHistogram()
+	for _, size := range []int{0, 64, 65, 5000, 10 << 20} {
+		h.observe(size)
+	}
+
+	var out bytes.Buffer
+	h.write(&out, "sizes")
+	body := out.String()
+	for _, want := range []string{
+		"# TYPE sizes histogram\n",
+		`sizes_bucket{le="64"} 2` + "\n",
+		`sizes_bucket{le="256"} 3` + "\n",
+		`sizes_bucket{le="4096"} 3` + "\n",
+		`sizes_bucket{le="16384"} 4` + "\n",
+		`sizes_bucket{le="4194304"} 4` + "\n",
+		`sizes_bucket{le="+Inf"} 5` + "\n",
+		"sizes_sum 10490889\n",
+		"sizes_count 5\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestBase64DataSize(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 4, 100} {
+		data := base64.StdEncoding.EncodeToString(make([]byte, n))
+		if got := base64DataSize(data); got != n {
+			t.Errorf("%d bytes: got %d", n, got)
+		}
+	}
+}
+
+func TestMetricsRecordEncodeAndDecodeSizes(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "")
+
+	// 300 bytes of plaintext, 328 bytes of ciphertext with the nonce and tag
+	payload := plainPayload(`"` + strings.Repeat("x", 298) + `"`)
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}}))
+	decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: encoded.Payloads}))
+
+	rec := getStats(t, mux, "/metrics", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`codec_plaintext_bytes_bucket{le="256"} 0` + "\n",
+		`codec_plaintext_bytes_bucket{le="1024"} 2` + "\n",
+		"codec_plaintext_bytes_sum 600\n",
+		"codec_plaintext_bytes_count 2\n",
+		"codec_ciphertext_bytes_sum 656\n",
+		"codec_ciphertext_bytes_count 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
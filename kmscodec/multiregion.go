@@ -0,0 +1,86 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// DefaultMultiRegionRefreshInterval is how often the CMK's multi-Region configuration is re-read
+const DefaultMultiRegionRefreshInterval = time.Hour
+
+// KeyDescriber is implemented by KMS clients that can describe keys, such as *kms.Client
+type KeyDescriber interface {
+	DescribeKey(ctx context.Context, params *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error)
+}
+
+// errDescribeUnsupported reports a KMS client that cannot describe keys
+var errDescribeUnsupported = errors.New("KMS client does not support DescribeKey")
+
+// MultiRegionInfo is the multi-Region configuration of the CMK, as reported in /stats
+type MultiRegionInfo struct {
+	MultiRegion    bool      `json:"multi_region"`
+	KeyType        string    `json:"key_type,omitempty"` // PRIMARY or REPLICA
+	PrimaryRegion  string    `json:"primary_region,omitempty"`
+	ReplicaRegions []string  `json:"replica_regions,omitempty"`
+	RefreshedAt    time.Time `json:"refreshed_at"`
+}
+
+// RefreshMultiRegionInfo reads the CMK's multi-Region configuration through DescribeKey.
+// The previous information is kept if the call fails.
+func (k *KMSManager) RefreshMultiRegionInfo(ctx context.Context) error {
+	describer, ok := k.client.(KeyDescriber)
+	if !ok {
+		return errDescribeUnsupported
+	}
+
+	result, err := describer.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(k.keyID)})
+	if err != nil {
+		return fmt.Errorf("failed to describe key: %w", err)
+	}
+
+	info := &MultiRegionInfo{RefreshedAt: k.clock.Now()}
+	if metadata := result.KeyMetadata; metadata != nil && aws.ToBool(metadata.MultiRegion) {
+		info.MultiRegion = true
+		if config := metadata.MultiRegionConfiguration; config != nil {
+			info.KeyType = string(config.MultiRegionKeyType)
+			if config.PrimaryKey != nil {
+				info.PrimaryRegion = aws.ToString(config.PrimaryKey.Region)
+			}
+			info.ReplicaRegions = make([]string, 0, len(config.ReplicaKeys))
+			for _, replica := range config.ReplicaKeys {
+				info.ReplicaRegions = append(info.ReplicaRegions, aws.ToString(replica.Region))
+			}
+		}
+	}
+
+	k.mux.Lock()
+	k.multiRegionInfo = info
+	k.mux.Unlock()
+	return nil
+}
+
+// StartMultiRegionRefresh re-reads the multi-Region configuration every interval until Close is called
+func (k *KMSManager) StartMultiRegionRefresh(interval time.Duration) {
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := k.RefreshMultiRegionInfo(context.Background()); err != nil {
+					log.Printf("Failed to refresh multi-Region key info: %v", err)
+				}
+			case <-k.stopCh:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// describingKMS is a fakeKMS that also answers DescribeKey
+type describingKMS struct {
+	*fakeKMS
+	metadata    *types.KeyMetadata
+	describeErr error
+}
+
+func (d *describingKMS) DescribeKey(ctx context.Context, params *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error) {
+	if d.describeErr != nil {
+		return nil, d.describeErr
+	}
+	return &kms.DescribeKeyOutput{KeyMetadata: d.metadata}, nil
+}
+
+func TestRefreshMultiRegionInfoReportsReplicas(t *testing.T) {
+	client := &describingKMS{
+		fakeKMS: newFakeKMS(),
+		metadata: &types.KeyMetadata{
+			KeyId:       aws.String("mrk-1234"),
+			MultiRegion: aws.Bool(true),
+			MultiRegionConfiguration: &types.MultiRegionConfiguration{
+				MultiRegionKeyType: types.MultiRegionKeyTypePrimary,
+				PrimaryKey:         &types.MultiRegionKey{Region: aws.String("us-east-1")},
+				ReplicaKeys: []types.MultiRegionKey{
+					{Region: aws.String("us-west-2")},
+					{Region: aws.String("eu-west-1")},
+				},
+			},
+		},
+	}
+	manager, err := NewKMSManagerWithClient(client, testKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	if _, reported := manager.GetKeyStats()["multi_region"]; reported {
+		t.Fatal("expected no multi-Region info before the first refresh")
+	}
+	if err := manager.RefreshMultiRegionInfo(context.Background()); err != nil {
+		t.Fatalf("RefreshMultiRegionInfo: %v", err)
+	}
+
+	info, ok := manager.GetKeyStats()["multi_region"].(*MultiRegionInfo)
+	if !ok {
+		t.Fatal("expected multi-Region info in the stats")
+	}
+	if !info.MultiRegion || info.KeyType != "PRIMARY" || info.PrimaryRegion != "us-east-1" {
+		t.Fatalf("unexpected multi-Region info: %+v", info)
+	}
+	if !slices.Equal(info.ReplicaRegions, []string{"us-west-2", "eu-west-1"}) {
+		t.Fatalf("unexpected replica regions: %v", info.ReplicaRegions)
+	}
+
+	// A failed refresh keeps the last known configuration
+	client.describeErr = errors.New("ThrottlingException")
+	if err := manager.RefreshMultiRegionInfo(context.Background()); err == nil {
+		t.Fatal("expected the describe error to be returned")
+	}
+	if manager.GetKeyStats()["multi_region"] != info {
+		t.Fatal("expected the previous info to be kept after a failed refresh")
+	}
+}
+
+func TestRefreshMultiRegionInfoSingleRegionKey(t *testing.T) {
+	client := &describingKMS{
+		fakeKMS:  newFakeKMS(),
+		metadata: &types.KeyMetadata{KeyId: aws.String("1234"), MultiRegion: aws.Bool(false)},
+	}
+	manager, err := NewKMSManagerWithClient(client, testKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	if err := manager.RefreshMultiRegionInfo(context.Background()); err != nil {
+		t.Fatalf("RefreshMultiRegionInfo: %v", err)
+	}
+	info := manager.GetKeyStats()["multi_region"].(*MultiRegionInfo)
+	if info.MultiRegion || len(info.ReplicaRegions) != 0 {
+		t.Fatalf("expected a single-Region key, got %+v", info)
+	}
+}
+
+func TestRefreshMultiRegionInfoWithoutDescribeKey(t *testing.T) {
+	manager := newTestManager(t, newFakeKMS())
+	if err := manager.RefreshMultiRegionInfo(context.Background()); !errors.Is(err, errDescribeUnsupported) {
+		t.Fatalf("expected errDescribeUnsupported, got %v", err)
+	}
+}
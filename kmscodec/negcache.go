@@ -0,0 +1,93 @@
+package kmscodec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// DefaultNegativeCacheTTL is how long a data key KMS refused to decrypt is refused locally
+const DefaultNegativeCacheTTL = 30 * time.Second
+
+// maxNegativeCacheEntries bounds the memory spent remembering undecryptable keys
+const maxNegativeCacheEntries = 10000
+
+// negativeEntry is a remembered KMS refusal
+type negativeEntry struct {
+	err       error
+	expiresAt time.Time
+}
+
+// WithNegativeCacheTTL sets how long a data key that KMS refused to decrypt (deleted or
+// disabled CMK, wrong key, invalid ciphertext) fails fast without another KMS call.
+// Throttling, network errors and an open circuit breaker are never cached. Zero disables it.
+func WithNegativeCacheTTL(ttl time.Duration) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.negativeCacheTTL = ttl
+	}
+}
+
+// negativeCacheKey identifies a decrypt request. The master key and encryption context are
+// part of it, so a payload with a forged context cannot block the genuine one.
+func negativeCacheKey(encryptedKey, masterKeyARN string, encryptionContext map[string]string) string {
+	h := sha256.New()
+	h.Write([]byte(encryptedKey + "\x00" + masterKeyARN))
+	for _, name := range slices.Sorted(maps.Keys(encryptionContext)) {
+		h.Write([]byte("\x00" + name + "=" + encryptionContext[name]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isPermanentDecryptError reports whether KMS refused a decrypt in a way retrying soon will not fix
+func isPermanentDecryptError(err error) bool {
+	var notFound *types.NotFoundException
+	var invalidCiphertext *types.InvalidCiphertextException
+	var incorrectKey *types.IncorrectKeyException
+	return errors.Is(err, ErrKeyUnavailable) || errors.As(err, &notFound) || errors.As(err, &invalidCiphertext) || errors.As(err, &incorrectKey)
+}
+
+// negativeCacheErr returns the remembered refusal for key, or nil if there is none
+func (k *KMSManager) negativeCacheErr(key string) error {
+	if k.negativeCacheTTL <= 0 {
+		return nil
+	}
+	k.mux.RLock()
+	entry, ok := k.negativeCache[key]
+	k.mux.RUnlock()
+	if !ok || k.clock.Now().After(entry.expiresAt) {
+		return nil
+	}
+	k.negativeCacheHits.Add(1)
+	return entry.err
+}
+
+// rememberDecryptFailure records a permanent KMS refusal for key; other errors are ignored
+func (k *KMSManager) rememberDecryptFailure(key string, err error) {
+	if k.negativeCacheTTL <= 0 || !isPermanentDecryptError(err) {
+		return
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	if len(k.negativeCache) >= maxNegativeCacheEntries {
+		k.pruneNegativeCacheLocked()
+		if len(k.negativeCache) >= maxNegativeCacheEntries {
+			return
+		}
+	}
+	k.negativeCache[key] = negativeEntry{err: err, expiresAt: k.clock.Now().Add(k.negativeCacheTTL)}
+}
+
+// pruneNegativeCacheLocked drops lapsed refusals. Callers must hold k.mux for writing.
+func (k *KMSManager) pruneNegativeCacheLocked() {
+	now := k.clock.Now()
+	for key, entry := range k.negativeCache {
+		if now.After(entry.expiresAt) {
+			delete(k.negativeCache, key)
+		}
+	}
+}
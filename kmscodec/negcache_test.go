@@ -0,0 +1,67 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+func TestNegativeCacheFailsFastOnRepeatedlyFailingKey(t *testing.T) {
+	fake := newFakeKMS()
+	clock := newFakeClock()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithClock(clock), WithNegativeCacheTTL(10*time.Second))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+	payload := encodeUnderRetiredKey(t, codec)
+	ctx := context.Background()
+
+	fake.decryptErr = &types.NotFoundException{Message: aws.String("key deleted")}
+	for i := 0; i < 5; i++ {
+		_, err := manager.DecryptDataKey(ctx, payload.EncryptedDataKey, payload.KMSKeyID, payload.EncryptionContext)
+		var notFound *types.NotFoundException
+		if !errors.As(err, &notFound) {
+			t.Fatalf("attempt %d: expected the KMS error, got %v", i, err)
+		}
+	}
+	if _, decrypts := fake.calls(); decrypts != 1 {
+		t.Fatalf("expected one KMS call for five attempts, got %d", decrypts)
+	}
+	if hits := manager.GetKeyStats()["negative_cache_hits"]; hits != int64(4) {
+		t.Fatalf("expected 4 negative cache hits, got %v", hits)
+	}
+
+	// A different encryption context is a different request and still reaches KMS
+	forged := map[string]string{"service": "temporal-codec", "version": "1.0", "timestamp": "1"}
+	manager.DecryptDataKey(ctx, payload.EncryptedDataKey, payload.KMSKeyID, forged)
+	if _, decrypts := fake.calls(); decrypts != 2 {
+		t.Fatalf("expected a KMS call for another context, got %d calls", decrypts)
+	}
+
+	// Once the TTL lapses the key is retried, and a recovered key decrypts again
+	fake.decryptErr = nil
+	clock.Advance(11 * time.Second)
+	if _, err := manager.DecryptDataKey(ctx, payload.EncryptedDataKey, payload.KMSKeyID, payload.EncryptionContext); err != nil {
+		t.Fatalf("expected the key to decrypt after the negative TTL, got %v", err)
+	}
+}
+
+func TestNegativeCacheIgnoresTransientErrors(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+	codec := NewKMSEncryptionCodec(manager)
+	payload := encodeUnderRetiredKey(t, codec)
+
+	fake.decryptErr = errors.New("throttled")
+	for i := 0; i < 3; i++ {
+		manager.DecryptDataKey(context.Background(), payload.EncryptedDataKey, payload.KMSKeyID, payload.EncryptionContext)
+	}
+	if _, decrypts := fake.calls(); decrypts != 3 {
+		t.Fatalf("expected every attempt to reach KMS, got %d calls", decrypts)
+	}
+}
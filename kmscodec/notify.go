@@ -0,0 +1,144 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Rotation notification event types, also sent as the event_type message attribute for SNS filter policies
+const (
+	EventKeyRotated    = "key_rotated"
+	EventKeyStateError = "key_state_error"
+)
+
+const (
+	// notificationQueueSize bounds the events waiting to be published; further events are dropped
+	notificationQueueSize = 100
+	// notificationPublishTimeout bounds each SNS call, so a slow SNS only delays later notifications
+	notificationPublishTimeout = 10 * time.Second
+)
+
+// SNSPublisher is the subset of the AWS SNS API used for rotation notifications
+type SNSPublisher interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// RotationEvent is the message published for a rotation or key-state error. It carries
+// fingerprints and timestamps only, never key material.
+type RotationEvent struct {
+	EventType           string     `json:"event_type"`
+	KeyARN              string     `json:"key_arn"`
+	Fingerprint         string     `json:"key_fingerprint,omitempty"`
+	PreviousFingerprint string     `json:"previous_key_fingerprint,omitempty"`
+	GeneratedAt         *time.Time `json:"generated_at,omitempty"`
+	ExpiresAt           *time.Time `json:"expires_at,omitempty"`
+	Error               string     `json:"error,omitempty"`
+	Timestamp           time.Time  `json:"timestamp"`
+}
+
+// rotationNotifier publishes rotation events to SNS from its own goroutine
+type rotationNotifier struct {
+	client   SNSPublisher
+	topicARN string
+	events   chan RotationEvent
+}
+
+// WithRotationNotifications publishes an event to the SNS topic on every data key rotation
+// and whenever KMS refuses the master key because of its state. Publishing happens in the
+// background: a slow or failing SNS never blocks or fails rotation, and events are dropped
+// (and logged) if too many are waiting.
+func WithRotationNotifications(client SNSPublisher, topicARN string) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.notifier = &rotationNotifier{
+			client:   client,
+			topicARN: topicARN,
+			events:   make(chan RotationEvent, notificationQueueSize),
+		}
+	}
+}
+
+// notify queues event for publishing without blocking
+func (k *KMSManager) notify(event RotationEvent) {
+	if k.notifier == nil {
+		return
+	}
+	event.Timestamp = k.clock.Now().UTC()
+	select {
+	case k.notifier.events <- event:
+	default:
+		log.Printf("Rotation notification queue full, dropped %s event", event.EventType)
+	}
+}
+
+// notifyKeyRotated queues a key_rotated event for the newly installed key
+func (k *KMSManager) notifyKeyRotated(previous, next *CurrentDataKey) {
+	generatedAt, expiresAt := next.GeneratedAt.UTC(), next.ExpiresAt.UTC()
+	event := RotationEvent{
+		EventType:   EventKeyRotated,
+		KeyARN:      k.keyID,
+		Fingerprint: KeyFingerprint(next.EncryptedKey),
+		GeneratedAt: &generatedAt,
+		ExpiresAt:   &expiresAt,
+	}
+	if previous != nil {
+		event.PreviousFingerprint = KeyFingerprint(previous.EncryptedKey)
+	}
+	k.notify(event)
+}
+
+// notifyKeyStateError queues a key_state_error event if err is a key-state refusal from KMS
+func (k *KMSManager) notifyKeyStateError(keyARN string, err error) {
+	if !errors.Is(err, ErrKeyUnavailable) {
+		return
+	}
+	k.notify(RotationEvent{EventType: EventKeyStateError, KeyARN: keyARN, Error: err.Error()})
+}
+
+// startNotifier publishes queued events until Close is called
+func (k *KMSManager) startNotifier() {
+	if k.notifier == nil {
+		return
+	}
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		for {
+			select {
+			case event := <-k.notifier.events:
+				k.notifier.publish(event)
+			case <-k.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// publish sends one event to SNS; failures are logged and the event is dropped
+func (n *rotationNotifier) publish(event RotationEvent) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s notification: %v", event.EventType, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notificationPublishTimeout)
+	defer cancel()
+	_, err = n.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(n.topicARN),
+		Subject:  aws.String("Temporal codec " + event.EventType),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"event_type": {DataType: aws.String("String"), StringValue: aws.String(event.EventType)},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to publish %s notification to %s: %v", event.EventType, n.topicARN, err)
+	}
+}
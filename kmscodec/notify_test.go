@@ -0,0 +1,177 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+const testTopicARN = "arn:aws:sns:us-east-1:123456789012:key-rotation"
+
+// fakeSNS records published messages; block, when set, holds every Publish until it is closed
+type fakeSNS struct {
+	mu        sync.Mutex
+	inputs    []*sns.PublishInput
+	published chan struct{}
+	block     chan struct{}
+	err       error
+}
+
+func newFakeSNS() *fakeSNS {
+	return &fakeSNS{published: make(chan struct{}, 100)}
+}
+
+func (f *fakeSNS) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f.mu.Lock()
+	f.inputs = append(f.inputs, params)
+	f.mu.Unlock()
+	select {
+	case f.published <- struct{}{}:
+	default:
+	}
+	return &sns.PublishOutput{MessageId: aws.String("message-id")}, f.err
+}
+
+// waitForEvent returns the next published event
+func (f *fakeSNS) waitForEvent(t *testing.T) (RotationEvent, *sns.PublishInput) {
+	t.Helper()
+	select {
+	case <-f.published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a notification")
+	}
+	f.mu.Lock()
+	input := f.inputs[0]
+	f.inputs = f.inputs[1:]
+	f.mu.Unlock()
+
+	var event RotationEvent
+	if err := json.Unmarshal([]byte(aws.ToString(input.Message)), &event); err != nil {
+		t.Fatalf("notification is not a JSON event: %v", err)
+	}
+	return event, input
+}
+
+func newNotifyingManager(t *testing.T, fake *fakeKMS, publisher *fakeSNS) *KMSManager {
+	t.Helper()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithRotationNotifications(publisher, testTopicARN))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	t.Cleanup(manager.Close)
+	return manager
+}
+
+func TestRotationPublishesNotification(t *testing.T) {
+	publisher := newFakeSNS()
+	manager := newNotifyingManager(t, newFakeKMS(), publisher)
+
+	initial, input := publisher.waitForEvent(t)
+	if initial.EventType != EventKeyRotated || initial.KeyARN != testKeyARN || initial.PreviousFingerprint != "" {
+		t.Fatalf("unexpected initial event: %+v", initial)
+	}
+	if aws.ToString(input.TopicArn) != testTopicARN {
+		t.Errorf("published to %q, want %q", aws.ToString(input.TopicArn), testTopicARN)
+	}
+	if got := aws.ToString(input.MessageAttributes["event_type"].StringValue); got != EventKeyRotated {
+		t.Errorf("expected event_type attribute %q, got %q", EventKeyRotated, got)
+	}
+
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	rotated, input := publisher.waitForEvent(t)
+	current, _ := manager.GetCurrentDataKey(context.Background())
+	if rotated.Fingerprint != KeyFingerprint(current.EncryptedKey) || rotated.PreviousFingerprint != initial.Fingerprint {
+		t.Fatalf("unexpected rotation event: %+v", rotated)
+	}
+	if rotated.GeneratedAt == nil || rotated.ExpiresAt == nil || !rotated.ExpiresAt.Equal(current.ExpiresAt) {
+		t.Fatalf("expected the key's timestamps, got %+v", rotated)
+	}
+
+	// Only fingerprints leave the process, never the key or its KMS ciphertext
+	message := aws.ToString(input.Message)
+	for _, secret := range []string{base64.StdEncoding.EncodeToString(current.PlaintextKey), current.EncryptedKey} {
+		if strings.Contains(message, secret) {
+			t.Fatalf("notification leaks key material: %s", message)
+		}
+	}
+}
+
+func TestKeyStateErrorPublishesNotification(t *testing.T) {
+	fake := newFakeKMS()
+	publisher := newFakeSNS()
+	manager := newNotifyingManager(t, fake, publisher)
+	publisher.waitForEvent(t)
+
+	fake.generateErr = &types.DisabledException{Message: aws.String("key is disabled")}
+	if err := manager.rotateDataKey(context.Background()); !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("expected ErrKeyUnavailable, got %v", err)
+	}
+	event, input := publisher.waitForEvent(t)
+	if event.EventType != EventKeyStateError || event.KeyARN != testKeyARN || event.Error == "" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if got := aws.ToString(input.MessageAttributes["event_type"].StringValue); got != EventKeyStateError {
+		t.Errorf("expected event_type attribute %q, got %q", EventKeyStateError, got)
+	}
+}
+
+func TestOtherKMSErrorsPublishNothing(t *testing.T) {
+	fake := newFakeKMS()
+	publisher := newFakeSNS()
+	manager := newNotifyingManager(t, fake, publisher)
+	publisher.waitForEvent(t)
+
+	fake.generateErr = errors.New("throttled")
+	manager.rotateDataKey(context.Background())
+	select {
+	case <-publisher.published:
+		t.Fatal("a transient KMS error should not be notified")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSlowOrFailingSNSNeverBlocksRotation(t *testing.T) {
+	publisher := newFakeSNS()
+	publisher.block = make(chan struct{})
+	publisher.err = errors.New("SNS unavailable")
+	manager := newNotifyingManager(t, newFakeKMS(), publisher)
+	t.Cleanup(func() { close(publisher.block) })
+
+	// More rotations than the queue holds, with the publisher stuck on the first event
+	done := make(chan error, 1)
+	go func() {
+		for range notificationQueueSize + 10 {
+			if err := manager.rotateDataKey(context.Background()); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("rotateDataKey: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotation blocked on SNS")
+	}
+}
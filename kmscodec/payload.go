@@ -0,0 +1,517 @@
+package kmscodec
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultPayloadConcurrency is the number of payloads processed in parallel per request
+const DefaultPayloadConcurrency = 8
+
+// codecError is a per-payload failure and the HTTP status it maps to
+type codecError struct {
+	status  int
+	message string
+	err     error
+}
+
+func (e *codecError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return e.message + ": " + e.err.Error()
+}
+
+func (e *codecError) Unwrap() error {
+	return e.err
+}
+
+// writeCodecError writes a payload processing failure as an HTTP error response
+func writeCodecError(w http.ResponseWriter, err error) {
+	var ce *codecError
+	if errors.As(err, &ce) {
+		http.Error(w, ce.Error(), ce.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// processPayloads applies fn to every payload with bounded concurrency.
+// The output has the same length and order as the input; the first failure aborts the batch.
+func (c *KMSEncryptionCodec) processPayloads(ctx context.Context, payloads []shared.PayloadData,
+	fn func(context.Context, shared.PayloadData) (shared.PayloadData, error)) ([]shared.PayloadData, error) {
+	results := make([]shared.PayloadData, len(payloads))
+
+	if c.concurrency <= 1 || len(payloads) <= 1 {
+		for i, payload := range payloads {
+			result, err := fn(ctx, payload)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = result
+		}
+		return results, nil
+	}
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(c.concurrency)
+	for i, payload := range payloads {
+		group.Go(func() error {
+			result, err := fn(groupCtx, payload)
+			if err != nil {
+				return err
+			}
+			results[i] = result // each goroutine owns its own index
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// processPayloadsPartial applies fn to every payload with bounded concurrency like
+// processPayloads, but a failure does not abort the batch: the output has an error sentinel in
+// place of each failed payload, and errs holds each failure at its payload's index.
+func (c *KMSEncryptionCodec) processPayloadsPartial(ctx context.Context, payloads []shared.PayloadData,
+	fn func(context.Context, shared.PayloadData) (shared.PayloadData, error)) ([]shared.PayloadData, []error) {
+	results := make([]shared.PayloadData, len(payloads))
+	errs := make([]error, len(payloads))
+
+	limit := max(c.concurrency, 1)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for i, payload := range payloads {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			result, err := fn(ctx, payload)
+			if err != nil {
+				result = decodeErrorSentinel(err.Error())
+			}
+			results[i], errs[i] = result, err // each goroutine owns its own index
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// payloadErrors lists the failures of a partial batch with the HTTP status each maps to
+func payloadErrors(errs []error) []shared.PayloadError {
+	var payloadErrs []shared.PayloadError
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		status := http.StatusInternalServerError
+		var ce *codecError
+		if errors.As(err, &ce) {
+			status = ce.status
+		}
+		payloadErrs = append(payloadErrs, shared.PayloadError{Index: i, Status: status, Message: err.Error()})
+	}
+	return payloadErrs
+}
+
+// encodePayload encrypts a single payload, passing non-JSON payloads through unchanged
+func (c *KMSEncryptionCodec) encodePayload(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	// Only JSON payloads are encrypted; everything else (including payloads that are
+	// already encrypted, e.g. by a chained codec) passes through unchanged
+	encoding, exists := payload.Metadata["encoding"]
+	if exists && encoding != "json/plain" {
+		return payload, nil
+	}
+	if c.policySkips(payload) {
+		return payload, nil
+	}
+
+	// Get current data key (with automatic rotation)
+	currentKey, err := c.kmsManager.GetCurrentDataKey(ctx)
+	if errors.Is(err, ErrKeyUnavailable) {
+		log.Printf("Failed to get current data key: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusServiceUnavailable, "KMS key unavailable (disabled or pending deletion)", err}
+	}
+	if errors.Is(err, ErrKMSUnavailable) {
+		return shared.PayloadData{}, &codecError{http.StatusServiceUnavailable, "Key retrieval failed", err}
+	}
+	if errors.Is(err, ErrKMSTimeout) {
+		log.Printf("Failed to get current data key: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusGatewayTimeout, "Key retrieval timed out", err}
+	}
+	if err != nil {
+		log.Printf("Failed to get current data key: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusInternalServerError, "Key retrieval failed", err}
+	}
+
+	// Prepare data to encrypt
+	var dataToEncrypt []byte
+	if payload.Data != "" {
+		// Try to decode as base64 first, if it fails, use as plain text
+		if decoded, err := decodeBase64(payload.Data); err == nil {
+			dataToEncrypt = decoded
+		} else {
+			dataToEncrypt = []byte(payload.Data)
+		}
+	}
+
+	if payload.Metadata[EncryptionModeMetadataKey] == EncryptionModeSignOnly {
+		if currentKey.PublicKey != nil {
+			return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Sign-only mode is not available in key pair mode", nil}
+		}
+		return c.signPayload(currentKey, dataToEncrypt, encoding)
+	}
+
+	// Encrypt the data with the current data key (or its public key in key pair mode)
+	var encryptedData, wrappedKey, encodedAt string
+	var encryptedFields []string
+	algorithm := AlgorithmAES256GCM
+	deterministic := payload.Metadata[EncryptionModeMetadataKey] == EncryptionModeDeterministic
+	switch {
+	case deterministic && currentKey.PublicKey != nil:
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Deterministic encryption is not available in key pair mode", nil}
+	case deterministic && len(currentKey.PlaintextKey) != algorithmKeyLength(AlgorithmAES256GCMDet):
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Deterministic encryption needs AES_256 data keys", nil}
+	case deterministic:
+		algorithm = AlgorithmAES256GCMDet
+		encryptedData, err = EncryptDeterministic(dataToEncrypt, currentKey.PlaintextKey)
+	case currentKey.PublicKey != nil:
+		algorithm = AlgorithmRSAOAEPAES256GCM
+		encryptedData, wrappedKey, err = EncryptWithPublicKey(dataToEncrypt, currentKey.PublicKey)
+	default:
+		// Field-level when configured; non-JSON payloads and documents with none of the fields are encrypted whole
+		var document []byte
+		if len(c.encryptFields) > 0 {
+			document, encryptedFields, _ = EncryptFields(dataToEncrypt, c.encryptFields, currentKey.PlaintextKey)
+		}
+		switch {
+		case len(encryptedFields) > 0:
+			algorithm = AlgorithmAES256GCMFields
+			encryptedData = base64.StdEncoding.EncodeToString(document)
+		case c.encodeTimestamp:
+			algorithm = PayloadAlgorithm(c.kmsManager.dataKeySpec, c.cipher)
+			encodedAt = c.kmsManager.clock.Now().UTC().Format(time.RFC3339)
+			encryptedData, err = EncryptWithAlgorithm(algorithm, dataToEncrypt, currentKey.PlaintextKey, encodedAtAAD(encodedAt))
+		default:
+			algorithm = PayloadAlgorithm(c.kmsManager.dataKeySpec, c.cipher)
+			encryptedData, err = EncryptWithAlgorithm(algorithm, dataToEncrypt, currentKey.PlaintextKey, nil)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to encrypt data: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusInternalServerError, "Encryption failed", err}
+	}
+
+	// Create response payload with KMS metadata
+	metadata := map[string]string{
+		"encoding":        "binary/encrypted",
+		SchemeMetadataKey: SchemeKMS,
+	}
+	if exists {
+		metadata[OriginalEncodingMetadataKey] = encoding
+	}
+	if len(encryptedFields) > 0 {
+		metadata[EncryptedFieldsMetadataKey] = strings.Join(encryptedFields, ",")
+	}
+
+	encrypted := shared.PayloadData{
+		Metadata:          metadata,
+		Data:              encryptedData,
+		KMSKeyID:          c.kmsManager.keyID,
+		EncryptedDataKey:  currentKey.EncryptedKey,
+		Algorithm:         algorithm,
+		WrappedKey:        wrappedKey,
+		EncryptionContext: currentKey.EncryptionContext,
+		EncodedAt:         encodedAt,
+	}
+	if encrypted.EnvelopeChecksum, err = envelopeChecksum(encrypted); err != nil {
+		return shared.PayloadData{}, &codecError{http.StatusInternalServerError, "Encryption failed", err}
+	}
+	return encrypted, nil
+}
+
+// signPayload builds a sign-only payload: the data stays readable and is authenticated with an HMAC
+func (c *KMSEncryptionCodec) signPayload(currentKey *CurrentDataKey, data []byte, encoding string) (shared.PayloadData, error) {
+	signature, err := SignData(data, encoding, currentKey.PlaintextKey)
+	if err != nil {
+		log.Printf("Failed to sign data: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusInternalServerError, "Signing failed", err}
+	}
+
+	metadata := map[string]string{
+		"encoding":               SignedEncoding,
+		SignatureMetadataKey:     signature,
+		SigningSchemeMetadataKey: SigningSchemeHMACSHA256,
+	}
+	if encoding != "" {
+		metadata[OriginalEncodingMetadataKey] = encoding
+	}
+
+	return shared.PayloadData{
+		Metadata:          metadata,
+		Data:              base64.StdEncoding.EncodeToString(data),
+		KMSKeyID:          c.kmsManager.keyID,
+		EncryptedDataKey:  currentKey.EncryptedKey,
+		EncryptionContext: currentKey.EncryptionContext,
+	}, nil
+}
+
+// decodePayload decrypts a single payload, passing unencrypted payloads through unchanged
+func (c *KMSEncryptionCodec) decodePayload(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	if payload.Metadata["encoding"] == SignedEncoding {
+		return c.verifySignedPayload(ctx, payload)
+	}
+
+	// Check if this payload is encrypted
+	if payload.Metadata["encoding"] != "binary/encrypted" {
+		// Not encrypted, return as-is
+		return payload, nil
+	}
+
+	// Legacy static-key payloads skip the KMS envelope entirely
+	if err := checkScheme(payload); err != nil {
+		return shared.PayloadData{}, err
+	}
+	if payload.Metadata[SchemeMetadataKey] == SchemeStatic {
+		return c.decodeStaticPayload(payload)
+	}
+
+	// For KMS encrypted payloads, we need the encrypted data key
+	if payload.EncryptedDataKey == "" {
+		log.Printf("Missing encrypted data key for encrypted payload")
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Missing encrypted data key", nil}
+	}
+
+	// The algorithm field is authoritative; refuse anything we cannot decrypt before spending a KMS call
+	if !isSupportedAlgorithm(payload.Algorithm) {
+		log.Printf("Refused to decrypt payload with unsupported algorithm %q", payload.Algorithm)
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, fmt.Sprintf("Unsupported algorithm %q", payload.Algorithm), nil}
+	}
+	if c.strictDecode {
+		if err := checkStrictEnvelope(payload); err != nil {
+			log.Printf("Refused payload in strict decode: %v", err)
+			return shared.PayloadData{}, err
+		}
+	}
+
+	// Only whole-payload AES-GCM(-SIV) authenticates the encode time; elsewhere it would be unverified
+	if payload.EncodedAt != "" && !isWholePayloadAlgorithm(payload.Algorithm) {
+		log.Printf("Refused payload with an encode time under algorithm %q", payload.Algorithm)
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Corrupt payload: encoded_at is only supported with " + AlgorithmAES256GCM + ", " + AlgorithmAES128GCM + " and " + AlgorithmAES256GCMSIV, nil}
+	}
+
+	if err := c.checkDecodeAge(ctx, payload); err != nil {
+		return shared.PayloadData{}, err
+	}
+
+	// Truncated or corrupted envelopes are cheap to spot; reject them before the KMS call
+	if err := verifyEnvelope(payload); err != nil {
+		log.Printf("Refused to decrypt corrupt payload: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Corrupt payload: envelope does not match its checksum", err}
+	}
+
+	// Decrypt the data key using KMS (with intelligent caching)
+	dataKey, keySource, err := c.payloadDataKey(ctx, payload)
+	if err != nil {
+		return shared.PayloadData{}, err
+	}
+
+	// Decrypt the actual data using the scheme recorded at encode time
+	var decryptedData []byte
+	switch payload.Algorithm {
+	case AlgorithmRSAOAEPAES256GCM:
+		decryptedData, err = DecryptWithPrivateKey(payload.Data, payload.WrappedKey, dataKey)
+	case AlgorithmAES256GCMDet:
+		decryptedData, err = DecryptDeterministic(payload.Data, dataKey)
+	case AlgorithmAES256GCMFields:
+		var document []byte
+		if document, err = decodeBase64(payload.Data); err == nil {
+			decryptedData, err = DecryptFields(document, ParseFieldPaths(payload.Metadata[EncryptedFieldsMetadataKey]), dataKey)
+		}
+	case AlgorithmAES256GCM, AlgorithmAES128GCM, AlgorithmAES256GCMSIV, "":
+		var additionalData []byte
+		if payload.EncodedAt != "" {
+			additionalData = encodedAtAAD(payload.EncodedAt)
+		}
+		algorithm := cmp.Or(payload.Algorithm, AlgorithmAES256GCM)
+		decryptedData, err = DecryptWithAlgorithm(algorithm, payload.Data, dataKey, additionalData)
+	}
+
+	// dataKey is our own copy, so it is safe to zero it now
+	zeroKey(dataKey)
+
+	if err != nil {
+		log.Printf("Failed to decrypt payload data: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusInternalServerError, "Data decryption failed", err}
+	}
+
+	// Create response payload with base64 encoded decrypted data
+	decoded := c.decodedPayload(payload, decryptedData, keySource)
+	if payload.EncodedAt != "" {
+		// Authenticated by the successful decryption above
+		decoded.Metadata[shared.EncodedAtMetadataKey] = payload.EncodedAt
+	}
+	return decoded, nil
+}
+
+// encodedAtAAD is the GCM additional data that binds an encode time to its ciphertext
+func encodedAtAAD(encodedAt string) []byte {
+	return []byte("temporal-codec encoded-at " + encodedAt)
+}
+
+// verifySignedPayload checks a sign-only payload's signature and returns its data
+func (c *KMSEncryptionCodec) verifySignedPayload(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	if payload.EncryptedDataKey == "" {
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Missing encrypted data key", nil}
+	}
+	if scheme := payload.Metadata[SigningSchemeMetadataKey]; scheme != SigningSchemeHMACSHA256 {
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, fmt.Sprintf("Unsupported signing scheme %q", scheme), nil}
+	}
+	data, err := decodeBase64(payload.Data)
+	if err != nil {
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Corrupt payload: data is not valid base64", err}
+	}
+
+	dataKey, keySource, err := c.payloadDataKey(ctx, payload)
+	if err != nil {
+		return shared.PayloadData{}, err
+	}
+	err = VerifyData(data, payload.Metadata[OriginalEncodingMetadataKey], payload.Metadata[SignatureMetadataKey], dataKey)
+	zeroKey(dataKey)
+	if err != nil {
+		log.Printf("Refused tampered sign-only payload: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Signature verification failed", err}
+	}
+
+	return c.decodedPayload(payload, data, keySource), nil
+}
+
+// payloadDataKey decrypts the data key of an encrypted or signed payload, mapping failures to codec errors
+func (c *KMSEncryptionCodec) payloadDataKey(ctx context.Context, payload shared.PayloadData) ([]byte, string, error) {
+	start := time.Now()
+	dataKey, keySource, err := c.kmsManager.DecryptDataKeyWithSource(ctx, payload.EncryptedDataKey, payload.KMSKeyID, payload.EncryptionContext)
+	recordKeyResolution(ctx, time.Since(start))
+	if errors.Is(err, ErrKeyRevoked) {
+		log.Printf("Refused to decrypt payload: %v", err)
+		return nil, "", &codecError{http.StatusForbidden, "Key decryption refused", err}
+	}
+	if errors.Is(err, ErrEncryptionContextMismatch) {
+		log.Printf("Refused to decrypt payload: %v", err)
+		return nil, "", &codecError{http.StatusBadRequest, "Encryption context rejected by strict validation", err}
+	}
+	if errors.Is(err, ErrMalformedDataKey) {
+		log.Printf("Refused to decrypt corrupt payload: %v", err)
+		return nil, "", &codecError{http.StatusBadRequest, "Corrupt payload: encrypted data key is not valid base64", err}
+	}
+	if errors.Is(err, ErrKeyUnavailable) {
+		log.Printf("Failed to decrypt data key: %v", err)
+		return nil, "", &codecError{http.StatusServiceUnavailable, "KMS key unavailable (disabled or pending deletion)", err}
+	}
+	if errors.Is(err, ErrKMSUnavailable) {
+		return nil, "", &codecError{http.StatusServiceUnavailable, "Key decryption failed", err}
+	}
+	if errors.Is(err, ErrKMSTimeout) {
+		log.Printf("Failed to decrypt data key: %v", err)
+		return nil, "", &codecError{http.StatusGatewayTimeout, "Key decryption timed out", err}
+	}
+	if err != nil {
+		log.Printf("Failed to decrypt data key: %v", err)
+		return nil, "", &codecError{http.StatusInternalServerError, "Key decryption failed", err}
+	}
+	return dataKey, keySource, nil
+}
+
+// decodedPayload builds the plaintext payload returned by decode, with provenance metadata
+func (c *KMSEncryptionCodec) decodedPayload(payload shared.PayloadData, data []byte, keySource string) shared.PayloadData {
+	// Restore the original encoding label when encode recorded one
+	originalEncoding := payload.Metadata[OriginalEncodingMetadataKey]
+	if originalEncoding == "" && len(data) == 0 {
+		originalEncoding = c.emptyDecodeEncoding
+	}
+	if originalEncoding == "" {
+		originalEncoding = c.defaultDecodeEncoding
+	}
+	if originalEncoding == DecodeEncodingSniff {
+		originalEncoding = sniffEncoding(data)
+	}
+
+	decoded := shared.PayloadData{
+		Metadata: map[string]string{
+			"encoding":                       originalEncoding,
+			shared.KeyFingerprintMetadataKey: KeyFingerprint(payload.EncryptedDataKey),
+			shared.KeySourceMetadataKey:      keySource,
+		},
+		Data: base64.StdEncoding.EncodeToString(data),
+	}
+	// Echo the correlation ID so logs across services can be joined on it
+	if id := payload.Metadata[shared.CorrelationIDMetadataKey]; id != "" {
+		decoded.Metadata[shared.CorrelationIDMetadataKey] = id
+	}
+	return decoded
+}
+
+// sniffEncoding guesses the encoding of plaintext that did not record one. Only a complete
+// JSON document counts as JSON; anything else, including empty data, is binary.
+func sniffEncoding(data []byte) string {
+	if json.Valid(data) {
+		return "json/plain"
+	}
+	return "binary/plain"
+}
+
+// isSupportedAlgorithm reports whether decode has a decryptor for algorithm.
+// An empty algorithm is a payload from before the field was recorded, which was always AES-256-GCM.
+func isSupportedAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case AlgorithmAES256GCM, AlgorithmAES128GCM, AlgorithmAES256GCMDet, AlgorithmRSAOAEPAES256GCM, AlgorithmAES256GCMFields, AlgorithmAES256GCMSIV, "":
+		return true
+	}
+	return false
+}
+
+// isWholePayloadAlgorithm reports whether algorithm encrypts the whole payload with the data key
+// directly, the only schemes that authenticate an encode time
+func isWholePayloadAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case AlgorithmAES256GCM, AlgorithmAES128GCM, AlgorithmAES256GCMSIV:
+		return true
+	}
+	return false
+}
+
+// decodePayloadLenient decodes like the pipeline but replaces payloads rejected as
+// corrupt (4xx) with an error sentinel. Server-side failures still fail the batch.
+func (c *KMSEncryptionCodec) decodePayloadLenient(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	decoded, err := c.decodeRouted(ctx, payload)
+	var ce *codecError
+	if err == nil || !errors.As(err, &ce) || ce.status >= http.StatusInternalServerError {
+		return decoded, err
+	}
+	return decodeErrorSentinel(ce.message), nil
+}
+
+// decodeErrorSentinel is the placeholder returned in lenient mode for a payload that could not be decoded
+func decodeErrorSentinel(message string) shared.PayloadData {
+	data, _ := json.Marshal(map[string]string{"decode_error": message})
+	return shared.PayloadData{
+		Metadata: map[string]string{
+			"encoding":                    "json/plain",
+			shared.DecodeErrorMetadataKey: message,
+		},
+		Data: base64.StdEncoding.EncodeToString(data),
+	}
+}
@@ -0,0 +1,464 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// encryptUnderManyKeys encrypts n payloads, rotating between each so every payload has its own data key
+func encryptUnderManyKeys(t testing.TB, codec *KMSEncryptionCodec, n int) []shared.PayloadData {
+	t.Helper()
+	payloads := make([]shared.PayloadData, n)
+	for i := range payloads {
+		encoded, err := codec.encodePayload(context.Background(), plainPayload(fmt.Sprintf(`{"n":%d}`, i)))
+		if err != nil {
+			t.Fatalf("encodePayload: %v", err)
+		}
+		payloads[i] = encoded
+		if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+			t.Fatalf("rotateDataKey: %v", err)
+		}
+	}
+	return payloads
+}
+
+// clearDecryptionCache forces subsequent decodes back to KMS
+func clearDecryptionCache(manager *KMSManager) {
+	cache := manager.decryptionCache.(*memoryCache)
+	cache.mu.Lock()
+	clear(cache.entries)
+	cache.mu.Unlock()
+}
+
+func TestParallelDecodePreservesOrder(t *testing.T) {
+	fake := newFakeKMS()
+	codec := NewKMSEncryptionCodec(newTestManager(t, fake), WithConcurrency(8))
+	payloads := encryptUnderManyKeys(t, codec, 50)
+	clearDecryptionCache(codec.kmsManager)
+	fake.decryptDelay = time.Millisecond
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: payloads}))
+	if len(decoded.Payloads) != len(payloads) {
+		t.Fatalf("expected %d payloads, got %d", len(payloads), len(decoded.Payloads))
+	}
+	for i, payload := range decoded.Payloads {
+		data, _ := base64.StdEncoding.DecodeString(payload.Data)
+		if want := fmt.Sprintf(`{"n":%d}`, i); string(data) != want {
+			t.Fatalf("payload %d out of order: got %s want %s", i, data, want)
+		}
+	}
+}
+
+func TestParallelDecodeFailsWholeBatchOnError(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	payloads := encryptUnderManyKeys(t, codec, 5)
+	payloads[3].EncryptedDataKey = ""
+
+	rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: payloads})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for the broken payload, got %d", rec.Code)
+	}
+}
+
+func TestConcurrentDecryptsOfSameKeyShareOneKMSCall(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+
+	old, _ := manager.GetCurrentDataKey(context.Background())
+	oldEncrypted := old.EncryptedKey
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	clearDecryptionCache(manager)
+	fake.decryptDelay = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := manager.DecryptDataKey(context.Background(), oldEncrypted, testKeyARN, old.EncryptionContext); err != nil {
+				t.Errorf("DecryptDataKey: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, decrypt := fake.calls(); decrypt != 1 {
+		t.Fatalf("expected concurrent lookups to share 1 KMS decrypt, got %d", decrypt)
+	}
+}
+
+// BenchmarkDecode100Payloads compares sequential and parallel decoding of a 100-payload
+// batch whose data keys all need a (simulated 1ms) KMS decrypt
+func TestDecodeReportsKeyProvenance(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	manager := codec.kmsManager
+
+	encoded, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	fingerprint := KeyFingerprint(encoded.EncryptedDataKey)
+
+	decodeSource := func() string {
+		t.Helper()
+		decoded, err := codec.decodePayload(context.Background(), encoded)
+		if err != nil {
+			t.Fatalf("decodePayload: %v", err)
+		}
+		if got := decoded.Metadata[shared.KeyFingerprintMetadataKey]; got != fingerprint {
+			t.Fatalf("expected fingerprint %s, got %q", fingerprint, got)
+		}
+		return decoded.Metadata[shared.KeySourceMetadataKey]
+	}
+
+	if source := decodeSource(); source != KeySourceCurrent {
+		t.Fatalf("expected source %q, got %q", KeySourceCurrent, source)
+	}
+
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	if source := decodeSource(); source != KeySourceCache {
+		t.Fatalf("expected source %q, got %q", KeySourceCache, source)
+	}
+
+	clearDecryptionCache(manager)
+	if source := decodeSource(); source != KeySourceKMS {
+		t.Fatalf("expected source %q, got %q", KeySourceKMS, source)
+	}
+}
+
+func TestDecodeRejectsMalformedDataKey(t *testing.T) {
+	codec, fake := newTestCodec(t)
+
+	corrupt, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	corrupt.EncryptedDataKey = "not*valid*base64"
+	corrupt.EnvelopeChecksum = "" // reach the data key decode, not the envelope pre-check
+
+	rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{corrupt}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a malformed data key, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "Corrupt payload") {
+		t.Fatalf("expected the error to identify a corrupt payload, got %q", rec.Body.String())
+	}
+	if _, decrypt := fake.calls(); decrypt != 0 {
+		t.Fatalf("expected no KMS call for a malformed key, got %d", decrypt)
+	}
+}
+
+func TestLenientDecodeReplacesCorruptPayloads(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	codec.lenientDecode = true
+
+	good, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	corrupt := good
+	corrupt.EncryptedDataKey = "not*valid*base64"
+
+	resp := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{corrupt, good},
+	}))
+	if len(resp.Payloads) != 2 {
+		t.Fatalf("expected 2 payloads, got %d", len(resp.Payloads))
+	}
+	if _, ok := resp.Payloads[0].Metadata[shared.DecodeErrorMetadataKey]; !ok {
+		t.Fatalf("expected a decode error sentinel, got %+v", resp.Payloads[0])
+	}
+	if _, ok := resp.Payloads[1].Metadata[shared.DecodeErrorMetadataKey]; ok {
+		t.Fatal("expected the good payload to decode normally")
+	}
+	data, _ := base64.StdEncoding.DecodeString(resp.Payloads[1].Data)
+	if string(data) != `{"id":1}` {
+		t.Fatalf("unexpected decoded data %q", data)
+	}
+}
+
+func TestPartialDecodeReportsFailedPayloads(t *testing.T) {
+	codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), WithPartialDecode(true))
+
+	var payloads []shared.PayloadData
+	for _, data := range []string{`{"id":1}`, `{"id":2}`, `{"id":3}`} {
+		encoded, err := codec.encodePayload(context.Background(), plainPayload(data))
+		if err != nil {
+			t.Fatalf("encodePayload: %v", err)
+		}
+		payloads = append(payloads, encoded)
+	}
+	payloads[1].EncryptedDataKey = "not*valid*base64"
+
+	rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: payloads})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a partly decodable batch, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeCodecResponse(t, rec)
+	if len(resp.Payloads) != 3 {
+		t.Fatalf("expected 3 payloads, got %d", len(resp.Payloads))
+	}
+	for i, want := range map[int]string{0: `{"id":1}`, 2: `{"id":3}`} {
+		if data, _ := base64.StdEncoding.DecodeString(resp.Payloads[i].Data); string(data) != want {
+			t.Fatalf("expected payload %d to decode to %s, got %q", i, want, data)
+		}
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Index != 1 || resp.Errors[0].Status != http.StatusBadRequest ||
+		!strings.Contains(resp.Errors[0].Message, "Corrupt payload") {
+		t.Fatalf("expected one 400 error for payload 1, got %+v", resp.Errors)
+	}
+	if _, ok := resp.Payloads[1].Metadata[shared.DecodeErrorMetadataKey]; !ok {
+		t.Fatalf("expected a decode error sentinel in place of payload 1, got %+v", resp.Payloads[1])
+	}
+	if failures := codec.partialDecodeFailures.Load(); failures != 1 {
+		t.Fatalf("expected 1 partial decode failure, got %d", failures)
+	}
+
+	// A fully decodable batch has no errors field at all
+	rec = doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: payloads[:1]})
+	if strings.Contains(rec.Body.String(), `"errors"`) {
+		t.Fatalf("expected no errors field, got %s", rec.Body.String())
+	}
+}
+
+func TestDecodeRejectsUnknownAlgorithm(t *testing.T) {
+	codec, fake := newTestCodec(t)
+
+	encoded, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	// Make the data key only reachable through KMS
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	clearDecryptionCache(codec.kmsManager)
+	encoded.Algorithm = "CHACHA20-POLY1305"
+
+	_, err = codec.decodePayload(context.Background(), encoded)
+	var ce *codecError
+	if !errors.As(err, &ce) || ce.status != http.StatusBadRequest || !strings.Contains(ce.message, "CHACHA20-POLY1305") {
+		t.Fatalf("expected a 400 naming the algorithm, got %v", err)
+	}
+	if _, decrypt := fake.calls(); decrypt != 0 {
+		t.Fatalf("expected no KMS call for an unknown algorithm, got %d", decrypt)
+	}
+}
+
+func TestDecodeDispatchesOnAlgorithm(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	// A randomized GCM payload relabelled as deterministic must fail, not decrypt by accident
+	encoded, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	encoded.EnvelopeChecksum = "" // exercise the decryptors, not the envelope pre-check
+	encoded.Algorithm = AlgorithmAES256GCMDet
+	if _, err := codec.decodePayload(context.Background(), encoded); err == nil {
+		t.Fatal("expected a mismatched algorithm to fail decryption")
+	}
+
+	// Payloads from before the algorithm field was recorded are AES-256-GCM
+	encoded.Algorithm = ""
+	decoded, err := codec.decodePayload(context.Background(), encoded)
+	if err != nil {
+		t.Fatalf("expected a legacy payload to decode, got %v", err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(decoded.Data)
+	if string(data) != `{"id":1}` {
+		t.Fatalf("unexpected decoded data %q", data)
+	}
+}
+
+func BenchmarkDecode100Payloads(b *testing.B) {
+	quietLogs(b)
+	for _, concurrency := range []int{1, DefaultPayloadConcurrency} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			fake := newFakeKMS()
+			codec := NewKMSEncryptionCodec(newTestManager(b, fake), WithConcurrency(concurrency))
+			payloads := encryptUnderManyKeys(b, codec, 100)
+			fake.decryptDelay = time.Millisecond
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				clearDecryptionCache(codec.kmsManager)
+				b.StartTimer()
+				if _, err := codec.processPayloads(context.Background(), payloads, codec.decodePayload); err != nil {
+					b.Fatalf("processPayloads: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeStoresEncryptionContextForDecode(t *testing.T) {
+	codec, fake := newTestCodec(t)
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	if encoded.EncryptionContext["timestamp"] == "" {
+		t.Fatalf("expected the full encryption context in the payload, got %v", encoded.EncryptionContext)
+	}
+
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	clearDecryptionCache(codec.kmsManager)
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{encoded},
+	})).Payloads[0]
+	if data, _ := base64.StdEncoding.DecodeString(decoded.Data); string(data) != `{"v":1}` {
+		t.Fatalf("unexpected round trip: %s", data)
+	}
+	if _, decrypt := fake.calls(); decrypt != 1 {
+		t.Fatalf("expected the decode to go to KMS, got %d decrypt calls", decrypt)
+	}
+}
+
+func TestKeyStateErrorsMapToServiceUnavailable(t *testing.T) {
+	keyStateErrors := map[string]error{
+		"disabled":         &types.DisabledException{Message: aws.String("arn:aws:kms:us-east-1:123456789012:key/test-key is disabled.")},
+		"pending deletion": &types.KMSInvalidStateException{Message: aws.String("arn:aws:kms:us-east-1:123456789012:key/test-key is pending deletion.")},
+	}
+
+	for name, kmsErr := range keyStateErrors {
+		t.Run(name, func(t *testing.T) {
+			codec, fake := newTestCodec(t)
+			old := encodeUnderRetiredKey(t, codec)
+			fake.generateErr = kmsErr
+			fake.decryptErr = kmsErr
+			codec.kmsManager.currentDataKey.ExpiresAt = time.Now().Add(-time.Second)
+
+			for endpoint, rec := range map[string]*httptest.ResponseRecorder{
+				"encode": doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{plainPayload(`{}`)}}),
+				"decode": doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{old}}),
+			} {
+				if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "KMS key unavailable") {
+					t.Errorf("%s: expected 503 key unavailable, got %d: %s", endpoint, rec.Code, rec.Body.String())
+				}
+			}
+
+			// The key's state is the problem, not KMS, so the breaker stays closed
+			if !codec.kmsManager.KMSAvailable() {
+				t.Fatal("expected key-state errors not to open the circuit breaker")
+			}
+			if _, err := codec.kmsManager.DecryptDataKey(context.Background(), old.EncryptedDataKey, testKeyARN, old.EncryptionContext); !errors.Is(err, ErrKeyUnavailable) {
+				t.Fatalf("expected ErrKeyUnavailable, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEncodeTimestampRoundTripAndTamperDetection(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	codec.encodeTimestamp = true
+
+	before := time.Now().UTC().Truncate(time.Second)
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	encodedAt, err := time.Parse(time.RFC3339, encoded.EncodedAt)
+	if err != nil || encodedAt.Before(before) || encodedAt.After(time.Now()) {
+		t.Fatalf("expected a current RFC 3339 encode time, got %q", encoded.EncodedAt)
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{encoded},
+	})).Payloads[0]
+	if decoded.Metadata[shared.EncodedAtMetadataKey] != encoded.EncodedAt {
+		t.Fatalf("expected the encode time in decode metadata, got %v", decoded.Metadata)
+	}
+	if data, _ := base64.StdEncoding.DecodeString(decoded.Data); string(data) != `{"v":1}` {
+		t.Fatalf("unexpected round trip: %s", data)
+	}
+
+	tampered := map[string]func(*shared.PayloadData){
+		"backdated": func(p *shared.PayloadData) { p.EncodedAt = "2001-01-01T00:00:00Z" },
+		"removed":   func(p *shared.PayloadData) { p.EncodedAt = "" },
+		"other algorithm": func(p *shared.PayloadData) {
+			p.Algorithm = AlgorithmAES256GCMDet
+			p.EnvelopeChecksum = ""
+		},
+	}
+	for name, tamper := range tampered {
+		t.Run(name, func(t *testing.T) {
+			payload := encoded
+			tamper(&payload)
+			rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}})
+			if rec.Code == http.StatusOK {
+				t.Fatalf("expected the tampered payload to be rejected, got: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestEncodeTimestampDisabledByDefault(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	if encoded.EncodedAt != "" {
+		t.Fatalf("expected no encode time, got %q", encoded.EncodedAt)
+	}
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{encoded},
+	})).Payloads[0]
+	if _, ok := decoded.Metadata[shared.EncodedAtMetadataKey]; ok {
+		t.Fatal("expected no encode time in decode metadata")
+	}
+}
+
+func TestEmptyPayloadRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []CodecOption
+		metadata map[string]string
+		want     string
+	}{
+		{"no encoding", nil, map[string]string{}, shared.NullEncoding},
+		{"recorded encoding wins", nil, map[string]string{"encoding": "json/plain"}, "json/plain"},
+		{"configured label", []CodecOption{WithEmptyDecodeEncoding("binary/plain")}, map[string]string{}, "binary/plain"},
+		{"default label", []CodecOption{WithEmptyDecodeEncoding("")}, map[string]string{}, DefaultDecodeEncoding},
+		{"sniffed label", []CodecOption{WithEmptyDecodeEncoding(""), WithDefaultDecodeEncoding(DecodeEncodingSniff)}, map[string]string{}, "binary/plain"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), tc.opts...)
+
+			encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+				Payloads: []shared.PayloadData{{Metadata: tc.metadata}},
+			})).Payloads[0]
+			if encoded.Metadata["encoding"] != "binary/encrypted" {
+				t.Fatalf("expected the empty payload to be encrypted, got %v", encoded.Metadata)
+			}
+			decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+				Payloads: []shared.PayloadData{encoded},
+			})).Payloads[0]
+			if decoded.Data != "" || decoded.Metadata["encoding"] != tc.want {
+				t.Fatalf("expected empty %s data, got %q labelled %s", tc.want, decoded.Data, decoded.Metadata["encoding"])
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package kmscodec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"temporal-key-rotation/shared"
+)
+
+// TransformsMetadataKey lists, in the order they were applied, the pipeline stages that
+// transformed a payload at encode time. Decode reverses them from last to first.
+const TransformsMetadataKey = "transforms"
+
+// Built-in pipeline stage names
+const (
+	TransformEncrypt = "encrypt" // KMS envelope encryption, including the sign-only and deterministic modes
+	TransformGzip    = "gzip"    // gzip compression of the plaintext
+)
+
+// DefaultTransforms is the pipeline of a codec configured without WithTransforms. Payloads that
+// went through exactly these stages carry no TransformsMetadataKey, so they look the same as
+// payloads written before the pipeline existed, and decode treats a missing key as these stages.
+var DefaultTransforms = []string{TransformEncrypt}
+
+// PayloadTransformer is one stage of the encode/decode pipeline
+type PayloadTransformer interface {
+	// Name identifies the stage in TransformsMetadataKey
+	Name() string
+	// Encode transforms payload, reporting false when the stage left it as it was
+	Encode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, bool, error)
+	// Decode reverses Encode; it is only called on payloads this stage transformed
+	Decode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error)
+}
+
+// pipeline runs payloads through its stages in order on encode and in reverse on decode
+type pipeline struct {
+	stages []PayloadTransformer
+	byName map[string]PayloadTransformer
+}
+
+func newPipeline(stages []PayloadTransformer) *pipeline {
+	p := &pipeline{stages: stages, byName: make(map[string]PayloadTransformer, len(stages))}
+	for _, stage := range stages {
+		p.byName[stage.Name()] = stage
+	}
+	return p
+}
+
+// builtinTransformer returns the built-in stage called name for codec
+func builtinTransformer(codec *KMSEncryptionCodec, name string) (PayloadTransformer, bool) {
+	switch name {
+	case TransformEncrypt:
+		return encryptTransformer{codec}, true
+	case TransformGzip:
+		return gzipTransformer{}, true
+	}
+	return nil, false
+}
+
+// ParseTransforms parses a comma separated list of built-in stages, in encode order. Every stage
+// may appear once and the encrypt stage is required.
+func ParseTransforms(spec string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := builtinTransformer(nil, name); !ok {
+			return nil, fmt.Errorf("unknown transform %q (use %s or %s)", name, TransformGzip, TransformEncrypt)
+		}
+		if slices.Contains(names, name) {
+			return nil, fmt.Errorf("transform %q is listed twice", name)
+		}
+		names = append(names, name)
+	}
+	if !slices.Contains(names, TransformEncrypt) {
+		return nil, fmt.Errorf("the %s transform is required", TransformEncrypt)
+	}
+	return names, nil
+}
+
+// Encode applies every stage in order and records the ones that transformed the payload.
+// Temporal control payloads, such as nil values, never reach a stage, and payloads that
+// already carry TransformsMetadataKey were encoded before; both pass through.
+func (p *pipeline) Encode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	if shared.IsControlEncoding(payload.Metadata["encoding"]) {
+		return payload, nil
+	}
+	if _, encoded := payload.Metadata[TransformsMetadataKey]; encoded {
+		return payload, nil
+	}
+
+	var applied []string
+	current := payload
+	for _, stage := range p.stages {
+		next, ok, err := stage.Encode(ctx, current)
+		if err != nil {
+			return shared.PayloadData{}, err
+		}
+		if ok {
+			current = next
+			applied = append(applied, stage.Name())
+		}
+	}
+
+	if len(applied) == 0 || slices.Equal(applied, DefaultTransforms) {
+		return current, nil
+	}
+	current.Metadata = maps.Clone(current.Metadata)
+	if current.Metadata == nil {
+		current.Metadata = make(map[string]string)
+	}
+	current.Metadata[TransformsMetadataKey] = strings.Join(applied, ",")
+	return current, nil
+}
+
+// Decode reverses the stages recorded on the payload, last applied first
+func (p *pipeline) Decode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	recorded, hasTransforms := payload.Metadata[TransformsMetadataKey]
+	names := DefaultTransforms
+	if hasTransforms {
+		names = strings.Split(recorded, ",")
+	}
+
+	current := payload
+	for i := len(names) - 1; i >= 0; i-- {
+		stage, ok := p.byName[names[i]]
+		if !ok {
+			if !hasTransforms {
+				return current, nil
+			}
+			log.Printf("Refused payload with unknown transform %q", names[i])
+			return shared.PayloadData{}, &codecError{http.StatusBadRequest, fmt.Sprintf("Unknown transform %q", names[i]), nil}
+		}
+
+		decoded, err := stage.Decode(ctx, current)
+		if err != nil {
+			return shared.PayloadData{}, err
+		}
+		if hasTransforms {
+			// Stages may build fresh metadata, so the remaining stages are recorded again each time
+			decoded.Metadata = maps.Clone(decoded.Metadata)
+			if decoded.Metadata == nil {
+				decoded.Metadata = make(map[string]string)
+			}
+			if i > 0 {
+				decoded.Metadata[TransformsMetadataKey] = strings.Join(names[:i], ",")
+			} else {
+				delete(decoded.Metadata, TransformsMetadataKey)
+			}
+		}
+		current = decoded
+	}
+	return current, nil
+}
+
+// encryptTransformer is the KMS encryption stage
+type encryptTransformer struct {
+	codec *KMSEncryptionCodec
+}
+
+func (t encryptTransformer) Name() string {
+	return TransformEncrypt
+}
+
+func (t encryptTransformer) Encode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, bool, error) {
+	encoded, err := t.codec.encodePayload(ctx, payload)
+	if err != nil {
+		return shared.PayloadData{}, false, err
+	}
+	// Payloads the codec leaves alone (non-JSON, skipped by policy) keep their encoding
+	return encoded, encoded.Metadata["encoding"] != payload.Metadata["encoding"], nil
+}
+
+func (t encryptTransformer) Decode(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	return t.codec.decodePayload(ctx, payload)
+}
@@ -0,0 +1,176 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func newPipelineCodec(t *testing.T, transforms ...string) *KMSEncryptionCodec {
+	t.Helper()
+	return NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), WithTransforms(transforms))
+}
+
+func TestPipelineCompressesThenEncrypts(t *testing.T) {
+	codec := newPipelineCodec(t, TransformGzip, TransformEncrypt)
+	plain := `{"items":"` + strings.Repeat("abcdefgh", 512) + `"}`
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(plain)},
+	})).Payloads[0]
+	if encoded.Metadata[TransformsMetadataKey] != "gzip,encrypt" {
+		t.Fatalf("expected transforms gzip,encrypt, got %q", encoded.Metadata[TransformsMetadataKey])
+	}
+	if encoded.Metadata["encoding"] != "binary/encrypted" {
+		t.Fatalf("expected an encrypted payload, got %v", encoded.Metadata)
+	}
+	// The ciphertext is of the compressed plaintext
+	if ciphertext, _ := decodeBase64(encoded.Data); len(ciphertext) >= len(plain) {
+		t.Fatalf("expected compressed ciphertext, got %d bytes for %d of plaintext", len(ciphertext), len(plain))
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{encoded},
+	})).Payloads[0]
+	if data, _ := decodeBase64(decoded.Data); string(data) != plain {
+		t.Fatalf("round trip mismatch: %q", data)
+	}
+	if _, ok := decoded.Metadata[TransformsMetadataKey]; ok || decoded.Metadata["encoding"] != "json/plain" {
+		t.Fatalf("unexpected decoded metadata %v", decoded.Metadata)
+	}
+	if decoded.Metadata[shared.KeySourceMetadataKey] == "" {
+		t.Fatal("expected the decrypt provenance to survive the later stages")
+	}
+}
+
+func TestPipelineSkipsCompressionThatDoesNotHelp(t *testing.T) {
+	codec := newPipelineCodec(t, TransformGzip, TransformEncrypt)
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+
+	// Only the default stages ran, so the payload looks like any other encrypted payload
+	if _, ok := encoded.Metadata[TransformsMetadataKey]; ok {
+		t.Fatalf("expected no transforms metadata, got %v", encoded.Metadata)
+	}
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{encoded},
+	})).Payloads[0]
+	if data, _ := decodeBase64(decoded.Data); string(data) != `{"v":1}` {
+		t.Fatalf("round trip mismatch: %q", data)
+	}
+}
+
+func TestPipelineDecodesDefaultPayloadsWithCompressionEnabled(t *testing.T) {
+	manager := newTestManager(t, newFakeKMS())
+	plain := `{"items":"` + strings.Repeat("x", 4096) + `"}`
+	encoded := decodeCodecResponse(t, doCodecRequest(t, NewKMSEncryptionCodec(manager).handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(plain)},
+	})).Payloads[0]
+
+	gzipCodec := NewKMSEncryptionCodec(manager, WithTransforms([]string{TransformGzip, TransformEncrypt}))
+	decoded := decodeCodecResponse(t, doCodecRequest(t, gzipCodec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{encoded},
+	})).Payloads[0]
+	if data, _ := decodeBase64(decoded.Data); string(data) != plain {
+		t.Fatalf("round trip mismatch: %q", data)
+	}
+}
+
+func TestPipelineCompressesPayloadsSkippedByPolicy(t *testing.T) {
+	policy, err := ParseEncryptionPolicy("sensitivity=public:skip")
+	if err != nil {
+		t.Fatalf("ParseEncryptionPolicy: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()),
+		WithTransforms([]string{TransformGzip, TransformEncrypt}), WithEncryptionPolicy(policy))
+	plain := `{"items":"` + strings.Repeat("x", 4096) + `"}`
+	payload := plainPayload(plain)
+	payload.Metadata["sensitivity"] = "public"
+
+	encoded, err := codec.pipeline.Encode(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if encoded.Metadata[TransformsMetadataKey] != TransformGzip || encoded.Metadata["encoding"] != "json/plain" {
+		t.Fatalf("expected a compressed, unencrypted payload, got %v", encoded.Metadata)
+	}
+	if payload.Metadata[TransformsMetadataKey] != "" {
+		t.Fatal("the input payload's metadata must not be modified")
+	}
+	decoded, err := codec.pipeline.Decode(context.Background(), encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if data, _ := decodeBase64(decoded.Data); string(data) != plain || decoded.Metadata["sensitivity"] != "public" {
+		t.Fatalf("unexpected decoded payload %+v", decoded)
+	}
+}
+
+func TestPipelineRejectsUnknownTransform(t *testing.T) {
+	codec := newPipelineCodec(t, TransformEncrypt)
+	payload := plainPayload(`{"v":1}`)
+	payload.Metadata[TransformsMetadataKey] = "zstd"
+
+	if rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestGzipDecodeRejectsOversizedPayload(t *testing.T) {
+	encoded, ok, err := gzipTransformer{}.Encode(context.Background(), plainPayload(string(bytes.Repeat([]byte{'a'}, MaxDecompressedPayloadSize+1))))
+	if err != nil || !ok {
+		t.Fatalf("Encode: %v, %t", err, ok)
+	}
+	if _, err := (gzipTransformer{}).Decode(context.Background(), encoded); err == nil {
+		t.Fatal("expected a payload expanding past the limit to be rejected")
+	}
+}
+
+func TestParseTransforms(t *testing.T) {
+	names, err := ParseTransforms(" gzip , encrypt ")
+	if err != nil || strings.Join(names, ",") != "gzip,encrypt" {
+		t.Fatalf("unexpected result %v, %v", names, err)
+	}
+	for _, spec := range []string{"gzip", "encrypt,encrypt", "encrypt,zstd"} {
+		if _, err := ParseTransforms(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestPipelinePassesThroughNullPayloads(t *testing.T) {
+	policy, err := ParseEncryptionPolicy("sensitivity=*:encrypt")
+	if err != nil {
+		t.Fatalf("ParseEncryptionPolicy: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()),
+		WithTransforms([]string{TransformGzip, TransformEncrypt}), WithEncryptionPolicy(policy))
+
+	// Neither an encrypt rule nor an encryption mode gets a nil value encrypted or signed
+	null := shared.PayloadData{Metadata: map[string]string{"encoding": shared.NullEncoding}}
+	nullWithModes := shared.PayloadData{Metadata: map[string]string{
+		"encoding":                shared.NullEncoding,
+		"sensitivity":             "high",
+		EncryptionModeMetadataKey: EncryptionModeSignOnly,
+	}}
+	input := []shared.PayloadData{null, plainPayload(`{"a":1}`), nullWithModes}
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: input}))
+	if !reflect.DeepEqual(encoded.Payloads[0], null) || !reflect.DeepEqual(encoded.Payloads[2], nullWithModes) {
+		t.Fatalf("expected null payloads unchanged, got %+v", encoded.Payloads)
+	}
+	if encoded.Payloads[1].Metadata["encoding"] != "binary/encrypted" {
+		t.Fatalf("expected the JSON payload to be encrypted, got %v", encoded.Payloads[1].Metadata)
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: encoded.Payloads}))
+	if !reflect.DeepEqual(decoded.Payloads[0], null) || !reflect.DeepEqual(decoded.Payloads[2], nullWithModes) {
+		t.Fatalf("expected null payloads unchanged by decode, got %+v", decoded.Payloads)
+	}
+}
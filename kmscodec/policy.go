@@ -0,0 +1,76 @@
+package kmscodec
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"temporal-key-rotation/shared"
+)
+
+// Encryption policy actions
+const (
+	PolicyEncrypt = "encrypt"
+	PolicySkip    = "skip"
+)
+
+// policyAnyValue as a rule's value matches any payload that has the metadata key
+const policyAnyValue = "*"
+
+// PolicyRule maps payloads whose metadata has Key set to Value to an action
+type PolicyRule struct {
+	Key    string
+	Value  string
+	Action string
+}
+
+func (r PolicyRule) String() string {
+	return fmt.Sprintf("%s=%s:%s", r.Key, r.Value, r.Action)
+}
+
+func (r PolicyRule) matches(metadata map[string]string) bool {
+	value, ok := metadata[r.Key]
+	return ok && (r.Value == policyAnyValue || value == r.Value)
+}
+
+// ParseEncryptionPolicy parses comma separated key=value:action rules, e.g.
+// "sensitivity=high:encrypt,sensitivity=public:skip,team=*:skip". A value of * matches any value.
+func ParseEncryptionPolicy(spec string) ([]PolicyRule, error) {
+	var rules []PolicyRule
+	for _, rule := range strings.Split(spec, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		match, action, ok := strings.Cut(rule, ":")
+		key, value, hasValue := strings.Cut(match, "=")
+		if !ok || !hasValue || key == "" || value == "" {
+			return nil, fmt.Errorf("invalid policy rule %q: want key=value:action", rule)
+		}
+		if action != PolicyEncrypt && action != PolicySkip {
+			return nil, fmt.Errorf("invalid policy rule %q: action must be %s or %s", rule, PolicyEncrypt, PolicySkip)
+		}
+		rules = append(rules, PolicyRule{Key: key, Value: value, Action: action})
+	}
+	return rules, nil
+}
+
+// WithEncryptionPolicy decides per payload whether encode encrypts it, by its metadata.
+// Rules are tried in order and the first match wins; payloads no rule matches are encrypted.
+// The policy only narrows what encode would otherwise encrypt: non-JSON and already
+// encrypted payloads pass through whatever it says.
+func WithEncryptionPolicy(rules []PolicyRule) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.encryptionPolicy = rules
+	}
+}
+
+// policySkips reports whether the encryption policy leaves payload unencrypted
+func (c *KMSEncryptionCodec) policySkips(payload shared.PayloadData) bool {
+	for _, rule := range c.encryptionPolicy {
+		if rule.matches(payload.Metadata) {
+			log.Printf("Encryption policy rule %s matched", rule)
+			return rule.Action == PolicySkip
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package kmscodec
+
+import (
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	rules, err := ParseEncryptionPolicy(" sensitivity=high:encrypt, sensitivity=public:skip,team=*:skip ,")
+	if err != nil {
+		t.Fatalf("ParseEncryptionPolicy: %v", err)
+	}
+	want := []PolicyRule{
+		{Key: "sensitivity", Value: "high", Action: PolicyEncrypt},
+		{Key: "sensitivity", Value: "public", Action: PolicySkip},
+		{Key: "team", Value: "*", Action: PolicySkip},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("expected %d rules, got %v", len(want), rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d: expected %v, got %v", i, want[i], rules[i])
+		}
+	}
+
+	for _, spec := range []string{"sensitivity=high", "sensitivity:skip", "=high:skip", "sensitivity=:skip", "sensitivity=high:drop"} {
+		if _, err := ParseEncryptionPolicy(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestEncodeAppliesEncryptionPolicy(t *testing.T) {
+	rules, err := ParseEncryptionPolicy("sensitivity=high:encrypt,sensitivity=public:skip,team=analytics:skip,scratch=*:skip")
+	if err != nil {
+		t.Fatalf("ParseEncryptionPolicy: %v", err)
+	}
+	fake := newFakeKMS()
+	codec := NewKMSEncryptionCodec(newTestManager(t, fake), WithEncryptionPolicy(rules))
+
+	withMetadata := func(metadata map[string]string) shared.PayloadData {
+		payload := plainPayload(`{"a":1}`)
+		for key, value := range metadata {
+			payload.Metadata[key] = value
+		}
+		return payload
+	}
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		skipped  bool
+	}{
+		{"no rule matches", nil, false},
+		{"encrypt rule", map[string]string{"sensitivity": "high"}, false},
+		{"skip rule", map[string]string{"sensitivity": "public"}, true},
+		{"first match wins", map[string]string{"sensitivity": "high", "team": "analytics"}, false},
+		{"later rule", map[string]string{"sensitivity": "internal", "team": "analytics"}, true},
+		{"wildcard value", map[string]string{"scratch": "yes"}, true},
+		{"other value", map[string]string{"team": "payments"}, false},
+	}
+
+	var payloads []shared.PayloadData
+	for _, tc := range cases {
+		payloads = append(payloads, withMetadata(tc.metadata))
+	}
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: payloads}))
+
+	for i, tc := range cases {
+		got := encoded.Payloads[i]
+		if tc.skipped {
+			if got.Metadata["encoding"] != "json/plain" || got.Data != payloads[i].Data || got.EncryptedDataKey != "" {
+				t.Errorf("%s: expected the payload to pass through, got %+v", tc.name, got)
+			}
+		} else if got.Metadata["encoding"] != "binary/encrypted" {
+			t.Errorf("%s: expected the payload to be encrypted, got %+v", tc.name, got)
+		}
+	}
+}
+
+func TestEncryptionPolicyNeverEncryptsPassThroughPayloads(t *testing.T) {
+	rules, _ := ParseEncryptionPolicy("sensitivity=high:encrypt")
+	codec := NewKMSEncryptionCodec(newTestManager(t, newFakeKMS()), WithEncryptionPolicy(rules))
+
+	binary := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/plain", "sensitivity": "high"}, Data: "AAE="}
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{binary}}))
+	if encoded.Payloads[0].Metadata["encoding"] != "binary/plain" {
+		t.Fatalf("expected the non-JSON payload to pass through, got %+v", encoded.Payloads[0])
+	}
+}
@@ -0,0 +1,110 @@
+package kmscodec
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"temporal-key-rotation/shared"
+)
+
+// ProfileSpec is one parsed entry of a codec profile list: payloads whose codec context has
+// the profile attribute set to Value are encrypted under KeyAlias with Cipher
+type ProfileSpec struct {
+	Value    string
+	KeyAlias string // master key alias, ID or ARN
+	Cipher   string // empty keeps the default codec's cipher
+}
+
+// ParseCodecProfiles parses comma separated value=key[@cipher] entries, e.g.
+// "PaymentWorkflow=alias/pii-codec@AES-256-GCM-SIV,ReportWorkflow=alias/internal-codec"
+func ParseCodecProfiles(spec string) ([]ProfileSpec, error) {
+	var profiles []ProfileSpec
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		value, target, ok := strings.Cut(entry, "=")
+		key, cipher, _ := strings.Cut(target, "@")
+		if !ok || value == "" || key == "" {
+			return nil, fmt.Errorf("invalid codec profile %q: want value=key[@cipher]", entry)
+		}
+		if cipher != "" && cipher != AlgorithmAES256GCM && cipher != AlgorithmAES256GCMSIV {
+			return nil, fmt.Errorf("invalid codec profile %q: cipher must be %s or %s", entry, AlgorithmAES256GCM, AlgorithmAES256GCMSIV)
+		}
+		if slices.ContainsFunc(profiles, func(p ProfileSpec) bool { return p.Value == value }) {
+			return nil, fmt.Errorf("duplicate codec profile %q", value)
+		}
+		profiles = append(profiles, ProfileSpec{Value: value, KeyAlias: key, Cipher: cipher})
+	}
+	return profiles, nil
+}
+
+// WithProfiles makes encode pick the codec that protects each request by the value of
+// attribute in the request's codec context, e.g. a workflow type or search attribute sent by
+// RemoteCodecClient. Each profile codec has its own KMSManager, so its own master key and
+// data keys, and its own cipher. Requests without the attribute, or with a value no profile
+// names, use this codec. Decode needs no context: payloads record their master key, and
+// are decoded by the profile codec using that key.
+func WithProfiles(attribute string, profiles map[string]*KMSEncryptionCodec) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.profileAttribute = attribute
+		c.profiles = profiles
+	}
+}
+
+// encoderFor returns the codec that encodes a request with the given codec context
+func (c *KMSEncryptionCodec) encoderFor(codecContext map[string]string) *KMSEncryptionCodec {
+	if value, ok := codecContext[c.profileAttribute]; ok && c.profileAttribute != "" {
+		if profile, ok := c.profiles[value]; ok {
+			return profile
+		}
+	}
+	return c
+}
+
+// decoderFor returns the codec whose master key encrypted payload, or c if none matches
+func (c *KMSEncryptionCodec) decoderFor(payload shared.PayloadData) *KMSEncryptionCodec {
+	if payload.KMSKeyID == "" || payload.KMSKeyID == c.kmsManager.keyID {
+		return c
+	}
+	for _, profile := range c.profiles {
+		if profile.kmsManager.keyID == payload.KMSKeyID {
+			return profile
+		}
+	}
+	return c
+}
+
+// decodeRouted decodes payload through the pipeline of the codec that encrypted it, so its
+// data key is found in that codec's current key or cache
+func (c *KMSEncryptionCodec) decodeRouted(ctx context.Context, payload shared.PayloadData) (shared.PayloadData, error) {
+	return c.decoderFor(payload).pipeline.Decode(ctx, payload)
+}
+
+// allManagers returns the default codec's manager followed by each profile's, in profile
+// order, so admin operations reach every data key this codec decodes
+func (c *KMSEncryptionCodec) allManagers() []*KMSManager {
+	managers := []*KMSManager{c.kmsManager}
+	for _, value := range slices.Sorted(maps.Keys(c.profiles)) {
+		managers = append(managers, c.profiles[value].kmsManager)
+	}
+	return managers
+}
+
+// cacheManagers returns one manager per distinct decryption cache among allManagers. Profile
+// managers usually share the default manager's Redis cache, which must be listed and flushed
+// once.
+func (c *KMSEncryptionCodec) cacheManagers() []*KMSManager {
+	var managers []*KMSManager
+	seen := make(map[DecryptionCache]bool)
+	for _, manager := range c.allManagers() {
+		if !seen[manager.decryptionCache] {
+			seen[manager.decryptionCache] = true
+			managers = append(managers, manager)
+		}
+	}
+	return managers
+}
@@ -0,0 +1,142 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+const piiKeyARN = "arn:aws:kms:us-east-1:123456789012:key/pii-key"
+
+// newProfiledCodec returns a default codec with a PaymentWorkflow profile under its own
+// master key and AES-256-GCM-SIV, both backed by fake
+func newProfiledCodec(t *testing.T, fake *fakeKMS) *KMSEncryptionCodec {
+	t.Helper()
+	piiManager, err := NewKMSManagerWithClient(fake, piiKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	pii := NewKMSEncryptionCodec(piiManager, WithCipher(AlgorithmAES256GCMSIV))
+	return NewKMSEncryptionCodec(newTestManager(t, fake),
+		WithProfiles("WorkflowType", map[string]*KMSEncryptionCodec{"PaymentWorkflow": pii}))
+}
+
+func TestProfileSelectedByCodecContext(t *testing.T) {
+	fake := newFakeKMS()
+	codec := newProfiledCodec(t, fake)
+
+	encode := func(codecContext map[string]string) shared.PayloadData {
+		return decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+			Payloads: []shared.PayloadData{plainPayload(`{"card":"4111"}`)},
+			Context:  codecContext,
+		})).Payloads[0]
+	}
+
+	tests := []struct {
+		name      string
+		context   map[string]string
+		keyARN    string
+		algorithm string
+	}{
+		{"matching profile", map[string]string{"WorkflowType": "PaymentWorkflow"}, piiKeyARN, AlgorithmAES256GCMSIV},
+		{"no context", nil, testKeyARN, AlgorithmAES256GCM},
+		{"other attribute", map[string]string{"Team": "PaymentWorkflow"}, testKeyARN, AlgorithmAES256GCM},
+		{"unlisted value", map[string]string{"WorkflowType": "ReportWorkflow"}, testKeyARN, AlgorithmAES256GCM},
+	}
+	var encoded []shared.PayloadData
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := encode(tc.context)
+			if payload.KMSKeyID != tc.keyARN || payload.Algorithm != tc.algorithm {
+				t.Fatalf("expected %s under %s, got %s under %s", tc.algorithm, tc.keyARN, payload.Algorithm, payload.KMSKeyID)
+			}
+			encoded = append(encoded, payload)
+		})
+	}
+
+	// Decode needs no context, and each payload is served from its profile's current key
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: encoded}))
+	for i, payload := range decoded.Payloads {
+		if data, _ := decodeBase64(payload.Data); string(data) != `{"card":"4111"}` {
+			t.Fatalf("payload %d: unexpected plaintext %q", i, data)
+		}
+		if source := payload.Metadata[shared.KeySourceMetadataKey]; source != KeySourceCurrent {
+			t.Fatalf("payload %d: expected the current key of its profile, got %s", i, source)
+		}
+	}
+	if _, decrypt := fake.calls(); decrypt != 0 {
+		t.Fatalf("expected no KMS decrypts, got %d", decrypt)
+	}
+}
+
+func TestAdminEndpointsReachProfileManagers(t *testing.T) {
+	fake := newFakeKMS()
+	codec := newProfiledCodec(t, fake)
+	pii := codec.profiles["PaymentWorkflow"].kmsManager
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"card":"4111"}`)},
+		Context:  map[string]string{"WorkflowType": "PaymentWorkflow"},
+	})).Payloads[0]
+	if encoded.KMSKeyID != piiKeyARN {
+		t.Fatalf("expected a profile payload, got one under %s", encoded.KMSKeyID)
+	}
+
+	// Retiring replaces the profile's current key too, keeping it in the profile's cache
+	rec := httptest.NewRecorder()
+	codec.handleRetireCurrent(rec, httptest.NewRequest(http.MethodPost, "/retire-current", nil))
+	var retired struct {
+		Profiles map[string]RetiredKeyResponse `json:"profiles"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&retired); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("retire-current: %d %v", rec.Code, err)
+	}
+	if retired.Profiles["PaymentWorkflow"].Fingerprint != KeyFingerprint(encoded.EncryptedDataKey) {
+		t.Fatalf("expected the profile's key to be retired, got %+v", retired.Profiles)
+	}
+	rec = httptest.NewRecorder()
+	codec.handleCache(rec, httptest.NewRequest(http.MethodGet, "/cache", nil))
+	if !strings.Contains(rec.Body.String(), KeyFingerprint(encoded.EncryptedDataKey)) {
+		t.Fatalf("expected /cache to list the profile's retired key, got %s", rec.Body.String())
+	}
+
+	// Revoking the key blocks decoding through the profile manager
+	body, _ := json.Marshal(RevokeRequest{EncryptedDataKey: encoded.EncryptedDataKey})
+	rec = httptest.NewRecorder()
+	codec.handleRevoke(rec, httptest.NewRequest(http.MethodPost, "/revoke", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{encoded}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected the revoked profile key to be refused with 403, got %d", rec.Code)
+	}
+	if pii.decryptionCache.Len(context.Background()) != 0 {
+		t.Fatal("expected the revoked key to be evicted from the profile's cache")
+	}
+}
+
+func TestParseCodecProfiles(t *testing.T) {
+	profiles, err := ParseCodecProfiles(" PaymentWorkflow=alias/pii-codec@AES-256-GCM-SIV, ReportWorkflow=" + piiKeyARN)
+	if err != nil {
+		t.Fatalf("ParseCodecProfiles: %v", err)
+	}
+	want := []ProfileSpec{
+		{Value: "PaymentWorkflow", KeyAlias: "alias/pii-codec", Cipher: AlgorithmAES256GCMSIV},
+		{Value: "ReportWorkflow", KeyAlias: piiKeyARN},
+	}
+	if len(profiles) != len(want) || profiles[0] != want[0] || profiles[1] != want[1] {
+		t.Fatalf("unexpected profiles %+v", profiles)
+	}
+
+	for _, spec := range []string{"PaymentWorkflow", "=alias/x", "PaymentWorkflow=", "PaymentWorkflow=alias/x@DES", "a=alias/x,a=alias/y"} {
+		if _, err := ParseCodecProfiles(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// DefaultReadyCacheMaxEntries is the decryption cache size above which the cache check fails
+const DefaultReadyCacheMaxEntries = 10000
+
+// Names of the built-in readiness checks
+const (
+	ReadinessCheckKMS        = "kms"
+	ReadinessCheckCurrentKey = "current_key"
+	ReadinessCheckCache      = "cache"
+)
+
+// ReadinessCheck is one named check run by /ready.
+// A failing critical check makes the server not ready; other failures are only reported.
+type ReadinessCheck struct {
+	Name     string
+	Critical bool
+	Check    func(ctx context.Context) error
+}
+
+// ReadinessCheckResult is the outcome of one check in a readiness report
+type ReadinessCheckResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"` // "pass" or "fail"
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ReadinessReport is the /ready response body
+type ReadinessReport struct {
+	Status string                 `json:"status"` // "ready" or "not_ready"
+	Checks []ReadinessCheckResult `json:"checks"`
+}
+
+// DefaultReadinessChecks returns the built-in checks for manager:
+//   - kms (critical): the KMS circuit breaker is not open. It makes no KMS call, so probes cost nothing.
+//   - current_key (critical): a current data key is available, rotating it first if it expired.
+//   - cache: the decryption cache holds at most maxCacheEntries keys.
+func DefaultReadinessChecks(manager *KMSManager, maxCacheEntries int) []ReadinessCheck {
+	return []ReadinessCheck{
+		{
+			Name:     ReadinessCheckKMS,
+			Critical: true,
+			Check: func(ctx context.Context) error {
+				if !manager.KMSAvailable() {
+					return ErrKMSUnavailable
+				}
+				return nil
+			},
+		},
+		{
+			Name:     ReadinessCheckCurrentKey,
+			Critical: true,
+			Check: func(ctx context.Context) error {
+				_, err := manager.GetCurrentDataKey(ctx)
+				return err
+			},
+		},
+		{
+			Name: ReadinessCheckCache,
+			Check: func(ctx context.Context) error {
+				if count := manager.decryptionCache.Len(ctx); count > maxCacheEntries {
+					return fmt.Errorf("%d cached keys exceeds the limit of %d", count, maxCacheEntries)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// SelectReadinessChecks keeps the checks named in the comma separated list, in their original order
+func SelectReadinessChecks(checks []ReadinessCheck, names string) ([]ReadinessCheck, error) {
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
+	}
+
+	selected := []ReadinessCheck{}
+	for _, check := range checks {
+		if wanted[check.Name] {
+			selected = append(selected, check)
+			delete(wanted, check.Name)
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("unknown readiness check %q", name)
+	}
+	return selected, nil
+}
+
+// RunReadinessChecks runs every check and reports not ready if any critical check failed
+func RunReadinessChecks(ctx context.Context, checks []ReadinessCheck) ReadinessReport {
+	report := ReadinessReport{Status: "ready", Checks: make([]ReadinessCheckResult, 0, len(checks))}
+	for _, check := range checks {
+		result := ReadinessCheckResult{Name: check.Name, Status: "pass", Critical: check.Critical}
+		if err := check.Check(ctx); err != nil {
+			result.Status = "fail"
+			result.Error = err.Error()
+			if check.Critical {
+				report.Status = "not_ready"
+			}
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+// handleReady handles the /ready endpoint, returning 503 when a critical check fails
+func (c *KMSEncryptionCodec) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := RunReadinessChecks(r.Context(), c.readinessChecks)
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("Failed to encode readiness report: %v", err)
+	}
+}
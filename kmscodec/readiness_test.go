@@ -0,0 +1,114 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getReadiness(t *testing.T, codec *KMSEncryptionCodec) (int, ReadinessReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	codec.handleReady(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var report ReadinessReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decode report: %v (%s)", err, rec.Body.String())
+	}
+	return rec.Code, report
+}
+
+func checkStatus(report ReadinessReport, name string) string {
+	for _, result := range report.Checks {
+		if result.Name == name {
+			return result.Status
+		}
+	}
+	return ""
+}
+
+func TestReadyReportsEveryCheck(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	code, report := getReadiness(t, codec)
+	if code != http.StatusOK || report.Status != "ready" {
+		t.Fatalf("expected ready, got %d %+v", code, report)
+	}
+	for _, name := range []string{ReadinessCheckKMS, ReadinessCheckCurrentKey, ReadinessCheckCache} {
+		if status := checkStatus(report, name); status != "pass" {
+			t.Errorf("expected %s to pass, got %q", name, status)
+		}
+	}
+}
+
+func TestReadyFailsOnCriticalCheck(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithCircuitBreaker(1, time.Hour))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+
+	// Trip the breaker with one failed rotation
+	fake.generateErr = errors.New("ThrottlingException: rate exceeded")
+	manager.rotateDataKey(context.Background())
+
+	code, report := getReadiness(t, codec)
+	if code != http.StatusServiceUnavailable || report.Status != "not_ready" {
+		t.Fatalf("expected not ready, got %d %+v", code, report)
+	}
+	if checkStatus(report, ReadinessCheckKMS) != "fail" {
+		t.Fatalf("expected the kms check to fail: %+v", report)
+	}
+}
+
+func TestReadyRotatesAnExpiredCurrentKey(t *testing.T) {
+	codec, fake := newTestCodec(t)
+	codec.kmsManager.currentDataKey.ExpiresAt = time.Now().Add(-time.Second)
+
+	if code, report := getReadiness(t, codec); code != http.StatusOK || checkStatus(report, ReadinessCheckCurrentKey) != "pass" {
+		t.Fatalf("expected the current key check to pass after rotating, got %d %+v", code, report)
+	}
+	if generate, _ := fake.calls(); generate != 2 {
+		t.Fatalf("expected an expired key to be rotated, got %d generate calls", generate)
+	}
+}
+
+func TestReadyNonCriticalFailureStaysReady(t *testing.T) {
+	fake := newFakeKMS()
+	manager := newTestManager(t, fake)
+	codec := NewKMSEncryptionCodec(manager, WithReadinessChecks(DefaultReadinessChecks(manager, 0)))
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	code, report := getReadiness(t, codec)
+	if code != http.StatusOK || report.Status != "ready" {
+		t.Fatalf("expected a cache over its bound not to fail readiness, got %d %+v", code, report)
+	}
+	if checkStatus(report, ReadinessCheckCache) != "fail" {
+		t.Fatalf("expected the cache check to report failure: %+v", report)
+	}
+}
+
+func TestSelectReadinessChecks(t *testing.T) {
+	checks := DefaultReadinessChecks(newTestManager(t, newFakeKMS()), DefaultReadyCacheMaxEntries)
+
+	selected, err := SelectReadinessChecks(checks, "cache, kms")
+	if err != nil {
+		t.Fatalf("SelectReadinessChecks: %v", err)
+	}
+	if len(selected) != 2 || selected[0].Name != ReadinessCheckKMS || selected[1].Name != ReadinessCheckCache {
+		t.Fatalf("unexpected selection: %+v", selected)
+	}
+
+	if selected, err := SelectReadinessChecks(checks, ""); err != nil || len(selected) != 0 {
+		t.Fatalf("expected an empty list to disable every check, got %d, %v", len(selected), err)
+	}
+	if _, err := SelectReadinessChecks(checks, "kms,disk"); err == nil {
+		t.Fatal("expected an unknown check name to be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package kmscodec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DefaultRevocationSyncInterval is how often managers apply the revocations other replicas shared
+const DefaultRevocationSyncInterval = 10 * time.Second
+
+// RevocationStore shares revoked data key fingerprints across codec replicas, so a key revoked
+// through one replica's /revoke stops decrypting on all of them and stays revoked across restarts.
+// Without one, revocations live in the memory of the replica that received them.
+// Implementations must be safe for concurrent use.
+type RevocationStore interface {
+	// StoreRevocation records fingerprint as revoked at revokedAt
+	StoreRevocation(ctx context.Context, fingerprint string, revokedAt time.Time) error
+	// LoadRevocations returns every revoked fingerprint with its revocation time
+	LoadRevocations(ctx context.Context) (map[string]time.Time, error)
+}
+
+// WithRevocationStore makes RevokeDataKey record revocations in store, and lets
+// StartRevocationSync apply the revocations other replicas recorded there
+func WithRevocationStore(store RevocationStore) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.revocations = store
+	}
+}
+
+// isKeyFingerprint reports whether s has the form KeyFingerprint returns: 16 lowercase hex digits
+func isKeyFingerprint(s string) bool {
+	if len(s) != 16 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// StartRevocationSync applies the shared revocations straight away and then every interval
+// until Close is called, so a key revoked on another replica is refused here within interval.
+// It does nothing without a revocation store.
+func (k *KMSManager) StartRevocationSync(interval time.Duration) {
+	if k.revocations == nil {
+		return
+	}
+	if err := k.syncRevocations(context.Background()); err != nil {
+		log.Printf("Failed to load shared revocations, will retry in %v: %v", interval, err)
+	}
+
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := k.syncRevocations(context.Background()); err != nil {
+					log.Printf("Failed to sync shared revocations: %v", err)
+				}
+			case <-k.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// syncRevocations revokes here every shared revocation this manager doesn't know yet
+func (k *KMSManager) syncRevocations(ctx context.Context) error {
+	revocations, err := k.revocations.LoadRevocations(ctx)
+	if err != nil {
+		return err
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	for fingerprint, revokedAt := range revocations {
+		if _, known := k.revokedKeys[fingerprint]; known || !isKeyFingerprint(fingerprint) {
+			continue
+		}
+		if err := k.revokeLocked(ctx, fingerprint, revokedAt); err != nil {
+			return fmt.Errorf("applying revocation of %s: %w", fingerprint, err)
+		}
+	}
+	return nil
+}
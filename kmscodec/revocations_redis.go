@@ -0,0 +1,53 @@
+package kmscodec
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisRevocationsKey is the Redis hash of shared revocations, apart from the
+// decryption cache entries so cache scans and flushes leave it alone
+const DefaultRedisRevocationsKey = "temporal-codec:revoked-keys"
+
+// redisRevocationStore is a RevocationStore in a Redis hash mapping each revoked fingerprint to
+// its revocation time in Unix nanoseconds. Fingerprints are not secret, so nothing is sealed,
+// and revocations never expire.
+type redisRevocationStore struct {
+	client redis.UniversalClient
+	key    string
+}
+
+// NewRedisRevocationStore creates a Redis-backed RevocationStore in the hash named key.
+// Replicas that share revocations must use the same Redis and key.
+func NewRedisRevocationStore(client redis.UniversalClient, key string) RevocationStore {
+	if key == "" {
+		key = DefaultRedisRevocationsKey
+	}
+	return &redisRevocationStore{client: client, key: key}
+}
+
+func (s *redisRevocationStore) StoreRevocation(ctx context.Context, fingerprint string, revokedAt time.Time) error {
+	// HSETNX keeps the first revocation time when several replicas or managers record the key
+	return s.client.HSetNX(ctx, s.key, fingerprint, revokedAt.UnixNano()).Err()
+}
+
+func (s *redisRevocationStore) LoadRevocations(ctx context.Context) (map[string]time.Time, error) {
+	fields, err := s.client.HGetAll(ctx, s.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	revocations := make(map[string]time.Time, len(fields))
+	for fingerprint, value := range fields {
+		nanos, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Printf("Redis revocation store holds an invalid entry for %s: %v", fingerprint, err)
+			continue
+		}
+		revocations[fingerprint] = time.Unix(0, nanos)
+	}
+	return revocations, nil
+}
@@ -0,0 +1,58 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRevocationsAreSharedAcrossReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	store := NewRedisRevocationStore(client, "")
+
+	fake := newFakeKMS()
+	newReplica := func() *KMSManager {
+		t.Helper()
+		manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithRevocationStore(store))
+		if err != nil {
+			t.Fatalf("NewKMSManagerWithClient: %v", err)
+		}
+		return manager
+	}
+	ctx := context.Background()
+	first, second := newReplica(), newReplica()
+
+	// The second replica decodes a payload of the first, caching its key
+	current, _ := first.GetCurrentDataKey(ctx)
+	revokedKey := current.EncryptedKey
+	if _, err := second.DecryptDataKey(ctx, revokedKey, testKeyARN, current.EncryptionContext); err != nil {
+		t.Fatalf("DecryptDataKey: %v", err)
+	}
+
+	if err := first.RevokeDataKey(ctx, KeyFingerprint(revokedKey)); err != nil {
+		t.Fatalf("RevokeDataKey: %v", err)
+	}
+	if !server.Exists(DefaultRedisRevocationsKey) {
+		t.Fatal("expected the revocation in Redis")
+	}
+	if err := second.syncRevocations(ctx); err != nil {
+		t.Fatalf("syncRevocations: %v", err)
+	}
+	if _, err := second.DecryptDataKey(ctx, revokedKey, testKeyARN, nil); !errors.Is(err, ErrKeyRevoked) {
+		t.Fatalf("expected ErrKeyRevoked on the other replica, got %v", err)
+	}
+
+	// A replica started later picks the revocation up before serving
+	third := newReplica()
+	third.StartRevocationSync(time.Hour)
+	defer third.Close()
+	if _, err := third.DecryptDataKey(ctx, revokedKey, testKeyARN, nil); !errors.Is(err, ErrKeyRevoked) {
+		t.Fatalf("expected ErrKeyRevoked on a new replica, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+
+	"temporal-key-rotation/shared"
+)
+
+// KeyReEncrypter is implemented by KMS clients that can re-encrypt ciphertext under another
+// key without revealing the plaintext, such as *kms.Client
+type KeyReEncrypter interface {
+	ReEncrypt(ctx context.Context, params *kms.ReEncryptInput, optFns ...func(*kms.Options)) (*kms.ReEncryptOutput, error)
+}
+
+// errRewrapUnsupported reports a KMS client that cannot re-encrypt data keys
+var errRewrapUnsupported = errors.New("KMS client does not support re-encryption")
+
+// NeedsRewrap reports whether payload has a KMS-encrypted data key under a master key other
+// than destinationKeyARN. Unencrypted and legacy static-key payloads have nothing to rewrap.
+func NeedsRewrap(payload shared.PayloadData, destinationKeyARN string) bool {
+	return payload.EncryptedDataKey != "" &&
+		payload.Metadata[SchemeMetadataKey] != SchemeStatic &&
+		payload.KMSKeyID != destinationKeyARN
+}
+
+// RewrapPayload re-encrypts payload's data key under destinationKeyARN with KMS ReEncrypt,
+// keeping the encryption context. Only the data key changes hands inside KMS: neither the
+// data key nor the payload data is ever decrypted here, and the ciphertext is left as is.
+// Payloads that do not need a rewrap are returned unchanged with changed false. A revoked
+// data key is refused with ErrKeyRevoked, since its new blob would have a fingerprint the
+// denylist doesn't know.
+func (k *KMSManager) RewrapPayload(ctx context.Context, payload shared.PayloadData, destinationKeyARN string) (rewrapped shared.PayloadData, changed bool, err error) {
+	reEncrypter, ok := k.client.(KeyReEncrypter)
+	if !ok {
+		return payload, false, errRewrapUnsupported
+	}
+	if !NeedsRewrap(payload, destinationKeyARN) {
+		return payload, false, nil
+	}
+
+	blob, err := decodeBase64(payload.EncryptedDataKey)
+	if err != nil {
+		return payload, false, fmt.Errorf("%w: %v", ErrMalformedDataKey, err)
+	}
+	if err := verifyEnvelope(payload); err != nil {
+		return payload, false, err
+	}
+	encryptionContext := payload.EncryptionContext
+	if encryptionContext == nil {
+		encryptionContext = legacyEncryptionContext()
+	}
+
+	fingerprint := KeyFingerprint(payload.EncryptedDataKey)
+	k.mux.RLock()
+	_, revoked := k.revokedKeys[fingerprint]
+	k.mux.RUnlock()
+	if revoked {
+		return payload, false, fmt.Errorf("%w (fingerprint %s)", ErrKeyRevoked, fingerprint)
+	}
+
+	if !k.breaker.allow() {
+		return payload, false, ErrKMSUnavailable
+	}
+	input := &kms.ReEncryptInput{
+		CiphertextBlob:               blob,
+		SourceEncryptionContext:      encryptionContext,
+		DestinationKeyId:             aws.String(destinationKeyARN),
+		DestinationEncryptionContext: encryptionContext,
+	}
+	// Payloads from before the key ID was recorded leave KMS to find the key from the ciphertext
+	if payload.KMSKeyID != "" {
+		input.SourceKeyId = aws.String(payload.KMSKeyID)
+	}
+	callCtx, cancel := kmsCallContext(ctx, k.decryptTimeout)
+	result, err := reEncrypter.ReEncrypt(callCtx, input)
+	err = kmsTimeoutError(ctx, callCtx, k.decryptTimeout, err)
+	cancel()
+	k.breaker.record(err)
+	k.keyARNMetrics.recordDecrypt(payload.KMSKeyID, err)
+	if err != nil {
+		err = keyStateError(err)
+		k.notifyKeyStateError(payload.KMSKeyID, err)
+		return payload, false, fmt.Errorf("failed to re-encrypt data key: %w", err)
+	}
+
+	rewrapped = payload
+	rewrapped.KMSKeyID = destinationKeyARN
+	rewrapped.EncryptedDataKey = base64.StdEncoding.EncodeToString(result.CiphertextBlob)
+	if payload.EnvelopeChecksum != "" {
+		if rewrapped.EnvelopeChecksum, err = envelopeChecksum(rewrapped); err != nil {
+			return payload, false, err
+		}
+	}
+	return rewrapped, true, nil
+}
@@ -0,0 +1,152 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+const testDestinationKeyARN = "arn:aws:kms:us-east-1:123456789012:key/destination-key"
+
+// reEncryptingKMS adds ReEncrypt to fakeKMS, moving a data key to a new blob under the destination key
+type reEncryptingKMS struct {
+	*fakeKMS
+	reEncryptCalls int
+	destinations   []string
+}
+
+func (f *reEncryptingKMS) ReEncrypt(ctx context.Context, params *kms.ReEncryptInput, optFns ...func(*kms.Options)) (*kms.ReEncryptOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reEncryptCalls++
+	f.destinations = append(f.destinations, *params.DestinationKeyId)
+	plaintext, ok := f.keys[string(params.CiphertextBlob)]
+	if !ok {
+		return nil, errors.New("InvalidCiphertextException: unknown ciphertext")
+	}
+	if !maps.Equal(f.contexts[string(params.CiphertextBlob)], params.SourceEncryptionContext) {
+		return nil, errors.New("InvalidCiphertextException: encryption context mismatch")
+	}
+
+	blob := append([]byte("rewrapped-"), params.CiphertextBlob...)
+	f.keys[string(blob)] = plaintext
+	f.contexts[string(blob)] = params.DestinationEncryptionContext
+	return &kms.ReEncryptOutput{CiphertextBlob: blob, KeyId: params.DestinationKeyId}, nil
+}
+
+func doRewrapRequest(t *testing.T, codec *KMSEncryptionCodec, payloads []shared.PayloadData) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(shared.CodecRequest{Payloads: payloads})
+	if err != nil {
+		t.Fatalf("marshal request: %v", err)
+	}
+	target := "/rewrap?destination_key_arn=" + url.QueryEscape(testDestinationKeyARN)
+	rec := httptest.NewRecorder()
+	codec.handleRewrap(rec, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body)))
+	return rec
+}
+
+func TestRewrapMovesDataKeyWithoutDecrypting(t *testing.T) {
+	fake := &reEncryptingKMS{fakeKMS: newFakeKMS()}
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`), plainPayload(`{"v":2}`)},
+	})).Payloads
+	_, decryptsBefore := fake.calls()
+
+	rec := doRewrapRequest(t, codec, encoded)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rewrap failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var response RewrapResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if response.Rewrapped != 2 || fake.reEncryptCalls != 2 {
+		t.Fatalf("expected 2 rewrapped payloads and ReEncrypt calls, got %d and %d", response.Rewrapped, fake.reEncryptCalls)
+	}
+	if _, decrypts := fake.calls(); decrypts != decryptsBefore {
+		t.Fatalf("rewrap must not decrypt data keys, got %d KMS decrypts", decrypts-decryptsBefore)
+	}
+	for i, payload := range response.Payloads {
+		if payload.KMSKeyID != testDestinationKeyARN || payload.EncryptedDataKey == encoded[i].EncryptedDataKey {
+			t.Fatalf("payload %d was not moved to the destination key: %+v", i, payload)
+		}
+		if payload.Data != encoded[i].Data {
+			t.Fatalf("payload %d ciphertext changed", i)
+		}
+	}
+
+	// Rewrapped payloads decrypt to the original data, and a second rewrap is a no-op
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: response.Payloads})).Payloads
+	if data, _ := decodeBase64(decoded[1].Data); string(data) != `{"v":2}` {
+		t.Fatalf("unexpected decoded data %q", decoded[1].Data)
+	}
+	again := doRewrapRequest(t, codec, response.Payloads)
+	if again.Code != http.StatusOK || fake.reEncryptCalls != 2 {
+		t.Fatalf("expected no further ReEncrypt calls, got %d (%d)", fake.reEncryptCalls, again.Code)
+	}
+}
+
+func TestRewrapRefusesRevokedKeys(t *testing.T) {
+	fake := &reEncryptingKMS{fakeKMS: newFakeKMS()}
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads
+	if err := manager.RevokeDataKey(context.Background(), KeyFingerprint(encoded[0].EncryptedDataKey)); err != nil {
+		t.Fatalf("RevokeDataKey: %v", err)
+	}
+
+	// A rewrapped blob would have a new fingerprint, so rewrap must not launder the revocation
+	if rec := doRewrapRequest(t, codec, encoded); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if fake.reEncryptCalls != 0 {
+		t.Fatalf("expected no ReEncrypt calls for a revoked key, got %d", fake.reEncryptCalls)
+	}
+	_, _, err = manager.RewrapPayload(context.Background(), encoded[0], testDestinationKeyARN)
+	if !errors.Is(err, ErrKeyRevoked) {
+		t.Fatalf("expected ErrKeyRevoked, got %v", err)
+	}
+}
+
+func TestRewrapUnsupportedClient(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads
+
+	if rec := doRewrapRequest(t, codec, encoded); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", rec.Code)
+	}
+}
+
+func TestRewrapRequiresDestination(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	rec := httptest.NewRecorder()
+	codec.handleRewrap(rec, httptest.NewRequest(http.MethodPost, "/rewrap", bytes.NewReader([]byte(`{"payloads":[]}`))))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
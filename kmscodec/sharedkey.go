@@ -0,0 +1,73 @@
+package kmscodec
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// SharedKeyStore lets codec replicas share their current data key, so that a standby taking
+// over decodes the payloads the primary encrypted recently on the current-key fast path
+// instead of calling KMS for each of their keys. Implementations must be safe for concurrent
+// use and must protect the plaintext key at rest. Errors are theirs to log; a failed load is
+// a miss and a failed store leaves the other replicas on their own keys.
+type SharedKeyStore interface {
+	// LoadCurrentKey returns the shared current data key of masterKeyID, or false if there is none
+	LoadCurrentKey(ctx context.Context, masterKeyID string) (*CurrentDataKey, bool)
+	// StoreCurrentKey publishes key as the shared current data key of masterKeyID for ttl, the
+	// time until key.ExpiresAt. key is still in use and must not be kept or modified.
+	StoreCurrentKey(ctx context.Context, masterKeyID string, key *CurrentDataKey, ttl time.Duration)
+}
+
+// WithSharedCurrentKey makes the manager publish every data key it generates to store, and
+// adopt the key another replica published instead of generating its own when the current key
+// is due for rotation. Adopted keys keep the expiry they were generated with, so replicas
+// sharing a key rotate together. Key pair mode has no plaintext key to share and ignores it.
+func WithSharedCurrentKey(store SharedKeyStore) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.sharedKeys = store
+	}
+}
+
+// scheduledRotationLocked replaces an expired or missing current key, adopting the shared key
+// when another replica published one (assumes lock is held)
+func (k *KMSManager) scheduledRotationLocked(ctx context.Context) error {
+	if k.adoptSharedKeyLocked(ctx, k.clock.Now()) {
+		return nil
+	}
+	return k.rotateDataKeyLocked(ctx)
+}
+
+// adoptSharedKeyLocked installs the shared current key if it stays valid past validUntil and
+// is not the key in use already, reporting whether it did (assumes lock is held). Keys revoked
+// here, or of another length than this manager's data keys, are never adopted.
+func (k *KMSManager) adoptSharedKeyLocked(ctx context.Context, validUntil time.Time) bool {
+	if k.sharedKeys == nil || k.keyPairSpec != "" {
+		return false
+	}
+	shared, ok := k.sharedKeys.LoadCurrentKey(ctx, k.keyID)
+	if !ok {
+		return false
+	}
+	fingerprint := KeyFingerprint(shared.EncryptedKey)
+	_, revoked := k.revokedKeys[fingerprint]
+	switch {
+	case !shared.ExpiresAt.After(validUntil), revoked, len(shared.PlaintextKey) != dataKeyLength(k.dataKeySpec),
+		k.currentDataKey != nil && k.currentDataKey.EncryptedKey == shared.EncryptedKey:
+		zeroKey(shared.PlaintextKey)
+		return false
+	}
+
+	k.installDataKeyLocked(ctx, shared)
+	k.sharedKeyAdoptions.Add(1)
+	log.Printf("Adopted shared data key %s, expires at: %v", fingerprint, shared.ExpiresAt)
+	return true
+}
+
+// publishDataKeyLocked shares a key this manager generated with the other replicas
+func (k *KMSManager) publishDataKeyLocked(ctx context.Context, key *CurrentDataKey) {
+	if k.sharedKeys == nil || key.PlaintextKey == nil {
+		return
+	}
+	k.sharedKeys.StoreCurrentKey(ctx, k.keyID, key, key.ExpiresAt.Sub(k.clock.Now()))
+}
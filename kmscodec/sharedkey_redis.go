@@ -0,0 +1,131 @@
+package kmscodec
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisCurrentKeyPrefix namespaces shared current data keys in Redis, apart from the
+// decryption cache entries so cache scans and flushes leave them alone
+const DefaultRedisCurrentKeyPrefix = "temporal-codec:current-key:"
+
+// sharedKeyRecord is the Redis form of a shared current data key, before sealing
+type sharedKeyRecord struct {
+	PlaintextKey      []byte            `json:"plaintext_key"`
+	EncryptedKey      string            `json:"encrypted_key"`
+	EncryptionContext map[string]string `json:"encryption_context,omitempty"`
+	GeneratedAt       time.Time         `json:"generated_at"`
+	ExpiresAt         time.Time         `json:"expires_at"`
+}
+
+// redisKeyStore is a SharedKeyStore in Redis. Like redisCache it seals every key with
+// AES-256-GCM under a local KEK before it leaves the process, binding the entry name as
+// additional data so a key can't be moved to another master key's slot. Each value is the GCM
+// nonce followed by the sealed record, and expires with the key.
+type redisKeyStore struct {
+	client redis.UniversalClient
+	kek    cipher.AEAD
+	prefix string
+}
+
+// NewRedisKeyStore creates a Redis-backed SharedKeyStore sealing keys under a 32-byte KEK.
+// Replicas that share keys must use the same Redis, KEK and prefix.
+func NewRedisKeyStore(client redis.UniversalClient, kek []byte, prefix string) (SharedKeyStore, error) {
+	if len(kek) != 32 {
+		return nil, fmt.Errorf("key store KEK must be 32 bytes, got %d", len(kek))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = DefaultRedisCurrentKeyPrefix
+	}
+	return &redisKeyStore{client: client, kek: aead, prefix: prefix}, nil
+}
+
+// entryName is the Redis key of a master key's shared data key; ARNs are hashed to keep it short
+func (s *redisKeyStore) entryName(masterKeyID string) string {
+	sum := sha256.Sum256([]byte(masterKeyID))
+	return s.prefix + hex.EncodeToString(sum[:8])
+}
+
+func (s *redisKeyStore) LoadCurrentKey(ctx context.Context, masterKeyID string) (*CurrentDataKey, bool) {
+	name := s.entryName(masterKeyID)
+	sealed, err := s.client.Get(ctx, name).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Redis key store read failed: %v", err)
+		return nil, false
+	}
+
+	nonceSize := s.kek.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, false
+	}
+	plaintext, err := s.kek.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil {
+		// Wrong KEK or a tampered entry; generate a key of our own
+		return nil, false
+	}
+	defer zeroKey(plaintext)
+
+	var record sharedKeyRecord
+	if err := json.Unmarshal(plaintext, &record); err != nil {
+		log.Printf("Redis key store holds an invalid entry: %v", err)
+		return nil, false
+	}
+	return &CurrentDataKey{
+		PlaintextKey:      record.PlaintextKey,
+		EncryptedKey:      record.EncryptedKey,
+		EncryptionContext: record.EncryptionContext,
+		GeneratedAt:       record.GeneratedAt,
+		ExpiresAt:         record.ExpiresAt,
+	}, true
+}
+
+func (s *redisKeyStore) StoreCurrentKey(ctx context.Context, masterKeyID string, key *CurrentDataKey, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	plaintext, err := json.Marshal(sharedKeyRecord{
+		PlaintextKey:      key.PlaintextKey,
+		EncryptedKey:      key.EncryptedKey,
+		EncryptionContext: key.EncryptionContext,
+		GeneratedAt:       key.GeneratedAt,
+		ExpiresAt:         key.ExpiresAt,
+	})
+	if err != nil {
+		log.Printf("Redis key store write failed: %v", err)
+		return
+	}
+	defer zeroKey(plaintext)
+
+	nonce := make([]byte, s.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		log.Printf("Redis key store write failed: %v", err)
+		return
+	}
+	name := s.entryName(masterKeyID)
+	sealed := s.kek.Seal(nonce, nonce, plaintext, []byte(name))
+	if err := s.client.Set(ctx, name, sealed, ttl).Err(); err != nil {
+		log.Printf("Redis key store write failed: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package kmscodec
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"temporal-key-rotation/shared"
+)
+
+func newTestKeyStore(t *testing.T, server *miniredis.Miniredis, kek []byte) SharedKeyStore {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	store, err := NewRedisKeyStore(client, kek, "")
+	if err != nil {
+		t.Fatalf("NewRedisKeyStore: %v", err)
+	}
+	return store
+}
+
+func TestStandbyDecodesPrimaryPayloadsOnTheFastPath(t *testing.T) {
+	server := miniredis.RunT(t)
+	kek := bytes.Repeat([]byte{5}, 32)
+	clock := newFakeClock()
+	newReplica := func(fake *fakeKMS) *KMSEncryptionCodec {
+		manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour,
+			WithClock(clock), WithSharedCurrentKey(newTestKeyStore(t, server, kek)))
+		if err != nil {
+			t.Fatalf("NewKMSManagerWithClient: %v", err)
+		}
+		return NewKMSEncryptionCodec(manager)
+	}
+	encode := func(codec *KMSEncryptionCodec) shared.PayloadData {
+		return decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+			Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+		})).Payloads[0]
+	}
+	assertFastPath := func(codec *KMSEncryptionCodec, fake *fakeKMS, payload shared.PayloadData) {
+		t.Helper()
+		decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+			Payloads: []shared.PayloadData{payload},
+		})).Payloads[0]
+		if source := decoded.Metadata[shared.KeySourceMetadataKey]; source != KeySourceCurrent {
+			t.Fatalf("expected the shared current key, got key source %s", source)
+		}
+		if _, decrypt := fake.calls(); decrypt != 0 {
+			t.Fatalf("expected no KMS decrypts, got %d", decrypt)
+		}
+	}
+
+	primaryKMS, standbyKMS := newFakeKMS(), newFakeKMS()
+	primary := newReplica(primaryKMS)
+	clock.Advance(10 * time.Minute)
+	standby := newReplica(standbyKMS)
+	if generate, _ := standbyKMS.calls(); generate != 0 {
+		t.Fatalf("expected the standby to adopt the primary's key, got %d GenerateDataKey calls", generate)
+	}
+	assertFastPath(standby, standbyKMS, encode(primary))
+
+	// The adopted key keeps its expiry, so both replicas rotate at the same time
+	primaryKey, _ := primary.kmsManager.GetCurrentDataKey(context.Background())
+	standbyKey, _ := standby.kmsManager.GetCurrentDataKey(context.Background())
+	if !standbyKey.ExpiresAt.Equal(primaryKey.ExpiresAt) {
+		t.Fatalf("expected the shared expiry %v, got %v", primaryKey.ExpiresAt, standbyKey.ExpiresAt)
+	}
+
+	// The primary's next key is published too and taken over by the standby's pre-rotation
+	clock.Advance(46 * time.Minute)
+	for _, replica := range []*KMSEncryptionCodec{primary, standby} {
+		if err := replica.kmsManager.preRotate(context.Background(), DefaultPreRotationWindow); err != nil {
+			t.Fatalf("preRotate: %v", err)
+		}
+	}
+	fresh := encode(primary)
+	if fresh.EncryptedDataKey == primaryKey.EncryptedKey {
+		t.Fatal("expected the primary to rotate")
+	}
+	if generate, _ := standbyKMS.calls(); generate != 0 {
+		t.Fatalf("expected the standby to adopt the primary's next key, got %d GenerateDataKey calls", generate)
+	}
+	assertFastPath(standby, standbyKMS, fresh)
+	if stats := standby.kmsManager.GetKeyStats(); stats["shared_key_adoptions"] != int64(2) {
+		t.Fatalf("expected 2 adoptions, got %v", stats["shared_key_adoptions"])
+	}
+}
+
+func TestSharedKeyNeedsTheSameKEK(t *testing.T) {
+	server := miniredis.RunT(t)
+	fake := newFakeKMS()
+	first, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour,
+		WithSharedCurrentKey(newTestKeyStore(t, server, bytes.Repeat([]byte{1}, 32))))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	current, _ := first.GetCurrentDataKey(context.Background())
+
+	// Redis only holds the sealed key, and another KEK cannot open it
+	if len(server.Keys()) != 1 {
+		t.Fatalf("expected one shared key entry, got %v", server.Keys())
+	}
+	for _, name := range server.Keys() {
+		if value, _ := server.Get(name); bytes.Contains([]byte(value), current.PlaintextKey) {
+			t.Fatal("expected the shared key to be sealed in Redis")
+		}
+	}
+	if _, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour,
+		WithSharedCurrentKey(newTestKeyStore(t, server, bytes.Repeat([]byte{2}, 32)))); err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	if generate, _ := fake.calls(); generate != 2 {
+		t.Fatalf("expected a replica with another KEK to generate its own key, got %d GenerateDataKey calls", generate)
+	}
+}
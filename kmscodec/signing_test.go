@@ -0,0 +1,100 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+func signOnlyPayload(data string) shared.PayloadData {
+	payload := plainPayload(data)
+	payload.Metadata[EncryptionModeMetadataKey] = EncryptionModeSignOnly
+	return payload
+}
+
+func TestSignOnlyRoundTrip(t *testing.T) {
+	codec, _ := newTestCodec(t)
+
+	signed := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{signOnlyPayload(`{"id":1}`)},
+	})).Payloads[0]
+	if signed.Metadata["encoding"] != SignedEncoding || signed.Metadata[SigningSchemeMetadataKey] != SigningSchemeHMACSHA256 {
+		t.Fatalf("unexpected signed metadata: %v", signed.Metadata)
+	}
+	if data, _ := base64.StdEncoding.DecodeString(signed.Data); string(data) != `{"id":1}` {
+		t.Fatalf("expected sign-only data to stay readable, got %q", data)
+	}
+
+	// Verify through KMS rather than the current key
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	clearDecryptionCache(codec.kmsManager)
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{signed},
+	})).Payloads[0]
+	if data, _ := base64.StdEncoding.DecodeString(decoded.Data); string(data) != `{"id":1}` || decoded.Metadata["encoding"] != "json/plain" {
+		t.Fatalf("unexpected decode: %s %v", data, decoded.Metadata)
+	}
+	if decoded.Metadata[shared.KeySourceMetadataKey] != KeySourceKMS {
+		t.Fatalf("expected the data key from KMS, got %q", decoded.Metadata[shared.KeySourceMetadataKey])
+	}
+}
+
+func TestSignOnlyRejectsTampering(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	signed, err := codec.encodePayload(context.Background(), signOnlyPayload(`{"amount":10}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+
+	cases := map[string]func(*shared.PayloadData){
+		"data": func(p *shared.PayloadData) {
+			p.Data = base64.StdEncoding.EncodeToString([]byte(`{"amount":99}`))
+		},
+		"encoding": func(p *shared.PayloadData) {
+			p.Metadata[OriginalEncodingMetadataKey] = "binary/plain"
+		},
+		"signature": func(p *shared.PayloadData) {
+			p.Metadata[SignatureMetadataKey] = base64.StdEncoding.EncodeToString(make([]byte, 32))
+		},
+		"scheme": func(p *shared.PayloadData) {
+			p.Metadata[SigningSchemeMetadataKey] = "NONE"
+		},
+	}
+	for name, tamper := range cases {
+		t.Run(name, func(t *testing.T) {
+			payload := signed
+			payload.Metadata = make(map[string]string)
+			for key, value := range signed.Metadata {
+				payload.Metadata[key] = value
+			}
+			tamper(&payload)
+
+			rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}})
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400 for tampered %s, got %d: %s", name, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSignOnlyRejectedInKeyPairMode(t *testing.T) {
+	manager, err := NewKMSManagerWithClient(newFakeKMS(), testKeyARN, time.Hour, time.Hour, WithKeyPairMode(types.DataKeyPairSpecRsa2048))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+
+	rec := doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{signOnlyPayload(`{}`)}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
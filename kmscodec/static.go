@@ -0,0 +1,129 @@
+package kmscodec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+
+	"temporal-key-rotation/shared"
+)
+
+// Payloads from the legacy static-key codec carry scheme: static and are plain AES-256-GCM
+// under one shared key, without an encrypted data key. Encode marks its own payloads
+// scheme: kms; payloads with no scheme predate the marker and are KMS payloads too.
+const (
+	SchemeMetadataKey = "scheme"
+	SchemeKMS         = "kms"
+	SchemeStatic      = "static"
+)
+
+// KeySourceStatic is the key-source reported for payloads decrypted with the legacy static key
+const KeySourceStatic = "static"
+
+// WithStaticKey lets decode read payloads of the legacy static-key codec during a migration
+// to KMS. Encode never uses it. The key must be 32 bytes; the option keeps its own copy.
+func WithStaticKey(key []byte) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.staticKey = cloneKey(key)
+	}
+}
+
+// ErrWeakStaticKey is returned by CheckStaticKeyStrength for a key that was evidently not
+// generated at random
+var ErrWeakStaticKey = errors.New("weak static key")
+
+// minStaticKeyEntropy is the least Shannon entropy, in bits per byte, CheckStaticKeyStrength
+// accepts. 32 random bytes almost always have about 30 distinct values and close to 5 bits.
+const minStaticKeyEntropy = 4.0
+
+// knownTestKeys are published AES-256 test vectors that turn up in examples and test configs
+var knownTestKeys = []string{
+	"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", // FIPS-197 C.3
+	"603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4", // SP 800-38A F.1.5
+	"feffe9928665731c6d6a8f9467308308feffe9928665731c6d6a8f9467308308", // GCM spec test cases 15-18
+}
+
+// CheckStaticKeyStrength rejects static keys that cannot have come from a random generator
+// such as keygen: a repeated byte (including all zeros), a run of consecutive bytes, a known
+// test vector, a key of printable ASCII (a passphrase rather than random bytes), or one with
+// too little entropy. It is a guard against configuration mistakes, not a proof of strength.
+func CheckStaticKeyStrength(key []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%w: empty", ErrWeakStaticKey)
+	}
+	if bytes.Count(key, key[:1]) == len(key) {
+		return fmt.Errorf("%w: every byte is 0x%02x", ErrWeakStaticKey, key[0])
+	}
+	consecutive := true
+	for i := 1; i < len(key) && consecutive; i++ {
+		consecutive = key[i] == key[i-1]+1
+	}
+	if consecutive {
+		return fmt.Errorf("%w: consecutive byte values", ErrWeakStaticKey)
+	}
+	for _, known := range knownTestKeys {
+		if hex.EncodeToString(key) == known {
+			return fmt.Errorf("%w: published test vector", ErrWeakStaticKey)
+		}
+	}
+	printable := true
+	for _, b := range key {
+		printable = printable && b >= 0x20 && b < 0x7f
+	}
+	if printable {
+		return fmt.Errorf("%w: printable text, not random bytes", ErrWeakStaticKey)
+	}
+	if entropy := byteEntropy(key); entropy < minStaticKeyEntropy {
+		return fmt.Errorf("%w: %.1f bits of entropy per byte, want at least %.1f", ErrWeakStaticKey, entropy, minStaticKeyEntropy)
+	}
+	return nil
+}
+
+// byteEntropy estimates the Shannon entropy of data in bits per byte from its byte frequencies
+func byteEntropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var entropy float64
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(data))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// decodeStaticPayload decrypts a legacy static-key payload
+func (c *KMSEncryptionCodec) decodeStaticPayload(payload shared.PayloadData) (shared.PayloadData, error) {
+	if c.staticKey == nil {
+		log.Printf("Refused static-key payload: no static key configured")
+		return shared.PayloadData{}, &codecError{http.StatusBadRequest, "Static-key payload but no static key is configured", nil}
+	}
+
+	data, err := DecryptWithDataKey(payload.Data, c.staticKey)
+	if err != nil {
+		log.Printf("Failed to decrypt static-key payload: %v", err)
+		return shared.PayloadData{}, &codecError{http.StatusInternalServerError, "Data decryption failed", err}
+	}
+
+	decoded := c.decodedPayload(payload, data, KeySourceStatic)
+	// There is no data key to fingerprint
+	delete(decoded.Metadata, shared.KeyFingerprintMetadataKey)
+	return decoded, nil
+}
+
+// checkScheme rejects encryption schemes other than the known ones
+func checkScheme(payload shared.PayloadData) error {
+	switch scheme := payload.Metadata[SchemeMetadataKey]; scheme {
+	case "", SchemeKMS, SchemeStatic:
+		return nil
+	default:
+		return &codecError{http.StatusBadRequest, fmt.Sprintf("Unsupported scheme %q", scheme), nil}
+	}
+}
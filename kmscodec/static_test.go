@@ -0,0 +1,111 @@
+package kmscodec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+// staticPayload encrypts data the way the legacy static-key codec did
+func staticPayload(t *testing.T, data string, key []byte) shared.PayloadData {
+	t.Helper()
+	encrypted, err := EncryptWithDataKey([]byte(data), key)
+	if err != nil {
+		t.Fatalf("EncryptWithDataKey: %v", err)
+	}
+	return shared.PayloadData{
+		Metadata: map[string]string{"encoding": "binary/encrypted", SchemeMetadataKey: SchemeStatic},
+		Data:     encrypted,
+	}
+}
+
+func TestHybridDecodeHandlesBothSchemesInOneBatch(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	staticKey := bytes.Repeat([]byte{7}, 32)
+	WithStaticKey(staticKey)(codec)
+
+	encoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"new":true}`)},
+	})).Payloads[0]
+	if encoded.Metadata[SchemeMetadataKey] != SchemeKMS {
+		t.Fatalf("expected encode to mark its payloads scheme: kms, got %v", encoded.Metadata)
+	}
+
+	decoded := decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{staticPayload(t, `{"old":true}`, staticKey), encoded},
+	})).Payloads
+
+	want := []struct{ data, source string }{{`{"old":true}`, KeySourceStatic}, {`{"new":true}`, KeySourceCurrent}}
+	for i, w := range want {
+		if data, _ := base64.StdEncoding.DecodeString(decoded[i].Data); string(data) != w.data {
+			t.Errorf("payload %d: expected %s, got %s", i, w.data, data)
+		}
+		if source := decoded[i].Metadata[shared.KeySourceMetadataKey]; source != w.source {
+			t.Errorf("payload %d: expected key source %q, got %q", i, w.source, source)
+		}
+	}
+	if _, ok := decoded[0].Metadata[shared.KeyFingerprintMetadataKey]; ok {
+		t.Error("expected no data key fingerprint on a static-key payload")
+	}
+}
+
+func TestStaticSchemeRequiresConfiguredKey(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	payload := staticPayload(t, `{"old":true}`, bytes.Repeat([]byte{7}, 32))
+
+	rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a static key, got %d", rec.Code)
+	}
+
+	payload.Metadata[SchemeMetadataKey] = "rot13"
+	rec = doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown scheme, got %d", rec.Code)
+	}
+}
+
+func TestStaticKeyOptionCopiesKey(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	staticKey := bytes.Repeat([]byte{7}, 32)
+	WithStaticKey(staticKey)(codec)
+	payload := staticPayload(t, `{"old":true}`, staticKey)
+
+	clear(staticKey)
+	decodeCodecResponse(t, doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}}))
+}
+
+func TestCheckStaticKeyStrength(t *testing.T) {
+	fips197, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	nist, _ := hex.DecodeString("603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4")
+	weak := map[string][]byte{
+		"all zero":      make([]byte, 32),
+		"repeated byte": bytes.Repeat([]byte{7}, 32),
+		"consecutive":   fips197,
+		"test vector":   nist,
+		"passphrase":    []byte("my-super-secret-temporal-codec-k"),
+		"low entropy":   append(bytes.Repeat([]byte{0x00, 0xff}, 15), 0x80, 0x81),
+		"empty":         nil,
+	}
+	for name, key := range weak {
+		if err := CheckStaticKeyStrength(key); !errors.Is(err, ErrWeakStaticKey) {
+			t.Errorf("%s: expected ErrWeakStaticKey, got %v", name, err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatalf("rand.Read: %v", err)
+		}
+		if err := CheckStaticKeyStrength(key); err != nil {
+			t.Fatalf("expected random key %x to pass, got %v", key, err)
+		}
+	}
+}
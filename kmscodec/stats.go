@@ -0,0 +1,109 @@
+package kmscodec
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metric names in the Prometheus rendering of /stats are prefixed with statsMetricPrefix
+const statsMetricPrefix = "temporal_codec_"
+
+// statsCounters are the /stats values that only ever increase
+var statsCounters = map[string]bool{
+	"current_key_hits":    true,
+	"cache_hits":          true,
+	"kms_decrypts":        true,
+	"negative_cache_hits": true,
+	"forced_rotations":    true,
+
+	"shared_key_adoptions": true,
+	"kms_replica_decrypts": true,
+
+	"audit_records_written": true,
+	"audit_records_dropped": true,
+	"audit_write_failures":  true,
+
+	"encode_dedup_hits":   true,
+	"encode_dedup_misses": true,
+
+	"foreign_encryption_skipped":  true,
+	"foreign_encryption_rejected": true,
+
+	"decode_max_age_rejections": true,
+	"metadata_keys_dropped":     true,
+
+	"partial_decode_failures": true,
+}
+
+// writePrometheusStats renders a /stats map in the Prometheus text exposition format.
+// Numbers and booleans become gauges (or counters), durations become *_seconds gauges,
+// and other strings become *_info gauges carrying the value as a label.
+func writePrometheusStats(w io.Writer, stats map[string]interface{}, entries []CacheEntryInfo, now time.Time) {
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		name := statsMetricPrefix + key
+		switch value := stats[key].(type) {
+		case int:
+			writeMetric(w, name, statsMetricType(key), "", float64(value))
+		case int64:
+			writeMetric(w, name, statsMetricType(key), "", float64(value))
+		case float64:
+			writeMetric(w, name, statsMetricType(key), "", value)
+		case bool:
+			writeMetric(w, name, "gauge", "", boolMetric(value))
+		case string:
+			if d, err := time.ParseDuration(value); err == nil {
+				writeMetric(w, name+"_seconds", "gauge", "", d.Seconds())
+			} else {
+				writeMetric(w, name+"_info", "gauge", fmt.Sprintf(`{value=%q}`, value), 1)
+			}
+		case *MultiRegionInfo:
+			writeMetric(w, name, "gauge", "", boolMetric(value.MultiRegion))
+			writeMetric(w, name+"_replicas", "gauge", "", float64(len(value.ReplicaRegions)))
+		}
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# TYPE %scache_entry_age_seconds gauge\n", statsMetricPrefix)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%scache_entry_age_seconds{fingerprint=%q} %s\n", statsMetricPrefix, entry.Fingerprint, formatMetric(now.Sub(entry.CachedAt).Seconds()))
+	}
+	fmt.Fprintf(w, "# TYPE %scache_entry_ttl_remaining_seconds gauge\n", statsMetricPrefix)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%scache_entry_ttl_remaining_seconds{fingerprint=%q} %s\n", statsMetricPrefix, entry.Fingerprint, formatMetric(entry.ExpiresAt.Sub(now).Seconds()))
+	}
+}
+
+func statsMetricType(key string) string {
+	// Fleet totals of counters are counters too
+	if statsCounters[strings.TrimPrefix(key, "fleet_")] {
+		return "counter"
+	}
+	return "gauge"
+}
+
+func writeMetric(w io.Writer, name, metricType, labels string, value float64) {
+	fmt.Fprintf(w, "# TYPE %s %s\n%s%s %s\n", name, metricType, name, labels, formatMetric(value))
+}
+
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,97 @@
+package kmscodec
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func getStats(t *testing.T, mux *http.ServeMux, target, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStatsPrometheusFormat(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "s3cr3t")
+	decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)}}))
+
+	rec := getStats(t, mux, "/stats?format=prometheus", "")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("expected a 200 text response, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE temporal_codec_current_key_hits counter\ntemporal_codec_current_key_hits 0\n",
+		"temporal_codec_max_payloads_per_request 1000\n",
+		"temporal_codec_current_key_expired 0\n",
+		"# TYPE temporal_codec_current_key_age_seconds gauge\n",
+		`temporal_codec_cache_backend_info{value="memory"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestStatsVerboseRequiresAdminToken(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "s3cr3t")
+	old, _ := codec.kmsManager.GetCurrentDataKey(context.Background())
+	if err := codec.kmsManager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+
+	if rec := getStats(t, mux, "/stats?verbose=true", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin token, got %d", rec.Code)
+	}
+
+	rec := getStats(t, mux, "/stats?verbose=true", "s3cr3t")
+	var stats struct {
+		CachedKeys   int                  `json:"cached_keys_count"`
+		CacheEntries []CacheEntryResponse `json:"cache_entries"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	if len(stats.CacheEntries) != 1 || stats.CacheEntries[0].Fingerprint != KeyFingerprint(old.EncryptedKey) {
+		t.Fatalf("expected the rotated-out key in cache_entries, got %+v", stats.CacheEntries)
+	}
+
+	rec = getStats(t, mux, "/stats?verbose=true&format=prometheus", "s3cr3t")
+	if want := `temporal_codec_cache_entry_age_seconds{fingerprint="` + KeyFingerprint(old.EncryptedKey) + `"} `; !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("expected %q in:\n%s", want, rec.Body.String())
+	}
+}
+
+func TestStatsDefaultsToJSON(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "")
+
+	rec := getStats(t, mux, "/stats", "")
+	var stats map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("expected JSON by default: %v", err)
+	}
+	if _, ok := stats["cache_entries"]; ok {
+		t.Fatal("expected no cache entries without verbose")
+	}
+
+	if rec := getStats(t, mux, "/stats?format=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown format, got %d", rec.Code)
+	}
+}
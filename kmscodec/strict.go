@@ -0,0 +1,41 @@
+package kmscodec
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"temporal-key-rotation/shared"
+)
+
+// WithStrictDecode validates the KMS envelope of every encrypted payload before decrypting
+// it: the algorithm must be recorded, the key ID present and the encrypted data key
+// well-formed. Payloads from before the algorithm field was recorded are rejected.
+func WithStrictDecode(strict bool) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.strictDecode = strict
+	}
+}
+
+// checkStrictEnvelope rejects encrypted payloads whose envelope fields are missing or inconsistent.
+// The algorithm is known to be supported and the encrypted data key non-empty by the time it runs.
+func checkStrictEnvelope(payload shared.PayloadData) error {
+	if payload.Algorithm == "" {
+		return &codecError{http.StatusBadRequest, "Strict decode: missing algorithm", nil}
+	}
+	if payload.KMSKeyID == "" {
+		return &codecError{http.StatusBadRequest, "Strict decode: missing KMS key ID", nil}
+	}
+	if encryptedKey, err := base64.StdEncoding.DecodeString(payload.EncryptedDataKey); err != nil || len(encryptedKey) == 0 {
+		return &codecError{http.StatusBadRequest, "Strict decode: encrypted data key is not valid base64", err}
+	}
+
+	// Only key pair payloads carry an RSA-wrapped content key
+	hasWrappedKey := payload.WrappedKey != ""
+	if payload.Algorithm == AlgorithmRSAOAEPAES256GCM && !hasWrappedKey {
+		return &codecError{http.StatusBadRequest, "Strict decode: missing wrapped key for " + AlgorithmRSAOAEPAES256GCM, nil}
+	}
+	if payload.Algorithm != AlgorithmRSAOAEPAES256GCM && hasWrappedKey {
+		return &codecError{http.StatusBadRequest, "Strict decode: unexpected wrapped key for " + payload.Algorithm, nil}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package kmscodec
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestStrictDecodeRejectsIncompleteEnvelopes(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	codec.strictDecode = true
+	encoded, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	if _, err := codec.decodePayload(context.Background(), encoded); err != nil {
+		t.Fatalf("expected a complete payload to decode in strict mode, got %v", err)
+	}
+
+	cases := map[string]struct {
+		tamper func(*shared.PayloadData)
+		want   string
+	}{
+		"missing algorithm":      {func(p *shared.PayloadData) { p.Algorithm = "" }, "missing algorithm"},
+		"missing key id":         {func(p *shared.PayloadData) { p.KMSKeyID = "" }, "missing KMS key ID"},
+		"malformed data key":     {func(p *shared.PayloadData) { p.EncryptedDataKey = "not base64!" }, "not valid base64"},
+		"missing wrapped key":    {func(p *shared.PayloadData) { p.Algorithm = AlgorithmRSAOAEPAES256GCM }, "missing wrapped key"},
+		"unexpected wrapped key": {func(p *shared.PayloadData) { p.WrappedKey = "d3JhcHBlZA==" }, "unexpected wrapped key"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			payload := encoded
+			payload.EnvelopeChecksum = ""
+			tc.tamper(&payload)
+
+			rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{payload}})
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.want) {
+				t.Fatalf("expected 400 mentioning %q, got %d: %s", tc.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestStrictDecodeDisabledAcceptsLegacyPayloads(t *testing.T) {
+	codec, _ := newTestCodec(t)
+	encoded, err := codec.encodePayload(context.Background(), plainPayload(`{"id":1}`))
+	if err != nil {
+		t.Fatalf("encodePayload: %v", err)
+	}
+	encoded.EnvelopeChecksum = ""
+	encoded.Algorithm = ""
+	encoded.KMSKeyID = ""
+	if _, err := codec.decodePayload(context.Background(), encoded); err != nil {
+		t.Fatalf("expected a legacy payload to decode outside strict mode, got %v", err)
+	}
+}
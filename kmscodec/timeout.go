@@ -0,0 +1,37 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrKMSTimeout reports a KMS call that did not finish within its configured timeout
+var ErrKMSTimeout = errors.New("KMS call timed out")
+
+// WithKMSTimeouts bounds each KMS data key generation and each KMS decrypt. Zero leaves that
+// operation bounded only by the caller's context.
+func WithKMSTimeouts(generate, decrypt time.Duration) KMSManagerOption {
+	return func(k *KMSManager) {
+		k.generateTimeout = generate
+		k.decryptTimeout = decrypt
+	}
+}
+
+// kmsCallContext derives the context for one KMS call, with timeout applied when positive
+func kmsCallContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// kmsTimeoutError marks err with ErrKMSTimeout when the call's own timeout expired, as opposed
+// to the caller giving up
+func kmsTimeoutError(ctx, callCtx context.Context, timeout time.Duration, err error) error {
+	if err == nil || ctx.Err() != nil || !errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w after %v: %w", ErrKMSTimeout, timeout, err)
+}
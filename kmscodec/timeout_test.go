@@ -0,0 +1,84 @@
+package kmscodec
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+func TestKMSDecryptTimeout(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithKMSTimeouts(0, 20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+	codec := NewKMSEncryptionCodec(manager)
+	old := decodeCodecResponse(t, doCodecRequest(t, codec.handleEncode, shared.CodecRequest{
+		Payloads: []shared.PayloadData{plainPayload(`{"v":1}`)},
+	})).Payloads[0]
+	if err := manager.rotateDataKey(context.Background()); err != nil {
+		t.Fatalf("rotateDataKey: %v", err)
+	}
+	manager.FlushDecryptionCache(context.Background())
+
+	fake.mu.Lock()
+	fake.decryptDelay = time.Second
+	fake.mu.Unlock()
+
+	start := time.Now()
+	_, err = manager.DecryptDataKey(context.Background(), old.EncryptedDataKey, old.KMSKeyID, old.EncryptionContext)
+	if !errors.Is(err, ErrKMSTimeout) {
+		t.Fatalf("expected ErrKMSTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the decrypt to give up after the timeout, took %v", elapsed)
+	}
+
+	if rec := doCodecRequest(t, codec.handleDecode, shared.CodecRequest{Payloads: []shared.PayloadData{old}}); rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rec.Code)
+	}
+
+	// A call that finishes within the timeout is unaffected
+	fake.mu.Lock()
+	fake.decryptDelay = time.Millisecond
+	fake.mu.Unlock()
+	if _, err := manager.DecryptDataKey(context.Background(), old.EncryptedDataKey, old.KMSKeyID, old.EncryptionContext); err != nil {
+		t.Fatalf("expected a fast decrypt to succeed, got %v", err)
+	}
+}
+
+func TestKMSGenerateTimeout(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithKMSTimeouts(20*time.Millisecond, 0))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	fake.mu.Lock()
+	fake.generateDelay = time.Second
+	fake.mu.Unlock()
+	if err := manager.rotateDataKey(context.Background()); !errors.Is(err, ErrKMSTimeout) {
+		t.Fatalf("expected ErrKMSTimeout, got %v", err)
+	}
+}
+
+func TestKMSTimeoutNotReportedForCallerCancellation(t *testing.T) {
+	fake := newFakeKMS()
+	manager, err := NewKMSManagerWithClient(fake, testKeyARN, time.Hour, time.Hour, WithKMSTimeouts(time.Second, 0))
+	if err != nil {
+		t.Fatalf("NewKMSManagerWithClient: %v", err)
+	}
+
+	fake.mu.Lock()
+	fake.generateDelay = time.Second
+	fake.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := manager.rotateDataKey(ctx); err == nil || errors.Is(err, ErrKMSTimeout) {
+		t.Fatalf("expected the caller's deadline error, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package kmscodec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// BuildInfo identifies the binary serving the codec; main fills it from -ldflags
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+}
+
+// WithBuildInfo sets the build reported by /version
+func WithBuildInfo(info BuildInfo) CodecOption {
+	return func(c *KMSEncryptionCodec) {
+		c.buildInfo = info
+	}
+}
+
+// VersionInfo is the /version response: the build and the crypto parameters replicas must agree on
+type VersionInfo struct {
+	BuildInfo
+	GoVersion        string   `json:"go_version"`
+	Algorithm        string   `json:"algorithm"`
+	DataKeyMode      string   `json:"data_key_mode"`
+	Transforms       []string `json:"transforms"`
+	RotationInterval string   `json:"rotation_interval"`
+	CacheTTL         string   `json:"cache_ttl"`
+	KMSKeyARN        string   `json:"kms_key_arn"` // masked
+	// ConfigHash is a short hash of the parameters above and the unmasked key, so replicas can be
+	// compared at a glance
+	ConfigHash string `json:"config_hash"`
+}
+
+// versionInfo describes this codec's build and crypto parameters
+func (c *KMSEncryptionCodec) versionInfo() VersionInfo {
+	k := c.kmsManager
+	info := VersionInfo{
+		BuildInfo:        c.buildInfo,
+		GoVersion:        runtime.Version(),
+		Algorithm:        c.cipher,
+		DataKeyMode:      "symmetric:" + string(k.dataKeySpec),
+		Transforms:       c.transforms,
+		RotationInterval: k.keyRotationInterval.String(),
+		CacheTTL:         k.cacheTTL.String(),
+		KMSKeyARN:        maskKeyARN(k.keyID),
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if k.keyPairSpec != "" {
+		info.Algorithm = AlgorithmRSAOAEPAES256GCM
+		info.DataKeyMode = "key_pair:" + string(k.keyPairSpec)
+	}
+
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s|%s|%s|%s|%s|%s", info.Algorithm, info.DataKeyMode,
+		strings.Join(info.Transforms, ","), info.RotationInterval, info.CacheTTL, k.keyID))
+	info.ConfigHash = hex.EncodeToString(sum[:6])
+	return info
+}
+
+// maskKeyARN hides most of the account and key ID of a KMS key ARN, keeping enough to tell keys apart
+func maskKeyARN(keyARN string) string {
+	parsed, err := arn.Parse(keyARN)
+	if err != nil {
+		return maskTail(keyARN, 8)
+	}
+	parsed.AccountID = "****" + parsed.AccountID[max(len(parsed.AccountID)-4, 0):]
+	if resourceType, id, ok := strings.Cut(parsed.Resource, "/"); ok && resourceType == "key" {
+		parsed.Resource = resourceType + "/" + maskTail(id, 8)
+	}
+	return parsed.String()
+}
+
+// maskTail keeps the first keep characters of s and masks the rest
+func maskTail(s string, keep int) string {
+	if len(s) <= keep {
+		return s
+	}
+	return s[:keep] + "****"
+}
+
+// handleVersion handles the /version endpoint, reporting the build and crypto parameters so a
+// rolling deploy can be checked for replicas that disagree
+func (c *KMSEncryptionCodec) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.versionInfo()); err != nil {
+		log.Printf("Failed to encode version response: %v", err)
+	}
+}
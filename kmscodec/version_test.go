@@ -0,0 +1,53 @@
+package kmscodec
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	manager := newTestManager(t, newFakeKMS())
+	codec := NewKMSEncryptionCodec(manager, WithBuildInfo(BuildInfo{Version: "v1.4.0", Commit: "abc123"}), WithCipher(AlgorithmAES256GCMSIV))
+	mux := http.NewServeMux()
+	codec.RegisterRoutes(mux, "")
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 without a token, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var info VersionInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if info.Version != "v1.4.0" || info.Commit != "abc123" || info.Algorithm != AlgorithmAES256GCMSIV ||
+		info.RotationInterval != "1h0m0s" || info.CacheTTL != "1h0m0s" || info.ConfigHash == "" {
+		t.Fatalf("unexpected version info %+v", info)
+	}
+	// The key ARN is masked, but still tells keys apart
+	if strings.Contains(info.KMSKeyARN, "123456789012") || info.KMSKeyARN == testKeyARN || !strings.HasPrefix(info.KMSKeyARN, "arn:aws:kms:") {
+		t.Fatalf("expected a masked key ARN, got %q", info.KMSKeyARN)
+	}
+
+	// Replicas with different crypto parameters report different hashes
+	other := NewKMSEncryptionCodec(manager).versionInfo()
+	if other.ConfigHash == info.ConfigHash || other.Version != "dev" {
+		t.Fatalf("unexpected version info %+v", other)
+	}
+}
+
+func TestMaskKeyARN(t *testing.T) {
+	tests := map[string]string{
+		"arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab": "arn:aws:kms:us-east-1:****9012:key/1234abcd****",
+		"arn:aws:kms:us-east-1:123456789012:alias/codec":                              "arn:aws:kms:us-east-1:****9012:alias/codec",
+		"1234abcd-12ab-34cd-56ef-1234567890ab":                                        "1234abcd****",
+	}
+	for keyARN, want := range tests {
+		if got := maskKeyARN(keyARN); got != want {
+			t.Errorf("maskKeyARN(%q) = %q, want %q", keyARN, got, want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package kmscodec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"temporal-key-rotation/shared"
+)
+
+// readCodecRequest parses a codec request body in the format its Content-Type selects
+func (c *KMSEncryptionCodec) readCodecRequest(w http.ResponseWriter, r *http.Request) (shared.CodecRequest, bool) {
+	var req shared.CodecRequest
+	if !shared.IsProtobufContentType(r.Header.Get("Content-Type")) {
+		if err := shared.DecodeJSON(r.Body, &req, c.strictJSON); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return req, false
+		}
+		return req, true
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		req.Payloads, err = shared.UnmarshalPayloadsProtobuf(body)
+	}
+	if err != nil {
+		http.Error(w, "Invalid protobuf: "+err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// writeCodecResponse writes a codec response in the same format as the request
+func writeCodecResponse(w http.ResponseWriter, r *http.Request, response shared.CodecResponse) {
+	if !shared.IsProtobufContentType(r.Header.Get("Content-Type")) {
+		w.Header().Set("Content-Type", shared.ContentTypeJSON)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Failed to encode response: %v", err)
+		}
+		return
+	}
+
+	body, err := shared.MarshalPayloadsProtobuf(response.Payloads)
+	if err != nil {
+		writeCodecError(w, fmt.Errorf("failed to encode response: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", shared.ContentTypeProtobuf)
+	w.Write(body)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint records how far a migration got, so an interrupted run can resume after the
+// last batch that was written back
+type checkpoint struct {
+	Source    string `json:"source"`    // identifies the source and destination key the run was for
+	After     string `json:"after"`     // key of the last record written back
+	Scanned   int    `json:"scanned"`   // records read so far
+	Rewrapped int    `json:"rewrapped"` // data keys re-encrypted so far
+	Written   int    `json:"written"`   // rewrapped records stored so far
+}
+
+// loadCheckpoint reads the checkpoint at path. A missing file starts from the beginning;
+// a checkpoint left by a run over a different source or destination key is an error.
+func loadCheckpoint(path, source string) (checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint{Source: source}, nil
+	}
+	if err != nil {
+		return checkpoint{}, err
+	}
+	var saved checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return checkpoint{}, fmt.Errorf("invalid checkpoint %s: %w", path, err)
+	}
+	if saved.Source != source {
+		return checkpoint{}, fmt.Errorf("checkpoint %s belongs to another run (%s)", path, saved.Source)
+	}
+	return saved, nil
+}
+
+// save writes the checkpoint through a temporary file, so a crash never leaves a partial one
+func (c checkpoint) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,235 @@
+// Command rewrap migrates stored encrypted payloads to a new KMS master key. Each payload's
+// data key is re-encrypted under the destination key with KMS ReEncrypt and written back;
+// the data itself is never decrypted. Progress is checkpointed after every batch, so an
+// interrupted run picks up where it stopped when started again with the same arguments.
+//
+// Payloads are read either from a file with one JSON payload per line (written to -output)
+// or from a JSON column of a Postgres table reached through DATABASE_URL (updated in place).
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"temporal-key-rotation/kmscodec"
+	"temporal-key-rotation/shared"
+)
+
+// rewrapper re-encrypts one payload's data key; *kmscodec.KMSManager implements it
+type rewrapper interface {
+	RewrapPayload(ctx context.Context, payload shared.PayloadData, destinationKeyARN string) (shared.PayloadData, bool, error)
+}
+
+// migration walks a source batch by batch, rewrapping every payload not yet under the destination key
+type migration struct {
+	source         payloadSource
+	rewrapper      rewrapper // nil in dry-run
+	destination    string
+	batchSize      int
+	interval       time.Duration // minimum time between ReEncrypt calls; zero means no limit
+	checkpointPath string        // empty in dry-run
+}
+
+// run processes the source from progress onwards and returns the final progress. The
+// checkpoint is saved only after a batch is written back, so an error or interruption never
+// skips records; at worst the data keys of the last, unwritten batch are re-encrypted again.
+func (m *migration) run(ctx context.Context, progress checkpoint) (checkpoint, error) {
+	var limiter <-chan time.Time
+	if m.interval > 0 {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+	started := time.Now()
+	startScanned := progress.Scanned
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+		batch, err := m.source.NextBatch(ctx, progress.After, m.batchSize)
+		if err != nil {
+			return progress, fmt.Errorf("failed to read batch after %q: %w", progress.After, err)
+		}
+		if len(batch) == 0 {
+			return progress, nil
+		}
+
+		var changed []record
+		for i := range batch {
+			rec := &batch[i]
+			if !kmscodec.NeedsRewrap(rec.Payload, m.destination) {
+				continue
+			}
+			if m.rewrapper == nil {
+				changed = append(changed, *rec)
+				continue
+			}
+			if limiter != nil {
+				select {
+				case <-limiter:
+				case <-ctx.Done():
+					return progress, ctx.Err()
+				}
+			}
+			rewrapped, ok, err := m.rewrapper.RewrapPayload(ctx, rec.Payload, m.destination)
+			if err != nil {
+				return progress, fmt.Errorf("record %s: %w", rec.Key, err)
+			}
+			if ok {
+				rec.Payload = rewrapped
+				changed = append(changed, *rec)
+			}
+		}
+
+		if m.checkpointPath != "" {
+			written, err := m.source.Write(ctx, batch, changed)
+			if err != nil {
+				return progress, fmt.Errorf("failed to write batch after %q: %w", progress.After, err)
+			}
+			progress.Written += written
+		}
+		progress.After = batch[len(batch)-1].Key
+		progress.Scanned += len(batch)
+		progress.Rewrapped += len(changed)
+		if m.checkpointPath != "" {
+			if err := progress.save(m.checkpointPath); err != nil {
+				return progress, fmt.Errorf("failed to save checkpoint: %w", err)
+			}
+		}
+
+		rate := float64(progress.Scanned-startScanned) / time.Since(started).Seconds()
+		if m.rewrapper == nil {
+			log.Printf("Scanned %d payloads, %d would be rewrapped (%.0f/s)", progress.Scanned, progress.Rewrapped, rate)
+		} else {
+			log.Printf("Scanned %d payloads, rewrapped %d, written %d (%.0f/s)", progress.Scanned, progress.Rewrapped, progress.Written, rate)
+		}
+	}
+}
+
+func main() {
+	log.SetOutput(shared.NewRedactingWriter(os.Stderr, shared.LogRedactFieldsFromEnv()))
+
+	destination := flag.String("destination-key-arn", "", "ARN of the master key to rewrap data keys under (required)")
+	sourceKind := flag.String("source", "file", "where the payloads are stored: file or postgres")
+	input := flag.String("input", "", "file source: input file with one JSON payload per line")
+	output := flag.String("output", "", "file source: output file for the rewrapped payloads")
+	table := flag.String("table", "", "postgres source: table holding the payloads")
+	keyColumn := flag.String("key-column", "id", "postgres source: unique column to order and resume by")
+	column := flag.String("column", "", "postgres source: JSON column holding the payloads")
+	batchSize := flag.Int("batch-size", 100, "payloads per batch and checkpoint")
+	rate := flag.Float64("rate", 50, "maximum KMS ReEncrypt calls per second; 0 means unlimited")
+	checkpointPath := flag.String("checkpoint", "rewrap.checkpoint", "file recording progress, for resuming")
+	dryRun := flag.Bool("dry-run", false, "only count the payloads that need a rewrap; no KMS calls and no writes")
+	flag.Parse()
+
+	if *destination == "" {
+		log.Fatal("-destination-key-arn is required")
+	}
+	if *batchSize <= 0 {
+		log.Fatal("-batch-size must be positive")
+	}
+	if *rate < 0 {
+		log.Fatal("-rate must not be negative")
+	}
+
+	// The checkpoint only applies to a run over the same source and destination key
+	var runID string
+	switch *sourceKind {
+	case "file":
+		if *input == "" || (*output == "" && !*dryRun) {
+			log.Fatal("the file source needs -input and -output")
+		}
+		inputPath, err := filepath.Abs(*input)
+		if err != nil {
+			log.Fatalf("Invalid -input: %v", err)
+		}
+		runID = fmt.Sprintf("file:%s -> %s", inputPath, *destination)
+	case "postgres":
+		if *table == "" || *column == "" {
+			log.Fatal("the postgres source needs -table and -column")
+		}
+		runID = fmt.Sprintf("postgres:%s.%s -> %s", *table, *column, *destination)
+	default:
+		log.Fatalf("Unknown -source %q (file or postgres)", *sourceKind)
+	}
+
+	progress, err := loadCheckpoint(*checkpointPath, runID)
+	if err != nil {
+		log.Fatalf("Failed to load checkpoint: %v", err)
+	}
+	if progress.After != "" {
+		log.Printf("Resuming after %s (%d payloads scanned so far)", progress.After, progress.Scanned)
+	}
+
+	var source payloadSource
+	switch *sourceKind {
+	case "file":
+		resumeLines := 0
+		if !*dryRun {
+			resumeLines = progress.Scanned
+		}
+		source, err = openFileSource(*input, *output, resumeLines, *dryRun)
+	case "postgres":
+		dbURL := os.Getenv("DATABASE_URL")
+		if dbURL == "" {
+			log.Fatal("DATABASE_URL is required for the postgres source")
+		}
+		var db *sql.DB
+		if db, err = sql.Open("postgres", dbURL); err == nil {
+			source, err = openPostgresSource(db, *table, *keyColumn, *column)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to open source: %v", err)
+	}
+	defer source.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	m := &migration{source: source, destination: *destination, batchSize: *batchSize}
+	if *rate > 0 {
+		m.interval = time.Duration(float64(time.Second) / *rate)
+	}
+	if *dryRun {
+		log.Printf("Dry run: nothing will be rewrapped or written")
+	} else {
+		kmsClient, err := kmscodec.NewKMSClient(ctx, kmscodec.KMSClientConfigFromEnv())
+		if err != nil {
+			log.Fatalf("Failed to create KMS client: %v", err)
+		}
+		manager, err := kmscodec.NewKMSManagerWithClient(kmsClient, *destination, time.Hour, time.Hour)
+		if err != nil {
+			log.Fatalf("Failed to create KMS manager: %v", err)
+		}
+		defer manager.Close()
+		m.rewrapper = manager
+		m.checkpointPath = *checkpointPath
+	}
+
+	progress, err = m.run(ctx, progress)
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Interrupted after %d payloads; run again with the same arguments to resume", progress.Scanned)
+		return
+	}
+	if err != nil {
+		log.Printf("Migration stopped after %d payloads: %v", progress.Scanned, err)
+		source.Close()
+		os.Exit(1)
+	}
+	if *dryRun {
+		log.Printf("Dry run complete: %d of %d payloads need a rewrap under %s", progress.Rewrapped, progress.Scanned, *destination)
+	} else {
+		log.Printf("Migration complete: %d payloads scanned, %d rewrapped, %d written", progress.Scanned, progress.Rewrapped, progress.Written)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+const destinationKeyARN = "arn:aws:kms:us-east-1:123456789012:key/destination"
+
+// fakeRewrapper moves data keys to the destination key, failing once it has rewrapped failAfter payloads
+type fakeRewrapper struct {
+	calls     int
+	failAfter int
+}
+
+func (f *fakeRewrapper) RewrapPayload(ctx context.Context, payload shared.PayloadData, destinationKeyARN string) (shared.PayloadData, bool, error) {
+	if f.failAfter > 0 && f.calls >= f.failAfter {
+		return payload, false, errors.New("KMS throttled")
+	}
+	f.calls++
+	payload.KMSKeyID = destinationKeyARN
+	payload.EncryptedDataKey = "rewrapped-" + payload.EncryptedDataKey
+	return payload, true, nil
+}
+
+// writeInput writes n payloads under an old key, with every third one already under the destination
+func writeInput(t *testing.T, dir string, n int) string {
+	t.Helper()
+	var lines []string
+	for i := range n {
+		payload := shared.PayloadData{KMSKeyID: "old-key", EncryptedDataKey: "key", Data: "ZGF0YQ=="}
+		if i%3 == 0 {
+			payload.KMSKeyID = destinationKeyARN
+		}
+		line, _ := json.Marshal(payload)
+		lines = append(lines, string(line))
+	}
+	path := filepath.Join(dir, "input.jsonl")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readOutput(t *testing.T, path string) []shared.PayloadData {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payloads []shared.PayloadData
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var payload shared.PayloadData
+		if err := json.Unmarshal([]byte(line), &payload); err != nil {
+			t.Fatalf("invalid output line %q: %v", line, err)
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+func runFileMigration(t *testing.T, input, output, checkpointPath string, rewrapper *fakeRewrapper) (checkpoint, error) {
+	t.Helper()
+	progress, err := loadCheckpoint(checkpointPath, "test")
+	if err != nil {
+		t.Fatalf("loadCheckpoint: %v", err)
+	}
+	source, err := openFileSource(input, output, progress.Scanned, false)
+	if err != nil {
+		t.Fatalf("openFileSource: %v", err)
+	}
+	defer source.Close()
+	m := &migration{source: source, rewrapper: rewrapper, destination: destinationKeyARN, batchSize: 4, checkpointPath: checkpointPath}
+	return m.run(context.Background(), progress)
+}
+
+func TestMigrationResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	input := writeInput(t, dir, 10)
+	output := filepath.Join(dir, "output.jsonl")
+	checkpointPath := filepath.Join(dir, "checkpoint")
+
+	// The first run fails in the second batch; only the first batch is kept
+	if _, err := runFileMigration(t, input, output, checkpointPath, &fakeRewrapper{failAfter: 4}); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	saved, err := loadCheckpoint(checkpointPath, "test")
+	if err != nil || saved.After != "4" || saved.Scanned != 4 {
+		t.Fatalf("unexpected checkpoint %+v (%v)", saved, err)
+	}
+
+	rewrapper := &fakeRewrapper{}
+	progress, err := runFileMigration(t, input, output, checkpointPath, rewrapper)
+	if err != nil {
+		t.Fatalf("resumed run failed: %v", err)
+	}
+	if progress.Scanned != 10 || progress.Rewrapped != 6 || rewrapper.calls != 4 {
+		t.Fatalf("unexpected progress %+v after %d calls", progress, rewrapper.calls)
+	}
+
+	payloads := readOutput(t, output)
+	if len(payloads) != 10 {
+		t.Fatalf("expected 10 output payloads, got %d", len(payloads))
+	}
+	for i, payload := range payloads {
+		if payload.KMSKeyID != destinationKeyARN {
+			t.Fatalf("payload %d is still under %s", i, payload.KMSKeyID)
+		}
+		if rewrapped := strings.HasPrefix(payload.EncryptedDataKey, "rewrapped-"); rewrapped == (i%3 == 0) {
+			t.Fatalf("payload %d: unexpected data key %q", i, payload.EncryptedDataKey)
+		}
+	}
+}
+
+func TestMigrationDryRunWritesNothing(t *testing.T) {
+	dir := t.TempDir()
+	input := writeInput(t, dir, 10)
+	output := filepath.Join(dir, "output.jsonl")
+
+	source, err := openFileSource(input, output, 0, true)
+	if err != nil {
+		t.Fatalf("openFileSource: %v", err)
+	}
+	defer source.Close()
+	m := &migration{source: source, destination: destinationKeyARN, batchSize: 4}
+	progress, err := m.run(context.Background(), checkpoint{})
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if progress.Scanned != 10 || progress.Rewrapped != 6 || progress.Written != 0 {
+		t.Fatalf("unexpected dry-run progress %+v", progress)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("dry run must not create the output file: %v", err)
+	}
+}
+
+func TestLoadCheckpointRejectsOtherRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	if err := (checkpoint{Source: "file:a -> key", After: "3"}).save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCheckpoint(path, "file:b -> key"); err == nil {
+		t.Fatal("expected a checkpoint from another run to be rejected")
+	}
+}
+
+func TestQuoteNameRejectsInjection(t *testing.T) {
+	if quoted, err := quoteName("public.payloads"); err != nil || quoted != `"public"."payloads"` {
+		t.Fatalf("unexpected quoting %q (%v)", quoted, err)
+	}
+	if _, err := quoteName("payloads; DROP TABLE x"); err == nil {
+		t.Fatal("expected an invalid identifier to be rejected")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/lib/pq"
+)
+
+// record is one stored payload. Key orders the records of a source and is what the checkpoint remembers.
+type record struct {
+	Key     string
+	Payload shared.PayloadData
+	raw     string // the payload as read, for detecting concurrent updates
+}
+
+// payloadSource reads stored payloads in key order and writes rewrapped ones back
+type payloadSource interface {
+	// NextBatch returns up to limit records with keys after the given one ("" starts at the
+	// beginning); an empty batch means the source is exhausted
+	NextBatch(ctx context.Context, after string, limit int) ([]record, error)
+	// Write stores a processed batch; changed holds the records whose data key was rewrapped
+	Write(ctx context.Context, batch []record, changed []record) (int, error)
+	Close() error
+}
+
+// fileSource reads one JSON payload per line and writes every payload, rewrapped or not,
+// to an output file in the same order. Keys are line numbers.
+type fileSource struct {
+	in      *os.File
+	scanner *bufio.Scanner
+	line    int
+	out     *os.File
+}
+
+// maxPayloadLine bounds the size of one line of the input file
+const maxPayloadLine = 16 << 20
+
+// openFileSource opens input and prepares output to continue after resumeLines lines, dropping
+// anything an interrupted run wrote past its last checkpoint. Output is not touched in dry-run.
+func openFileSource(input, output string, resumeLines int, dryRun bool) (*fileSource, error) {
+	in, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	source := &fileSource{in: in, scanner: bufio.NewScanner(in)}
+	source.scanner.Buffer(nil, maxPayloadLine)
+	if dryRun {
+		return source, nil
+	}
+
+	out, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	offset, err := lineOffset(out, resumeLines)
+	if err == nil {
+		err = out.Truncate(offset)
+	}
+	if err == nil {
+		_, err = out.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		in.Close()
+		out.Close()
+		return nil, fmt.Errorf("failed to prepare %s for resuming: %w", output, err)
+	}
+	source.out = out
+	return source, nil
+}
+
+// lineOffset returns the byte offset just after the first n lines of f
+func lineOffset(f *os.File, n int) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	reader := bufio.NewReader(f)
+	var offset int64
+	for range n {
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		if err != nil {
+			return 0, fmt.Errorf("output has fewer than the %d lines recorded in the checkpoint", n)
+		}
+	}
+	return offset, nil
+}
+
+func (s *fileSource) NextBatch(ctx context.Context, after string, limit int) ([]record, error) {
+	skip := 0
+	if after != "" {
+		var err error
+		if skip, err = strconv.Atoi(after); err != nil {
+			return nil, fmt.Errorf("invalid file checkpoint %q", after)
+		}
+	}
+
+	var batch []record
+	for len(batch) < limit && s.scanner.Scan() {
+		s.line++
+		if s.line <= skip {
+			continue
+		}
+		raw := s.scanner.Text()
+		var payload shared.PayloadData
+		if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+			return nil, fmt.Errorf("line %d: invalid payload: %w", s.line, err)
+		}
+		batch = append(batch, record{Key: strconv.Itoa(s.line), Payload: payload, raw: raw})
+	}
+	return batch, s.scanner.Err()
+}
+
+func (s *fileSource) Write(ctx context.Context, batch []record, changed []record) (int, error) {
+	writer := bufio.NewWriter(s.out)
+	for _, rec := range batch {
+		line, err := json.Marshal(rec.Payload)
+		if err != nil {
+			return 0, err
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	// The checkpoint is only saved once the batch is on disk
+	return len(changed), s.out.Sync()
+}
+
+func (s *fileSource) Close() error {
+	if s.out != nil {
+		s.out.Close()
+	}
+	return s.in.Close()
+}
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// quoteName quotes a possibly schema-qualified SQL name, rejecting anything but plain identifiers
+func quoteName(name string) (string, error) {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if !identifierPattern.MatchString(part) {
+			return "", fmt.Errorf("invalid SQL identifier %q", name)
+		}
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// postgresSource reads payloads stored as JSON in a table column and updates the rewrapped ones
+// in place. Rows are visited in key column order, so the key must be unique and orderable.
+type postgresSource struct {
+	db          *sql.DB
+	selectFirst string
+	selectAfter string
+	update      string
+}
+
+func openPostgresSource(db *sql.DB, table, keyColumn, column string) (*postgresSource, error) {
+	quotedTable, err := quoteName(table)
+	if err != nil {
+		return nil, err
+	}
+	quotedKey, err := quoteName(keyColumn)
+	if err != nil {
+		return nil, err
+	}
+	quotedColumn, err := quoteName(column)
+	if err != nil {
+		return nil, err
+	}
+
+	selectRows := fmt.Sprintf("SELECT %s, %s::text FROM %s", quotedKey, quotedColumn, quotedTable)
+	order := fmt.Sprintf(" ORDER BY %s LIMIT $", quotedKey)
+	return &postgresSource{
+		db:          db,
+		selectFirst: selectRows + fmt.Sprintf(" WHERE %s IS NOT NULL", quotedColumn) + order + "1",
+		selectAfter: selectRows + fmt.Sprintf(" WHERE %s IS NOT NULL AND %s > $1", quotedColumn, quotedKey) + order + "2",
+		// A row changed since it was read is left alone rather than overwritten
+		update: fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2 AND %s::text = $3", quotedTable, quotedColumn, quotedKey, quotedColumn),
+	}, nil
+}
+
+func (s *postgresSource) NextBatch(ctx context.Context, after string, limit int) ([]record, error) {
+	var rows *sql.Rows
+	var err error
+	if after == "" {
+		rows, err = s.db.QueryContext(ctx, s.selectFirst, limit)
+	} else {
+		rows, err = s.db.QueryContext(ctx, s.selectAfter, after, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []record
+	for rows.Next() {
+		var rec record
+		if err := rows.Scan(&rec.Key, &rec.raw); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(rec.raw), &rec.Payload); err != nil {
+			return nil, fmt.Errorf("row %s: invalid payload: %w", rec.Key, err)
+		}
+		batch = append(batch, rec)
+	}
+	return batch, rows.Err()
+}
+
+func (s *postgresSource) Write(ctx context.Context, batch []record, changed []record) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	written := 0
+	for _, rec := range changed {
+		value, err := json.Marshal(rec.Payload)
+		if err != nil {
+			return 0, err
+		}
+		result, err := tx.ExecContext(ctx, s.update, string(value), rec.Key, rec.raw)
+		if err != nil {
+			return 0, fmt.Errorf("row %s: %w", rec.Key, err)
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			written++
+		}
+	}
+	return written, tx.Commit()
+}
+
+func (s *postgresSource) Close() error {
+	return s.db.Close()
+}
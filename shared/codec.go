@@ -1,20 +1,163 @@
 package shared
 
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Decode provenance metadata, for audit display only; clients strip it before handing payloads to Temporal
+const (
+	KeyFingerprintMetadataKey = "key-fingerprint" // fingerprint of the data key that decrypted the payload
+	KeySourceMetadataKey      = "key-source"      // where that data key came from: current, cache or kms
+	EncodedAtMetadataKey      = "encoded-at"      // authenticated encode time, when the payload carries one
+)
+
+// Decode timing metadata, added only when /decode is called with ?debug=true. Durations are in Go
+// duration syntax (for example "1.204ms"); key-source tells whether the key came from KMS.
+const (
+	KeyResolutionTimeMetadataKey = "key-resolution-time" // time spent obtaining the data key
+	DecodeTimeMetadataKey        = "decode-time"         // time spent decoding the whole payload
+)
+
+// Correlation IDs tie an encrypted payload to the request that produced it. Encode stores the
+// ID in clear in the encrypted payload's metadata, outside the ciphertext, and decode echoes it.
+const (
+	CorrelationIDHeader      = "X-Correlation-ID"
+	CorrelationIDMetadataKey = "correlation-id"
+)
+
+// MaxCorrelationIDLength bounds the length of a correlation ID
+const MaxCorrelationIDLength = 128
+
+// ValidCorrelationID reports whether id is non-empty, at most MaxCorrelationIDLength long and
+// printable ASCII without spaces, so it is safe to log and to show in the Web UI
+func ValidCorrelationID(id string) bool {
+	if id == "" || len(id) > MaxCorrelationIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// IsCodecOnlyMetadata reports whether a decoded payload's metadata key was added by the codec
+// server for display and must be stripped before the payload is handed to Temporal
+func IsCodecOnlyMetadata(key string) bool {
+	switch key {
+	case KeyFingerprintMetadataKey, KeySourceMetadataKey, EncodedAtMetadataKey, CorrelationIDMetadataKey,
+		KeyResolutionTimeMetadataKey, DecodeTimeMetadataKey:
+		return true
+	}
+	return false
+}
+
+// NullEncoding is the encoding of Temporal's payloads for nil values, which carry no data
+const NullEncoding = "binary/null"
+
+// IsControlEncoding reports whether payloads with this encoding are Temporal control payloads,
+// such as nil values, that codecs pass through untouched: they hold nothing worth protecting
+// and the SDK expects to read them back exactly as it wrote them
+func IsControlEncoding(encoding string) bool {
+	return encoding == NullEncoding
+}
+
+// DecodeErrorMetadataKey marks a lenient-mode sentinel standing in for a payload that failed to decode
+const DecodeErrorMetadataKey = "decode-error"
+
+// ParseCodecContext parses comma separated key=value pairs for CodecRequest.Context,
+// e.g. "WorkflowType=PaymentWorkflow,DataClass=pii"
+func ParseCodecContext(spec string) (map[string]string, error) {
+	context := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid codec context entry %q: want key=value", pair)
+		}
+		context[key] = value
+	}
+	return context, nil
+}
+
+// maxCodecErrorBody bounds how much of a codec server error response is kept as its message
+const maxCodecErrorBody = 4096
+
+// CodecServerError is returned by codec clients when the codec server answers with a status
+// other than 200. A 4xx means the request itself was refused, typically because of the
+// payloads it carried, and sending it again won't help; a 5xx is a server fault worth retrying.
+type CodecServerError struct {
+	Endpoint   string // path the request was sent to, e.g. /decode
+	StatusCode int
+	Message    string // the server's error text, trimmed and truncated
+}
+
+func (e *CodecServerError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("codec server returned status %d for %s", e.StatusCode, e.Endpoint)
+	}
+	return fmt.Sprintf("codec server returned status %d for %s: %s", e.StatusCode, e.Endpoint, e.Message)
+}
+
+// ClientFault reports whether the server refused the request as invalid (4xx)
+func (e *CodecServerError) ClientFault() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// Retryable reports whether the same request may succeed later: server faults, and 429s from
+// rate limits that lift on their own
+func (e *CodecServerError) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// NewCodecServerError builds the error for a non-200 codec server response, reading its body
+// as the message
+func NewCodecServerError(endpoint string, resp *http.Response) *CodecServerError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxCodecErrorBody))
+	return &CodecServerError{Endpoint: endpoint, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
 // CodecRequest represents the request structure for codec operations
 type CodecRequest struct {
 	Payloads []PayloadData `json:"payloads"`
+	// ForceNewKey asks /encode to rotate the data key before encrypting this batch. Rate
+	// limited by the codec server; JSON requests only.
+	ForceNewKey bool `json:"force_new_key,omitempty"`
+	// Context describes what the payloads belong to, such as a workflow type or search
+	// attribute, so the codec server can pick a protection profile. JSON requests only.
+	Context map[string]string `json:"context,omitempty"`
 }
 
 // CodecResponse represents the response structure for codec operations
 type CodecResponse struct {
 	Payloads []PayloadData `json:"payloads"`
+	// Errors lists the payloads a partial decode could not decode; each is returned unchanged in
+	// Payloads, marked with DecodeErrorMetadataKey
+	Errors []PayloadError `json:"errors,omitempty"`
+}
+
+// PayloadError is the failure of one payload of a partial decode
+type PayloadError struct {
+	Index   int    `json:"index"`  // position in Payloads
+	Status  int    `json:"status"` // the HTTP status the failure would have failed the batch with
+	Message string `json:"message"`
 }
 
 // PayloadData represents individual payload data
 type PayloadData struct {
-	Metadata         map[string]string `json:"metadata"`
-	Data             string            `json:"data"` // base64 encoded
-	KMSKeyID         string            `json:"kms_key_id,omitempty"`
-	EncryptedDataKey string            `json:"encrypted_data_key,omitempty"`
-	Algorithm        string            `json:"algorithm,omitempty"`
+	Metadata          map[string]string `json:"metadata"`
+	Data              string            `json:"data"` // base64 encoded
+	KMSKeyID          string            `json:"kms_key_id,omitempty"`
+	EncryptedDataKey  string            `json:"encrypted_data_key,omitempty"`
+	Algorithm         string            `json:"algorithm,omitempty"`
+	WrappedKey        string            `json:"wrapped_key,omitempty"`        // RSA-OAEP wrapped content key (key pair mode)
+	EncryptionContext map[string]string `json:"encryption_context,omitempty"` // KMS context the data key was generated with (not secret)
+	EnvelopeChecksum  string            `json:"envelope_checksum,omitempty"`  // digest of the envelope fields, checked before KMS
+	EncodedAt         string            `json:"encoded_at,omitempty"`         // RFC 3339 encode time, authenticated as GCM additional data
 }
@@ -0,0 +1,7 @@
+package shared
+
+// Record is a schema-less payload whose fields are written to a table
+// configured on the worker, so arbitrary data can reuse the same pipeline
+type Record struct {
+	Fields map[string]interface{} `json:"fields"`
+}
@@ -0,0 +1,127 @@
+package shared
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RedactedValue replaces the value of a redacted field in log output
+const RedactedValue = "[REDACTED]"
+
+// DefaultLogRedactFields are redacted when LOG_REDACT_FIELDS is not set
+var DefaultLogRedactFields = []string{"email", "name"}
+
+// LogRedactFieldsFromEnv reads the comma separated LOG_REDACT_FIELDS. Unset means
+// DefaultLogRedactFields; set but empty disables redaction.
+func LogRedactFieldsFromEnv() []string {
+	list, ok := os.LookupEnv("LOG_REDACT_FIELDS")
+	if !ok {
+		return DefaultLogRedactFields
+	}
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Redactor masks the values of named fields in log lines. Field names match case-insensitively
+// as JSON keys ("email":"a@b.c") and as key=value or key: value pairs (Email=a@b.c). An unquoted
+// pair value runs to the next separator or key, so it may contain spaces (Name=John Smith).
+type Redactor struct {
+	jsonPattern  *regexp.Regexp
+	pairsPattern *regexp.Regexp
+}
+
+// NewRedactor returns a redactor for fields, or nil if there are none
+func NewRedactor(fields []string) *Redactor {
+	if len(fields) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(fields))
+	for i, field := range fields {
+		quoted[i] = regexp.QuoteMeta(field)
+	}
+	names := "(?:" + strings.Join(quoted, "|") + ")"
+	return &Redactor{
+		jsonPattern:  regexp.MustCompile(`(?i)("` + names + `"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`),
+		pairsPattern: regexp.MustCompile(`(?i)(\b` + names + `\s*[=:]\s*)("(?:[^"\\]|\\.)*"|[^\s,;)}\]]+)`),
+	}
+}
+
+// Redact returns s with the values of the redactor's fields masked
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	s = r.jsonPattern.ReplaceAllString(s, `${1}"`+RedactedValue+`"`)
+
+	var b strings.Builder
+	last := 0
+	for _, m := range r.pairsPattern.FindAllStringSubmatchIndex(s, -1) {
+		if m[0] < last {
+			continue // inside the previous value
+		}
+		end := m[1]
+		if s[m[4]] != '"' {
+			end = unquotedValueEnd(s, end)
+		}
+		b.WriteString(s[last:m[3]])
+		b.WriteString(RedactedValue)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// isValueSeparator reports whether c ends an unquoted pair value
+func isValueSeparator(c byte) bool {
+	return strings.IndexByte(",;)}]\r\n", c) >= 0
+}
+
+// unquotedValueEnd extends an unquoted value whose first word ends at i over the words after it,
+// stopping at a separator or at a word that is the next key (Version=2, Email:)
+func unquotedValueEnd(s string, i int) int {
+	for {
+		j := i
+		for j < len(s) && (s[j] == ' ' || s[j] == '\t') {
+			j++
+		}
+		k := j
+		for k < len(s) && s[k] != ' ' && s[k] != '\t' && !isValueSeparator(s[k]) {
+			k++
+		}
+		if j == i || k == j || strings.ContainsAny(s[j:k], "=:") {
+			return i
+		}
+		i = k
+	}
+}
+
+// redactingWriter redacts every write before passing it on. The log package writes each
+// entry in a single call, so fields never straddle writes.
+type redactingWriter struct {
+	redactor *Redactor
+	w        io.Writer
+}
+
+// NewRedactingWriter wraps w, typically the standard logger's output, so the values of fields
+// are masked in everything written to it. With no fields it returns w unchanged.
+func NewRedactingWriter(w io.Writer, fields []string) io.Writer {
+	redactor := NewRedactor(fields)
+	if redactor == nil {
+		return w
+	}
+	return &redactingWriter{redactor: redactor, w: w}
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, rw.redactor.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,55 @@
+package shared
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestRedactMasksConfiguredFields(t *testing.T) {
+	redactor := NewRedactor([]string{"email", "name"})
+	cases := map[string]string{
+		"Inserting payload: ID=1, Name=John, Email=john@example.com, Version=2":    "Inserting payload: ID=1, Name=[REDACTED], Email=[REDACTED], Version=2",
+		`decode failed: {"name":"John \"JJ\" Doe","email":"j@example.com","id":1}`: `decode failed: {"name":"[REDACTED]","email":"[REDACTED]","id":1}`,
+		`user email: "j@example.com" rejected`:                                     `user email: [REDACTED] rejected`,
+		`{"Email": null}`:                                                          `{"Email": "[REDACTED]"}`,
+		"Username=jdoe, renamed=true":                                              "Username=jdoe, renamed=true",
+		"Name=John Smith, Email=j@example.com":                                     "Name=[REDACTED], Email=[REDACTED]",
+		"Name=John Smith Version=2":                                                "Name=[REDACTED] Version=2",
+		"name: Mary Ann Jones; email: m@example.com":                               "name: [REDACTED]; email: [REDACTED]",
+		"no fields here":                                                           "no fields here",
+	}
+	for in, want := range cases {
+		if got := redactor.Redact(in); got != want {
+			t.Errorf("Redact(%q)\n got %q\nwant %q", in, got, want)
+		}
+	}
+}
+
+func TestRedactingWriterWrapsTheStandardLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New(NewRedactingWriter(&out, []string{"ssn"}), "", 0)
+	logger.Printf("Inserting record: ssn=%s, name=%s", "123-45-6789", "John")
+
+	if got, want := out.String(), "Inserting record: ssn=[REDACTED], name=John\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestNoRedactFieldsLeavesOutputAlone(t *testing.T) {
+	var out bytes.Buffer
+	if w := NewRedactingWriter(&out, nil); w != &out {
+		t.Fatal("expected the writer to be returned unchanged")
+	}
+}
+
+func TestLogRedactFieldsFromEnv(t *testing.T) {
+	t.Setenv("LOG_REDACT_FIELDS", " email, phone ,")
+	if got := LogRedactFieldsFromEnv(); len(got) != 2 || got[0] != "email" || got[1] != "phone" {
+		t.Fatalf("unexpected fields %v", got)
+	}
+	t.Setenv("LOG_REDACT_FIELDS", "")
+	if got := LogRedactFieldsFromEnv(); len(got) != 0 {
+		t.Fatalf("expected an empty list to disable redaction, got %v", got)
+	}
+}
@@ -0,0 +1,65 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Temporal's default per-payload blob size limits: the server logs a warning above the first
+// and rejects the request above the second
+const (
+	DefaultPayloadSizeWarnBytes  = 512 * 1024
+	DefaultPayloadSizeLimitBytes = 2 * 1024 * 1024
+)
+
+// ErrPayloadTooLarge is returned by enforcing PayloadSizeLimits for an encoded payload over the limit
+var ErrPayloadTooLarge = errors.New("encoded payload exceeds the payload size limit")
+
+// PayloadSizeLimits are the sizes, in bytes, at which codec clients report encoded payloads.
+// Encryption and the codec's envelope make a payload larger than what the workflow passed in,
+// so a payload under Temporal's limit before encoding can be over it after. Checking the
+// encoded size in the client names the payload before Temporal rejects the workflow.
+type PayloadSizeLimits struct {
+	WarnBytes  int  // an encoded payload at least this large is logged; zero disables the warning
+	LimitBytes int  // the limit Temporal enforces; zero disables the check
+	Enforce    bool // fail encoding of a payload over LimitBytes instead of only logging it
+}
+
+// PayloadSizeLimitsFromEnv reads the payload size limits, falling back to Temporal's defaults
+func PayloadSizeLimitsFromEnv() PayloadSizeLimits {
+	limits := PayloadSizeLimits{
+		WarnBytes:  DefaultPayloadSizeWarnBytes,
+		LimitBytes: DefaultPayloadSizeLimitBytes,
+		Enforce:    os.Getenv("PAYLOAD_SIZE_ENFORCE") == "true",
+	}
+	if warnStr := os.Getenv("PAYLOAD_SIZE_WARN_BYTES"); warnStr != "" {
+		if warn, err := strconv.Atoi(warnStr); err == nil && warn >= 0 {
+			limits.WarnBytes = warn
+		}
+	}
+	if limitStr := os.Getenv("PAYLOAD_SIZE_LIMIT_BYTES"); limitStr != "" {
+		if limit, err := strconv.Atoi(limitStr); err == nil && limit >= 0 {
+			limits.LimitBytes = limit
+		}
+	}
+	return limits
+}
+
+// CheckEncodedSize checks the size of encoded payload index of a batch. It logs payloads at the
+// warning size or over the limit, and returns an error wrapping ErrPayloadTooLarge for one over
+// the limit when enforcing.
+func (l PayloadSizeLimits) CheckEncodedSize(index, size int) error {
+	switch {
+	case l.LimitBytes > 0 && size > l.LimitBytes:
+		if l.Enforce {
+			return fmt.Errorf("%w: payload %d is %d bytes, limit %d", ErrPayloadTooLarge, index, size, l.LimitBytes)
+		}
+		log.Printf("Encoded payload %d is %d bytes, over the %d-byte payload size limit; Temporal will reject it", index, size, l.LimitBytes)
+	case l.WarnBytes > 0 && size >= l.WarnBytes:
+		log.Printf("Encoded payload %d is %d bytes, at or over the %d-byte payload size warning threshold", index, size, l.WarnBytes)
+	}
+	return nil
+}
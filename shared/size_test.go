@@ -0,0 +1,41 @@
+package shared
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckEncodedSize(t *testing.T) {
+	limits := PayloadSizeLimits{WarnBytes: 100, LimitBytes: 200}
+	for _, size := range []int{50, 100, 201} {
+		if err := limits.CheckEncodedSize(0, size); err != nil {
+			t.Fatalf("size %d: expected no error without Enforce, got %v", size, err)
+		}
+	}
+
+	limits.Enforce = true
+	if err := limits.CheckEncodedSize(3, 200); err != nil {
+		t.Fatalf("expected a payload at the limit to pass, got %v", err)
+	}
+	if err := limits.CheckEncodedSize(3, 201); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	if err := (PayloadSizeLimits{Enforce: true}).CheckEncodedSize(0, 1<<30); err != nil {
+		t.Fatalf("expected zero limits to check nothing, got %v", err)
+	}
+}
+
+func TestPayloadSizeLimitsFromEnv(t *testing.T) {
+	want := PayloadSizeLimits{WarnBytes: DefaultPayloadSizeWarnBytes, LimitBytes: DefaultPayloadSizeLimitBytes}
+	if got := PayloadSizeLimitsFromEnv(); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	t.Setenv("PAYLOAD_SIZE_WARN_BYTES", "1000")
+	t.Setenv("PAYLOAD_SIZE_LIMIT_BYTES", "0")
+	t.Setenv("PAYLOAD_SIZE_ENFORCE", "true")
+	want = PayloadSizeLimits{WarnBytes: 1000, LimitBytes: 0, Enforce: true}
+	if got := PayloadSizeLimitsFromEnv(); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
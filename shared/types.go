@@ -1,8 +1,44 @@
 package shared
 
+import "fmt"
+
+// Payload schema versions. Fields are only ever added, so a worker can process every
+// version up to CurrentPayloadVersion; payloads without a version predate the field.
+const (
+	PayloadVersion1       = 1 // id, name, email, deleted
+	PayloadVersion2       = 2 // adds phone
+	CurrentPayloadVersion = PayloadVersion2
+)
+
 // Payload represents the data structure used across the application
 type Payload struct {
 	ID    int    `json:"id"`
 	Name  string `json:"name"`
 	Email string `json:"email"`
+
+	// Phone was added in PayloadVersion2; empty means the payload has none
+	Phone string `json:"phone,omitempty"`
+
+	// Deleted turns the workflow into an erasure request for ID instead of an upsert
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Version is the schema version the payload was written with; zero means PayloadVersion1
+	Version int `json:"version,omitempty"`
+}
+
+// SchemaVersion returns the payload's schema version, treating a missing version as version 1
+func (p Payload) SchemaVersion() int {
+	if p.Version == 0 {
+		return PayloadVersion1
+	}
+	return p.Version
+}
+
+// CheckVersion rejects payloads written with a schema newer than this build understands,
+// whose added fields would otherwise be silently dropped
+func (p Payload) CheckVersion() error {
+	if v := p.SchemaVersion(); v < PayloadVersion1 || v > CurrentPayloadVersion {
+		return fmt.Errorf("unsupported payload version %d (supported: %d-%d)", v, PayloadVersion1, CurrentPayloadVersion)
+	}
+	return nil
 }
@@ -0,0 +1,291 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec request and response bodies are JSON by default. Clients that send a protobuf body get
+// a protobuf response; the Web UI keeps using JSON.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// IsProtobufContentType reports whether a Content-Type header selects the protobuf wire format.
+// Anything else, including no header at all, is JSON.
+func IsProtobufContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == ContentTypeProtobuf
+}
+
+// The protobuf wire format is hand-encoded to this schema, shared by requests and responses.
+// Data travels as raw bytes instead of base64; the other fields keep their JSON string form.
+//
+//	message CodecMessage {
+//	  repeated Payload payloads = 1;
+//	}
+//	message Payload {
+//	  map<string, string> metadata = 1;
+//	  bytes data = 2;
+//	  string kms_key_id = 3;
+//	  string encrypted_data_key = 4;
+//	  string algorithm = 5;
+//	  string wrapped_key = 6;
+//	  map<string, string> encryption_context = 7;
+//	  string envelope_checksum = 8;
+//	  string encoded_at = 9;
+//	}
+const (
+	wirePayloads          protowire.Number = 1
+	wireMetadata          protowire.Number = 1
+	wireData              protowire.Number = 2
+	wireKMSKeyID          protowire.Number = 3
+	wireEncryptedDataKey  protowire.Number = 4
+	wireAlgorithm         protowire.Number = 5
+	wireWrappedKey        protowire.Number = 6
+	wireEncryptionContext protowire.Number = 7
+	wireEnvelopeChecksum  protowire.Number = 8
+	wireEncodedAt         protowire.Number = 9
+
+	wireMapKey   protowire.Number = 1
+	wireMapValue protowire.Number = 2
+)
+
+var errTruncatedMessage = errors.New("truncated protobuf message")
+
+// MarshalPayloadsProtobuf encodes payloads in the protobuf wire format.
+// Data must be standard base64, as the codec clients and server produce it.
+func MarshalPayloadsProtobuf(payloads []PayloadData) ([]byte, error) {
+	var b []byte
+	for i, payload := range payloads {
+		data, err := base64.StdEncoding.DecodeString(payload.Data)
+		if err != nil {
+			return nil, fmt.Errorf("payload %d: data is not base64: %w", i, err)
+		}
+
+		var p []byte
+		p = appendStringMap(p, wireMetadata, payload.Metadata)
+		if len(data) > 0 {
+			p = protowire.AppendTag(p, wireData, protowire.BytesType)
+			p = protowire.AppendBytes(p, data)
+		}
+		p = appendString(p, wireKMSKeyID, payload.KMSKeyID)
+		p = appendString(p, wireEncryptedDataKey, payload.EncryptedDataKey)
+		p = appendString(p, wireAlgorithm, payload.Algorithm)
+		p = appendString(p, wireWrappedKey, payload.WrappedKey)
+		p = appendStringMap(p, wireEncryptionContext, payload.EncryptionContext)
+		p = appendString(p, wireEnvelopeChecksum, payload.EnvelopeChecksum)
+		p = appendString(p, wireEncodedAt, payload.EncodedAt)
+
+		b = protowire.AppendTag(b, wirePayloads, protowire.BytesType)
+		b = protowire.AppendBytes(b, p)
+	}
+	return b, nil
+}
+
+// UnmarshalPayloadsProtobuf decodes the protobuf wire format. Data is returned as standard
+// base64 and unknown fields are skipped.
+func UnmarshalPayloadsProtobuf(b []byte) ([]PayloadData, error) {
+	payloads := []PayloadData{}
+	err := consumeFields(b, func(num protowire.Number, value []byte) error {
+		if num != wirePayloads {
+			return nil
+		}
+		payload, err := unmarshalPayload(value)
+		if err != nil {
+			return fmt.Errorf("payload %d: %w", len(payloads), err)
+		}
+		payloads = append(payloads, payload)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payloads, nil
+}
+
+func unmarshalPayload(b []byte) (PayloadData, error) {
+	payload := PayloadData{Metadata: map[string]string{}}
+	err := consumeFields(b, func(num protowire.Number, value []byte) error {
+		switch num {
+		case wireMetadata:
+			return consumeMapEntry(value, payload.Metadata)
+		case wireData:
+			payload.Data = base64.StdEncoding.EncodeToString(value)
+		case wireKMSKeyID:
+			payload.KMSKeyID = string(value)
+		case wireEncryptedDataKey:
+			payload.EncryptedDataKey = string(value)
+		case wireAlgorithm:
+			payload.Algorithm = string(value)
+		case wireWrappedKey:
+			payload.WrappedKey = string(value)
+		case wireEncryptionContext:
+			if payload.EncryptionContext == nil {
+				payload.EncryptionContext = map[string]string{}
+			}
+			return consumeMapEntry(value, payload.EncryptionContext)
+		case wireEnvelopeChecksum:
+			payload.EnvelopeChecksum = string(value)
+		case wireEncodedAt:
+			payload.EncodedAt = string(value)
+		}
+		return nil
+	})
+	return payload, err
+}
+
+// consumeFields calls fn with every length-delimited field of b and skips fields of other types
+func consumeFields(b []byte, fn func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errTruncatedMessage
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return errTruncatedMessage
+			}
+			b = b[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return errTruncatedMessage
+		}
+		b = b[n:]
+		if err := fn(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumeMapEntry adds one map<string, string> entry to m
+func consumeMapEntry(b []byte, m map[string]string) error {
+	var key, value string
+	err := consumeFields(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case wireMapKey:
+			key = string(v)
+		case wireMapValue:
+			value = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m[key] = value
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendStringMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for key, value := range m {
+		var entry []byte
+		entry = appendString(entry, wireMapKey, key)
+		entry = appendString(entry, wireMapValue, value)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// DecodeJSON decodes the single JSON value in body into v. Its errors say what is wrong with the
+// body in terms a client can act on: empty or truncated, a syntax error and where, which field
+// has the wrong type, or data after the value. With disallowUnknownFields, fields v has no
+// place for are rejected too, so a misspelled field name fails instead of being ignored.
+func DecodeJSON(body io.Reader, v any, disallowUnknownFields bool) error {
+	decoder := json.NewDecoder(body)
+	if disallowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return jsonDecodeError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after the JSON value at byte %d", decoder.InputOffset())
+	}
+	return nil
+}
+
+// jsonDecodeError rewords an encoding/json decode error
+func jsonDecodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return errors.New("request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("request body is truncated")
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("syntax error at byte %d: %v", syntaxErr.Offset, syntaxErr)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("request body must be %s, got %s", jsonTypeName(typeErr.Type), typeErr.Value)
+		}
+		return fmt.Errorf("field %q must be %s, got %s", jsonFieldPath(typeErr.Field), jsonTypeName(typeErr.Type), typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return err
+}
+
+// jsonFieldPath turns the dotted path of a decode error, such as payloads.0.data, into
+// payloads[0].data
+func jsonFieldPath(field string) string {
+	var path strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			path.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			path.WriteByte('.')
+		}
+		path.WriteString(part)
+	}
+	return path.String()
+}
+
+// jsonTypeName names the JSON value a Go type decodes from
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,129 @@
+package shared
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testPayloads() []PayloadData {
+	return []PayloadData{
+		{
+			Metadata: map[string]string{"encoding": "json/plain"},
+			Data:     base64.StdEncoding.EncodeToString([]byte(`{"id":1}`)),
+		},
+		{
+			Metadata:          map[string]string{"encoding": "binary/encrypted", CorrelationIDMetadataKey: "req-1"},
+			Data:              base64.StdEncoding.EncodeToString([]byte{0, 1, 2, 0xff}),
+			KMSKeyID:          "arn:aws:kms:us-east-1:123456789012:key/test",
+			EncryptedDataKey:  "ZWRr",
+			Algorithm:         "AES-256-GCM",
+			EncryptionContext: map[string]string{"purpose": "temporal-payload-encryption"},
+			EnvelopeChecksum:  "abcd",
+			EncodedAt:         "2024-01-01T00:00:00Z",
+		},
+		{Metadata: map[string]string{}, Data: ""},
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	payloads := testPayloads()
+	body, err := MarshalPayloadsProtobuf(payloads)
+	if err != nil {
+		t.Fatalf("MarshalPayloadsProtobuf: %v", err)
+	}
+	got, err := UnmarshalPayloadsProtobuf(body)
+	if err != nil {
+		t.Fatalf("UnmarshalPayloadsProtobuf: %v", err)
+	}
+	if !reflect.DeepEqual(got, payloads) {
+		t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", got, payloads)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	payloads := testPayloads()
+	body, err := json.Marshal(CodecRequest{Payloads: payloads})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var got CodecRequest
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got.Payloads, payloads) {
+		t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", got.Payloads, payloads)
+	}
+}
+
+func TestProtobufIsSmallerThanJSON(t *testing.T) {
+	payloads := []PayloadData{{
+		Metadata: map[string]string{"encoding": "binary/encrypted"},
+		Data:     base64.StdEncoding.EncodeToString(make([]byte, 4096)),
+	}}
+	protobufBody, err := MarshalPayloadsProtobuf(payloads)
+	if err != nil {
+		t.Fatalf("MarshalPayloadsProtobuf: %v", err)
+	}
+	jsonBody, _ := json.Marshal(CodecRequest{Payloads: payloads})
+	if len(protobufBody) >= len(jsonBody)*4/5 {
+		t.Errorf("expected protobuf to avoid base64 inflation: %d bytes vs %d for JSON", len(protobufBody), len(jsonBody))
+	}
+}
+
+func TestUnmarshalProtobufRejectsTruncatedInput(t *testing.T) {
+	body, err := MarshalPayloadsProtobuf(testPayloads())
+	if err != nil {
+		t.Fatalf("MarshalPayloadsProtobuf: %v", err)
+	}
+	if _, err := UnmarshalPayloadsProtobuf(body[:len(body)-3]); err == nil {
+		t.Fatal("expected an error for a truncated message")
+	}
+}
+
+func TestIsProtobufContentType(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/x-protobuf":                true,
+		"application/x-protobuf; charset=utf-8": true,
+		"application/json":                      false,
+		"":                                      false,
+	} {
+		if got := IsProtobufContentType(contentType); got != want {
+			t.Errorf("IsProtobufContentType(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestDecodeJSONDescribesMalformedBodies(t *testing.T) {
+	tests := map[string]struct {
+		body    string
+		strict  bool
+		message string
+	}{
+		"empty":            {``, false, "request body is empty"},
+		"truncated":        {`{"payloads":[{"data":"e30="}`, false, "request body is truncated"},
+		"syntax":           {`{"payloads" []}`, false, "syntax error at byte 13: invalid character '[' after object key"},
+		"trailing data":    {`{"payloads":[]}}`, false, "unexpected data after the JSON value at byte 15"},
+		"wrong field type": {`{"payloads":[{"metadata":"json/plain"}]}`, false, `field "payloads[0].metadata" must be an object, got string`},
+		"not an array":     {`{"payloads":{}}`, false, `field "payloads" must be an array, got object`},
+		"not an object":    {`[]`, false, "request body must be an object, got array"},
+		"unknown field":    {`{"payload":[]}`, true, `unknown field "payload"`},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var req CodecRequest
+			err := DecodeJSON(strings.NewReader(tc.body), &req, tc.strict)
+			if err == nil || err.Error() != tc.message {
+				t.Fatalf("expected %q, got %v", tc.message, err)
+			}
+		})
+	}
+
+	// Unknown fields are ignored unless disallowed
+	var req CodecRequest
+	if err := DecodeJSON(strings.NewReader(`{"payload":[]} `), &req, false); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -1,33 +1,168 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"temporal-key-rotation/shared"
+
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
 )
 
+// DefaultStatementTimeout bounds a single database statement when none is configured
+const DefaultStatementTimeout = 10 * time.Second
+
+// heartbeatInterval is how often a running statement heartbeats; cancellation only reaches
+// an activity through its heartbeats. The SDK throttles the calls to the heartbeat timeout.
+const heartbeatInterval = time.Second
+
 type Activities struct {
-	DB *sql.DB
+	DB               *sql.DB
+	StatementTimeout time.Duration
+	Records          *RecordMapping // nil disables InsertRecord
+	HardDelete       bool           // DeletePayload removes rows instead of blanking them and setting deleted_at
+	Metrics          *workerMetrics // nil disables instrumentation
 }
 
-func (a *Activities) InsertPayload(p shared.Payload) error {
-	log.Printf("Inserting payload: ID=%d, Name=%s, Email=%s", p.ID, p.Name, p.Email)
+func (a *Activities) InsertPayload(ctx context.Context, p shared.Payload) (err error) {
+	defer func() { a.Metrics.recordInsert(err) }()
 
-	// Use UPSERT to handle potential duplicate IDs
-	query := `
-		INSERT INTO payloads (id, name, email) 
-		VALUES ($1, $2, $3) 
-		ON CONFLICT (id) 
-		DO UPDATE SET name = EXCLUDED.name, email = EXCLUDED.email
-	`
+	// A deleted payload is an erasure request, never an upsert
+	if p.Deleted {
+		return a.DeletePayload(ctx, p)
+	}
 
-	_, err := a.DB.Exec(query, p.ID, p.Name, p.Email)
-	if err != nil {
-		return fmt.Errorf("insert failed: %w", err)
+	// Also checked here, since histories from before the workflow check skip it
+	if err := p.CheckVersion(); err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "UnsupportedPayloadVersion", err)
+	}
+
+	log.Printf("Inserting payload: ID=%d, Name=%s, Email=%s, Version=%d", p.ID, p.Name, p.Email, p.SchemaVersion())
+
+	// Version 1 payloads predate phone, so their upserts leave a stored phone as it is
+	query, args := upsertPayloadQuery, []interface{}{p.ID, p.Name, p.Email}
+	if p.SchemaVersion() >= shared.PayloadVersion2 {
+		query, args = upsertPayloadV2Query, append(args, p.Phone)
+	}
+	if err := a.exec(ctx, query, args...); err != nil {
+		return err
 	}
 
 	log.Printf("Successfully inserted/updated payload with ID=%d", p.ID)
 	return nil
 }
+
+// upsertPayloadQuery inserts a payload or updates the row with the same ID.
+// A soft deleted row is left as it is: the erasure wins over any later upsert of its ID.
+const upsertPayloadQuery = `INSERT INTO payloads (id, name, email) VALUES ($1, $2, $3) ` +
+	`ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, email = EXCLUDED.email WHERE payloads.deleted_at IS NULL`
+
+// upsertPayloadV2Query is upsertPayloadQuery for PayloadVersion2 payloads, which also set phone
+// (NULL when the payload has none)
+const upsertPayloadV2Query = `INSERT INTO payloads (id, name, email, phone) VALUES ($1, $2, $3, NULLIF($4, '')) ` +
+	`ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, email = EXCLUDED.email, phone = EXCLUDED.phone WHERE payloads.deleted_at IS NULL`
+
+// DeletePayload soft deletes a payload by blanking its name, email and phone and setting deleted_at,
+// or removes the row in hard delete mode.
+// Deleting a missing or already deleted payload succeeds, so retries are safe.
+func (a *Activities) DeletePayload(ctx context.Context, p shared.Payload) error {
+	log.Printf("Deleting payload: ID=%d, hard=%t", p.ID, a.HardDelete)
+
+	if err := a.exec(ctx, deletePayloadQuery(a.HardDelete), p.ID); err != nil {
+		return err
+	}
+
+	log.Printf("Successfully deleted payload with ID=%d", p.ID)
+	return nil
+}
+
+// deletePayloadQuery returns the statement DeletePayload runs
+func deletePayloadQuery(hard bool) string {
+	if hard {
+		return `DELETE FROM payloads WHERE id = $1`
+	}
+	// Also blanks rows deleted before soft delete scrubbed them, keeping their original deleted_at
+	return `UPDATE payloads SET name = '', email = '', phone = NULL, deleted_at = COALESCE(deleted_at, now()) WHERE id = $1`
+}
+
+// InsertRecord writes a generic record into the configured table
+func (a *Activities) InsertRecord(ctx context.Context, r shared.Record) error {
+	if a.Records == nil {
+		return temporal.NewNonRetryableApplicationError("generic records are not configured (set RECORD_TABLE)", "RecordsNotConfigured", nil)
+	}
+
+	query, args, err := a.Records.BuildInsert(r.Fields)
+	if err != nil {
+		// A malformed record will never succeed, so don't retry it
+		return temporal.NewNonRetryableApplicationError("invalid record: "+err.Error(), "InvalidRecord", err)
+	}
+
+	log.Printf("Inserting record into %s with %d fields", a.Records.Table, len(args))
+	if err := a.exec(ctx, query, args...); err != nil {
+		return err
+	}
+
+	log.Printf("Successfully inserted record into %s", a.Records.Table)
+	return nil
+}
+
+// exec runs a statement bounded by the configured statement timeout.
+// Cancelling ctx aborts the statement and returns a Temporal canceled error; a statement
+// that already committed is not undone.
+func (a *Activities) exec(ctx context.Context, query string, args ...interface{}) error {
+	timeout := a.StatementTimeout
+	if timeout <= 0 {
+		timeout = DefaultStatementTimeout
+	}
+	stmtCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	defer heartbeatUntilDone(ctx)()
+
+	start := time.Now()
+	_, err := a.DB.ExecContext(stmtCtx, query, args...)
+	a.Metrics.observeExec(time.Since(start))
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// Not retried: the workflow no longer wants this write
+			return temporal.NewCanceledError(fmt.Sprintf("statement cancelled: %v", err))
+		}
+		if errors.Is(stmtCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			// Retryable: the statement hit our own deadline, not the activity's
+			return temporal.NewApplicationErrorWithCause(
+				fmt.Sprintf("statement timed out after %v", timeout), "DatabaseTimeout", err)
+		}
+		return fmt.Errorf("statement failed: %w", err)
+	}
+
+	return nil
+}
+
+// heartbeatUntilDone heartbeats in the background until the returned stop function is called,
+// so a cancellation requested while a statement runs is delivered to ctx
+func heartbeatUntilDone(ctx context.Context) (stop func()) {
+	if !activity.IsActivity(ctx) {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				activity.RecordHeartbeat(ctx)
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"temporal-key-rotation/shared"
+
+	"go.temporal.io/sdk/temporal"
+)
+
+// slowConnector opens connections whose statements block until their context ends,
+// like a database stuck on a lock
+type slowConnector struct {
+	started chan struct{}
+}
+
+func (c *slowConnector) Connect(context.Context) (driver.Conn, error) {
+	return &slowConn{c.started}, nil
+}
+func (c *slowConnector) Driver() driver.Driver { return nil }
+
+type slowConn struct {
+	started chan struct{}
+}
+
+func (c *slowConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	close(c.started)
+	<-ctx.Done()
+	// lib/pq reports a cancelled statement as a server error, not ctx.Err()
+	return nil, errors.New("pq: canceling statement due to user request")
+}
+
+func (c *slowConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *slowConn) Close() error              { return nil }
+func (c *slowConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func TestInsertPayloadAbortsOnCancellation(t *testing.T) {
+	connector := &slowConnector{started: make(chan struct{})}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	activities := &Activities{DB: db, StatementTimeout: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- activities.InsertPayload(ctx, shared.Payload{ID: 1, Name: "John", Email: "john@example.com"})
+	}()
+
+	<-connector.started
+	cancel()
+
+	select {
+	case err := <-result:
+		if !temporal.IsCanceledError(err) {
+			t.Fatalf("expected a canceled error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("InsertPayload did not return after cancellation")
+	}
+}
+
+// recordingConnector opens connections that record the statements they execute
+type recordingConnector struct {
+	queries []string
+	args    [][]driver.NamedValue
+}
+
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return &recordingConn{c}, nil
+}
+func (c *recordingConnector) Driver() driver.Driver { return nil }
+
+type recordingConn struct {
+	connector *recordingConnector
+}
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.connector.queries = append(c.connector.queries, query)
+	c.connector.args = append(c.connector.args, args)
+	return driver.RowsAffected(0), nil
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func TestSoftDeleteIsAuthoritative(t *testing.T) {
+	connector := &recordingConnector{}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	activities := &Activities{DB: db}
+
+	ctx := context.Background()
+	if err := activities.InsertPayload(ctx, shared.Payload{ID: 1, Deleted: true}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := activities.InsertPayload(ctx, shared.Payload{ID: 1, Name: "John", Email: "john@example.com"}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if len(connector.queries) != 2 {
+		t.Fatalf("expected 2 statements, got %q", connector.queries)
+	}
+
+	// The delete scrubs the personal data along with setting the tombstone
+	if del := connector.queries[0]; !strings.Contains(del, "name = ''") || !strings.Contains(del, "email = ''") {
+		t.Fatalf("soft delete keeps name or email: %s", del)
+	}
+	// and a later upsert of the ID does not bring it back
+	if upsert := connector.queries[1]; !strings.HasSuffix(upsert, "WHERE payloads.deleted_at IS NULL") {
+		t.Fatalf("upsert overwrites soft deleted rows: %s", upsert)
+	}
+}
+
+func TestInsertPayloadHandlesEachVersion(t *testing.T) {
+	connector := &recordingConnector{}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	activities := &Activities{DB: db}
+	ctx := context.Background()
+
+	// A v1 payload from an old history, processed by this v2 worker
+	var v1 shared.Payload
+	if err := json.Unmarshal([]byte(`{"id":1,"name":"John","email":"john@example.com"}`), &v1); err != nil {
+		t.Fatalf("unmarshal v1 payload: %v", err)
+	}
+	if err := activities.InsertPayload(ctx, v1); err != nil {
+		t.Fatalf("insert v1 payload: %v", err)
+	}
+	if query := connector.queries[0]; strings.Contains(query, "phone") || len(connector.args[0]) != 3 {
+		t.Fatalf("a v1 upsert must leave phone alone: %s %v", query, connector.args[0])
+	}
+
+	var v2 shared.Payload
+	if err := json.Unmarshal([]byte(`{"id":1,"name":"John","email":"john@example.com","phone":"+15550100","version":2}`), &v2); err != nil {
+		t.Fatalf("unmarshal v2 payload: %v", err)
+	}
+	if err := activities.InsertPayload(ctx, v2); err != nil {
+		t.Fatalf("insert v2 payload: %v", err)
+	}
+	if args := connector.args[1]; len(args) != 4 || args[3].Value != "+15550100" {
+		t.Fatalf("expected the v2 upsert to write phone, got %v", args)
+	}
+	if query := connector.queries[1]; !strings.Contains(query, "phone = EXCLUDED.phone") {
+		t.Fatalf("expected the v2 upsert to update phone: %s", query)
+	}
+}
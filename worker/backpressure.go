@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.temporal.io/sdk/interceptor"
+)
+
+// Defaults for codec backpressure
+const (
+	DefaultBackpressureInterval         = 5 * time.Second
+	DefaultBackpressureFailureThreshold = 3
+	DefaultBackpressureLatencyThreshold = time.Second
+)
+
+// BackpressureConfig sets when the worker considers the codec server degraded and how much
+// activity execution it allows until the codec recovers
+type BackpressureConfig struct {
+	Interval            time.Duration // time between codec /health checks
+	FailureThreshold    int           // consecutive failed checks before the codec counts as degraded
+	LatencyThreshold    time.Duration // a check answered slower than this fails; zero disables it
+	DegradedConcurrency int           // activities run at once while degraded; zero pauses them
+}
+
+// BackpressureConfigFromEnv reads the backpressure settings, falling back to the defaults
+func BackpressureConfigFromEnv() BackpressureConfig {
+	config := BackpressureConfig{
+		Interval:         DefaultBackpressureInterval,
+		FailureThreshold: DefaultBackpressureFailureThreshold,
+		LatencyThreshold: DefaultBackpressureLatencyThreshold,
+	}
+	if intervalStr := os.Getenv("CODEC_BACKPRESSURE_INTERVAL"); intervalStr != "" {
+		if interval, err := strconv.Atoi(intervalStr); err == nil && interval > 0 {
+			config.Interval = time.Duration(interval) * time.Second
+		}
+	}
+	if thresholdStr := os.Getenv("CODEC_BACKPRESSURE_FAILURE_THRESHOLD"); thresholdStr != "" {
+		if threshold, err := strconv.Atoi(thresholdStr); err == nil && threshold > 0 {
+			config.FailureThreshold = threshold
+		}
+	}
+	if latencyStr := os.Getenv("CODEC_BACKPRESSURE_LATENCY_THRESHOLD_MS"); latencyStr != "" {
+		if latency, err := strconv.Atoi(latencyStr); err == nil && latency >= 0 {
+			config.LatencyThreshold = time.Duration(latency) * time.Millisecond
+		}
+	}
+	if concurrencyStr := os.Getenv("CODEC_BACKPRESSURE_DEGRADED_CONCURRENCY"); concurrencyStr != "" {
+		if concurrency, err := strconv.Atoi(concurrencyStr); err == nil && concurrency >= 0 {
+			config.DegradedConcurrency = concurrency
+		}
+	}
+	return config
+}
+
+// codecBackpressure checks the codec server's /health, which fails while its KMS circuit
+// breaker is open, and holds back new activities while the codec is degraded, so the worker
+// doesn't keep running activities whose payloads the codec cannot encode. Activities already
+// running finish; new ones wait until fewer than DegradedConcurrency are running or the codec
+// recovers, whichever comes first, or until their context is done.
+type codecBackpressure struct {
+	healthURL  string
+	httpClient *http.Client
+	config     BackpressureConfig
+	metrics    *workerMetrics
+
+	mu       sync.Mutex
+	failures int           // consecutive failed checks
+	degraded bool          // failures reached the threshold
+	running  int           // activities executing
+	changed  chan struct{} // closed and replaced whenever degraded or running changes
+}
+
+func newCodecBackpressure(codecServerURL string, config BackpressureConfig, metrics *workerMetrics) *codecBackpressure {
+	return &codecBackpressure{
+		healthURL:  strings.TrimSuffix(codecServerURL, "/") + "/health",
+		httpClient: &http.Client{Timeout: config.Interval},
+		config:     config,
+		metrics:    metrics,
+		changed:    make(chan struct{}),
+	}
+}
+
+// run checks the codec's health every interval until ctx is done
+func (b *codecBackpressure) run(ctx context.Context) {
+	ticker := time.NewTicker(b.config.Interval)
+	defer ticker.Stop()
+	for {
+		b.check(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check makes one health check and updates the degraded state
+func (b *codecBackpressure) check(ctx context.Context) {
+	healthy := false
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.healthURL, nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = b.httpClient.Do(req); err == nil {
+			resp.Body.Close()
+			elapsed := time.Since(start)
+			healthy = resp.StatusCode == http.StatusOK && (b.config.LatencyThreshold == 0 || elapsed <= b.config.LatencyThreshold)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if healthy {
+		b.failures = 0
+		if b.degraded {
+			log.Printf("Codec server recovered, resuming activity execution")
+			b.setDegradedLocked(false)
+		}
+		return
+	}
+	b.failures++
+	if !b.degraded && b.failures >= b.config.FailureThreshold {
+		log.Printf("Codec server degraded after %d failed health checks (last: %v), limiting activities to %d",
+			b.failures, err, b.config.DegradedConcurrency)
+		b.setDegradedLocked(true)
+	}
+}
+
+// setDegradedLocked switches the degraded state and wakes waiting activities (assumes lock is held)
+func (b *codecBackpressure) setDegradedLocked(degraded bool) {
+	b.degraded = degraded
+	b.metrics.setCodecDegraded(degraded)
+	b.notifyLocked()
+}
+
+func (b *codecBackpressure) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// acquire waits until an activity may run, or ctx is done
+func (b *codecBackpressure) acquire(ctx context.Context) error {
+	waited := false
+	for {
+		b.mu.Lock()
+		if !b.degraded || b.running < b.config.DegradedConcurrency {
+			b.running++
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		if !waited {
+			waited = true
+			b.metrics.recordBackpressureWait()
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release ends an activity started by acquire
+func (b *codecBackpressure) release() {
+	b.mu.Lock()
+	b.running--
+	b.notifyLocked()
+	b.mu.Unlock()
+}
+
+// backpressureInterceptor makes every activity of the worker pass through codecBackpressure
+type backpressureInterceptor struct {
+	interceptor.WorkerInterceptorBase
+	backpressure *codecBackpressure
+}
+
+func (i *backpressureInterceptor) InterceptActivity(ctx context.Context, next interceptor.ActivityInboundInterceptor) interceptor.ActivityInboundInterceptor {
+	return &backpressureActivityInbound{
+		ActivityInboundInterceptorBase: interceptor.ActivityInboundInterceptorBase{Next: next},
+		backpressure:                   i.backpressure,
+	}
+}
+
+type backpressureActivityInbound struct {
+	interceptor.ActivityInboundInterceptorBase
+	backpressure *codecBackpressure
+}
+
+func (a *backpressureActivityInbound) ExecuteActivity(ctx context.Context, in *interceptor.ExecuteActivityInput) (interface{}, error) {
+	if err := a.backpressure.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer a.backpressure.release()
+	return a.Next.ExecuteActivity(ctx, in)
+}
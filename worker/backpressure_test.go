@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newHealthServer serves /health with the status held in status
+func newHealthServer(t *testing.T, status *atomic.Int32, delay time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBackpressurePausesActivitiesUntilCodecRecovers(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := newHealthServer(t, &status, 0)
+	metrics := newWorkerMetrics()
+	backpressure := newCodecBackpressure(server.URL, BackpressureConfig{Interval: time.Second, FailureThreshold: 2}, metrics)
+
+	// One failed check is below the threshold
+	backpressure.check(context.Background())
+	if err := backpressure.acquire(context.Background()); err != nil {
+		t.Fatalf("expected activities to run before the threshold, got %v", err)
+	}
+	backpressure.release()
+
+	backpressure.check(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := backpressure.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a degraded codec to hold the activity back, got %v", err)
+	}
+	var body strings.Builder
+	metrics.write(&body)
+	if !strings.Contains(body.String(), "worker_codec_degraded 1\n") || !strings.Contains(body.String(), "worker_codec_backpressure_waits_total 1\n") {
+		t.Fatalf("unexpected metrics:\n%s", body.String())
+	}
+
+	// A waiting activity starts as soon as a check succeeds
+	started := make(chan error, 1)
+	go func() { started <- backpressure.acquire(context.Background()) }()
+	status.Store(http.StatusOK)
+	backpressure.check(context.Background())
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the activity to start once the codec recovered")
+	}
+	backpressure.release()
+	if metrics.codecDegraded.Load() {
+		t.Fatal("expected the degraded gauge to clear")
+	}
+}
+
+func TestBackpressureLimitsConcurrencyWhileDegraded(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	// Healthy but slower than the latency threshold counts as a failure
+	server := newHealthServer(t, &status, 20*time.Millisecond)
+	backpressure := newCodecBackpressure(server.URL, BackpressureConfig{
+		Interval: time.Second, FailureThreshold: 1, LatencyThreshold: 5 * time.Millisecond, DegradedConcurrency: 1,
+	}, nil)
+	backpressure.check(context.Background())
+
+	if err := backpressure.acquire(context.Background()); err != nil {
+		t.Fatalf("expected one activity to run while degraded, got %v", err)
+	}
+	second := make(chan error, 1)
+	go func() { second <- backpressure.acquire(context.Background()) }()
+	select {
+	case err := <-second:
+		t.Fatalf("expected the second activity to wait, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	backpressure.release()
+	if err := <-second; err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	backpressure.release()
+}
+
+func TestBackpressureConfigFromEnv(t *testing.T) {
+	t.Setenv("CODEC_BACKPRESSURE_INTERVAL", "10")
+	t.Setenv("CODEC_BACKPRESSURE_FAILURE_THRESHOLD", "5")
+	t.Setenv("CODEC_BACKPRESSURE_LATENCY_THRESHOLD_MS", "250")
+	t.Setenv("CODEC_BACKPRESSURE_DEGRADED_CONCURRENCY", "2")
+	want := BackpressureConfig{Interval: 10 * time.Second, FailureThreshold: 5, LatencyThreshold: 250 * time.Millisecond, DegradedConcurrency: 2}
+	if got := BackpressureConfigFromEnv(); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -5,17 +5,25 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
 
 	"temporal-key-rotation/shared"
 
 	commonpb "go.temporal.io/api/common/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 // RemoteCodecClient implements the PayloadCodec interface
 type RemoteCodecClient struct {
-	endpoint   string
-	httpClient *http.Client
+	endpoint      string
+	httpClient    *http.Client
+	correlationID string                   // sent with every request; empty sends none
+	codecContext  map[string]string        // sent with encode requests to select a codec profile
+	protobuf      bool                     // use the protobuf wire format instead of JSON
+	sizeLimits    shared.PayloadSizeLimits // checked against encoded payloads; zero checks nothing
+	metrics       *workerMetrics           // counts codec server errors; nil counts nothing
 }
 
 // NewRemoteCodecClient creates a new remote codec client
@@ -26,27 +34,91 @@ func NewRemoteCodecClient(endpoint string) *RemoteCodecClient {
 	}
 }
 
+// WithCorrelationID makes the client send id with its requests. The codec server records it
+// in the metadata of every payload it encrypts, so the payloads can be traced to the request.
+func (c *RemoteCodecClient) WithCorrelationID(id string) *RemoteCodecClient {
+	c.correlationID = id
+	return c
+}
+
+// WithCodecContext makes the client send context with its encode requests, such as the
+// workflow type or a search attribute, so the codec server can pick the protection profile
+// for the payloads. The context only travels in the JSON wire format.
+func (c *RemoteCodecClient) WithCodecContext(context map[string]string) *RemoteCodecClient {
+	c.codecContext = context
+	return c
+}
+
+// WithMetrics makes the client count codec server errors, by client and server fault, in metrics
+func (c *RemoteCodecClient) WithMetrics(metrics *workerMetrics) *RemoteCodecClient {
+	c.metrics = metrics
+	return c
+}
+
+// http2Transport is shared by every client using HTTP/2, so they multiplex requests over
+// one connection per codec server instead of each opening its own
+var http2Transport = sync.OnceValue(func() *http.Transport {
+	var protocols http.Protocols
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true) // h2c with prior knowledge for http:// endpoints
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Protocols = &protocols
+	return transport
+})
+
+// WithHTTP2 makes the client use HTTP/2, over TLS for https:// endpoints and as h2c for
+// http:// ones. The codec server must have HTTP/2 enabled too.
+func (c *RemoteCodecClient) WithHTTP2() *RemoteCodecClient {
+	c.httpClient = &http.Client{Transport: http2Transport()}
+	return c
+}
+
+// WithSizeLimits makes the client check every payload it encodes against limits, warning
+// about payloads near Temporal's size limit before Temporal rejects them
+func (c *RemoteCodecClient) WithSizeLimits(limits shared.PayloadSizeLimits) *RemoteCodecClient {
+	c.sizeLimits = limits
+	return c
+}
+
+// WithProtobuf makes the client talk to the codec server in the protobuf wire format, which
+// sends payload data as raw bytes instead of base64
+func (c *RemoteCodecClient) WithProtobuf() *RemoteCodecClient {
+	c.protobuf = true
+	return c
+}
+
 // Encode implements the PayloadCodec interface
 func (c *RemoteCodecClient) Encode(payloads []*commonpb.Payload) ([]*commonpb.Payload, error) {
 	if len(payloads) == 0 {
 		return payloads, nil
 	}
 
-	// Convert Temporal payloads to codec request format
-	request := shared.CodecRequest{
-		Payloads: make([]shared.PayloadData, len(payloads)),
-	}
+	// Temporal control payloads, such as nil values, are returned as-is, in place
+	result := make([]*commonpb.Payload, len(payloads))
+	request := shared.CodecRequest{Context: c.codecContext}
+	var positions []int
 
+	// Convert Temporal payloads to codec request format
 	for i, payload := range payloads {
+		if shared.IsControlEncoding(string(payload.Metadata["encoding"])) {
+			result[i] = payload
+			continue
+		}
+
 		metadata := make(map[string]string)
 		for key, value := range payload.Metadata {
 			metadata[key] = string(value)
 		}
 
-		request.Payloads[i] = shared.PayloadData{
+		request.Payloads = append(request.Payloads, shared.PayloadData{
 			Metadata: metadata,
 			Data:     base64.StdEncoding.EncodeToString(payload.Data),
-		}
+		})
+		positions = append(positions, i)
+	}
+
+	if len(request.Payloads) == 0 {
+		return result, nil
 	}
 
 	// Send encode request to codec server
@@ -54,9 +126,11 @@ func (c *RemoteCodecClient) Encode(payloads []*commonpb.Payload) ([]*commonpb.Pa
 	if err != nil {
 		return nil, fmt.Errorf("encode request failed: %w", err)
 	}
+	if len(response.Payloads) != len(request.Payloads) {
+		return nil, fmt.Errorf("codec server returned %d payloads for %d sent to /encode", len(response.Payloads), len(request.Payloads))
+	}
 
 	// Convert response back to Temporal payloads
-	result := make([]*commonpb.Payload, len(response.Payloads))
 	for i, payloadData := range response.Payloads {
 		// SERIALIZE THE ENTIRE PayloadData struct as JSON
 		serializedPayload, err := json.Marshal(payloadData)
@@ -64,12 +138,16 @@ func (c *RemoteCodecClient) Encode(payloads []*commonpb.Payload) ([]*commonpb.Pa
 			return nil, fmt.Errorf("failed to serialize payload data: %w", err)
 		}
 
-		result[i] = &commonpb.Payload{
+		encoded := &commonpb.Payload{
 			Metadata: map[string][]byte{
 				"encoding": []byte("temporal-codec"), // Mark as codec-processed
 			},
 			Data: serializedPayload, // Store entire PayloadData as JSON
 		}
+		if err := c.sizeLimits.CheckEncodedSize(positions[i], proto.Size(encoded)); err != nil {
+			return nil, err
+		}
+		result[positions[i]] = encoded
 	}
 
 	return result, nil
@@ -81,16 +159,16 @@ func (c *RemoteCodecClient) Decode(payloads []*commonpb.Payload) ([]*commonpb.Pa
 		return payloads, nil
 	}
 
-	// Convert Temporal payloads to codec request format
-	request := shared.CodecRequest{
-		Payloads: make([]shared.PayloadData, len(payloads)),
-	}
+	// Payloads not processed by our codec are returned as-is, in place
+	result := make([]*commonpb.Payload, len(payloads))
+	var request shared.CodecRequest
+	var positions []int
 
 	for i, payload := range payloads {
 		// Check if this was processed by our codec
 		if string(payload.Metadata["encoding"]) != "temporal-codec" {
-			// Not our payload, return as-is
-			return []*commonpb.Payload{payload}, nil
+			result[i] = payload
+			continue
 		}
 
 		// DESERIALIZE the PayloadData struct from JSON
@@ -99,7 +177,12 @@ func (c *RemoteCodecClient) Decode(payloads []*commonpb.Payload) ([]*commonpb.Pa
 			return nil, fmt.Errorf("failed to deserialize payload data: %w", err)
 		}
 
-		request.Payloads[i] = payloadData // This includes ALL KMS fields
+		request.Payloads = append(request.Payloads, payloadData) // This includes ALL KMS fields
+		positions = append(positions, i)
+	}
+
+	if len(request.Payloads) == 0 {
+		return result, nil
 	}
 
 	// Send decode request to codec server
@@ -107,12 +190,23 @@ func (c *RemoteCodecClient) Decode(payloads []*commonpb.Payload) ([]*commonpb.Pa
 	if err != nil {
 		return nil, fmt.Errorf("decode request failed: %w", err)
 	}
+	if len(response.Payloads) != len(request.Payloads) {
+		return nil, fmt.Errorf("codec server returned %d payloads for %d sent to /decode", len(response.Payloads), len(request.Payloads))
+	}
 
 	// Convert response back to Temporal payloads
-	result := make([]*commonpb.Payload, len(response.Payloads))
 	for i, payloadData := range response.Payloads {
+		// A lenient codec server's sentinel must never reach a workflow as if it were real data
+		if message, ok := payloadData.Metadata[shared.DecodeErrorMetadataKey]; ok {
+			return nil, fmt.Errorf("codec server could not decode payload %d: %s", positions[i], message)
+		}
+
 		metadata := make(map[string][]byte)
 		for key, value := range payloadData.Metadata {
+			// Provenance metadata is for the Web UI; Temporal gets the original payload shape
+			if shared.IsCodecOnlyMetadata(key) {
+				continue
+			}
 			metadata[key] = []byte(value)
 		}
 
@@ -122,7 +216,7 @@ func (c *RemoteCodecClient) Decode(payloads []*commonpb.Payload) ([]*commonpb.Pa
 			return nil, fmt.Errorf("failed to decode base64 data: %w", err)
 		}
 
-		result[i] = &commonpb.Payload{
+		result[positions[i]] = &commonpb.Payload{
 			Metadata: metadata,
 			Data:     data, // Original decrypted data
 		}
@@ -133,26 +227,51 @@ func (c *RemoteCodecClient) Decode(payloads []*commonpb.Payload) ([]*commonpb.Pa
 
 // sendRequest sends a request to the codec server
 func (c *RemoteCodecClient) sendRequest(endpoint string, request shared.CodecRequest) (*shared.CodecResponse, error) {
-	reqBody, err := json.Marshal(request)
+	contentType := shared.ContentTypeJSON
+	var reqBody []byte
+	var err error
+	if c.protobuf {
+		contentType = shared.ContentTypeProtobuf
+		reqBody, err = shared.MarshalPayloadsProtobuf(request.Payloads)
+	} else {
+		reqBody, err = json.Marshal(request)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	resp, err := c.httpClient.Post(
-		c.endpoint+endpoint,
-		"application/json",
-		bytes.NewBuffer(reqBody),
-	)
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+endpoint, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.correlationID != "" {
+		req.Header.Set(shared.CorrelationIDHeader, c.correlationID)
+	}
+
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("HTTP request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("codec server returned status %d", resp.StatusCode)
+		serverErr := shared.NewCodecServerError(endpoint, resp)
+		c.metrics.recordCodecError(serverErr)
+		return nil, serverErr
 	}
 
 	var response shared.CodecResponse
+	if c.protobuf {
+		body, err := io.ReadAll(resp.Body)
+		if err == nil {
+			response.Payloads, err = shared.UnmarshalPayloadsProtobuf(body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+		return &response, nil
+	}
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
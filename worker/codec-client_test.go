@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"temporal-key-rotation/shared"
+
+	commonpb "go.temporal.io/api/common/v1"
+)
+
+// newCodecServer returns a test server that answers every request with the given payloads
+func newCodecServer(t *testing.T, payloads []shared.PayloadData) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shared.CodecResponse{Payloads: payloads})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func jsonPayload(data string) *commonpb.Payload {
+	return &commonpb.Payload{
+		Metadata: map[string][]byte{"encoding": []byte("json/plain")},
+		Data:     []byte(data),
+	}
+}
+
+func codecPayload(t *testing.T, data shared.PayloadData) *commonpb.Payload {
+	t.Helper()
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("marshal payload data: %v", err)
+	}
+	return &commonpb.Payload{
+		Metadata: map[string][]byte{"encoding": []byte("temporal-codec")},
+		Data:     serialized,
+	}
+}
+
+func TestEncodeRejectsPayloadCountMismatch(t *testing.T) {
+	server := newCodecServer(t, []shared.PayloadData{{Metadata: map[string]string{"encoding": "binary/encrypted"}}})
+	client := NewRemoteCodecClient(server.URL)
+
+	_, err := client.Encode([]*commonpb.Payload{jsonPayload(`{"a":1}`), jsonPayload(`{"b":2}`)})
+	if err == nil || !strings.Contains(err.Error(), "returned 1 payloads for 2") {
+		t.Fatalf("expected a count mismatch error, got %v", err)
+	}
+}
+
+func TestEncodeChecksEncodedPayloadSize(t *testing.T) {
+	server := newCodecServer(t, []shared.PayloadData{{
+		Metadata: map[string]string{"encoding": "binary/encrypted"},
+		Data:     strings.Repeat("A", 4096),
+	}})
+	limits := shared.PayloadSizeLimits{WarnBytes: 1024, LimitBytes: 2048}
+
+	if _, err := NewRemoteCodecClient(server.URL).WithSizeLimits(limits).Encode([]*commonpb.Payload{jsonPayload(`{"a":1}`)}); err != nil {
+		t.Fatalf("expected an oversized payload to only be logged, got %v", err)
+	}
+
+	limits.Enforce = true
+	_, err := NewRemoteCodecClient(server.URL).WithSizeLimits(limits).Encode([]*commonpb.Payload{jsonPayload(`{"a":1}`)})
+	if !errors.Is(err, shared.ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+func TestDecodeRejectsPayloadCountMismatch(t *testing.T) {
+	server := newCodecServer(t, nil)
+	client := NewRemoteCodecClient(server.URL)
+
+	encrypted := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/encrypted"}, Data: "eA=="}
+	_, err := client.Decode([]*commonpb.Payload{codecPayload(t, encrypted)})
+	if err == nil || !strings.Contains(err.Error(), "returned 0 payloads for 1") {
+		t.Fatalf("expected a count mismatch error, got %v", err)
+	}
+}
+
+func TestDecodeKeepsForeignPayloadsInPlace(t *testing.T) {
+	server := newCodecServer(t, []shared.PayloadData{{Metadata: map[string]string{"encoding": "json/plain"}, Data: "eyJiIjoyfQ=="}})
+	client := NewRemoteCodecClient(server.URL)
+
+	foreign := jsonPayload(`{"a":1}`)
+	encrypted := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/encrypted"}, Data: "eA=="}
+
+	result, err := client.Decode([]*commonpb.Payload{foreign, codecPayload(t, encrypted)})
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("expected 2 payloads, got %d", len(result))
+	}
+	if result[0] != foreign {
+		t.Fatal("expected the foreign payload to be returned unchanged in place")
+	}
+	if string(result[1].Data) != `{"b":2}` {
+		t.Fatalf("unexpected decoded data %q", result[1].Data)
+	}
+}
+
+func TestDecodeStripsProvenanceMetadata(t *testing.T) {
+	server := newCodecServer(t, []shared.PayloadData{{
+		Metadata: map[string]string{
+			"encoding":                       "json/plain",
+			shared.KeyFingerprintMetadataKey: "0123456789abcdef",
+			shared.KeySourceMetadataKey:      "cache",
+		},
+		Data: "eyJiIjoyfQ==",
+	}})
+	client := NewRemoteCodecClient(server.URL)
+
+	encrypted := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/encrypted"}, Data: "eA=="}
+	result, err := client.Decode([]*commonpb.Payload{codecPayload(t, encrypted)})
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(result[0].Metadata) != 1 || string(result[0].Metadata["encoding"]) != "json/plain" {
+		t.Fatalf("expected only the encoding metadata, got %v", result[0].Metadata)
+	}
+}
+
+func TestCorrelationIDIsSentAndStrippedOnDecode(t *testing.T) {
+	var sent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get(shared.CorrelationIDHeader)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shared.CodecResponse{Payloads: []shared.PayloadData{{
+			Metadata: map[string]string{"encoding": "json/plain", shared.CorrelationIDMetadataKey: "req-42"},
+			Data:     "eyJiIjoyfQ==",
+		}}})
+	}))
+	t.Cleanup(server.Close)
+	client := NewRemoteCodecClient(server.URL).WithCorrelationID("req-42")
+
+	encrypted := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/encrypted"}, Data: "eA=="}
+	result, err := client.Decode([]*commonpb.Payload{codecPayload(t, encrypted)})
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if sent != "req-42" {
+		t.Errorf("expected the correlation header to be sent, got %q", sent)
+	}
+	if _, ok := result[0].Metadata[shared.CorrelationIDMetadataKey]; ok {
+		t.Errorf("correlation ID should not reach the data converter, got %v", result[0].Metadata)
+	}
+}
+
+func TestProtobufClientRoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !shared.IsProtobufContentType(r.Header.Get("Content-Type")) {
+			http.Error(w, "expected protobuf", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		payloads, err := shared.UnmarshalPayloadsProtobuf(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Echo the payloads back, marked the way the codec server marks its output
+		for i := range payloads {
+			payloads[i].Metadata["echoed"] = "true"
+		}
+		response, _ := shared.MarshalPayloadsProtobuf(payloads)
+		w.Header().Set("Content-Type", shared.ContentTypeProtobuf)
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	client := NewRemoteCodecClient(server.URL).WithProtobuf()
+
+	encoded, err := client.Encode([]*commonpb.Payload{jsonPayload(`{"a":1}`)})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	decoded, err := client.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if string(decoded[0].Data) != `{"a":1}` || string(decoded[0].Metadata["echoed"]) != "true" {
+		t.Fatalf("unexpected round trip result: %v %q", decoded[0].Metadata, decoded[0].Data)
+	}
+}
+
+func TestHTTP2ClientMultiplexesOneConnection(t *testing.T) {
+	var connections, h1Requests atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			h1Requests.Add(1)
+		}
+		var req shared.CodecRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shared.CodecResponse{Payloads: req.Payloads})
+	}))
+	// Configured like the codec server with CODEC_HTTP2=true
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	client := NewRemoteCodecClient(server.URL).WithHTTP2()
+
+	// The first request opens the connection; the concurrent ones must share it
+	if _, err := client.Encode([]*commonpb.Payload{jsonPayload(`{"n":0}`)}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Encode([]*commonpb.Payload{jsonPayload(fmt.Sprintf(`{"n":%d}`, i+1))})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+
+	if n := h1Requests.Load(); n != 0 {
+		t.Errorf("expected every request over HTTP/2, %d used HTTP/1", n)
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("expected concurrent requests to share one connection, server saw %d", n)
+	}
+}
+
+func TestDecodeRejectsLenientSentinels(t *testing.T) {
+	server := newCodecServer(t, []shared.PayloadData{{
+		Metadata: map[string]string{"encoding": "json/plain", shared.DecodeErrorMetadataKey: "Corrupt payload"},
+		Data:     "e30=",
+	}})
+	client := NewRemoteCodecClient(server.URL)
+
+	encrypted := shared.PayloadData{Metadata: map[string]string{"encoding": "binary/encrypted"}, Data: "eA=="}
+	_, err := client.Decode([]*commonpb.Payload{codecPayload(t, encrypted)})
+	if err == nil || !strings.Contains(err.Error(), "Corrupt payload") {
+		t.Fatalf("expected the sentinel to surface as an error, got %v", err)
+	}
+}
+
+func TestEncodePassesThroughNullPayloads(t *testing.T) {
+	var sent atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req shared.CodecRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		sent.Add(int32(len(req.Payloads)))
+		json.NewEncoder(w).Encode(shared.CodecResponse{Payloads: []shared.PayloadData{{Metadata: map[string]string{"encoding": "binary/encrypted"}, Data: "eA=="}}})
+	}))
+	t.Cleanup(server.Close)
+	client := NewRemoteCodecClient(server.URL)
+	null := &commonpb.Payload{Metadata: map[string][]byte{"encoding": []byte(shared.NullEncoding)}}
+
+	// A batch of nil values alone never reaches the codec server
+	result, err := client.Encode([]*commonpb.Payload{null})
+	if err != nil || result[0] != null || sent.Load() != 0 {
+		t.Fatalf("expected the nil value back without a request, got %v, %v after %d payloads sent", result, err, sent.Load())
+	}
+
+	result, err = client.Encode([]*commonpb.Payload{null, jsonPayload(`{"a":1}`)})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if sent.Load() != 1 {
+		t.Fatalf("expected only the JSON payload to be sent, got %d", sent.Load())
+	}
+	if result[0] != null || string(result[1].Metadata["encoding"]) != "temporal-codec" {
+		t.Fatalf("unexpected result %v", result)
+	}
+}
+
+func TestCodecContextIsSentWithEncode(t *testing.T) {
+	var sent shared.CodecRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shared.CodecResponse{Payloads: []shared.PayloadData{{Metadata: map[string]string{"encoding": "binary/encrypted"}}}})
+	}))
+	t.Cleanup(server.Close)
+	client := NewRemoteCodecClient(server.URL).WithCodecContext(map[string]string{"WorkflowType": "PaymentWorkflow"})
+
+	if _, err := client.Encode([]*commonpb.Payload{jsonPayload(`{"a":1}`)}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if sent.Context["WorkflowType"] != "PaymentWorkflow" {
+		t.Fatalf("expected the codec context in the encode request, got %v", sent.Context)
+	}
+}
+
+func TestCodecServerErrorsAreTypedAndCounted(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		message   string
+		retryable bool
+		metric    string
+	}{
+		{"bad request", http.StatusBadRequest, "envelope checksum mismatch", false, `worker_codec_request_errors_total{fault="client"} 1`},
+		{"unavailable", http.StatusServiceUnavailable, "failed to get data key", true, `worker_codec_request_errors_total{fault="server"} 1`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, tc.message, tc.status)
+			}))
+			defer server.Close()
+			metrics := newWorkerMetrics()
+
+			_, err := NewRemoteCodecClient(server.URL).WithMetrics(metrics).Encode([]*commonpb.Payload{jsonPayload(`{}`)})
+			var serverErr *shared.CodecServerError
+			if !errors.As(err, &serverErr) {
+				t.Fatalf("expected a CodecServerError, got %v", err)
+			}
+			if serverErr.StatusCode != tc.status || serverErr.Message != tc.message || serverErr.Endpoint != "/encode" {
+				t.Fatalf("unexpected error fields %+v", serverErr)
+			}
+			if serverErr.Retryable() != tc.retryable || serverErr.ClientFault() == tc.retryable {
+				t.Fatalf("expected retryable=%v for status %d", tc.retryable, tc.status)
+			}
+			if out := scrapeMetrics(t, metrics, nil); !strings.Contains(out, tc.metric) {
+				t.Fatalf("expected %s in metrics:\n%s", tc.metric, out)
+			}
+		})
+	}
+}
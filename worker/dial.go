@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"time"
+
+	"go.temporal.io/sdk/client"
+)
+
+// Defaults for retrying the initial Temporal dial
+const (
+	DefaultDialMaxAttempts    = 10
+	DefaultDialInitialBackoff = time.Second
+	DefaultDialMaxBackoff     = 30 * time.Second
+)
+
+// DialRetryConfig bounds the retries of the initial Temporal dial
+type DialRetryConfig struct {
+	MaxAttempts    int           // total dial attempts; 1 disables retrying
+	InitialBackoff time.Duration // wait after the first failure, doubled after each further failure
+	MaxBackoff     time.Duration // cap on the wait between attempts
+}
+
+// DialRetryConfigFromEnv reads the dial retry settings, falling back to the defaults
+func DialRetryConfigFromEnv() DialRetryConfig {
+	config := DialRetryConfig{
+		MaxAttempts:    DefaultDialMaxAttempts,
+		InitialBackoff: DefaultDialInitialBackoff,
+		MaxBackoff:     DefaultDialMaxBackoff,
+	}
+	if attemptsStr := os.Getenv("TEMPORAL_DIAL_MAX_ATTEMPTS"); attemptsStr != "" {
+		if attempts, err := strconv.Atoi(attemptsStr); err == nil && attempts > 0 {
+			config.MaxAttempts = attempts
+		}
+	}
+	if backoffStr := os.Getenv("TEMPORAL_DIAL_INITIAL_BACKOFF"); backoffStr != "" {
+		if backoff, err := strconv.Atoi(backoffStr); err == nil && backoff > 0 {
+			config.InitialBackoff = time.Duration(backoff) * time.Second
+		}
+	}
+	if backoffStr := os.Getenv("TEMPORAL_DIAL_MAX_BACKOFF"); backoffStr != "" {
+		if backoff, err := strconv.Atoi(backoffStr); err == nil && backoff > 0 {
+			config.MaxBackoff = time.Duration(backoff) * time.Second
+		}
+	}
+	return config
+}
+
+// backoff returns the wait before the attempt after failed attempt n (counting from 1):
+// exponential, capped at MaxBackoff, with equal jitter so restarted workers spread out
+func (c DialRetryConfig) backoff(n int) time.Duration {
+	wait := c.InitialBackoff
+	for i := 1; i < n && wait < c.MaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, c.MaxBackoff)
+	half := wait / 2
+	return half + rand.N(half+1)
+}
+
+// dialWithRetry dials Temporal, retrying failures with backoff until the attempts run out or ctx is done.
+// Only the initial connection is retried here; once connected, the SDK's gRPC connection
+// reconnects on its own after transient disconnects.
+func dialWithRetry(ctx context.Context, dial func(context.Context, client.Options) (client.Client, error), options client.Options, config DialRetryConfig) (client.Client, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var c client.Client
+		if c, err = dial(ctx, options); err == nil {
+			return c, nil
+		}
+		if attempt >= config.MaxAttempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		wait := config.backoff(attempt)
+		log.Printf("Temporal dial attempt %d/%d failed, retrying in %v: %v", attempt, config.MaxAttempts, wait.Round(time.Millisecond), err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("dial cancelled: %w", err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.temporal.io/sdk/client"
+)
+
+func TestDialWithRetryRecoversFromTransientFailures(t *testing.T) {
+	attempts := 0
+	dial := func(ctx context.Context, options client.Options) (client.Client, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	}
+
+	config := DialRetryConfig{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	if _, err := dialWithRetry(context.Background(), dial, client.Options{}, config); err != nil {
+		t.Fatalf("dialWithRetry: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestDialWithRetryGivesUp(t *testing.T) {
+	attempts := 0
+	dialErr := errors.New("connection refused")
+	dial := func(ctx context.Context, options client.Options) (client.Client, error) {
+		attempts++
+		return nil, dialErr
+	}
+
+	config := DialRetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	if _, err := dialWithRetry(context.Background(), dial, client.Options{}, config); !errors.Is(err, dialErr) {
+		t.Fatalf("expected the last dial error, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestDialWithRetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dial := func(ctx context.Context, options client.Options) (client.Client, error) {
+		cancel()
+		return nil, errors.New("connection refused")
+	}
+
+	config := DialRetryConfig{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+	if _, err := dialWithRetry(ctx, dial, client.Options{}, config); err == nil {
+		t.Fatal("expected an error once the context is cancelled")
+	}
+}
+
+func TestDialBackoffIsExponentialCappedAndJittered(t *testing.T) {
+	config := DialRetryConfig{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for attempt, ceiling := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		for range 100 {
+			if wait := config.backoff(attempt); wait < ceiling/2 || wait > ceiling {
+				t.Fatalf("attempt %d: backoff %v outside [%v, %v]", attempt, wait, ceiling/2, ceiling)
+			}
+		}
+	}
+}
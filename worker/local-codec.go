@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"temporal-key-rotation/kmscodec"
+)
+
+// newLocalCodec creates an in-process codec configured like the codec server, from the same
+// KMS_KEY_ALIAS, KMS_CACHE_TTL, DATA_KEY_ROTATION_INTERVAL and KMS timeout variables and KMS client overrides
+func newLocalCodec(ctx context.Context) (*kmscodec.LocalCodec, error) {
+	keyAlias := os.Getenv("KMS_KEY_ALIAS")
+	if keyAlias == "" {
+		keyAlias = "alias/temporal-codec-latest"
+	}
+
+	kmsClient, err := kmscodec.NewKMSClient(ctx, kmscodec.KMSClientConfigFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	keyARN, err := kmscodec.ResolveKMSAlias(kmsClient, keyAlias)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheTTL := 24 * time.Hour
+	if ttl, err := strconv.Atoi(os.Getenv("KMS_CACHE_TTL")); err == nil {
+		cacheTTL = time.Duration(ttl) * time.Second
+	}
+	rotationInterval := 1 * time.Hour
+	if interval, err := strconv.Atoi(os.Getenv("DATA_KEY_ROTATION_INTERVAL")); err == nil {
+		rotationInterval = time.Duration(interval) * time.Second
+	}
+
+	var generateTimeout, decryptTimeout time.Duration
+	if timeout, err := strconv.Atoi(os.Getenv("KMS_GENERATE_TIMEOUT")); err == nil && timeout > 0 {
+		generateTimeout = time.Duration(timeout) * time.Second
+	}
+	if timeout, err := strconv.Atoi(os.Getenv("KMS_DECRYPT_TIMEOUT")); err == nil && timeout > 0 {
+		decryptTimeout = time.Duration(timeout) * time.Second
+	}
+
+	manager, err := kmscodec.NewKMSManagerWithClient(kmsClient, keyARN, cacheTTL, rotationInterval,
+		kmscodec.WithKMSTimeouts(generateTimeout, decryptTimeout))
+	if err != nil {
+		return nil, err
+	}
+	manager.StartCacheCleanup(15 * time.Minute)
+
+	return kmscodec.NewLocalCodec(kmscodec.NewKMSEncryptionCodec(manager)), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"temporal-key-rotation/shared"
+)
+
+// DefaultMetricsPort is where the worker serves /metrics and /health when WORKER_METRICS_PORT is unset
+const DefaultMetricsPort = "9090"
+
+// healthCheckTimeout bounds the database ping behind /health
+const healthCheckTimeout = 2 * time.Second
+
+// dbExecBuckets are the upper bounds, in seconds, of the statement latency histogram buckets
+var dbExecBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// workerMetrics counts activity outcomes and database latency. Recording only touches atomics,
+// so instrumenting an activity never takes a lock. A nil *workerMetrics records nothing.
+type workerMetrics struct {
+	insertAttempts  atomic.Uint64
+	insertSuccesses atomic.Uint64
+	insertFailures  atomic.Uint64
+
+	codecClientErrors atomic.Uint64 // 4xx from the codec server
+	codecServerErrors atomic.Uint64 // 5xx and anything else but 200
+
+	codecDegraded     atomic.Bool   // codec backpressure is holding back activities
+	backpressureWaits atomic.Uint64 // activities that had to wait for the codec
+
+	execCounts []atomic.Uint64 // per bucket, not cumulative; the last one is +Inf
+	execSum    atomic.Uint64   // float64 bits of the total seconds
+}
+
+func newWorkerMetrics() *workerMetrics {
+	return &workerMetrics{execCounts: make([]atomic.Uint64, len(dbExecBuckets)+1)}
+}
+
+// recordInsert counts one InsertPayload attempt and its outcome
+func (m *workerMetrics) recordInsert(err error) {
+	if m == nil {
+		return
+	}
+	m.insertAttempts.Add(1)
+	if err != nil {
+		m.insertFailures.Add(1)
+	} else {
+		m.insertSuccesses.Add(1)
+	}
+}
+
+// recordCodecError counts one non-200 response from the codec server by whose fault it was
+func (m *workerMetrics) recordCodecError(err *shared.CodecServerError) {
+	if m == nil {
+		return
+	}
+	if err.ClientFault() {
+		m.codecClientErrors.Add(1)
+	} else {
+		m.codecServerErrors.Add(1)
+	}
+}
+
+// setCodecDegraded records whether codec backpressure is holding back activities
+func (m *workerMetrics) setCodecDegraded(degraded bool) {
+	if m == nil {
+		return
+	}
+	m.codecDegraded.Store(degraded)
+}
+
+// recordBackpressureWait counts one activity that waited for the codec to recover
+func (m *workerMetrics) recordBackpressureWait() {
+	if m == nil {
+		return
+	}
+	m.backpressureWaits.Add(1)
+}
+
+// observeExec records the latency of one database statement, whether or not it succeeded
+func (m *workerMetrics) observeExec(elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	seconds := elapsed.Seconds()
+	i := len(dbExecBuckets)
+	for j, bound := range dbExecBuckets {
+		if seconds <= bound {
+			i = j
+			break
+		}
+	}
+	m.execCounts[i].Add(1)
+	for {
+		old := m.execSum.Load()
+		if m.execSum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+seconds)) {
+			return
+		}
+	}
+}
+
+// write renders the metrics in the Prometheus text exposition format
+func (m *workerMetrics) write(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE worker_insert_payload_attempts_total counter\nworker_insert_payload_attempts_total %d\n", m.insertAttempts.Load())
+	fmt.Fprintf(w, "# TYPE worker_insert_payload_successes_total counter\nworker_insert_payload_successes_total %d\n", m.insertSuccesses.Load())
+	fmt.Fprintf(w, "# TYPE worker_insert_payload_failures_total counter\nworker_insert_payload_failures_total %d\n", m.insertFailures.Load())
+	fmt.Fprintf(w, "# TYPE worker_codec_request_errors_total counter\n")
+	fmt.Fprintf(w, "worker_codec_request_errors_total{fault=\"client\"} %d\n", m.codecClientErrors.Load())
+	fmt.Fprintf(w, "worker_codec_request_errors_total{fault=\"server\"} %d\n", m.codecServerErrors.Load())
+	degraded := 0
+	if m.codecDegraded.Load() {
+		degraded = 1
+	}
+	fmt.Fprintf(w, "# TYPE worker_codec_degraded gauge\nworker_codec_degraded %d\n", degraded)
+	fmt.Fprintf(w, "# TYPE worker_codec_backpressure_waits_total counter\nworker_codec_backpressure_waits_total %d\n", m.backpressureWaits.Load())
+
+	const name = "worker_db_exec_seconds"
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i := range m.execCounts {
+		cumulative += m.execCounts[i].Load()
+		le := "+Inf"
+		if i < len(dbExecBuckets) {
+			le = strconv.FormatFloat(dbExecBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, cumulative)
+	}
+	// The sum is loaded after the counts, so under concurrent observes it can run slightly ahead of them
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, math.Float64frombits(m.execSum.Load()), name, cumulative)
+}
+
+// newMetricsMux serves /metrics and a /health check that fails while the database is unreachable
+func newMetricsMux(metrics *workerMetrics, db *sql.DB) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	return mux
+}
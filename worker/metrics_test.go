@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"temporal-key-rotation/shared"
+)
+
+// execConnector opens connections whose statements return execErr straight away
+type execConnector struct {
+	connectErr error
+	execErr    error
+}
+
+func (c *execConnector) Connect(context.Context) (driver.Conn, error) {
+	if c.connectErr != nil {
+		return nil, c.connectErr
+	}
+	return &execConn{c}, nil
+}
+func (c *execConnector) Driver() driver.Driver { return nil }
+
+type execConn struct {
+	connector *execConnector
+}
+
+func (c *execConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.connector.execErr; err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *execConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *execConn) Close() error              { return nil }
+func (c *execConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func scrapeMetrics(t *testing.T, metrics *workerMetrics, db *sql.DB) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	newMetricsMux(metrics, db).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestInsertPayloadMetrics(t *testing.T) {
+	connector := &execConnector{}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	metrics := newWorkerMetrics()
+	activities := &Activities{DB: db, Metrics: metrics}
+
+	payload := shared.Payload{ID: 1, Name: "John", Email: "john@example.com"}
+	for range 2 {
+		if err := activities.InsertPayload(context.Background(), payload); err != nil {
+			t.Fatalf("InsertPayload: %v", err)
+		}
+	}
+	connector.execErr = errors.New("pq: connection reset")
+	if err := activities.InsertPayload(context.Background(), payload); err == nil {
+		t.Fatal("expected the insert to fail")
+	}
+
+	body := scrapeMetrics(t, metrics, db)
+	for _, want := range []string{
+		"worker_insert_payload_attempts_total 3\n",
+		"worker_insert_payload_successes_total 2\n",
+		"worker_insert_payload_failures_total 1\n",
+		`worker_db_exec_seconds_bucket{le="+Inf"} 3` + "\n",
+		"worker_db_exec_seconds_count 3\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestNilMetricsRecordNothing(t *testing.T) {
+	db := sql.OpenDB(&execConnector{})
+	defer db.Close()
+	activities := &Activities{DB: db}
+	if err := activities.InsertPayload(context.Background(), shared.Payload{ID: 1, Name: "John"}); err != nil {
+		t.Fatalf("InsertPayload: %v", err)
+	}
+}
+
+func TestWorkerHealth(t *testing.T) {
+	for name, tc := range map[string]struct {
+		connectErr error
+		want       int
+	}{
+		"database reachable":   {nil, http.StatusOK},
+		"database unreachable": {errors.New("connection refused"), http.StatusServiceUnavailable},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := sql.OpenDB(&execConnector{connectErr: tc.connectErr})
+			defer db.Close()
+			rec := httptest.NewRecorder()
+			newMetricsMux(newWorkerMetrics(), db).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if rec.Code != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, rec.Code)
+			}
+		})
+	}
+}
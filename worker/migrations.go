@@ -0,0 +1,37 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// runMigrations applies the embedded SQL migrations in filename order.
+// Every migration must be idempotent so it can run on each worker start.
+func runMigrations(db *sql.DB) error {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return fmt.Errorf("failed to list migrations: %w", err)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		query, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+
+		if _, err := db.Exec(string(query)); err != nil {
+			return fmt.Errorf("migration %s failed: %w", name, err)
+		}
+		log.Printf("Applied migration %s", name)
+	}
+
+	return nil
+}
@@ -0,0 +1 @@
+ALTER TABLE payloads ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
@@ -0,0 +1 @@
+ALTER TABLE payloads ADD COLUMN IF NOT EXISTS phone TEXT;
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// RecordMapping describes where generic records are written.
+// Table and column names always come from worker configuration, never from the record itself.
+type RecordMapping struct {
+	Table     string
+	KeyColumn string            // optional; enables upsert on this column
+	Columns   map[string]string // record field -> column; empty means field names are used as-is
+}
+
+// LoadRecordMappingFromEnv reads RECORD_TABLE, RECORD_KEY_COLUMN and RECORD_COLUMNS.
+// It returns nil when RECORD_TABLE is unset, which disables generic records.
+func LoadRecordMappingFromEnv() (*RecordMapping, error) {
+	table := os.Getenv("RECORD_TABLE")
+	if table == "" {
+		return nil, nil
+	}
+
+	mapping := &RecordMapping{
+		Table:     table,
+		KeyColumn: os.Getenv("RECORD_KEY_COLUMN"),
+		Columns:   make(map[string]string),
+	}
+
+	// RECORD_COLUMNS is a comma separated list of field[:column] entries
+	if columns := os.Getenv("RECORD_COLUMNS"); columns != "" {
+		for _, entry := range strings.Split(columns, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			field, column, found := strings.Cut(entry, ":")
+			if !found {
+				column = field
+			}
+			mapping.Columns[strings.TrimSpace(field)] = strings.TrimSpace(column)
+		}
+	}
+
+	if err := mapping.Validate(); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// Validate checks that all configured identifiers are safe to use in SQL
+func (m *RecordMapping) Validate() error {
+	if !identifierPattern.MatchString(m.Table) {
+		return fmt.Errorf("invalid record table name %q", m.Table)
+	}
+	if m.KeyColumn != "" && !identifierPattern.MatchString(m.KeyColumn) {
+		return fmt.Errorf("invalid record key column %q", m.KeyColumn)
+	}
+	for field, column := range m.Columns {
+		if !identifierPattern.MatchString(column) {
+			return fmt.Errorf("invalid column %q for field %q", column, field)
+		}
+	}
+	return nil
+}
+
+// BuildInsert returns the INSERT (or UPSERT) statement and arguments for a record's fields
+func (m *RecordMapping) BuildInsert(fields map[string]interface{}) (string, []interface{}, error) {
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("record has no fields")
+	}
+
+	// Sort field names so the generated statement is deterministic
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	columns := make([]string, 0, len(names))
+	placeholders := make([]string, 0, len(names))
+	args := make([]interface{}, 0, len(names))
+	hasKey := false
+
+	for i, name := range names {
+		column := name
+		if len(m.Columns) > 0 {
+			mapped, ok := m.Columns[name]
+			if !ok {
+				return "", nil, fmt.Errorf("field %q is not mapped to a column", name)
+			}
+			column = mapped
+		} else if !identifierPattern.MatchString(column) {
+			return "", nil, fmt.Errorf("invalid field name %q", name)
+		}
+		if column == m.KeyColumn {
+			hasKey = true
+		}
+
+		value, err := columnValue(fields[name])
+		if err != nil {
+			return "", nil, fmt.Errorf("field %q: %w", name, err)
+		}
+
+		columns = append(columns, pq.QuoteIdentifier(column))
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i+1))
+		args = append(args, value)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		pq.QuoteIdentifier(m.Table), strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+
+	if m.KeyColumn != "" {
+		if !hasKey {
+			return "", nil, fmt.Errorf("record is missing key column %q", m.KeyColumn)
+		}
+		var updates []string
+		for _, column := range columns {
+			if column != pq.QuoteIdentifier(m.KeyColumn) {
+				updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+			}
+		}
+		if len(updates) == 0 {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", pq.QuoteIdentifier(m.KeyColumn))
+		} else {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s",
+				pq.QuoteIdentifier(m.KeyColumn), strings.Join(updates, ", "))
+		}
+	}
+
+	return query, args, nil
+}
+
+// columnValue converts a decoded JSON value into something the Postgres driver accepts
+func columnValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool, float64, int, int64:
+		return v, nil
+	default:
+		// Nested objects and arrays are stored as JSON text
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(encoded), nil
+	}
+}
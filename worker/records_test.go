@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildInsertUsesFieldNamesWithoutMapping(t *testing.T) {
+	mapping := &RecordMapping{Table: "events"}
+
+	query, args, err := mapping.BuildInsert(map[string]interface{}{"name": "John", "id": float64(7)})
+	if err != nil {
+		t.Fatalf("BuildInsert: %v", err)
+	}
+
+	want := `INSERT INTO "events" ("id", "name") VALUES ($1, $2)`
+	if query != want {
+		t.Fatalf("unexpected query:\n got: %s\nwant: %s", query, want)
+	}
+	if len(args) != 2 || args[0] != float64(7) || args[1] != "John" {
+		t.Fatalf("unexpected args: %v", args)
+	}
+}
+
+func TestBuildInsertAppliesColumnMappingAndUpsert(t *testing.T) {
+	mapping := &RecordMapping{
+		Table:     "customers",
+		KeyColumn: "customer_id",
+		Columns:   map[string]string{"id": "customer_id", "email": "email_address"},
+	}
+
+	query, _, err := mapping.BuildInsert(map[string]interface{}{"id": float64(1), "email": "a@b.c"})
+	if err != nil {
+		t.Fatalf("BuildInsert: %v", err)
+	}
+
+	want := `INSERT INTO "customers" ("email_address", "customer_id") VALUES ($1, $2)` +
+		` ON CONFLICT ("customer_id") DO UPDATE SET "email_address" = EXCLUDED."email_address"`
+	if query != want {
+		t.Fatalf("unexpected query:\n got: %s\nwant: %s", query, want)
+	}
+}
+
+func TestBuildInsertRejectsUnmappedAndUnsafeFields(t *testing.T) {
+	mapped := &RecordMapping{Table: "customers", Columns: map[string]string{"id": "id"}}
+	if _, _, err := mapped.BuildInsert(map[string]interface{}{"id": 1, "ssn": "x"}); err == nil {
+		t.Fatal("expected an error for an unmapped field")
+	}
+
+	unmapped := &RecordMapping{Table: "customers"}
+	if _, _, err := unmapped.BuildInsert(map[string]interface{}{"id); DROP TABLE x; --": 1}); err == nil {
+		t.Fatal("expected an error for an unsafe field name")
+	}
+
+	keyed := &RecordMapping{Table: "customers", KeyColumn: "id"}
+	if _, _, err := keyed.BuildInsert(map[string]interface{}{"name": "x"}); err == nil {
+		t.Fatal("expected an error when the key column is missing")
+	}
+}
+
+func TestBuildInsertEncodesNestedValuesAsJSON(t *testing.T) {
+	mapping := &RecordMapping{Table: "events"}
+
+	_, args, err := mapping.BuildInsert(map[string]interface{}{"tags": []interface{}{"a", "b"}})
+	if err != nil {
+		t.Fatalf("BuildInsert: %v", err)
+	}
+	if args[0] != `["a","b"]` {
+		t.Fatalf("expected nested value as JSON text, got %v", args[0])
+	}
+}
+
+func TestRecordMappingValidateRejectsUnsafeTable(t *testing.T) {
+	mapping := &RecordMapping{Table: "payloads; DROP TABLE payloads"}
+	if err := mapping.Validate(); err == nil {
+		t.Fatal("expected an error for an unsafe table name")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// SecretsClient is the subset of the Secrets Manager API used to resolve DB credentials
+type SecretsClient interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// dbSecret is the JSON layout of an RDS-style database secret; every field is optional
+type dbSecret struct {
+	Username string      `json:"username"`
+	Password string      `json:"password"`
+	Host     string      `json:"host"`
+	Port     json.Number `json:"port"`
+	DBName   string      `json:"dbname"`
+}
+
+// newSecretsClient creates a Secrets Manager client from the default AWS config chain
+func newSecretsClient(ctx context.Context) (*secretsmanager.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return secretsmanager.NewFromConfig(cfg), nil
+}
+
+// resolveDatabaseURL builds the connection string from the secret at secretARN.
+// A plain string secret is used as the whole DSN. A JSON secret overrides the
+// matching parts of baseURL, so a secret holding only the password keeps the
+// host, database and sslmode from DATABASE_URL.
+func resolveDatabaseURL(ctx context.Context, client SecretsClient, secretARN, baseURL string) (string, error) {
+	result, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretARN),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read DB secret: %w", err)
+	}
+	if result.SecretString == nil {
+		return "", fmt.Errorf("DB secret %s has no string value", secretARN)
+	}
+
+	value := strings.TrimSpace(*result.SecretString)
+	if !strings.HasPrefix(value, "{") {
+		return value, nil
+	}
+
+	var secret dbSecret
+	if err := json.Unmarshal([]byte(value), &secret); err != nil {
+		return "", fmt.Errorf("invalid DB secret JSON: %w", err)
+	}
+
+	dsn, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid DATABASE_URL: %w", err)
+	}
+
+	if secret.Username != "" || secret.Password != "" {
+		username := secret.Username
+		if username == "" && dsn.User != nil {
+			username = dsn.User.Username()
+		}
+		if secret.Password != "" {
+			dsn.User = url.UserPassword(username, secret.Password)
+		} else if password, ok := dsn.User.Password(); ok {
+			dsn.User = url.UserPassword(username, password)
+		} else {
+			dsn.User = url.User(username)
+		}
+	}
+
+	if secret.Host != "" || secret.Port != "" {
+		host, port := dsn.Hostname(), dsn.Port()
+		if secret.Host != "" {
+			host = secret.Host
+		}
+		if secret.Port != "" {
+			if _, err := strconv.Atoi(secret.Port.String()); err != nil {
+				return "", fmt.Errorf("invalid port in DB secret: %q", secret.Port)
+			}
+			port = secret.Port.String()
+		}
+		if port != "" {
+			host = host + ":" + port
+		}
+		dsn.Host = host
+	}
+
+	if secret.DBName != "" {
+		dsn.Path = "/" + secret.DBName
+	}
+
+	return dsn.String(), nil
+}
@@ -9,12 +9,15 @@ import (
 	"go.temporal.io/sdk/workflow"
 )
 
-func ProcessPayloadWorkflow(ctx workflow.Context, p shared.Payload) error {
-	logger := workflow.GetLogger(ctx)
-	logger.Info("Workflow started", "ID", p.ID, "Name", p.Name, "Email", p.Email)
+// payloadVersionCheckChange is the GetVersion change ID that added payload schema version
+// checks; histories recorded before it replay without the check
+const payloadVersionCheckChange = "payload-version-check"
 
-	ao := workflow.ActivityOptions{
+// defaultActivityOptions returns the activity options shared by all workflows
+func defaultActivityOptions() workflow.ActivityOptions {
+	return workflow.ActivityOptions{
 		StartToCloseTimeout: time.Second * 30, // Increased timeout for database operations
+		HeartbeatTimeout:    time.Second * 10, // Lets a cancelled workflow reach a running statement
 		RetryPolicy: &temporal.RetryPolicy{
 			InitialInterval:    time.Second * 2,
 			BackoffCoefficient: 2.0,
@@ -22,15 +25,56 @@ func ProcessPayloadWorkflow(ctx workflow.Context, p shared.Payload) error {
 			MaximumAttempts:    3,
 		},
 	}
-	ctx = workflow.WithActivityOptions(ctx, ao)
+}
+
+func ProcessPayloadWorkflow(ctx workflow.Context, p shared.Payload) error {
+	logger := workflow.GetLogger(ctx)
+	// The SDK logger bypasses the standard logger's redaction, so personal fields stay out of it
+	logger.Info("Workflow started", "ID", p.ID, "Version", p.SchemaVersion())
+
+	// A payload from a newer schema would lose its added fields here; fail instead of retrying
+	if workflow.GetVersion(ctx, payloadVersionCheckChange, workflow.DefaultVersion, 1) >= 1 {
+		if err := p.CheckVersion(); err != nil {
+			logger.Error("Rejected payload", "ID", p.ID, "error", err)
+			return temporal.NewNonRetryableApplicationError(err.Error(), "UnsupportedPayloadVersion", err)
+		}
+	}
+
+	ctx = workflow.WithActivityOptions(ctx, defaultActivityOptions())
+
+	// Erasure requests delete the payload; everything else is upserted
+	activity := "InsertPayload"
+	if p.Deleted {
+		activity = "DeletePayload"
+	}
+
+	err := workflow.ExecuteActivity(ctx, activity, p).Get(ctx, nil)
+	if temporal.IsCanceledError(err) {
+		logger.Info("Activity cancelled", "ID", p.ID)
+		return err
+	}
+	if err != nil {
+		logger.Error("Activity failed", "error", err)
+		return err
+	}
+
+	logger.Info("Workflow completed successfully", "ID", p.ID, "Deleted", p.Deleted)
+	return nil
+}
+
+// ProcessRecordWorkflow writes a generic record using the worker's configured table mapping
+func ProcessRecordWorkflow(ctx workflow.Context, r shared.Record) error {
+	logger := workflow.GetLogger(ctx)
+	logger.Info("Record workflow started", "Fields", len(r.Fields))
+
+	ctx = workflow.WithActivityOptions(ctx, defaultActivityOptions())
 
-	// Execute the InsertPayload activity
-	err := workflow.ExecuteActivity(ctx, "InsertPayload", p).Get(ctx, nil)
+	err := workflow.ExecuteActivity(ctx, "InsertRecord", r).Get(ctx, nil)
 	if err != nil {
 		logger.Error("Activity failed", "error", err)
 		return err
 	}
 
-	logger.Info("Workflow completed successfully", "ID", p.ID)
+	logger.Info("Record workflow completed successfully")
 	return nil
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"temporal-key-rotation/shared"
+
+	"github.com/stretchr/testify/mock"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+)
+
+func TestProcessPayloadWorkflowBranchesOnDeleted(t *testing.T) {
+	cases := []struct {
+		name     string
+		payload  shared.Payload
+		activity string
+	}{
+		{"upsert", shared.Payload{ID: 1, Name: "John", Email: "john@example.com"}, "InsertPayload"},
+		{"erasure", shared.Payload{ID: 1, Deleted: true}, "DeletePayload"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var suite testsuite.WorkflowTestSuite
+			env := suite.NewTestWorkflowEnvironment()
+			activities := &Activities{}
+			env.RegisterActivity(activities.InsertPayload)
+			env.RegisterActivity(activities.DeletePayload)
+
+			var called []string
+			for _, name := range []string{"InsertPayload", "DeletePayload"} {
+				env.OnActivity(name, mock.Anything, mock.Anything).Return(func(ctx context.Context, p shared.Payload) error {
+					called = append(called, name)
+					return nil
+				}).Maybe()
+			}
+
+			env.ExecuteWorkflow(ProcessPayloadWorkflow, tc.payload)
+			if err := env.GetWorkflowError(); err != nil {
+				t.Fatalf("workflow failed: %v", err)
+			}
+			if len(called) != 1 || called[0] != tc.activity {
+				t.Fatalf("expected only %s to run, got %v", tc.activity, called)
+			}
+		})
+	}
+}
+
+func TestDeletePayloadQuery(t *testing.T) {
+	if got := deletePayloadQuery(false); got != `UPDATE payloads SET name = '', email = '', phone = NULL, deleted_at = COALESCE(deleted_at, now()) WHERE id = $1` {
+		t.Fatalf("unexpected soft delete query: %s", got)
+	}
+	if got := deletePayloadQuery(true); got != `DELETE FROM payloads WHERE id = $1` {
+		t.Fatalf("unexpected hard delete query: %s", got)
+	}
+}
+
+func TestProcessPayloadWorkflowAcceptsV1Payload(t *testing.T) {
+	// A payload recorded before the version field existed
+	var p shared.Payload
+	if err := json.Unmarshal([]byte(`{"id":1,"name":"John","email":"john@example.com"}`), &p); err != nil {
+		t.Fatalf("unmarshal v1 payload: %v", err)
+	}
+	if p.SchemaVersion() != shared.PayloadVersion1 {
+		t.Fatalf("expected a payload without version to be v1, got %d", p.SchemaVersion())
+	}
+
+	var suite testsuite.WorkflowTestSuite
+	env := suite.NewTestWorkflowEnvironment()
+	activities := &Activities{}
+	env.RegisterActivity(activities.InsertPayload)
+
+	var inserted shared.Payload
+	env.OnActivity("InsertPayload", mock.Anything, mock.Anything).Return(func(ctx context.Context, p shared.Payload) error {
+		inserted = p
+		return nil
+	})
+
+	env.ExecuteWorkflow(ProcessPayloadWorkflow, p)
+	if err := env.GetWorkflowError(); err != nil {
+		t.Fatalf("workflow failed: %v", err)
+	}
+	if inserted.ID != 1 || inserted.Email != "john@example.com" {
+		t.Fatalf("expected the v1 payload to be inserted unchanged, got %+v", inserted)
+	}
+}
+
+func TestProcessPayloadWorkflowRejectsNewerPayloadVersion(t *testing.T) {
+	var suite testsuite.WorkflowTestSuite
+	env := suite.NewTestWorkflowEnvironment()
+	activities := &Activities{}
+	env.RegisterActivity(activities.InsertPayload)
+
+	env.ExecuteWorkflow(ProcessPayloadWorkflow, shared.Payload{ID: 1, Name: "John", Email: "john@example.com", Version: shared.CurrentPayloadVersion + 1})
+	err := env.GetWorkflowError()
+	var appErr *temporal.ApplicationError
+	if !errors.As(err, &appErr) || !appErr.NonRetryable() {
+		t.Fatalf("expected a non-retryable error for a newer payload version, got %v", err)
+	}
+}